@@ -0,0 +1,840 @@
+// sora-e2ee はブラウザを利用せずに E2EE の鍵合意を再現するためのコマンド
+//
+// Engine の状態は -state で指定したファイルに Export した状態で保存し、サブコマンドごとに Import して利用する
+// 結果はすべて JSON で標準出力に出力する、バイナリは base64 で表現する
+//
+//	sora-e2ee init -state alice.state -connection-id ALICE---------------------
+//	sora-e2ee bundle -state bob.state -one-time-pre-key-id 1 > bob.json
+//	sora-e2ee start-session -state alice.state -remote-connection-id BOB----------------------- -bundle bob.json
+//	sora-e2ee add-prekey-bundle -state bob.state -remote-connection-id ALICE--------------------- -bundle alice.json
+//	sora-e2ee receive -state bob.state <base64 message>...
+//
+// -identity-store と -remote-identifier を指定すると、識別子ごとに最初に受け取った identityKey を保存して確認する
+//
+//	sora-e2ee start-session -state alice.state -identity-store alice.identities -remote-connection-id BOB----------------------- -remote-identifier bob -bundle bob.json
+//	sora-e2ee identity -state alice.state -identity-store alice.identities -identifier bob -verified=true
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	e2ee "github.com/shiguredo/sora-e2ee"
+)
+
+// Version は Makefile 側で flag を利用して設定する
+var Version = "dev"
+
+// Export と Import に利用する passphraseKey のデフォルト
+// 検証用のコマンドなので固定値で良い
+const defaultPassphrase = "sora-e2ee"
+
+const usage = `usage: sora-e2ee <command> [flags]
+
+commands:
+  init               鍵を生成して状態を保存する
+  bundle             自分の preKeyBundle を出力する
+  replenish          利用された oneTimePreKey を補充して、補充した oneTimePreKey を出力する
+  add-prekey-bundle  相手の preKeyBundle を追加する
+  start-session      相手の preKeyBundle を利用してセッションを開始する
+  stop-session       相手とのセッションを破棄する
+  reset-session      相手とのセッションだけを作り直す
+  commit             -queue を指定した start-session と stop-session の入退室をまとめて SK を更新する
+  receive            相手から届いたメッセージを処理する
+  status             自分の keyId とフィンガープリントを出力する
+  safety-number      相手とのセーフティナンバーを出力する、-payload を指定した場合は相手の payload と照合する
+  identity           -identity-store に保存した相手の identityKey を出力する、-trust や -verified で更新する
+  version            バージョンを出力する
+
+各コマンドのフラグは sora-e2ee <command> -h で確認できる`
+
+type oneTimePreKeyJSON struct {
+	ID        uint32 `json:"id"`
+	PublicKey []byte `json:"publicKey"`
+	Signature []byte `json:"signature"`
+}
+
+// wasm の init が返す preKeyBundle と同じ形式
+type preKeyBundleJSON struct {
+	IdentityKey     []byte             `json:"identityKey"`
+	SignedPreKeyID  uint32             `json:"signedPreKeyId"`
+	SignedPreKey    []byte             `json:"signedPreKey"`
+	PreKeySignature []byte             `json:"preKeySignature"`
+	OneTimePreKey   *oneTimePreKeyJSON `json:"oneTimePreKey,omitempty"`
+	Capabilities    uint32             `json:"capabilities,omitempty"`
+
+	PQPreKey          []byte `json:"pqPreKey,omitempty"`
+	PQPreKeySignature []byte `json:"pqPreKeySignature,omitempty"`
+
+	KeyPackage []byte `json:"keyPackage,omitempty"`
+}
+
+type remoteSecretKeyMaterialJSON struct {
+	KeyID             uint32 `json:"keyId"`
+	SecretKeyMaterial []byte `json:"secretKeyMaterial"`
+}
+
+type errorJSON struct {
+	Code               string `json:"code"`
+	Message            string `json:"message"`
+	RemoteConnectionID string `json:"remoteConnectionId,omitempty"`
+	MessageType        string `json:"messageType,omitempty"`
+	Identifier         string `json:"identifier,omitempty"`
+}
+
+// -identity-store で指定したファイルに保存する Identity
+type identityJSON struct {
+	IdentityKey []byte    `json:"identityKey"`
+	FirstSeenAt time.Time `json:"firstSeenAt"`
+	Verified    bool      `json:"verified"`
+}
+
+type receiveResultJSON struct {
+	Index int `json:"index"`
+	// グループモードでエポックが進んだ場合だけ出力する
+	SelfKeyID                *uint32                                `json:"selfKeyId,omitempty"`
+	SelfSecretKeyMaterial    []byte                                 `json:"selfSecretKeyMaterial,omitempty"`
+	RemoteSecretKeyMaterials map[string]remoteSecretKeyMaterialJSON `json:"remoteSecretKeyMaterials,omitempty"`
+	Messages                 [][]byte                               `json:"messages,omitempty"`
+	Error                    *errorJSON                             `json:"error,omitempty"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[1], os.Args[2:], os.Stdin, os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		printJSON(os.Stdout, map[string]interface{}{"error": newErrorJSON(err)})
+		os.Exit(1)
+	}
+}
+
+func run(command string, args []string, stdin io.Reader, stdout io.Writer) error {
+	switch command {
+	case "init":
+		return initCommand(args, stdout)
+	case "bundle":
+		return bundleCommand(args, stdout)
+	case "replenish":
+		return replenishCommand(args, stdout)
+	case "add-prekey-bundle":
+		return addPreKeyBundleCommand(args, stdout)
+	case "start-session":
+		return startSessionCommand(args, stdout)
+	case "stop-session":
+		return stopSessionCommand(args, stdout)
+	case "reset-session":
+		return resetSessionCommand(args, stdout)
+	case "commit":
+		return commitCommand(args, stdout)
+	case "receive":
+		return receiveCommand(args, stdin, stdout)
+	case "status":
+		return statusCommand(args, stdout)
+	case "safety-number":
+		return safetyNumberCommand(args, stdout)
+	case "identity":
+		return identityCommand(args, stdout)
+	case "version":
+		return printJSON(stdout, map[string]string{"version": Version})
+	default:
+		return fmt.Errorf("unknown command: %s\n%s", command, usage)
+	}
+}
+
+// 全コマンド共通のフラグ
+type stateFlags struct {
+	path             string
+	passphrase       string
+	headerEncryption bool
+	chaCha20Poly1305 bool
+	pqxdh            bool
+	requirePQXDH     bool
+	groupMode        bool
+	mls              bool
+	identityStore    string
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *stateFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	sf := &stateFlags{}
+	fs.StringVar(&sf.path, "state", "", "Engine の状態を保存するファイル")
+	fs.StringVar(&sf.passphrase, "passphrase", defaultPassphrase, "状態の暗号化に利用する passphraseKey")
+	fs.BoolVar(&sf.headerEncryption, "header-encryption", false, "相手も対応している場合に Double Ratchet のヘッダーを暗号化する、状態には保存しないので毎回指定する")
+	fs.BoolVar(&sf.chaCha20Poly1305, "chacha20-poly1305", false, "相手も対応している場合に Double Ratchet の AEAD に ChaCha20-Poly1305 を利用する、状態には保存しないので毎回指定する")
+	fs.BoolVar(&sf.pqxdh, "pqxdh", false, "相手も対応している場合に ML-KEM-768 を組み合わせた PQXDH を行う、状態には保存しないので毎回指定する")
+	fs.BoolVar(&sf.requirePQXDH, "require-pqxdh", false, "PQXDH を利用しない相手とはセッションを開始しない、-pqxdh も有効になる、状態には保存しないので毎回指定する")
+	fs.BoolVar(&sf.groupMode, "group-mode", false, "TreeKEM のグループモードを利用する、init で指定すると状態に保存される")
+	fs.BoolVar(&sf.mls, "mls", false, "グループモードで MLS の鍵スケジュールと KeyPackage を利用する、-group-mode も有効になる、init で指定すると状態に保存される")
+	fs.StringVar(&sf.identityStore, "identity-store", "", "識別子ごとの相手の identityKey を保存するファイル、状態には保存しないので毎回指定する")
+	return fs, sf
+}
+
+func (sf *stateFlags) options() []e2ee.Option {
+	var options []e2ee.Option
+	if sf.headerEncryption {
+		options = append(options, e2ee.WithHeaderEncryption())
+	}
+	if sf.chaCha20Poly1305 {
+		options = append(options, e2ee.WithChaCha20Poly1305())
+	}
+	if sf.pqxdh {
+		options = append(options, e2ee.WithPQXDH())
+	}
+	if sf.requirePQXDH {
+		options = append(options, e2ee.WithRequirePQXDH())
+	}
+	if sf.groupMode {
+		options = append(options, e2ee.WithGroupMode())
+	}
+	if sf.mls {
+		options = append(options, e2ee.WithMLS())
+	}
+	if sf.identityStore != "" {
+		options = append(options, e2ee.WithIdentityStore(fileIdentityStore(sf.identityStore)))
+	}
+	return options
+}
+
+// 識別子ごとの identityJSON を 1 つの JSON ファイルに保存する IdentityStore
+// 検証用のコマンドなので、保存するたびにファイル全体を書き直す
+type fileIdentityStore string
+
+func (path fileIdentityStore) read() (map[string]identityJSON, error) {
+	identities := make(map[string]identityJSON)
+	b, err := os.ReadFile(string(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return identities, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &identities); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (path fileIdentityStore) LoadIdentity(identifier string) (*e2ee.Identity, error) {
+	identities, err := path.read()
+	if err != nil {
+		return nil, err
+	}
+	identity, ok := identities[identifier]
+	if !ok {
+		return nil, nil
+	}
+	return &e2ee.Identity{
+		IdentityKey: identity.IdentityKey,
+		FirstSeenAt: identity.FirstSeenAt,
+		Verified:    identity.Verified,
+	}, nil
+}
+
+func (path fileIdentityStore) SaveIdentity(identifier string, identity e2ee.Identity) error {
+	identities, err := path.read()
+	if err != nil {
+		return err
+	}
+	identities[identifier] = identityJSON(identity)
+	b, err := json.MarshalIndent(identities, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(string(path), b, 0600)
+}
+
+func (sf *stateFlags) load() (*e2ee.Engine, error) {
+	if sf.path == "" {
+		return nil, errors.New("-state is required")
+	}
+	blob, err := os.ReadFile(sf.path)
+	if err != nil {
+		return nil, err
+	}
+	engine := e2ee.NewEngine(Version, sf.options()...)
+	if err := engine.Import([]byte(sf.passphrase), blob); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+func (sf *stateFlags) save(engine *e2ee.Engine) error {
+	blob, err := engine.Export([]byte(sf.passphrase))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sf.path, blob, 0600)
+}
+
+func initCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("init")
+	connectionID := fs.String("connection-id", "", "自分の ConnectionID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sf.path == "" {
+		return errors.New("-state is required")
+	}
+
+	engine := e2ee.NewEngine(Version, sf.options()...)
+	if err := engine.Init(); err != nil {
+		return err
+	}
+	selfSecretKeyMaterial, err := engine.Start(*connectionID)
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	var oneTimePreKeys []oneTimePreKeyJSON
+	for _, oneTimePreKey := range engine.OneTimePreKeys() {
+		oneTimePreKeys = append(oneTimePreKeys, oneTimePreKeyJSON(oneTimePreKey))
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"selfConnectionId":      *connectionID,
+		"selfKeyId":             engine.SelfKeyID(),
+		"selfSecretKeyMaterial": selfSecretKeyMaterial,
+		"fingerprint":           engine.SelfFingerprint(),
+		"preKeyBundle":          toPreKeyBundleJSON(engine.SelfPreKeyBundle()),
+		"oneTimePreKeys":        oneTimePreKeys,
+	})
+}
+
+func bundleCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("bundle")
+	// 状態は保存しないので、相手ごとに異なる oneTimePreKey を配るには ID を指定する
+	oneTimePreKeyID := fs.Uint("one-time-pre-key-id", 0, "この ID の未使用の oneTimePreKey を含める、init や replenish で出力した ID を指定する")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	bundle := toPreKeyBundleJSON(engine.SelfPreKeyBundle())
+	if *oneTimePreKeyID != 0 {
+		for _, oneTimePreKey := range engine.OneTimePreKeys() {
+			if oneTimePreKey.ID == uint32(*oneTimePreKeyID) {
+				o := oneTimePreKeyJSON(oneTimePreKey)
+				bundle.OneTimePreKey = &o
+				break
+			}
+		}
+		if bundle.OneTimePreKey == nil {
+			return fmt.Errorf("one-time pre key not found: %d", *oneTimePreKeyID)
+		}
+	}
+
+	return printJSON(stdout, bundle)
+}
+
+func replenishCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("replenish")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	replenished, err := engine.ReplenishOneTimePreKeys()
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	oneTimePreKeys := []oneTimePreKeyJSON{}
+	for _, oneTimePreKey := range replenished {
+		oneTimePreKeys = append(oneTimePreKeys, oneTimePreKeyJSON(oneTimePreKey))
+	}
+	return printJSON(stdout, map[string]interface{}{
+		"oneTimePreKeys": oneTimePreKeys,
+	})
+}
+
+func addPreKeyBundleCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("add-prekey-bundle")
+	remoteConnectionID := fs.String("remote-connection-id", "", "相手の ConnectionID")
+	bundlePath := fs.String("bundle", "", "相手の preKeyBundle の JSON ファイル")
+	remoteIdentifier := fs.String("remote-identifier", "", "相手の変わらない識別子、-identity-store に保存した identityKey と照合する")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+	if *remoteIdentifier != "" {
+		if err := engine.SetRemoteIdentifier(*remoteConnectionID, *remoteIdentifier); err != nil {
+			return err
+		}
+	}
+	bundle, err := readPreKeyBundle(*bundlePath)
+	if err != nil {
+		return err
+	}
+
+	result, err := engine.AddPreKeyBundle(*remoteConnectionID, bundle)
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"remoteSecretKeyMaterials": toRemoteSecretKeyMaterialsJSON(result.RemoteSecretKeyMaterials),
+		"messages":                 result.Messages,
+	})
+}
+
+func startSessionCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("start-session")
+	remoteConnectionID := fs.String("remote-connection-id", "", "相手の ConnectionID")
+	bundlePath := fs.String("bundle", "", "相手の preKeyBundle の JSON ファイル")
+	remoteIdentifier := fs.String("remote-identifier", "", "相手の変わらない識別子、-identity-store に保存した identityKey と照合する")
+	queue := fs.Bool("queue", false, "SK を更新せずにキューに入れる、commit でまとめて更新する")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+	if *remoteIdentifier != "" {
+		if err := engine.SetRemoteIdentifier(*remoteConnectionID, *remoteIdentifier); err != nil {
+			return err
+		}
+	}
+	bundle, err := readPreKeyBundle(*bundlePath)
+	if err != nil {
+		return err
+	}
+
+	if *queue {
+		result, err := engine.QueueStartSession(*remoteConnectionID, bundle)
+		if err != nil {
+			return err
+		}
+		return saveQueueSessionResult(sf, engine, result, stdout)
+	}
+
+	result, err := engine.StartSession(*remoteConnectionID, bundle)
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"selfConnectionId":         result.SelfConnectionID,
+		"selfKeyId":                result.SelfKeyID,
+		"selfSecretKeyMaterial":    result.SelfSecretKeyMaterial,
+		"remoteSecretKeyMaterials": toRemoteSecretKeyMaterialsJSON(result.RemoteSecretKeyMaterials),
+		"messages":                 result.Messages,
+	})
+}
+
+func stopSessionCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("stop-session")
+	remoteConnectionID := fs.String("remote-connection-id", "", "相手の ConnectionID")
+	queue := fs.Bool("queue", false, "SK を更新せずにキューに入れる、commit でまとめて更新する")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	if *queue {
+		result, err := engine.QueueStopSession(*remoteConnectionID)
+		if err != nil {
+			return err
+		}
+		return saveQueueSessionResult(sf, engine, result, stdout)
+	}
+
+	result, err := engine.StopSession(*remoteConnectionID)
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"selfConnectionId":         result.SelfConnectionID,
+		"selfKeyId":                result.SelfKeyID,
+		"selfSecretKeyMaterial":    result.SelfSecretKeyMaterial,
+		"remoteSecretKeyMaterials": toRemoteSecretKeyMaterialsJSON(result.RemoteSecretKeyMaterials),
+		"messages":                 result.Messages,
+	})
+}
+
+// キューに入れた場合は commit を実行する時刻を出力する、キューが空になった場合は出力しない
+func saveQueueSessionResult(sf *stateFlags, engine *e2ee.Engine, result *e2ee.QueueSessionResult, stdout io.Writer) error {
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	output := make(map[string]interface{})
+	if !result.Deadline.IsZero() {
+		output["deadline"] = result.Deadline
+	}
+	return printJSON(stdout, output)
+}
+
+func commitCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("commit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	result, err := engine.CommitMembershipChanges()
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"selfConnectionId":         result.SelfConnectionID,
+		"selfKeyId":                result.SelfKeyID,
+		"selfSecretKeyMaterial":    result.SelfSecretKeyMaterial,
+		"remoteSecretKeyMaterials": toRemoteSecretKeyMaterialsJSON(result.RemoteSecretKeyMaterials),
+		"messages":                 result.Messages,
+	})
+}
+
+func resetSessionCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("reset-session")
+	remoteConnectionID := fs.String("remote-connection-id", "", "相手の ConnectionID")
+	bundlePath := fs.String("bundle", "", "相手の新しい preKeyBundle の JSON ファイル、省略した場合は保持しているものを利用する")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	var remotePreKeyBundle *e2ee.PreKeyBundle
+	if *bundlePath != "" {
+		bundle, err := readPreKeyBundle(*bundlePath)
+		if err != nil {
+			return err
+		}
+		remotePreKeyBundle = &bundle
+	}
+
+	result, err := engine.ResetSession(*remoteConnectionID, remotePreKeyBundle)
+	if err != nil {
+		return err
+	}
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"selfConnectionId": result.SelfConnectionID,
+		"messages":         result.Messages,
+	})
+}
+
+// メッセージは引数に base64 で指定する、指定しなかった場合は標準入力から 1 行ずつ読む
+// 途中のメッセージの処理に失敗しても残りのメッセージを処理する
+func receiveCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, sf := newFlagSet("receive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	encodedMessages := fs.Args()
+	if len(encodedMessages) == 0 {
+		scanner := bufio.NewScanner(stdin)
+		// 標準入力の 1 行は 64KiB を超えることがある
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" {
+				encodedMessages = append(encodedMessages, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	results := []receiveResultJSON{}
+	for i, encodedMessage := range encodedMessages {
+		r := receiveResultJSON{Index: i}
+
+		message, err := base64.StdEncoding.DecodeString(encodedMessage)
+		if err != nil {
+			r.Error = newErrorJSON(err)
+			results = append(results, r)
+			continue
+		}
+
+		result, err := engine.ReceiveMessage(message)
+		if err != nil {
+			r.Error = newErrorJSON(err)
+		} else {
+			if result.SelfSecretKeyMaterial != nil {
+				r.SelfKeyID = &result.SelfKeyID
+				r.SelfSecretKeyMaterial = result.SelfSecretKeyMaterial
+			}
+			r.RemoteSecretKeyMaterials = toRemoteSecretKeyMaterialsJSON(result.RemoteSecretKeyMaterials)
+			r.Messages = result.Messages
+		}
+		results = append(results, r)
+	}
+
+	if err := sf.save(engine); err != nil {
+		return err
+	}
+
+	return printJSON(stdout, results)
+}
+
+func statusCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	// セッションを開始した相手ごとに PQXDH を利用しているかどうか
+	pqxdhSessions := make(map[string]bool)
+	for remoteConnectionID := range engine.RemoteFingerprints() {
+		if pqxdh, err := engine.SessionPQXDH(remoteConnectionID); err == nil {
+			pqxdhSessions[remoteConnectionID] = pqxdh
+		}
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"selfKeyId":          engine.SelfKeyID(),
+		"fingerprint":        engine.SelfFingerprint(),
+		"remoteFingerprints": engine.RemoteFingerprints(),
+		"oneTimePreKeyCount": len(engine.OneTimePreKeys()),
+		"pqxdhSessions":      pqxdhSessions,
+	})
+}
+
+func safetyNumberCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("safety-number")
+	remoteConnectionID := fs.String("remote-connection-id", "", "相手の ConnectionID")
+	selfIdentifier := fs.String("self-identifier", "", "自分の変わらない識別子、相手の -remote-identifier と同じ値を指定する")
+	remoteIdentifier := fs.String("remote-identifier", "", "相手の変わらない識別子、相手の -self-identifier と同じ値を指定する")
+	payload := fs.String("payload", "", "相手の safety-number が出力した payload (base64)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	if *payload != "" {
+		b, err := base64.StdEncoding.DecodeString(*payload)
+		if err != nil {
+			return err
+		}
+		ok, err := engine.VerifySafetyNumber(*remoteConnectionID, *selfIdentifier, *remoteIdentifier, b)
+		if err != nil {
+			return err
+		}
+		return printJSON(stdout, map[string]interface{}{
+			"verified": ok,
+		})
+	}
+
+	safetyNumber, err := engine.SafetyNumber(*remoteConnectionID, *selfIdentifier, *remoteIdentifier)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(stdout, map[string]interface{}{
+		"numeric": safetyNumber.Numeric,
+		"emoji":   safetyNumber.Emoji,
+		"payload": safetyNumber.Payload,
+	})
+}
+
+func identityCommand(args []string, stdout io.Writer) error {
+	fs, sf := newFlagSet("identity")
+	identifier := fs.String("identifier", "", "相手の変わらない識別子")
+	trust := fs.String("trust", "", "この preKeyBundle の JSON ファイルの identityKey で置き換える")
+	verified := fs.String("verified", "", "true で確認済みの印を付ける、false で外す")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sf.identityStore == "" {
+		return errors.New("-identity-store is required")
+	}
+
+	engine, err := sf.load()
+	if err != nil {
+		return err
+	}
+
+	if *trust != "" {
+		bundle, err := readPreKeyBundle(*trust)
+		if err != nil {
+			return err
+		}
+		if err := engine.TrustIdentity(*identifier, bundle.IdentityKey); err != nil {
+			return err
+		}
+	}
+	if *verified != "" {
+		v, err := strconv.ParseBool(*verified)
+		if err != nil {
+			return err
+		}
+		if err := engine.SetIdentityVerified(*identifier, v); err != nil {
+			return err
+		}
+	}
+
+	identity, err := engine.RemoteIdentity(*identifier)
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return e2ee.ErrMissingIdentity
+	}
+
+	return printJSON(stdout, identityJSON(*identity))
+}
+
+func readPreKeyBundle(path string) (e2ee.PreKeyBundle, error) {
+	if path == "" {
+		return e2ee.PreKeyBundle{}, errors.New("-bundle is required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return e2ee.PreKeyBundle{}, err
+	}
+
+	var bundle preKeyBundleJSON
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return e2ee.PreKeyBundle{}, err
+	}
+
+	preKeyBundle := e2ee.PreKeyBundle{
+		IdentityKey:     bundle.IdentityKey,
+		SignedPreKeyID:  bundle.SignedPreKeyID,
+		SignedPreKey:    bundle.SignedPreKey,
+		PreKeySignature: bundle.PreKeySignature,
+		Capabilities:    bundle.Capabilities,
+
+		PQPreKey:          bundle.PQPreKey,
+		PQPreKeySignature: bundle.PQPreKeySignature,
+
+		KeyPackage: bundle.KeyPackage,
+	}
+	if bundle.OneTimePreKey != nil {
+		oneTimePreKey := e2ee.OneTimePreKey(*bundle.OneTimePreKey)
+		preKeyBundle.OneTimePreKey = &oneTimePreKey
+	}
+	return preKeyBundle, nil
+}
+
+func toPreKeyBundleJSON(preKeyBundle e2ee.PreKeyBundle) preKeyBundleJSON {
+	bundle := preKeyBundleJSON{
+		IdentityKey:     preKeyBundle.IdentityKey,
+		SignedPreKeyID:  preKeyBundle.SignedPreKeyID,
+		SignedPreKey:    preKeyBundle.SignedPreKey,
+		PreKeySignature: preKeyBundle.PreKeySignature,
+		Capabilities:    preKeyBundle.Capabilities,
+
+		PQPreKey:          preKeyBundle.PQPreKey,
+		PQPreKeySignature: preKeyBundle.PQPreKeySignature,
+
+		KeyPackage: preKeyBundle.KeyPackage,
+	}
+	if preKeyBundle.OneTimePreKey != nil {
+		oneTimePreKey := oneTimePreKeyJSON(*preKeyBundle.OneTimePreKey)
+		bundle.OneTimePreKey = &oneTimePreKey
+	}
+	return bundle
+}
+
+func toRemoteSecretKeyMaterialsJSON(m map[string]e2ee.RemoteSecretKeyMaterial) map[string]remoteSecretKeyMaterialJSON {
+	remoteSecretKeyMaterials := make(map[string]remoteSecretKeyMaterialJSON)
+	for connectionID, remoteSecretKeyMaterial := range m {
+		remoteSecretKeyMaterials[connectionID] = remoteSecretKeyMaterialJSON(remoteSecretKeyMaterial)
+	}
+	return remoteSecretKeyMaterials
+}
+
+func newErrorJSON(err error) *errorJSON {
+	e := &errorJSON{
+		Code:    e2ee.ErrorCode(err),
+		Message: err.Error(),
+	}
+	var messageError *e2ee.MessageError
+	if errors.As(err, &messageError) {
+		e.RemoteConnectionID = messageError.RemoteConnectionID
+		e.MessageType = messageError.MessageType.String()
+	}
+	var identityKeyChangedError *e2ee.IdentityKeyChangedError
+	if errors.As(err, &identityKeyChangedError) {
+		e.RemoteConnectionID = identityKeyChangedError.RemoteConnectionID
+		e.Identifier = identityKeyChangedError.Identifier
+	}
+	return e
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	aliceConnectionID = "ALICE---------------------"
+	bobConnectionID   = "BOB-----------------------"
+)
+
+func runJSON(t *testing.T, v interface{}, command string, args ...string) {
+	t.Helper()
+	var stdout bytes.Buffer
+	require.Nil(t, run(command, args, strings.NewReader(""), &stdout))
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), v))
+}
+
+func runToFile(t *testing.T, path string, command string, args ...string) {
+	t.Helper()
+	var stdout bytes.Buffer
+	require.Nil(t, run(command, args, strings.NewReader(""), &stdout))
+	require.Nil(t, os.WriteFile(path, stdout.Bytes(), 0600))
+}
+
+func encodeMessages(messages [][]byte) []string {
+	var encoded []string
+	for _, message := range messages {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(message))
+	}
+	return encoded
+}
+
+func TestCommandSession(t *testing.T) {
+	dir := t.TempDir()
+	aliceState := filepath.Join(dir, "alice.state")
+	bobState := filepath.Join(dir, "bob.state")
+	aliceBundle := filepath.Join(dir, "alice.json")
+	bobBundle := filepath.Join(dir, "bob.json")
+
+	runJSON(t, &struct{}{}, "init", "-state", aliceState, "-connection-id", aliceConnectionID)
+	var bobInit struct {
+		SelfSecretKeyMaterial []byte              `json:"selfSecretKeyMaterial"`
+		OneTimePreKeys        []oneTimePreKeyJSON `json:"oneTimePreKeys"`
+	}
+	runJSON(t, &bobInit, "init", "-state", bobState, "-connection-id", bobConnectionID)
+	require.GreaterOrEqual(t, len(bobInit.OneTimePreKeys), 2)
+
+	// ID ごとに異なる oneTimePreKey を含める
+	first := strconv.Itoa(int(bobInit.OneTimePreKeys[0].ID))
+	second := strconv.Itoa(int(bobInit.OneTimePreKeys[1].ID))
+	var bundle preKeyBundleJSON
+	runJSON(t, &bundle, "bundle", "-state", bobState, "-one-time-pre-key-id", second)
+	require.NotNil(t, bundle.OneTimePreKey)
+	assert.Equal(t, bobInit.OneTimePreKeys[1], *bundle.OneTimePreKey)
+	runToFile(t, bobBundle, "bundle", "-state", bobState, "-one-time-pre-key-id", first)
+	runToFile(t, aliceBundle, "bundle", "-state", aliceState)
+
+	var started struct {
+		SelfSecretKeyMaterial []byte   `json:"selfSecretKeyMaterial"`
+		Messages              [][]byte `json:"messages"`
+	}
+	runJSON(t, &started, "start-session", "-state", aliceState, "-remote-connection-id", bobConnectionID, "-bundle", bobBundle)
+	var added struct {
+		Messages [][]byte `json:"messages"`
+	}
+	runJSON(t, &added, "add-prekey-bundle", "-state", bobState, "-remote-connection-id", aliceConnectionID, "-bundle", aliceBundle)
+
+	// bob は alice から届いたメッセージで alice の SK を受け取る
+	var bobReceived []receiveResultJSON
+	runJSON(t, &bobReceived, "receive", append([]string{"-state", bobState}, encodeMessages(started.Messages)...)...)
+	var bobMessages [][]byte
+	received := false
+	for _, r := range bobReceived {
+		assert.Nil(t, r.Error)
+		if remote, ok := r.RemoteSecretKeyMaterials[aliceConnectionID]; ok {
+			assert.Equal(t, started.SelfSecretKeyMaterial, remote.SecretKeyMaterial)
+			received = true
+		}
+		bobMessages = append(bobMessages, r.Messages...)
+	}
+	assert.True(t, received)
+
+	// alice は bob から届いたメッセージで bob の SK を受け取る
+	var aliceReceived []receiveResultJSON
+	runJSON(t, &aliceReceived, "receive", append([]string{"-state", aliceState}, encodeMessages(append(added.Messages, bobMessages...))...)...)
+	received = false
+	for _, r := range aliceReceived {
+		assert.Nil(t, r.Error)
+		if remote, ok := r.RemoteSecretKeyMaterials[bobConnectionID]; ok {
+			assert.Equal(t, bobInit.SelfSecretKeyMaterial, remote.SecretKeyMaterial)
+			received = true
+		}
+	}
+	assert.True(t, received)
+
+	// 利用された oneTimePreKey は含められない、もう一方は残っている
+	var stdout bytes.Buffer
+	assert.NotNil(t, run("bundle", []string{"-state", bobState, "-one-time-pre-key-id", first}, strings.NewReader(""), &stdout))
+	runJSON(t, &bundle, "bundle", "-state", bobState, "-one-time-pre-key-id", second)
+	assert.Equal(t, bobInit.OneTimePreKeys[1], *bundle.OneTimePreKey)
+
+	var status struct {
+		RemoteFingerprints map[string]string `json:"remoteFingerprints"`
+	}
+	runJSON(t, &status, "status", "-state", aliceState)
+	assert.Contains(t, status.RemoteFingerprints, bobConnectionID)
+}
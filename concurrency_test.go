@@ -0,0 +1,200 @@
+package e2ee
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -race で実行する
+
+// remote から self に送る cipherMessage を生成する
+func testCipherMessages(t *testing.T, remote *Engine, selfConnectionID string, n int) [][]byte {
+	session := remote.sessions[selfConnectionID]
+	plaintext, err := remote.plaintext()
+	assert.Nil(t, err)
+
+	var messages [][]byte
+	for i := 0; i < n; i++ {
+		header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.messageAD(session.protocolVersion))
+		assert.Nil(t, err)
+		message, err := session.cipherMessage(header, ciphertext)
+		assert.Nil(t, err)
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestEngineConcurrentReceiveMessage(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+
+	// WithRandom で指定した goroutine-safe ではない io.Reader も並行して読む
+	alice := NewEngine(version, WithRandom(newTestRandom("concurrent alice")))
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	remotes := make(map[string]*Engine)
+	for i := 0; i < 8; i++ {
+		remoteConnectionID := fmt.Sprintf("REMOTE%02d------------------", i)
+
+		remote := NewEngine(version)
+		assert.Nil(t, remote.Init())
+		_, err := remote.Start(remoteConnectionID)
+		assert.Nil(t, err)
+
+		r1, err := alice.StartSession(remoteConnectionID, remote.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		_, err = remote.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		_, err = remote.ReceiveMessage(r1.Messages[0])
+		assert.Nil(t, err)
+		r2, err := remote.ReceiveMessage(r1.Messages[1])
+		assert.Nil(t, err)
+		_, err = alice.ReceiveMessage(r2.Messages[0])
+		assert.Nil(t, err)
+		// 相手の次のメッセージで DH ratchet を行い、受信したときに乱数を読むようにする
+		_, err = remote.ReceiveMessage(testCipherMessages(t, alice, remoteConnectionID, 1)[0])
+		assert.Nil(t, err)
+
+		remotes[remoteConnectionID] = remote
+	}
+
+	var wg sync.WaitGroup
+
+	// 相手ごとに並行して受信する、同じ相手のメッセージは順番に処理する
+	for remoteConnectionID, remote := range remotes {
+		messages := testCipherMessages(t, remote, aliceConnectionID, 32)
+		wg.Add(1)
+		go func(remoteConnectionID string, messages [][]byte) {
+			defer wg.Done()
+			for _, message := range messages {
+				r, err := alice.ReceiveMessage(message)
+				assert.Nil(t, err)
+				assert.Equal(t, 1, len(r.RemoteSecretKeyMaterials))
+			}
+		}(remoteConnectionID, messages)
+	}
+
+	// 受信中に Engine の状態を参照、変更する
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 16; i++ {
+			alice.SelfKeyID()
+			alice.RemoteFingerprints()
+			alice.OneTimePreKeys()
+			_, err := alice.Export([]byte("passphrase"))
+			assert.Nil(t, err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		carolConnectionID := "CAROL---------------------"
+		carol := NewEngine(version)
+		assert.Nil(t, carol.Init())
+		_, err := carol.Start(carolConnectionID)
+		assert.Nil(t, err)
+
+		_, err = alice.StartSession(carolConnectionID, carol.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		_, err = alice.RotateSignedPreKey()
+		assert.Nil(t, err)
+	}()
+
+	wg.Wait()
+
+	// 相手のスキップしたメッセージキーは残っていない
+	assert.Equal(t, 0, alice.totalSkippedMessageKeys())
+}
+
+func TestEngineConcurrentResetSession(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+	messages := testCipherMessages(t, bob, aliceConnectionID, 16)
+
+	var wg sync.WaitGroup
+
+	// 作り直す前のセッションのメッセージは復号できないことがあるが、状態は壊れない
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, message := range messages {
+			alice.ReceiveMessage(message)
+		}
+	}()
+
+	var resetMessage []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r, err := alice.ResetSession(bobConnectionID, nil)
+		assert.Nil(t, err)
+		resetMessage = r.Messages[0]
+	}()
+
+	wg.Wait()
+
+	r1, err := bob.ReceiveMessage(resetMessage)
+	assert.Nil(t, err)
+	_, err = alice.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+}
+
+func TestSFrameConcurrent(t *testing.T) {
+	skm := make([]byte, 32)
+
+	sender, err := NewSFrameSender(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.SetKey(1, skm))
+
+	receiver, err := NewSFrameReceiver(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+	assert.Nil(t, receiver.SetKey(1, skm))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counters := make(map[uint64]bool)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 64; j++ {
+				frame, err := sender.Encrypt(nil, []byte("frame"))
+				assert.Nil(t, err)
+
+				header, _, err := decodeSFrameHeader(frame)
+				assert.Nil(t, err)
+				mu.Lock()
+				// 同じ CTR を 2 回使わない
+				assert.False(t, counters[header.counter])
+				counters[header.counter] = true
+				mu.Unlock()
+
+				plaintext, err := receiver.Decrypt(nil, frame)
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("frame"), plaintext)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 16; j++ {
+			// 鍵 1 が破棄されない範囲で追加する
+			assert.Nil(t, receiver.SetKey(uint32(j%2+2), skm))
+		}
+	}()
+
+	wg.Wait()
+	assert.Equal(t, 8*64, len(counters))
+}
@@ -3,19 +3,63 @@ package e2ee
 import (
 	"crypto/aes"
 	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func decrypt(key []byte, nonce []byte, ciphertext []byte, ad []byte) ([]byte, error) {
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// Double Ratchet のメッセージとヘッダーの暗号化に利用する AEAD
+// セッションごとに capabilities で決める
+type aeadAlgorithm uint8
+
+const (
+	aeadAES256GCM aeadAlgorithm = iota
+	// AES の命令を持たない端末向け
+	aeadChaCha20Poly1305
+	// MLS の暗号スイートの HPKE で利用する
+	aeadAES128GCM
+)
+
+func (a aeadAlgorithm) keyLength() int {
+	switch a {
+	case aeadChaCha20Poly1305:
+		return chacha20poly1305.KeySize
+	case aeadAES128GCM:
+		return 16
+	default:
+		return 32
+	}
+}
+
+func (a aeadAlgorithm) nonceLength() int {
+	switch a {
+	case aeadChaCha20Poly1305:
+		return chacha20poly1305.NonceSize
+	default:
+		return 12
+	}
+}
+
+func (a aeadAlgorithm) newAEAD(key []byte, nonceLength int) (cipher.AEAD, error) {
+	switch a {
+	case aeadChaCha20Poly1305:
+		// nonce は nonceLength で生成するので 12 バイト以外にはならない
+		return chacha20poly1305.New(key)
+	default:
+		c, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCMWithNonceSize(c, nonceLength)
 	}
-	gcm, err := cipher.NewGCMWithNonceSize(c, len(nonce))
+}
+
+func (a aeadAlgorithm) decrypt(key []byte, nonce []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, err := a.newAEAD(key, len(nonce))
 	if err != nil {
 		return nil, err
 	}
 
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, ad)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -23,17 +67,22 @@ func decrypt(key []byte, nonce []byte, ciphertext []byte, ad []byte) ([]byte, er
 	return plaintext, nil
 }
 
-func encrypt(key []byte, nonce []byte, plaintext []byte, ad []byte) ([]byte, error) {
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCMWithNonceSize(c, len(nonce))
+func (a aeadAlgorithm) encrypt(key []byte, nonce []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, err := a.newAEAD(key, len(nonce))
 	if err != nil {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nil, nonce, plaintext, ad)
+	ciphertext := aead.Seal(nil, nonce, plaintext, ad)
 
 	return ciphertext, nil
 }
+
+// export した状態の暗号化など、セッションに依存しないものは AES-256-GCM を利用する
+func decrypt(key []byte, nonce []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	return aeadAES256GCM.decrypt(key, nonce, ciphertext, ad)
+}
+
+func encrypt(key []byte, nonce []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	return aeadAES256GCM.encrypt(key, nonce, plaintext, ad)
+}
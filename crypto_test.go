@@ -19,3 +19,120 @@ func TestCrypto(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, plaintext, newPlaintext)
 }
+
+func TestAEADAlgorithm(t *testing.T) {
+	key := make([]byte, 32)
+	ad := []byte("ad")
+	plaintext := []byte("1234560")
+
+	ciphertexts := make(map[aeadAlgorithm][]byte)
+	for _, aead := range []aeadAlgorithm{aeadAES256GCM, aeadChaCha20Poly1305} {
+		assert.Equal(t, 32, aead.keyLength())
+		assert.Equal(t, 12, aead.nonceLength())
+		nonce := make([]byte, aead.nonceLength())
+
+		ciphertext, err := aead.encrypt(key, nonce, plaintext, ad)
+		assert.Nil(t, err)
+		assert.Equal(t, len(plaintext)+16, len(ciphertext))
+
+		newPlaintext, err := aead.decrypt(key, nonce, ciphertext, ad)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext, newPlaintext)
+
+		_, err = aead.decrypt(key, nonce, ciphertext, []byte("other"))
+		assert.NotNil(t, err)
+
+		ciphertexts[aead] = ciphertext
+	}
+
+	// 同じ鍵と nonce でも AEAD が異なれば復号できない
+	assert.NotEqual(t, ciphertexts[aeadAES256GCM], ciphertexts[aeadChaCha20Poly1305])
+	_, err := aeadAES256GCM.decrypt(key, make([]byte, 12), ciphertexts[aeadChaCha20Poly1305], ad)
+	assert.NotNil(t, err)
+}
+
+func TestChaCha20Poly1305Negotiation(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	for _, tc := range []struct {
+		name  string
+		alice []Option
+		bob   []Option
+		aead  aeadAlgorithm
+	}{
+		{name: "both", alice: []Option{WithChaCha20Poly1305()}, bob: []Option{WithChaCha20Poly1305()}, aead: aeadChaCha20Poly1305},
+		{name: "sender only", alice: []Option{WithChaCha20Poly1305()}, aead: aeadAES256GCM},
+		{name: "receiver only", bob: []Option{WithChaCha20Poly1305()}, aead: aeadAES256GCM},
+		{name: "with header encryption",
+			alice: []Option{WithChaCha20Poly1305(), WithHeaderEncryption()},
+			bob:   []Option{WithChaCha20Poly1305(), WithHeaderEncryption()},
+			aead:  aeadChaCha20Poly1305},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			alice := NewEngine(version, tc.alice...)
+			assert.Nil(t, alice.Init())
+			_, err := alice.Start(aliceConnectionID)
+			assert.Nil(t, err)
+
+			bob := NewEngine(version, tc.bob...)
+			assert.Nil(t, bob.Init())
+			_, err = bob.Start(bobConnectionID)
+			assert.Nil(t, err)
+
+			r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+			assert.Nil(t, err)
+			_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+			assert.Nil(t, err)
+			_, err = bob.ReceiveMessage(r1.Messages[0])
+			assert.Nil(t, err)
+			r2, err := bob.ReceiveMessage(r1.Messages[1])
+			assert.Nil(t, err)
+			_, err = alice.ReceiveMessage(r2.Messages[0])
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.aead, alice.sessions[bobConnectionID].ratchetState.aead)
+			assert.Equal(t, tc.aead, bob.sessions[aliceConnectionID].ratchetState.aead)
+			assert.Equal(t, bob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
+			assert.Equal(t, alice.secretKeyMaterial, bob.sessions[aliceConnectionID].remoteSecretKeyMaterial)
+		})
+	}
+}
+
+func TestChaCha20Poly1305Session(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	passphraseKey := []byte("passphrase-key")
+
+	alice, bob := newTestEnginePair(t, WithChaCha20Poly1305())
+
+	// スキップしたメッセージキーも ChaCha20-Poly1305 で復号する
+	delayed, err := alice.messages()
+	assert.Nil(t, err)
+	latest, err := alice.messages()
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(latest[0])
+	assert.Nil(t, err)
+
+	// AEAD は状態には保存しないが、セッションの capabilities から復元する
+	blob, err := bob.Export(passphraseKey)
+	assert.Nil(t, err)
+	restoredBob := NewEngine(version, WithChaCha20Poly1305())
+	assert.Nil(t, restoredBob.Import(passphraseKey, blob))
+	assert.Equal(t, aeadChaCha20Poly1305, restoredBob.sessions[aliceConnectionID].ratchetState.aead)
+
+	_, err = restoredBob.ReceiveMessage(delayed[0])
+	assert.Nil(t, err)
+
+	// resetSession した後も ChaCha20-Poly1305 を利用する
+	r1, err := restoredBob.ResetSession(aliceConnectionID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, typeExtendedResetMessage, r1.Messages[0][0])
+	r2, err := alice.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, aeadChaCha20Poly1305, alice.sessions[bobConnectionID].ratchetState.aead)
+	_, err = restoredBob.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, restoredBob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
+}
@@ -5,12 +5,16 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
-	"errors"
 	"io"
+	"time"
 
 	"golang.org/x/crypto/hkdf"
 )
 
+// 1 つのチェインで送受信できるメッセージの最大数
+// 1 つのヘッダーキーで暗号化する回数を制限して、N が一周するよりも十分手前で止める
+const maxChainMessages = 1 << 31
+
 type ratchetHeader struct {
 	DH  [32]byte
 	PN  uint32
@@ -27,8 +31,11 @@ type ratchetKeyPair struct {
 type messageKey struct {
 	key   []byte
 	nonce []byte
+	// 古いものから破棄するために保存した時刻を持つ
+	storedAt time.Time
 }
 
+// ヘッダーを暗号化している場合は DH の代わりにヘッダーキーでチェインを識別する
 type mkskippedKey struct {
 	DH [32]byte
 	N  uint32
@@ -44,10 +51,20 @@ type ratchetState struct {
 	remoteN        uint32
 	PN             uint32
 	mkskipped      map[mkskippedKey]messageKey
+
+	// ヘッダーを暗号化する場合のみ設定される
+	// receiver は最初のメッセージを受け取るまで selfHeaderKey と remoteHeaderKey を持たない
+	selfHeaderKey       []byte
+	remoteHeaderKey     []byte
+	selfNextHeaderKey   []byte
+	remoteNextHeaderKey []byte
+
+	// メッセージとヘッダーの暗号化に利用する AEAD、セッションの capabilities で決める
+	aead aeadAlgorithm
 }
 
-func generateRatchetKeyPair() (*ratchetKeyPair, error) {
-	x25519KeyPair, err := generateX25519KeyPair()
+func generateRatchetKeyPair(random io.Reader) (*ratchetKeyPair, error) {
+	x25519KeyPair, err := generateX25519KeyPair(random)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +76,13 @@ func generateRatchetKeyPair() (*ratchetKeyPair, error) {
 }
 
 func kdfRk(previousRootKey []byte, senderRatchetKeyPrivate x25519PrivateKey, receiverRatchetKeyPublic x25519PublicKey) ([]byte, []byte, error) {
+	rootKey, chainKey, _, err := kdfRkHE(previousRootKey, senderRatchetKeyPrivate, receiverRatchetKeyPublic)
+	return rootKey, chainKey, err
+}
+
+// KDF_RK_HE
+// KDF_RK の出力の続きを次のヘッダーキーにするので、rootKey と chainKey は KDF_RK と同じになる
+func kdfRkHE(previousRootKey []byte, senderRatchetKeyPrivate x25519PrivateKey, receiverRatchetKeyPublic x25519PublicKey) ([]byte, []byte, []byte, error) {
 	a := dh(senderRatchetKeyPrivate, receiverRatchetKeyPublic)
 
 	hash := sha256.New
@@ -67,19 +91,23 @@ func kdfRk(previousRootKey []byte, senderRatchetKeyPrivate x25519PrivateKey, rec
 
 	rootKey := make([]byte, 32)
 	chainKey := make([]byte, 32)
+	nextHeaderKey := make([]byte, 32)
 
 	if _, err := io.ReadFull(hkdf, rootKey); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if _, err := io.ReadFull(hkdf, chainKey); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	if _, err := io.ReadFull(hkdf, nextHeaderKey); err != nil {
+		return nil, nil, nil, err
 	}
 
-	return rootKey, chainKey, nil
+	return rootKey, chainKey, nextHeaderKey, nil
 }
 
-func senderRatchetInit(sk []byte, preKeyBundle preKeyBundle) (*ratchetState, error) {
-	ratchetKeyPair, err := generateRatchetKeyPair()
+func senderRatchetInit(random io.Reader, sk []byte, preKeyBundle preKeyBundle) (*ratchetState, error) {
+	ratchetKeyPair, err := generateRatchetKeyPair(random)
 	if err != nil {
 		return nil, err
 	}
@@ -133,26 +161,32 @@ func parseHeader(header []byte) (*ratchetHeader, error) {
 }
 
 // 送られてきた header.dh を引数にとる
-func (rs *ratchetState) ratchet(remoteDH [32]byte) error {
+func (rs *ratchetState) ratchet(remoteDH [32]byte, random io.Reader) error {
 	rs.PN = rs.selfN
 	rs.selfN = 0
 	rs.remoteN = 0
 	rs.remoteDH = remoteDH
 
-	rootKey, remoteChainKey, err := kdfRk(rs.rootKey, rs.selfDH.privateKey, rs.remoteDH)
+	headerEncryption := rs.headerEncryption()
+	if headerEncryption {
+		rs.selfHeaderKey = rs.selfNextHeaderKey
+		rs.remoteHeaderKey = rs.remoteNextHeaderKey
+	}
+
+	rootKey, remoteChainKey, remoteNextHeaderKey, err := kdfRkHE(rs.rootKey, rs.selfDH.privateKey, rs.remoteDH)
 	if err != nil {
 		return err
 	}
 	rs.rootKey = rootKey
 	rs.remoteChainKey = remoteChainKey
 
-	ratchetKeyPair, err := generateRatchetKeyPair()
+	ratchetKeyPair, err := generateRatchetKeyPair(random)
 	if err != nil {
 		return err
 	}
 	rs.selfDH = *ratchetKeyPair
 
-	rootKey, selfChainKey, err := kdfRk(rs.rootKey, rs.selfDH.privateKey, rs.remoteDH)
+	rootKey, selfChainKey, selfNextHeaderKey, err := kdfRkHE(rs.rootKey, rs.selfDH.privateKey, rs.remoteDH)
 	if err != nil {
 		return err
 	}
@@ -160,10 +194,23 @@ func (rs *ratchetState) ratchet(remoteDH [32]byte) error {
 	rs.rootKey = rootKey
 	rs.selfChainKey = selfChainKey
 
+	if headerEncryption {
+		rs.remoteNextHeaderKey = remoteNextHeaderKey
+		rs.selfNextHeaderKey = selfNextHeaderKey
+	}
+
 	return nil
 }
 
-func (rs *ratchetState) ratchetDecrypt(header []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+// maxSkip は 1 つのチェインでスキップできるメッセージキーの最大数
+// random は DH ratchet で新しい鍵ペアを生成する場合に利用する
+// 復号に失敗した場合は状態を変更しない
+// ヘッダーを暗号化している場合、header は暗号化したヘッダー
+func (rs *ratchetState) ratchetDecrypt(header []byte, ciphertext []byte, ad []byte, maxSkip uint32, now time.Time, random io.Reader) ([]byte, error) {
+	if rs.headerEncryption() {
+		return rs.ratchetDecryptHE(header, ciphertext, ad, maxSkip, now, random)
+	}
+
 	ratchetHeader, err := parseHeader(header)
 	if err != nil {
 		return nil, err
@@ -177,38 +224,93 @@ func (rs *ratchetState) ratchetDecrypt(header []byte, ciphertext []byte, ad []by
 		return plaintext, nil
 	}
 
-	remoteDH := ratchetHeader.DH
+	return rs.decryptMessage(ratchetHeader, rs.remoteDH != ratchetHeader.DH, ciphertext, append(ad, header...), maxSkip, now, random)
+}
+
+// スキップしたメッセージキーで復号できなかったメッセージを、必要であれば DH ratchet してから復号する
+// dhRatchet は相手の新しいチェインのメッセージかどうか、aad はメッセージの本体の復号に利用する
+func (rs *ratchetState) decryptMessage(ratchetHeader *ratchetHeader, dhRatchet bool, ciphertext []byte, aad []byte, maxSkip uint32, now time.Time, random io.Reader) ([]byte, error) {
+	// 復号済みか、破棄したスキップしたメッセージキーのメッセージ
+	if !dhRatchet && ratchetHeader.N < rs.remoteN {
+		return nil, ErrDecryptMessage
+	}
 
-	if rs.remoteDH != remoteDH {
-		if err := rs.skipMessageKeys(ratchetHeader.PN); err != nil {
+	// 上限を超える N や PN は送られてこないので、スキップする数を確認する前に拒否する
+	if ratchetHeader.N >= maxChainMessages || (dhRatchet && ratchetHeader.PN > maxChainMessages) {
+		return nil, ErrRejoinRequired
+	}
+
+	// 状態を変更する前にスキップする数を確認する
+	if dhRatchet {
+		if rs.tooManySkippedMessageKeys(rs.remoteN, ratchetHeader.PN, maxSkip) || rs.tooManySkippedMessageKeys(0, ratchetHeader.N, maxSkip) {
+			return nil, ErrTooManySkippedMessages
+		}
+	} else if rs.tooManySkippedMessageKeys(rs.remoteN, ratchetHeader.N, maxSkip) {
+		return nil, ErrTooManySkippedMessages
+	}
+
+	// 古いセッションのメッセージや改ざんされたメッセージで状態が壊れないように、失敗したら元に戻す
+	previous := *rs
+	var skippedKeys []mkskippedKey
+	rollback := func() {
+		for _, k := range skippedKeys {
+			delete(rs.mkskipped, k)
+		}
+		*rs = previous
+	}
+
+	if dhRatchet {
+		keys, err := rs.skipMessageKeys(ratchetHeader.PN, now)
+		skippedKeys = append(skippedKeys, keys...)
+		if err != nil {
+			rollback()
 			return nil, err
 		}
-		if err := rs.ratchet(remoteDH); err != nil {
+		if err := rs.ratchet(ratchetHeader.DH, random); err != nil {
+			rollback()
 			return nil, err
 		}
 	}
 
-	if err := rs.skipMessageKeys(ratchetHeader.N); err != nil {
+	keys, err := rs.skipMessageKeys(ratchetHeader.N, now)
+	skippedKeys = append(skippedKeys, keys...)
+	if err != nil {
+		rollback()
 		return nil, err
 	}
 
 	messageKey, nonce, err := rs.newReceiverMessageKey()
 	if err != nil {
+		rollback()
 		return nil, err
 	}
 	rs.newReceiverChainKey()
 	rs.remoteN++
 
-	plaintext, err = decrypt(messageKey, nonce, ciphertext, append(ad, header...))
+	plaintext, err := rs.aead.decrypt(messageKey, nonce, ciphertext, aad)
 	if err != nil {
-		return nil, err
+		rollback()
+		return nil, ErrDecryptMessage
 	}
 
 	return plaintext, nil
 }
 
+// 相手が応答せずに DH ratchet しない場合は 1 つのチェインで送り続けることになる
+func (rs *ratchetState) checkSendLimit() error {
+	if rs.selfN >= maxChainMessages {
+		return ErrRejoinRequired
+	}
+	return nil
+}
+
 // チェインキーは生成済みとする
+// ヘッダーを暗号化している場合は暗号化したヘッダーを返す
 func (rs *ratchetState) ratchetEncrypt(plaintext []byte, ad []byte) ([]byte, []byte, error) {
+	if err := rs.checkSendLimit(); err != nil {
+		return nil, nil, err
+	}
+
 	messageKey, nonce, err := rs.newSenderMessageKey()
 	if err != nil {
 		return nil, nil, err
@@ -222,9 +324,17 @@ func (rs *ratchetState) ratchetEncrypt(plaintext []byte, ad []byte) ([]byte, []b
 		return nil, nil, err
 	}
 
+	// 相手にはヘッダーの代わりに暗号化したヘッダーを送る
+	if rs.headerEncryption() {
+		header, err = encryptHeader(rs.aead, rs.selfHeaderKey, header, ad)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	rs.selfN++
 
-	ciphertext, err := encrypt(messageKey, nonce, plaintext, append(ad, header...))
+	ciphertext, err := rs.aead.encrypt(messageKey, nonce, plaintext, append(ad, header...))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -265,20 +375,19 @@ func (rs *ratchetState) newSenderChainKey() {
 }
 
 // KDF_CK
-func newMessageKey(chainKey []byte) ([]byte, []byte, error) {
+// messageKey と nonce の長さは AEAD に合わせる
+func newMessageKey(chainKey []byte, aead aeadAlgorithm) ([]byte, []byte, error) {
 	h := hmac.New(sha256.New, chainKey)
 	h.Write([]byte{1})
 	seed := h.Sum(nil)
 
 	hash := sha256.New
-	salt := make([]byte, 44)
+	salt := make([]byte, aead.keyLength()+aead.nonceLength())
 	info := []byte("SoraMessageKeys")
 	hkdf := hkdf.New(hash, seed, salt, info)
 
-	// AES-GCM は 32 でよし
-	messageKey := make([]byte, 32)
-	// 12 ほしい
-	nonce := make([]byte, 12)
+	messageKey := make([]byte, aead.keyLength())
+	nonce := make([]byte, aead.nonceLength())
 
 	if _, err := io.ReadFull(hkdf, messageKey); err != nil {
 		return nil, nil, err
@@ -291,11 +400,11 @@ func newMessageKey(chainKey []byte) ([]byte, []byte, error) {
 }
 
 func (rs *ratchetState) newSenderMessageKey() ([]byte, []byte, error) {
-	return newMessageKey(rs.selfChainKey)
+	return newMessageKey(rs.selfChainKey, rs.aead)
 }
 
 func (rs *ratchetState) newReceiverMessageKey() ([]byte, []byte, error) {
-	return newMessageKey(rs.remoteChainKey)
+	return newMessageKey(rs.remoteChainKey, rs.aead)
 }
 
 func (rs *ratchetState) trySkippedMessageKeys(header *ratchetHeader, ciphertext []byte, AD []byte) ([]byte, error) {
@@ -305,49 +414,63 @@ func (rs *ratchetState) trySkippedMessageKeys(header *ratchetHeader, ciphertext
 	}
 	messageKey, ok := rs.mkskipped[*mkskippedKey]
 	if ok {
-		delete(rs.mkskipped, *mkskippedKey)
-		plaintext, err := decrypt(messageKey.key, messageKey.nonce, ciphertext, append(AD, header.raw...))
+		plaintext, err := rs.aead.decrypt(messageKey.key, messageKey.nonce, ciphertext, append(AD, header.raw...))
 		if err != nil {
-			return nil, err
+			return nil, ErrDecryptMessage
 		}
+		// 改ざんされたメッセージで破棄しないように、復号できてから破棄する
+		delete(rs.mkskipped, *mkskippedKey)
 		return plaintext, nil
 	}
 	return nil, nil
 }
 
-// MAX_SKIP定数も定義する必要がある。
-// これは、1つのチェーンでスキップできるメッセージキーの最大数を指定します。
+// MAX_SKIP 定数は 1 つのチェーンでスキップできるメッセージキーの最大数を指定する。
 // ルーチンでのメッセージの紛失や遅延を許容するのに十分な高さに設定しなければならないが、
 // 悪意のある送信者が過剰な受信者の計算を引き起こすことができないように十分に低い値に設定しなければならない。
-var maxSkip uint32 = 10
+// Engine ごとに WithMaxSkip で指定する
+func (rs *ratchetState) tooManySkippedMessageKeys(from uint32, until uint32, maxSkip uint32) bool {
+	// uint32 の桁あふれを避ける
+	return uint64(from)+uint64(maxSkip) < uint64(until)
+}
 
-func (rs *ratchetState) skipMessageKeys(until uint32) error {
-	if rs.remoteN+maxSkip < until {
-		// TODO(v): 切断を促すエラー処理
-		return errors.New("NotImplementedError")
+// スキップしたメッセージキーを保存するときの相手のチェインの識別子
+// ヘッダーを暗号化している場合は受け取ったメッセージのヘッダーを復号するまで DH がわからないので、ヘッダーキーを利用する
+func (rs *ratchetState) remoteChainID() [32]byte {
+	if !rs.headerEncryption() {
+		return rs.remoteDH
 	}
+	var id [32]byte
+	copy(id[:], rs.remoteHeaderKey)
+	return id
+}
 
+// スキップしたメッセージキーのキーを返す
+func (rs *ratchetState) skipMessageKeys(until uint32, now time.Time) ([]mkskippedKey, error) {
+	var keys []mkskippedKey
 	if rs.remoteChainKey != nil {
 		for rs.remoteN < until {
 			var mkskippedKey = &mkskippedKey{
-				DH: rs.remoteDH,
+				DH: rs.remoteChainID(),
 				N:  rs.remoteN,
 			}
 			key, nonce, err := rs.newReceiverMessageKey()
 			if err != nil {
-				return err
+				return keys, err
 			}
 
 			rs.newReceiverChainKey()
 			var messageKey = &messageKey{
-				key:   key,
-				nonce: nonce,
+				key:      key,
+				nonce:    nonce,
+				storedAt: now,
 			}
 
 			rs.mkskipped[*mkskippedKey] = *messageKey
+			keys = append(keys, *mkskippedKey)
 			rs.remoteN++
 		}
 	}
 
-	return nil
+	return keys, nil
 }
@@ -1,25 +1,27 @@
 package e2ee
 
 import (
+	"crypto/rand"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestDoubleRatchet(t *testing.T) {
-	alice, err := generateIdentityKeyPair()
+	alice, err := generateIdentityKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair()
+	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	bob, err := generateIdentityKeyPair()
+	bob, err := generateIdentityKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	bobPreKeyPair, err := generatePreKeyPair()
+	bobPreKeyPair, err := generatePreKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	bobPreKeyBundle := generatePreKeyBundle(*bob, *bobPreKeyPair)
+	bobPreKeyBundle := generatePreKeyBundle(*bob, *bobPreKeyPair, 1, selfCapabilities, nil)
 
 	aliceX25519IdentityPrivateKey := alice.privateEd25519KeyToCurve25519()
 	aliceX25519IdentityPublicKey, err := alice.publicEd25519KeyToCurve25519()
@@ -29,10 +31,10 @@ func TestDoubleRatchet(t *testing.T) {
 	bobX25519IdentityPublicKey, err := bob.publicEd25519KeyToCurve25519()
 	assert.Nil(t, err)
 
-	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey)
+	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey, nil, nil)
 	assert.Nil(t, err)
 
-	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey)
+	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey, nil, nil)
 	assert.Nil(t, err)
 
 	assert.Equal(t, aliceRootKey, bobRootKey)
@@ -41,14 +43,14 @@ func TestDoubleRatchet(t *testing.T) {
 	// 関数化
 	var ad []byte = append(alice.publicKey[:], bob.publicKey[:]...)
 
-	aliceRatchetState, err := senderRatchetInit(aliceRootKey, *bobPreKeyBundle)
+	aliceRatchetState, err := senderRatchetInit(rand.Reader, aliceRootKey, *bobPreKeyBundle)
 	bobRatchetState := receiverRatchetInit(bobRootKey, bobPreKeyBundle.signedPreKey, bobPreKeyPair.privateKey)
 
 	// Alice 1 回目のメッセージ
 	header, ciphertext, err := aliceRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
 
-	plaintext1, err := bobRatchetState.ratchetDecrypt(header, ciphertext, ad)
+	plaintext1, err := bobRatchetState.ratchetDecrypt(header, ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 
 	assert.Equal(t, plaintext, plaintext1)
@@ -57,14 +59,14 @@ func TestDoubleRatchet(t *testing.T) {
 	header2, ciphertext2, err := aliceRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
 
-	plaintext2, _ := bobRatchetState.ratchetDecrypt(header2, ciphertext2, ad)
+	plaintext2, _ := bobRatchetState.ratchetDecrypt(header2, ciphertext2, ad, defaultMaxSkip, time.Now(), rand.Reader)
 
 	assert.Equal(t, plaintext, plaintext2)
 
 	// Alice 3 回目のメッセージ
 	header3, ciphertext3, err := aliceRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
-	plaintext3, err := bobRatchetState.ratchetDecrypt(header3, ciphertext3, ad)
+	plaintext3, err := bobRatchetState.ratchetDecrypt(header3, ciphertext3, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 
 	assert.Equal(t, plaintext, plaintext3)
@@ -72,7 +74,7 @@ func TestDoubleRatchet(t *testing.T) {
 	// Bob 1 回目のメッセージ
 	header4, ciphertext4, err := bobRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
-	plaintext4, err := aliceRatchetState.ratchetDecrypt(header4, ciphertext4, ad)
+	plaintext4, err := aliceRatchetState.ratchetDecrypt(header4, ciphertext4, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 
 	assert.Equal(t, plaintext, plaintext4)
@@ -80,24 +82,24 @@ func TestDoubleRatchet(t *testing.T) {
 	// Alice 4 回目のメッセージ
 	header5, ciphertext5, err := aliceRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
-	plaintext5, err := bobRatchetState.ratchetDecrypt(header5, ciphertext5, ad)
+	plaintext5, err := bobRatchetState.ratchetDecrypt(header5, ciphertext5, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 
 	assert.Equal(t, plaintext, plaintext5)
 }
 
 func TestSkipMessageKey(t *testing.T) {
-	alice, err := generateIdentityKeyPair()
+	alice, err := generateIdentityKeyPair(rand.Reader)
 	assert.Nil(t, err)
-	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair()
+	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	bob, err := generateIdentityKeyPair()
+	bob, err := generateIdentityKeyPair(rand.Reader)
 	assert.Nil(t, err)
-	bobPreKeyPair, err := generatePreKeyPair()
+	bobPreKeyPair, err := generatePreKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	bobPreKeyBundle := generatePreKeyBundle(*bob, *bobPreKeyPair)
+	bobPreKeyBundle := generatePreKeyBundle(*bob, *bobPreKeyPair, 1, selfCapabilities, nil)
 
 	aliceX25519IdentityPrivateKey := alice.privateEd25519KeyToCurve25519()
 	aliceX25519IdentityPublicKey, err := alice.publicEd25519KeyToCurve25519()
@@ -107,9 +109,9 @@ func TestSkipMessageKey(t *testing.T) {
 	bobX25519IdentityPublicKey, err := bob.publicEd25519KeyToCurve25519()
 	assert.Nil(t, err)
 
-	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey)
+	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey, nil, nil)
 	assert.Nil(t, err)
-	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey)
+	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey, nil, nil)
 	assert.Nil(t, err)
 
 	assert.Equal(t, aliceRootKey, bobRootKey)
@@ -118,7 +120,7 @@ func TestSkipMessageKey(t *testing.T) {
 	// 関数化
 	var ad []byte = append(alice.publicKey[:], bobPreKeyBundle.identityKey[:]...)
 
-	aliceRatchetState, err := senderRatchetInit(aliceRootKey, *bobPreKeyBundle)
+	aliceRatchetState, err := senderRatchetInit(rand.Reader, aliceRootKey, *bobPreKeyBundle)
 	assert.Nil(t, err)
 	bobRatchetState := receiverRatchetInit(bobRootKey, bobPreKeyBundle.signedPreKey, bobPreKeyPair.privateKey)
 
@@ -126,7 +128,7 @@ func TestSkipMessageKey(t *testing.T) {
 	header, ciphertext, err := aliceRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
 
-	plaintext1, err := bobRatchetState.ratchetDecrypt(header, ciphertext, ad)
+	plaintext1, err := bobRatchetState.ratchetDecrypt(header, ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 	assert.Equal(t, plaintext, plaintext1)
 
@@ -136,14 +138,49 @@ func TestSkipMessageKey(t *testing.T) {
 	// Alice 3 回目のメッセージ
 	header3, ciphertext3, err := aliceRatchetState.ratchetEncrypt(plaintext, ad)
 	assert.Nil(t, err)
-	plaintext3, err := bobRatchetState.ratchetDecrypt(header3, ciphertext3, ad)
+	plaintext3, err := bobRatchetState.ratchetDecrypt(header3, ciphertext3, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 
 	assert.Equal(t, plaintext, plaintext3)
 
 	// メッセージが送れてきた
-	plaintext2, err := bobRatchetState.ratchetDecrypt(header2, ciphertext2, ad)
+	plaintext2, err := bobRatchetState.ratchetDecrypt(header2, ciphertext2, ad, defaultMaxSkip, time.Now(), rand.Reader)
 	assert.Nil(t, err)
 
 	assert.Equal(t, plaintext, plaintext2)
 }
+
+func TestRatchetMaxChainMessages(t *testing.T) {
+	alice, bob, ad := newTestRatchetStates(t)
+	plaintext := []byte("hello world")
+
+	header, ciphertext, err := alice.ratchetEncrypt(plaintext, ad)
+	assert.Nil(t, err)
+	_, err = bob.ratchetDecrypt(header, ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
+	assert.Nil(t, err)
+
+	// 上限の直前までは送れて、上限に達したら送らない
+	alice.selfN = maxChainMessages - 1
+	header, ciphertext, err = alice.ratchetEncrypt(plaintext, ad)
+	assert.Nil(t, err)
+	_, _, err = alice.ratchetEncrypt(plaintext, ad)
+	assert.ErrorIs(t, err, ErrRejoinRequired)
+	assert.Equal(t, uint32(maxChainMessages), alice.selfN)
+
+	// 受信側は上限の直前の N までは受け付ける
+	bob.remoteN = maxChainMessages - 1
+	_, err = bob.ratchetDecrypt(header, ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
+	assert.NotErrorIs(t, err, ErrRejoinRequired)
+
+	// 上限を超える N は maxSkip に関係なく状態を変更せずに拒否する
+	for _, n := range []uint32{maxChainMessages, maxChainMessages + 1, 1<<32 - 2} {
+		alice.selfN = n
+		header, err := alice.header()
+		assert.Nil(t, err)
+		bob.remoteN = 0
+		_, err = bob.ratchetDecrypt(header, ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
+		assert.ErrorIs(t, err, ErrRejoinRequired, n)
+		assert.Equal(t, uint32(0), bob.remoteN)
+		assert.Empty(t, bob.mkskipped)
+	}
+}
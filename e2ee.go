@@ -6,12 +6,34 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
 )
 
-type e2ee struct {
+const (
+	connectionIDLength = 26
+
+	// Init で生成する oneTimePreKey の数、ReplenishOneTimePreKeys ではこの数まで補充する
+	oneTimePreKeyCount = 100
+)
+
+// Engine は E2EE の鍵合意とメッセージの処理を行う
+// syscall/js に依存しないため Go のプログラムからもそのまま利用できる
+// 複数の goroutine から同時に呼び出してもよい
+type Engine struct {
 	// このライブラリのバージョン
 	version string
 
+	// cipherMessage の処理は読み込みロックとセッションごとのロックで行うため、
+	// 相手ごとのメッセージの処理はお互いを待たない
+	// それ以外の Engine の状態を変更する処理は書き込みロックで行う
+	mu sync.RWMutex
+	// 全セッションのスキップしたメッセージキーの破棄を同時に行わないようにする
+	evictMu sync.Mutex
+
 	// 自分
 	keyID             uint32
 	secretKeyMaterial []byte
@@ -20,27 +42,113 @@ type e2ee struct {
 	// TODO(v): self をつけるかどうか考える
 	identityKeyPair ed25519KeyPair
 	preKeyPair      x25519KeyPair
+	signedPreKeyID  uint32
+
+	// RotateSignedPreKey で更新された古い signedPreKey
+	previousPreKeyPairs     map[uint32]previousPreKeyPair
+	signedPreKeyGracePeriod time.Duration
 
 	selfPreKeyBundle preKeyBundle
 
+	// 相手に利用されたら破棄する
+	oneTimePreKeyPairs map[uint32]oneTimePreKeyPair
+	// 最後に採番した oneTimePreKey の ID、利用された ID は再利用しない
+	oneTimePreKeyID uint32
+
+	// セッションや preKeyBundle が揃う前に届いたメッセージ
+	pendingMessages    map[string][]pendingMessage
+	pendingMessageTTL  time.Duration
+	maxPendingMessages int
+
+	// 遅延や紛失したメッセージのためにスキップしたメッセージキー
+	maxSkip               uint32
+	maxSkippedMessageKeys int
+	skippedMessageKeyTTL  time.Duration
+
+	// 鍵や nonce の生成に利用する乱数
+	random io.Reader
+	// 期限の判定に利用する現在時刻
+	now func() time.Time
+
+	// 相手も対応している場合に Double Ratchet のヘッダーを暗号化する
+	headerEncryption bool
+	// 相手も対応している場合に Double Ratchet の AEAD に ChaCha20-Poly1305 を利用する
+	chaCha20Poly1305 bool
+	// 相手も対応している場合に PQXDH を行う
+	pqxdh bool
+	// PQXDH を利用しないセッションは開始しない
+	requirePQXDH bool
+	// signedPreKey と一緒に生成して同じ ID で配布する、PQXDH を行わない場合は nil
+	pqPreKeyPair *pqPreKeyPair
+	// signedPreKey と一緒に生成して KeyPackage の葉の鍵にする、MLS を利用しない場合は nil
+	mlsEncryptionKeyPair *x25519KeyPair
+
+	// ConnectionID ごとの相手の変わらない識別子と、識別子ごとに最初に受け取った identityKey
+	remoteIdentifiers map[string]string
+	identityStore     IdentityStore
+
+	// グループモードの場合は sessions の代わりに group で SK を導出する
+	groupMode bool
+	// グループモードで MLS の鍵スケジュールと KeyPackage を利用する
+	mls   bool
+	group *group
+	// まだコミットされていない追加する参加者と削除する参加者
+	groupJoiners map[string]bool
+	groupLeavers map[string]bool
+
+	// QueueStartSession と QueueStopSession で入れた順番の入退室、グループモードの場合は groupJoiners と groupLeavers を利用する
+	membershipChanges []membershipChange
+	// 最初にキューに入れた時刻、空の場合はゼロ値
+	membershipChangeQueuedAt time.Time
+	membershipChangeDebounce time.Duration
+	maxMembershipChangeDelay time.Duration
+
 	remotePreKeyBundles map[string]preKeyBundle
-	sessions            map[string]session
+	sessions            map[string]*session
 }
 
-func newE2EE(version string) *e2ee {
-	return &e2ee{version: version}
+// NewEngine は Engine を生成する
+// 利用する前に Init を必ず呼ぶこと
+func NewEngine(version string, options ...Option) *Engine {
+	e := &Engine{
+		version:                  version,
+		signedPreKeyGracePeriod:  defaultSignedPreKeyGracePeriod,
+		pendingMessageTTL:        defaultPendingMessageTTL,
+		maxPendingMessages:       defaultMaxPendingMessages,
+		maxSkip:                  defaultMaxSkip,
+		maxSkippedMessageKeys:    defaultMaxSkippedMessageKeys,
+		skippedMessageKeyTTL:     defaultSkippedMessageKeyTTL,
+		membershipChangeDebounce: defaultMembershipChangeDebounce,
+		maxMembershipChangeDelay: defaultMaxMembershipChangeDelay,
+		random:                   rand.Reader,
+		now:                      time.Now,
+		identityStore:            NewMemoryIdentityStore(),
+	}
+	for _, option := range options {
+		option(e)
+	}
+	return e
 }
 
-func (e *e2ee) getVersion() string {
+// Version はこのライブラリのバージョンを返す
+func (e *Engine) Version() string {
 	return e.version
 }
 
-func (e *e2ee) selfFingerprint() string {
+// SelfFingerprint は自分の IdentityKey のフィンガープリントを返す
+func (e *Engine) SelfFingerprint() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return fingerprint(e.identityKeyPair.publicKey)
 }
 
-func (e *e2ee) remoteFingerprints() map[string]interface{} {
-	remoteIdentityKeyFingerprints := make(map[string]interface{})
+// RemoteFingerprints は ConnectionID ごとの相手の IdentityKey のフィンガープリントを返す
+func (e *Engine) RemoteFingerprints() map[string]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	remoteIdentityKeyFingerprints := make(map[string]string)
 	for remoteConnectionID, remotePreKeyBundle := range e.remotePreKeyBundles {
 		fingerprint := fingerprint(remotePreKeyBundle.identityKey)
 		remoteIdentityKeyFingerprints[remoteConnectionID] = fingerprint
@@ -48,31 +156,64 @@ func (e *e2ee) remoteFingerprints() map[string]interface{} {
 	return remoteIdentityKeyFingerprints
 }
 
-func generateSecretKeyMaterial() ([]byte, error) {
+func generateSecretKeyMaterial(random io.Reader) ([]byte, error) {
 	b := make([]byte, 32)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(random, b)
 	if err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
-func (e *e2ee) init() error {
-	secretKeyMaterial, err := generateSecretKeyMaterial()
+// Init は鍵を生成して Engine を初期化する
+func (e *Engine) Init() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.checkPQXDH(); err != nil {
+		return err
+	}
+
+	secretKeyMaterial, err := generateSecretKeyMaterial(e.random)
 	if err != nil {
 		return err
 	}
 
-	identityKeyPair, err := generateEd25519KeyPair()
+	identityKeyPair, err := generateEd25519KeyPair(e.random)
 	if err != nil {
 		return err
 	}
-	preKeyPair, err := generateX25519KeyPair()
+	preKeyPair, err := generateX25519KeyPair(e.random)
 	if err != nil {
 		return err
 	}
 
-	selfPreKeyBundle := generatePreKeyBundle(*identityKeyPair, *preKeyPair)
+	// signedPreKey の ID は 1 から採番する
+	signedPreKeyID := uint32(1)
+
+	oneTimePreKeyPairs := make(map[uint32]oneTimePreKeyPair)
+	// ID は 1 から採番する
+	for id := uint32(1); id <= oneTimePreKeyCount; id++ {
+		oneTimePreKeyPair, err := generateOneTimePreKeyPair(e.random, *identityKeyPair, id)
+		if err != nil {
+			return err
+		}
+		oneTimePreKeyPairs[id] = *oneTimePreKeyPair
+	}
+
+	// 今までと同じ乱数の順番になるように最後に生成する
+	pqPreKeyPair, err := e.generatePQPreKeyPair()
+	if err != nil {
+		return err
+	}
+	mlsEncryptionKeyPair, err := e.generateMLSEncryptionKeyPair()
+	if err != nil {
+		return err
+	}
+	keyPackage, err := e.generateKeyPackage(*identityKeyPair, *preKeyPair, mlsEncryptionKeyPair)
+	if err != nil {
+		return err
+	}
 
 	e.keyID = 0
 	e.secretKeyMaterial = secretKeyMaterial
@@ -80,22 +221,194 @@ func (e *e2ee) init() error {
 
 	e.identityKeyPair = *identityKeyPair
 	e.preKeyPair = *preKeyPair
+	e.signedPreKeyID = signedPreKeyID
+	e.previousPreKeyPairs = make(map[uint32]previousPreKeyPair)
+	e.pqPreKeyPair = pqPreKeyPair
+	e.mlsEncryptionKeyPair = mlsEncryptionKeyPair
+
+	e.selfPreKeyBundle = *generatePreKeyBundle(*identityKeyPair, *preKeyPair, signedPreKeyID, e.capabilities(), e.selfPQPreKeyPair())
+	e.selfPreKeyBundle.keyPackage = keyPackage
 
-	e.selfPreKeyBundle = *selfPreKeyBundle
+	e.oneTimePreKeyPairs = oneTimePreKeyPairs
+	e.oneTimePreKeyID = oneTimePreKeyCount
 
+	e.remoteIdentifiers = make(map[string]string)
 	e.remotePreKeyBundles = make(map[string]preKeyBundle)
-	e.sessions = make(map[string]session)
+	e.sessions = make(map[string]*session)
+	e.pendingMessages = make(map[string][]pendingMessage)
+	e.group = nil
+	e.groupJoiners = make(map[string]bool)
+	e.groupLeavers = make(map[string]bool)
 
 	return nil
 }
 
-func (e *e2ee) start(selfConnectionID string) []byte {
+// SelfPreKeyBundle は相手に配布する自分の PreKeyBundle を返す
+func (e *Engine) SelfPreKeyBundle() PreKeyBundle {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.selfPreKeyBundle.export()
+}
+
+// RotateSignedPreKey は signedPreKey を新しく生成して、署名した PreKeyBundle を返す
+// 返した PreKeyBundle は相手に配布し直すこと
+// 古い signedPreKey は猶予期間が過ぎるまで preKeyMessage の受信に利用できる
+func (e *Engine) RotateSignedPreKey() (*PreKeyBundle, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	preKeyPair, err := generatePreKeyPair(e.random)
+	if err != nil {
+		return nil, err
+	}
+	pqPreKeyPair, err := e.generatePQPreKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	mlsEncryptionKeyPair, err := e.generateMLSEncryptionKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	keyPackage, err := e.generateKeyPackage(e.identityKeyPair, *preKeyPair, mlsEncryptionKeyPair)
+	if err != nil {
+		return nil, err
+	}
+
+	now := e.now()
+	e.removeExpiredPreKeyPairs(now)
+
+	e.previousPreKeyPairs[e.signedPreKeyID] = previousPreKeyPair{
+		keyPair:              e.preKeyPair,
+		pqPreKeyPair:         e.pqPreKeyPair,
+		mlsEncryptionKeyPair: e.mlsEncryptionKeyPair,
+		expiresAt:            now.Add(e.signedPreKeyGracePeriod),
+	}
+
+	e.signedPreKeyID++
+	e.preKeyPair = *preKeyPair
+	e.pqPreKeyPair = pqPreKeyPair
+	e.mlsEncryptionKeyPair = mlsEncryptionKeyPair
+	e.selfPreKeyBundle = *generatePreKeyBundle(e.identityKeyPair, e.preKeyPair, e.signedPreKeyID, e.capabilities(), e.selfPQPreKeyPair())
+	e.selfPreKeyBundle.keyPackage = keyPackage
+
+	selfPreKeyBundle := e.selfPreKeyBundle.export()
+	return &selfPreKeyBundle, nil
+}
+
+// 猶予期間が過ぎた古い signedPreKey を破棄する
+func (e *Engine) removeExpiredPreKeyPairs(now time.Time) {
+	for id, previousPreKeyPair := range e.previousPreKeyPairs {
+		if !now.Before(previousPreKeyPair.expiresAt) {
+			delete(e.previousPreKeyPairs, id)
+		}
+	}
+}
+
+// preKeyMessage で指定された signedPreKey を探す
+// 0 の場合は ID を送ってこない古いクライアントなので現在の signedPreKey を利用する
+func (e *Engine) signedPreKeyPair(signedPreKeyID uint32) (*x25519KeyPair, error) {
+	if signedPreKeyID == 0 || signedPreKeyID == e.signedPreKeyID {
+		return &e.preKeyPair, nil
+	}
+
+	e.removeExpiredPreKeyPairs(e.now())
+
+	previousPreKeyPair, ok := e.previousPreKeyPairs[signedPreKeyID]
+	if !ok {
+		return nil, ErrMissingSignedPreKey
+	}
+	return &previousPreKeyPair.keyPair, nil
+}
+
+// OneTimePreKeys はまだ利用されていない自分の oneTimePreKey を ID 順に返す
+// 相手ごとに異なる oneTimePreKey を配布すること
+func (e *Engine) OneTimePreKeys() []OneTimePreKey {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.exportOneTimePreKeys(e.oneTimePreKeyPairs)
+}
+
+func (e *Engine) exportOneTimePreKeys(oneTimePreKeyPairs map[uint32]oneTimePreKeyPair) []OneTimePreKey {
+	oneTimePreKeys := make([]OneTimePreKey, 0, len(oneTimePreKeyPairs))
+	for _, oneTimePreKeyPair := range oneTimePreKeyPairs {
+		oneTimePreKeys = append(oneTimePreKeys, oneTimePreKeyPair.export())
+	}
+	sort.Slice(oneTimePreKeys, func(i, j int) bool {
+		return oneTimePreKeys[i].ID < oneTimePreKeys[j].ID
+	})
+	return oneTimePreKeys
+}
+
+// ReplenishOneTimePreKeys は利用された oneTimePreKey の数だけ新しい oneTimePreKey を生成して、生成したものを ID 順に返す
+// 利用されていない oneTimePreKey は Init と同じ数まで補充され、ID は利用されたものと重ならないように続きから採番する
+// 返した oneTimePreKey は OneTimePreKeys と同様に相手ごとに異なるものを配布すること
+func (e *Engine) ReplenishOneTimePreKeys() ([]OneTimePreKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.oneTimePreKeyPairs == nil {
+		return nil, ErrUninitialized
+	}
+
+	n := oneTimePreKeyCount - len(e.oneTimePreKeyPairs)
+	if n <= 0 {
+		return []OneTimePreKey{}, nil
+	}
+	// ID が一周すると利用された oneTimePreKey と区別できなくなる
+	if e.oneTimePreKeyID > math.MaxUint32-uint32(n) {
+		return nil, ErrRejoinRequired
+	}
+
+	oneTimePreKeyPairs := make(map[uint32]oneTimePreKeyPair)
+	for id := e.oneTimePreKeyID + 1; id <= e.oneTimePreKeyID+uint32(n); id++ {
+		oneTimePreKeyPair, err := generateOneTimePreKeyPair(e.random, e.identityKeyPair, id)
+		if err != nil {
+			return nil, err
+		}
+		oneTimePreKeyPairs[id] = *oneTimePreKeyPair
+	}
+
+	for id, oneTimePreKeyPair := range oneTimePreKeyPairs {
+		e.oneTimePreKeyPairs[id] = oneTimePreKeyPair
+	}
+	e.oneTimePreKeyID += uint32(n)
+	return e.exportOneTimePreKeys(oneTimePreKeyPairs), nil
+}
+
+// Start は自分の ConnectionID を設定して、自分の SecretKeyMaterial を返す
+func (e *Engine) Start(selfConnectionID string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(selfConnectionID) != connectionIDLength {
+		return nil, ErrUnexpectedSelfConnectionID
+	}
 	e.connectionID = selfConnectionID
-	return e.secretKeyMaterial
+
+	// グループモードの場合は自分だけのグループを作り、welcome を受け取るまではその SK を利用する
+	if e.groupMode {
+		g, err := newGroup(e.random, e.groupCipherSuite(), selfConnectionID, e.identityKeyPair.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		e.setGroup(g)
+	}
+
+	return e.secretKeyMaterial, nil
+}
+
+// SelfKeyID は自分の現在の KeyID を返す
+func (e *Engine) SelfKeyID() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.keyID
 }
 
 // TODO(v): 関数名前がひどい
-func (e *e2ee) plaintext() ([]byte, error) {
+func (e *Engine) plaintext() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, e.keyID); err != nil {
 		return nil, err
@@ -104,34 +417,28 @@ func (e *e2ee) plaintext() ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, e.secretKeyMaterial); err != nil {
 		return nil, err
 	}
+
+	// 古いクライアントは読まないので、常に付与する
+	if err := binary.Write(buf, binary.BigEndian, protocolVersion); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, e.capabilities()); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
-func (e *e2ee) messages() ([][]byte, error) {
+func (e *Engine) messages() ([][]byte, error) {
 	var index = 0
 	messages := make([][]byte, len(e.sessions))
-	for cid, session := range e.sessions {
+	for _, session := range e.sessions {
 		// 全員に送る CipherMessage を生成する
-		buf := new(bytes.Buffer)
-		if err := binary.Write(buf, binary.BigEndian, e.keyID); err != nil {
-			return nil, err
-		}
-
-		if err := binary.Write(buf, binary.BigEndian, e.secretKeyMaterial); err != nil {
-			return nil, err
-		}
-
-		header, ciphertext, err := session.ratchetState.ratchetEncrypt(buf.Bytes(), session.ad)
+		message, err := e.sessionMessage(session)
 		if err != nil {
 			return nil, err
 		}
 
-		message, err := session.cipherMessage(header, ciphertext)
-		if err != nil {
-			return nil, err
-		}
-
-		e.sessions[cid] = session
 		messages[index] = message
 		index++
 	}
@@ -139,148 +446,370 @@ func (e *e2ee) messages() ([][]byte, error) {
 	return messages, nil
 }
 
-func (e *e2ee) startSession(remoteConnectionID string, identityKey, signedPreKey, preKeySignature []byte) (*startSessionResult, error) {
+// 自分の KeyID と SecretKeyMaterial を含む CipherMessage を生成する
+func (e *Engine) sessionMessage(session *session) ([]byte, error) {
+	plaintext, err := e.plaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.messageAD(session.protocolVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	return session.cipherMessage(header, ciphertext)
+}
+
+// StartSession は相手の PreKeyBundle を利用してセッションを開始する
+// PreKeyBundle に OneTimePreKey が指定されている場合は DH4 も行う
+// 戻り値の Messages は相手に送る必要がある
+func (e *Engine) StartSession(remoteConnectionID string, remotePreKeyBundle PreKeyBundle) (*StartSessionResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(remoteConnectionID) != connectionIDLength {
+		return nil, ErrUnexpectedRemoteConnectionID
+	}
+
+	if e.groupMode {
+		return e.groupStartSession(remoteConnectionID, remotePreKeyBundle)
+	}
+
 	// セッションがすでに無いかどうかの確認をする
 	_, ok := e.sessions[remoteConnectionID]
 	if ok {
 		// すでにセッションがあるのに呼んでるのでエラーにする
 		// いい名前のエラーが必要
-		return nil, errors.New("SessionAlreadyExists")
+		return nil, ErrSessionAlreadyExists
 	}
 
-	// すでに持っている preKeyBundle だったらエラーを返す
-	if err := e.addPreKeyBundle(remoteConnectionID, identityKey, signedPreKey, preKeySignature); err != nil {
+	preKeyBundle, err := newPreKeyBundle(remotePreKeyBundle)
+	if err != nil {
 		return nil, err
 	}
 
-	var copySignedPreKey [32]byte
-	copy(copySignedPreKey[:], signedPreKey)
-
-	preKeyBundle := &preKeyBundle{
-		identityKey:     identityKey,
-		signedPreKey:    copySignedPreKey,
-		preKeySignature: preKeySignature,
-	}
-
 	// secretMaterialKey の更新が必要
-	session, err := e.initSession(remoteConnectionID, *preKeyBundle)
+	session, err := e.senderSession(remoteConnectionID, *preKeyBundle)
 	if err != nil {
 		return nil, err
 	}
 
-	// start 側が sender になる
-	session.role = sender
-	if err := session.senderRootKey(); err != nil {
-		return nil, err
-	}
-	if err := session.senderRatchetInit(session.rootKey, *preKeyBundle); err != nil {
+	preKeyMessage, err := session.preKeyMessage()
+	if err != nil {
 		return nil, err
 	}
 
-	var remoteSecretKeyMaterials = make(map[string]remoteSecretKeyMaterial)
+	// 途中で失敗しても状態を変更しないように、先に全部計算してから反映する
+	// KeyID が一周する場合は参加者全員に送るので、全員のセッションの上限も確認する
+	wrapped := e.keyID == math.MaxUint32
+	if wrapped {
+		if err := e.checkSendLimit(nil); err != nil {
+			return nil, err
+		}
+	}
 
-	// ここで startSesson 以外のセッションの SK を更新する
+	// startSesson 以外のセッションの次の SK を計算する
+	var remoteSecretKeyMaterials = make(map[string]RemoteSecretKeyMaterial)
 	for cid, s := range e.sessions {
-		s.ratchetSecretKeymaterial()
+		keyID, secretKeyMaterial, err := s.nextRemoteSecretKeyMaterial()
+		if err != nil {
+			return nil, err
+		}
 
-		remoteKeyMaterial := &remoteSecretKeyMaterial{
-			keyID:             s.remoteKeyID,
-			secretKeyMaterial: s.remoteSecretKeyMaterial,
+		remoteSecretKeyMaterials[cid] = RemoteSecretKeyMaterial{
+			KeyID:             keyID,
+			SecretKeyMaterial: secretKeyMaterial,
 		}
+	}
 
-		remoteSecretKeyMaterials[cid] = *remoteKeyMaterial
+	// 自分の次の SK を計算する
+	keyID, secretKeyMaterial, err := e.nextSecretKeyMaterial(false)
+	if err != nil {
+		return nil, err
+	}
 
-		// セッション更新して代入
-		e.sessions[cid] = s
+	// すでに持っている preKeyBundle だったらエラーを返す
+	if err := e.addPreKeyBundle(remoteConnectionID, remotePreKeyBundle); err != nil {
+		return nil, err
 	}
 
+	// ここから先は上限を確認済みなので失敗しない
+	for cid, m := range remoteSecretKeyMaterials {
+		e.sessions[cid].remoteKeyID = m.KeyID
+		e.sessions[cid].remoteSecretKeyMaterial = m.SecretKeyMaterial
+	}
 	// startSession はここで追加する
-	e.sessions[remoteConnectionID] = *session
+	e.sessions[remoteConnectionID] = session
+	e.keyID = keyID
+	e.secretKeyMaterial = secretKeyMaterial
 
-	// ここで自分の SK を更新する
-	newSecretKeyMaterial, err := ratchetSecretKeyMaterial(e.secretKeyMaterial)
-	if err != nil {
-		return nil, err
+	// KeyID が一周した場合は、他の参加者が予測できない新しい SK になったので全員に送る
+	if wrapped {
+		messages, err := e.messages()
+		if err != nil {
+			return nil, err
+		}
+		return &StartSessionResult{
+			SelfConnectionID:         e.connectionID,
+			SelfKeyID:                e.keyID,
+			SelfSecretKeyMaterial:    e.secretKeyMaterial,
+			RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+			Messages:                 append([][]byte{preKeyMessage}, messages...),
+		}, nil
 	}
-	e.secretKeyMaterial = newSecretKeyMaterial
-	// SK 更新したので KeyIdentifier をインクリメントする
-	e.keyID++
 
-	preKeyMessage, err := session.preKeyMessage()
+	// selfKeyId + selfSecretKeyMaterial
+	ratchetMessage, err := e.sessionMessage(session)
 	if err != nil {
 		return nil, err
 	}
 
-	// selfKeyId + selfSecretKeyMaterial
-	plaintext, err := e.plaintext()
+	return &StartSessionResult{
+		SelfConnectionID:         e.connectionID,
+		SelfKeyID:                e.keyID,
+		SelfSecretKeyMaterial:    e.secretKeyMaterial,
+		RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+		Messages:                 [][]byte{preKeyMessage, ratchetMessage},
+	}, nil
+}
+
+// 自分の次の KeyID と SK を返す、KeyID の更新は必ずここで行う
+// fresh の場合はそれまでの SK から導出できない新しい SK を生成し、それ以外は ratchet する
+// KeyID が一周する場合は fresh に関わらず新しい SK を生成して KeyID を 0 に戻す
+// SFrame の受信側は KeyID ごとに鍵を持つので、一周した KeyID で以前の SK を ratchet した鍵を使い回さない
+func (e *Engine) nextSecretKeyMaterial(fresh bool) (uint32, []byte, error) {
+	var newSecretKeyMaterial []byte
+	var err error
+	if fresh || e.keyID == math.MaxUint32 {
+		newSecretKeyMaterial, err = generateSecretKeyMaterial(e.random)
+	} else {
+		newSecretKeyMaterial, err = ratchetSecretKeyMaterial(e.secretKeyMaterial)
+	}
 	if err != nil {
+		return 0, nil, err
+	}
+	// uint32 なので一周すると 0 に戻る
+	return e.keyID + 1, newSecretKeyMaterial, nil
+}
+
+// 参加者全員に送る前に上限を確認して、途中のセッションで失敗して一部のセッションだけ変更しないようにする
+// excluded のセッションには送らないので確認しない
+func (e *Engine) checkSendLimit(excluded map[string]bool) error {
+	for connectionID, session := range e.sessions {
+		if excluded[connectionID] {
+			continue
+		}
+		if err := session.ratchetState.checkSendLimit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StopSession は相手とのセッションを破棄して、自分の SecretKeyMaterial を更新する
+// 戻り値の Messages は残りの参加者に送る必要がある
+func (e *Engine) StopSession(remoteConnectionID string) (*StopSessionResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(remoteConnectionID) != connectionIDLength {
+		return nil, ErrUnexpectedRemoteConnectionID
+	}
+
+	if e.groupMode {
+		return e.groupStopSession(remoteConnectionID)
+	}
+
+	_, ok := e.sessions[remoteConnectionID]
+	if !ok {
+		return nil, ErrMissingSession
+	}
+
+	_, ok = e.remotePreKeyBundles[remoteConnectionID]
+	if !ok {
+		return nil, ErrMissingRemotePreKeyBundle
+	}
+
+	// 途中で失敗しても状態を変更しないように、残りの参加者全員に送れることを先に確認する
+	if err := e.checkSendLimit(map[string]bool{remoteConnectionID: true}); err != nil {
 		return nil, err
 	}
 
-	header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.ad)
+	// 新しく SK を生成する、KeyID が一周しても全員に送るので問題ない
+	keyID, secretKeyMaterial, err := e.nextSecretKeyMaterial(true)
 	if err != nil {
 		return nil, err
 	}
 
-	ratchetMessage, err := session.cipherMessage(header, ciphertext)
+	delete(e.sessions, remoteConnectionID)
+	delete(e.remotePreKeyBundles, remoteConnectionID)
+	delete(e.remoteIdentifiers, remoteConnectionID)
+	e.keyID = keyID
+	e.secretKeyMaterial = secretKeyMaterial
+
+	messages, err := e.messages()
 	if err != nil {
 		return nil, err
 	}
 
-	return &startSessionResult{
-		selfConnectionID:         e.connectionID,
-		selfKeyID:                e.keyID,
-		selfSecretKeyMaterial:    e.secretKeyMaterial,
-		remoteSecretKeyMaterials: remoteSecretKeyMaterials,
-		messages:                 [][]byte{preKeyMessage, ratchetMessage},
+	return &StopSessionResult{
+		SelfConnectionID:      e.connectionID,
+		SelfKeyID:             e.keyID,
+		SelfSecretKeyMaterial: e.secretKeyMaterial,
+		Messages:              messages,
 	}, nil
 }
 
-func (e *e2ee) stopSession(remoteConnectionID string) (*stopSessionResult, error) {
-	_, ok := e.sessions[remoteConnectionID]
+// ResetSession は相手との X3DH と Double Ratchet のセッションだけを作り直す
+// 復号に失敗し続ける場合や ErrTooManySkippedMessages が返ってきた場合に利用する
+// StopSession と StartSession と異なり、自分や他の参加者の KeyID と SecretKeyMaterial は変更しない
+// remotePreKeyBundle を指定した場合はそれを利用する、nil の場合は保持している相手の preKeyBundle を利用する
+// 戻り値の Messages は相手に送る必要がある
+func (e *Engine) ResetSession(remoteConnectionID string, remotePreKeyBundle *PreKeyBundle) (*ResetSessionResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(remoteConnectionID) != connectionIDLength {
+		return nil, ErrUnexpectedRemoteConnectionID
+	}
+
+	oldSession, ok := e.sessions[remoteConnectionID]
 	if !ok {
-		return nil, errors.New("MissingSessionError")
+		return nil, ErrMissingSession
+	}
+	// 古いクライアントは resetMessage を処理できない
+	if !oldSession.hasRemoteCapability(capabilityResetMessage) {
+		return nil, ErrUnsupportedByRemote
 	}
-	delete(e.sessions, remoteConnectionID)
 
-	_, ok = e.remotePreKeyBundles[remoteConnectionID]
+	storedPreKeyBundle, ok := e.remotePreKeyBundles[remoteConnectionID]
 	if !ok {
-		return nil, errors.New("MissingPreKeyBundleError")
+		return nil, ErrMissingRemotePreKeyBundle
+	}
+
+	preKeyBundle := &storedPreKeyBundle
+	if remotePreKeyBundle != nil {
+		var err error
+		preKeyBundle, err = newPreKeyBundle(*remotePreKeyBundle)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(preKeyBundle.identityKey, storedPreKeyBundle.identityKey) {
+			return nil, ErrUnmatchIdentityKey
+		}
 	}
-	delete(e.remotePreKeyBundles, remoteConnectionID)
 
-	// 新しく SK を生成する
-	newSecretKeyMaterial, err := generateSecretKeyMaterial()
+	session, err := e.senderSession(remoteConnectionID, *preKeyBundle)
 	if err != nil {
 		return nil, err
 	}
-	e.secretKeyMaterial = newSecretKeyMaterial
-	e.keyID++
+	// 相手の SK とネゴシエーション済みのバージョンはそのまま引き継ぐ
+	session.remoteKeyID = oldSession.remoteKeyID
+	session.remoteSecretKeyMaterial = oldSession.remoteSecretKeyMaterial
+	session.protocolVersion = oldSession.protocolVersion
+	session.remoteProtocolVersion = oldSession.remoteProtocolVersion
+	session.remoteCapabilities = oldSession.remoteCapabilities
+	session.resetPending = true
 
-	messages, err := e.messages()
+	plaintext, err := e.plaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.messageAD(session.protocolVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	resetMessage, err := session.resetMessage(header, ciphertext)
 	if err != nil {
 		return nil, err
 	}
 
-	return &stopSessionResult{
-		selfConnectionID:      e.connectionID,
-		selfKeyID:             e.keyID,
-		selfSecretKeyMaterial: e.secretKeyMaterial,
-		messages:              messages,
+	// 新しい signedPreKey を受け取っていた場合は次回以降も利用する
+	if remotePreKeyBundle != nil {
+		preKeyBundle.oneTimePreKey = nil
+		e.remotePreKeyBundles[remoteConnectionID] = *preKeyBundle
+	}
+	e.sessions[remoteConnectionID] = session
+
+	return &ResetSessionResult{
+		SelfConnectionID: e.connectionID,
+		Messages:         [][]byte{resetMessage},
 	}, nil
 }
 
 const (
 	typePreKeyMessage uint8 = 0
 	typeCipherMessage uint8 = 1
+	typeResetMessage  uint8 = 2
+	// ヘッダーを暗号化した cipherMessage
+	typeEncryptedCipherMessage uint8 = 3
+	// capabilities を含む resetMessage
+	typeExtendedResetMessage uint8 = 4
+	// グループモードの全員宛のコミットと、追加した参加者宛の welcome
+	typeGroupCommitMessage  uint8 = 5
+	typeGroupWelcomeMessage uint8 = 6
 )
 
-// preKeyMessage または cipherMessage
+// ReceiveMessage は相手から届いた preKeyMessage、cipherMessage または resetMessage を処理する
+// セッションや preKeyBundle が揃う前に届いたメッセージは保留して、揃った時点で処理した結果をまとめて返す
 // cid, sk, msgs, err
-func (e *e2ee) receiveMessage(data []byte) (*receiveMessageResult, error) {
+func (e *Engine) ReceiveMessage(data []byte) (*ReceiveMessageResult, error) {
+	now := e.now()
+
+	var result *ReceiveMessageResult
+	var err error
+
+	// cipherMessage は読み込みロックとセッションごとのロックで処理するため、他の相手のメッセージの処理を待たない
+	if isCipherMessage(data) {
+		e.mu.RLock()
+		result, err = e.receiveMessage(data)
+		hasPendingMessages := len(e.pendingMessages) > 0
+		e.mu.RUnlock()
+
+		if err == nil && !hasPendingMessages {
+			return result, nil
+		}
+		if err != nil && !isPendingError(err) {
+			return nil, err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if result == nil {
+		// 書き込みロックを取るまでにセッションができているかもしれないので、保留する場合も処理し直す
+		result, err = e.receiveMessage(data)
+		if err != nil {
+			var messageError *MessageError
+			if isPendingError(err) && errors.As(err, &messageError) {
+				if e.addPendingMessage(messageError.RemoteConnectionID, data, now) {
+					return &ReceiveMessageResult{}, nil
+				}
+			}
+			return nil, err
+		}
+	}
+
+	// このメッセージでセッションができた場合は保留しているメッセージを処理できる
+	if len(e.pendingMessages) > 0 {
+		result.merge(e.drainPendingMessages(now))
+	}
+
+	return result, nil
+}
+
+func isCipherMessage(data []byte) bool {
+	return len(data) > 0 && (data[0] == typeCipherMessage || data[0] == typeEncryptedCipherMessage)
+}
+
+func (e *Engine) receiveMessage(data []byte) (*ReceiveMessageResult, error) {
 	header, buf, err := decodeMessageHeader(data)
 	if err != nil {
-		return nil, errors.New("ReceiveMessageDecodeError")
+		return nil, ErrDecodeMessage
 	}
 
 	switch header.packetType {
@@ -288,129 +817,323 @@ func (e *e2ee) receiveMessage(data []byte) (*receiveMessageResult, error) {
 		// この m, err の m を使う
 		m, err := decodePreKeyMessage(*header, buf)
 		if err != nil {
-			return nil, err
+			return nil, ErrDecodeMessage
 		}
 		result, err := e.preKeyMessage(*m)
 		if err != nil {
-			return nil, err
+			return nil, &MessageError{
+				Err:                err,
+				RemoteConnectionID: string(m.selfConnectionID[:]),
+				MessageType:        MessageTypePreKey,
+			}
 		}
 		return result, nil
-	case typeCipherMessage:
+	case typeCipherMessage, typeEncryptedCipherMessage:
 		m, err := decodeCipherMessage(*header, buf)
 		if err != nil {
-			return nil, err
+			return nil, ErrDecodeMessage
 		}
 		result, err := e.cipherMessage(*m)
 		if err != nil {
-			return nil, err
+			return nil, &MessageError{
+				Err:                err,
+				RemoteConnectionID: string(m.selfConnectionID[:]),
+				MessageType:        MessageTypeCipher,
+				PN:                 m.PN,
+				N:                  m.N,
+			}
+		}
+		return result, nil
+	case typeResetMessage, typeExtendedResetMessage:
+		m, err := decodeResetMessage(*header, buf)
+		if err != nil {
+			return nil, ErrDecodeMessage
+		}
+		result, err := e.resetMessage(*m)
+		if err != nil {
+			return nil, &MessageError{
+				Err:                err,
+				RemoteConnectionID: string(m.preKeyMessage.selfConnectionID[:]),
+				MessageType:        MessageTypeReset,
+				PN:                 m.cipherMessage.PN,
+				N:                  m.cipherMessage.N,
+			}
+		}
+		return result, nil
+	case typeGroupCommitMessage:
+		if !e.groupMode {
+			return nil, ErrUnknownMessage
+		}
+		m, err := decodeGroupCommitMessage(*header, buf)
+		if err != nil {
+			return nil, ErrDecodeMessage
+		}
+		result, err := e.groupCommitMessage(*m)
+		if err != nil {
+			return nil, &MessageError{
+				Err:                err,
+				RemoteConnectionID: string(m.selfConnectionID[:]),
+				MessageType:        MessageTypeGroupCommit,
+			}
+		}
+		return result, nil
+	case typeGroupWelcomeMessage:
+		if !e.groupMode {
+			return nil, ErrUnknownMessage
+		}
+		m, err := decodeGroupWelcomeMessage(*header, buf)
+		if err != nil {
+			return nil, ErrDecodeMessage
+		}
+		if string(m.remoteConnectionID[:]) != e.connectionID {
+			return nil, ErrDiscardMessage
+		}
+		result, err := e.groupWelcomeMessage(*m)
+		if err != nil {
+			return nil, &MessageError{
+				Err:                err,
+				RemoteConnectionID: string(m.selfConnectionID[:]),
+				MessageType:        MessageTypeGroupWelcome,
+			}
 		}
 		return result, nil
 	default:
-		return nil, errors.New("UnknownMessageError")
+		return nil, ErrUnknownMessage
 	}
 }
 
-func (e *e2ee) addPreKeyBundle(connectionID string, identityKey, signedPreKey, preKeySignature []byte) error {
-	var copySignedPreKey [32]byte
-	copy(copySignedPreKey[:], signedPreKey)
+// AddPreKeyBundle は metadata_list などから取得した相手の PreKeyBundle を追加する
+// preKeyBundle が届く前に保留していたメッセージがあれば処理した結果を返す
+func (e *Engine) AddPreKeyBundle(connectionID string, remotePreKeyBundle PreKeyBundle) (*ReceiveMessageResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	ok := ed25519.Verify(identityKey, signedPreKey, preKeySignature)
-	if !ok {
-		return errors.New("VerifyFailedError")
+	if err := e.addPreKeyBundle(connectionID, remotePreKeyBundle); err != nil {
+		return nil, err
+	}
+
+	result := &ReceiveMessageResult{}
+	if len(e.pendingMessages) > 0 {
+		result.merge(e.drainPendingMessages(e.now()))
+	}
+
+	return result, nil
+}
+
+func (e *Engine) addPreKeyBundle(connectionID string, remotePreKeyBundle PreKeyBundle) error {
+	if len(connectionID) != connectionIDLength {
+		return ErrUnexpectedRemoteConnectionID
 	}
 
-	preKeyBundle := &preKeyBundle{
-		identityKey:     identityKey,
-		signedPreKey:    copySignedPreKey,
-		preKeySignature: preKeySignature,
+	preKeyBundle, err := newPreKeyBundle(remotePreKeyBundle)
+	if err != nil {
+		return err
+	}
+	// oneTimePreKey は StartSession でのみ利用するので保持しない
+	preKeyBundle.oneTimePreKey = nil
+	// 受け取る側も、相手が PQXDH を利用しない preKeyMessage を送ってくる前に拒否する
+	if err := e.checkRequirePQXDH(e.sessionCapabilities(*preKeyBundle)); err != nil {
+		return err
 	}
 
-	_, ok = e.remotePreKeyBundles[connectionID]
+	_, ok := e.remotePreKeyBundles[connectionID]
 	if ok {
-		return errors.New("AlreadyExistRemotePreKeyBundle")
+		return ErrRemotePreKeyBundleExists
+	}
+	if err := e.checkIdentity(connectionID, preKeyBundle.identityKey); err != nil {
+		return err
 	}
 	e.remotePreKeyBundles[connectionID] = *preKeyBundle
 	return nil
 }
 
-func (e *e2ee) preKeyMessage(m preKeyMessage) (*receiveMessageResult, error) {
+func (e *Engine) preKeyMessage(m preKeyMessage) (*ReceiveMessageResult, error) {
 	// 相手が自分の ConnectionID を送ってきているので、リモートになる
 	remoteConnectionID := string(m.selfConnectionID[:])
 
 	preKeyBundle, ok := e.remotePreKeyBundles[remoteConnectionID]
 
 	if !ok {
-		return nil, errors.New("MissingRemotePreKeyBundle")
+		return nil, ErrMissingRemotePreKeyBundle
 	}
 
 	if !bytes.Equal(preKeyBundle.identityKey, m.identityKey[:]) {
 		// metadata_list から取得した公開鍵と x3dh メッセージから取得した公開鍵が異なる
-		return nil, errors.New("UnmatchIdentityKey")
+		return nil, ErrUnmatchIdentityKey
 	}
 
 	// session, ok だけどそもそもセッションがあった時点で破棄する
 	// メッセージを 2 回送ってきてる
 	_, ok = e.sessions[remoteConnectionID]
 	if !ok {
-		newSession, err := e.initSession(remoteConnectionID, preKeyBundle)
+		newSession, err := e.receiverSession(remoteConnectionID, preKeyBundle, m)
 		if err != nil {
 			return nil, err
 		}
 
-		newSession.role = receiver
-		newSession.remoteEphemeralKey = m.ephemeralKey
-
-		newSession.receiverRootKey()
-		newSession.receiverRatchetInit()
+		// 利用した oneTimePreKey はリプレイされないように破棄する
+		delete(e.oneTimePreKeyPairs, m.oneTimePreKeyID)
 
-		e.sessions[remoteConnectionID] = *newSession
+		e.sessions[remoteConnectionID] = newSession
 
 		// ここで相手に送るべきメッセージを生成する必要はない
 		// cipherMessage メッセージを待つ
-		return &receiveMessageResult{}, nil
+		return &ReceiveMessageResult{}, nil
+	}
+
+	return nil, ErrDiscardMessage
+}
+
+// 相手が ResetSession で作り直したセッションに置き換える
+// 同梱されている cipherMessage を新しいセッションで復号できるまで、今のセッションは変更しない
+func (e *Engine) resetMessage(m resetMessage) (*ReceiveMessageResult, error) {
+	remoteConnectionID := string(m.preKeyMessage.selfConnectionID[:])
+
+	preKeyBundle, ok := e.remotePreKeyBundles[remoteConnectionID]
+	if !ok {
+		return nil, ErrMissingRemotePreKeyBundle
+	}
+
+	if !bytes.Equal(preKeyBundle.identityKey, m.preKeyMessage.identityKey[:]) {
+		return nil, ErrUnmatchIdentityKey
+	}
+
+	oldSession, ok := e.sessions[remoteConnectionID]
+	if ok {
+		// 今のセッションを作った resetMessage が再送されてきた
+		// それより前の resetMessage の再送は検出できないが、その場合も相手が ResetSession し直せば回復できる
+		if oldSession.role == receiver && oldSession.remoteEphemeralKey == m.preKeyMessage.ephemeralKey {
+			return nil, ErrDiscardMessage
+		}
+		// お互いに ResetSession した場合は ConnectionID が小さい方のセッションを利用する
+		if oldSession.resetPending && e.connectionID < remoteConnectionID {
+			return nil, ErrDiscardMessage
+		}
+	}
+
+	newSession, err := e.receiverSession(remoteConnectionID, preKeyBundle, m.preKeyMessage)
+	if err != nil {
+		return nil, err
+	}
+	// ネゴシエーション済みのバージョンはそのまま引き継ぐ
+	if oldSession != nil {
+		newSession.protocolVersion = oldSession.protocolVersion
+		newSession.remoteProtocolVersion = oldSession.remoteProtocolVersion
+		newSession.remoteCapabilities = oldSession.remoteCapabilities
+	}
+	if err := newSession.checkProtocolVersion(m.cipherMessage.protocolVersion); err != nil {
+		return nil, err
+	}
+
+	header, err := cipherMessageHeader(m.cipherMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := newSession.ratchetState.ratchetDecrypt(header, m.cipherMessage.ciphertext, newSession.messageAD(m.cipherMessage.protocolVersion), e.maxSkip, e.now(), e.random)
+	if err != nil {
+		return nil, err
+	}
+	senderKeyMessage, err := decodeSenderKeyMessage(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	newSession.updateProtocolVersion(m.cipherMessage.protocolVersion, senderKeyMessage)
+	newSession.remoteKeyID = senderKeyMessage.keyID
+	newSession.remoteSecretKeyMaterial = senderKeyMessage.secretKeyMaterial[:]
+
+	// 相手が新しいセッションで復号できるように自分の SK を送り返す
+	selfPlaintext, err := e.plaintext()
+	if err != nil {
+		return nil, err
+	}
+	header, ciphertext, err := newSession.ratchetState.ratchetEncrypt(selfPlaintext, newSession.messageAD(newSession.protocolVersion))
+	if err != nil {
+		return nil, err
+	}
+	message, err := newSession.cipherMessage(header, ciphertext)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("DiscardMessage")
+	delete(e.oneTimePreKeyPairs, m.preKeyMessage.oneTimePreKeyID)
+	e.sessions[remoteConnectionID] = newSession
+
+	return &ReceiveMessageResult{
+		RemoteSecretKeyMaterials: map[string]RemoteSecretKeyMaterial{
+			remoteConnectionID: {
+				KeyID:             senderKeyMessage.keyID,
+				SecretKeyMaterial: senderKeyMessage.secretKeyMaterial[:],
+			},
+		},
+		Messages: [][]byte{message},
+	}, nil
 }
 
-func (e *e2ee) cipherMessage(m cipherMessage) (*receiveMessageResult, error) {
+func (e *Engine) cipherMessage(m cipherMessage) (*ReceiveMessageResult, error) {
 	remoteConnectionID := string(m.selfConnectionID[:])
 
 	session, ok := e.sessions[remoteConnectionID]
 	if !ok {
-		// TODO(v): メッセージが入れ違った可能性があるので、どうするか考える
-		return nil, errors.New("MissingSession")
+		// メッセージが入れ違った可能性があるので ReceiveMessage で保留する
+		return nil, ErrMissingSession
 	}
 
+	now := e.now()
+	result, err := e.sessionCipherMessage(session, m, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// 他のセッションのロックを取るので、このセッションのロックを外してから破棄する
+	e.evictSkippedMessageKeys(now)
+
+	return result, nil
+}
+
+// e.mu の読み込みロックだけで呼ばれるため、セッションはセッションのロックを取って変更する
+func (e *Engine) sessionCipherMessage(session *session, m cipherMessage, now time.Time) (*ReceiveMessageResult, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
 	header, err := cipherMessageHeader(m)
 	if err != nil {
 		return nil, err
 	}
 
-	plaintext, err := session.ratchetState.ratchetDecrypt(header, m.ciphertext, session.ad)
+	if err := session.checkProtocolVersion(m.protocolVersion); err != nil {
+		return nil, err
+	}
+
+	// ヘッダーを暗号化するかどうかはセッションごとに決まっているので、異なるメッセージは復号できない
+	if (m.encryptedHeader != nil) != session.headerEncryption() {
+		return nil, ErrDecryptMessage
+	}
+
+	plaintext, err := session.ratchetState.ratchetDecrypt(header, m.ciphertext, session.messageAD(m.protocolVersion), e.maxSkip, now, e.random)
 	if err != nil {
 		return nil, err
 	}
+	// 相手が新しいセッションを受け入れた
+	session.resetPending = false
 	senderKeyMessage, err := decodeSenderKeyMessage(plaintext)
 	if err != nil {
 		return nil, err
 	}
+	// 返信する前にバージョンを上げる
+	session.updateProtocolVersion(m.protocolVersion, senderKeyMessage)
 
-	var remoteSecretKeyMaterials = make(map[string]remoteSecretKeyMaterial)
+	var remoteSecretKeyMaterials = make(map[string]RemoteSecretKeyMaterial)
 	var messages = [][]byte{}
 
 	// receiver で 相手の SecretKeyMaterial を保持していない場合はメッセージを送る必要がある
 	if session.role == receiver && bytes.Equal(session.remoteSecretKeyMaterial, []byte{}) {
-		buf := new(bytes.Buffer)
-		if err := binary.Write(buf, binary.BigEndian, e.keyID); err != nil {
-			return nil, err
-		}
-
-		if err := binary.Write(buf, binary.BigEndian, e.secretKeyMaterial); err != nil {
+		plaintext, err := e.plaintext()
+		if err != nil {
 			return nil, err
 		}
 
-		header, ciphertext, err := session.ratchetState.ratchetEncrypt(buf.Bytes(), session.ad)
+		header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.messageAD(session.protocolVersion))
 		if err != nil {
 			return nil, err
 		}
@@ -424,31 +1147,102 @@ func (e *e2ee) cipherMessage(m cipherMessage) (*receiveMessageResult, error) {
 
 	session.remoteKeyID = senderKeyMessage.keyID
 	session.remoteSecretKeyMaterial = senderKeyMessage.secretKeyMaterial[:]
-	e.sessions[remoteConnectionID] = session
 
-	remoteKeyMaterial := &remoteSecretKeyMaterial{
-		keyID:             senderKeyMessage.keyID,
-		secretKeyMaterial: senderKeyMessage.secretKeyMaterial[:],
+	remoteKeyMaterial := &RemoteSecretKeyMaterial{
+		KeyID:             senderKeyMessage.keyID,
+		SecretKeyMaterial: senderKeyMessage.secretKeyMaterial[:],
 	}
 
-	remoteSecretKeyMaterials[remoteConnectionID] = *remoteKeyMaterial
+	remoteSecretKeyMaterials[session.remoteConnectionID] = *remoteKeyMaterial
 
-	return &receiveMessageResult{
-		remoteSecretKeyMaterials: remoteSecretKeyMaterials,
-		messages:                 messages,
+	return &ReceiveMessageResult{
+		RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+		Messages:                 messages,
 	}, nil
 }
 
-func (e *e2ee) initSession(remoteConnectionID string, preKeyBundle preKeyBundle) (*session, error) {
+// 自分が X3DH を開始する側のセッションを生成する
+func (e *Engine) senderSession(remoteConnectionID string, preKeyBundle preKeyBundle) (*session, error) {
+	session, err := e.initSession(remoteConnectionID, preKeyBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	// start 側が sender になる
+	session.role = sender
+	session.capabilities = e.sessionCapabilities(preKeyBundle)
+	if err := e.checkRequirePQXDH(session.capabilities); err != nil {
+		return nil, err
+	}
+	if err := session.senderRootKey(e.pqRandom()); err != nil {
+		return nil, err
+	}
+	if err := session.senderRatchetInit(e.random, session.rootKey, preKeyBundle); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// 相手の preKeyMessage からセッションを生成する
+// 利用した oneTimePreKey は呼び出し側で破棄する
+func (e *Engine) receiverSession(remoteConnectionID string, preKeyBundle preKeyBundle, m preKeyMessage) (*session, error) {
+	newSession, err := e.initSession(remoteConnectionID, preKeyBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	newSession.role = receiver
+	newSession.remoteEphemeralKey = m.ephemeralKey
+	newSession.capabilities = m.capabilities
+	if err := e.checkRequirePQXDH(newSession.capabilities); err != nil {
+		return nil, err
+	}
+
+	selfPreKeyPair, err := e.signedPreKeyPair(m.signedPreKeyID)
+	if err != nil {
+		return nil, err
+	}
+	newSession.selfPreKeyPair = *selfPreKeyPair
+
+	if newSession.pqxdh() {
+		selfPQPreKeyPair, err := e.signedPQPreKeyPair(m.signedPreKeyID)
+		if err != nil {
+			return nil, err
+		}
+		newSession.selfPQPreKeyPair = selfPQPreKeyPair
+		newSession.pqCiphertext = m.pqCiphertext
+	}
+
+	if m.oneTimePreKeyID != 0 {
+		oneTimePreKeyPair, ok := e.oneTimePreKeyPairs[m.oneTimePreKeyID]
+		if !ok {
+			// 既に利用済みか、配布していない oneTimePreKey が指定された
+			return nil, ErrMissingOneTimePreKey
+		}
+		newSession.selfOneTimePreKeyPair = &oneTimePreKeyPair.keyPair
+	}
+
+	if err := newSession.receiverRootKey(); err != nil {
+		return nil, err
+	}
+	if err := newSession.receiverRatchetInit(); err != nil {
+		return nil, err
+	}
+
+	return newSession, nil
+}
+
+func (e *Engine) initSession(remoteConnectionID string, preKeyBundle preKeyBundle) (*session, error) {
 	// ここで相手の公開鍵の verify を行う
 	ok := ed25519.Verify(preKeyBundle.identityKey, preKeyBundle.signedPreKey[:], preKeyBundle.preKeySignature)
 	if !ok {
-		return nil, errors.New("Ed25519VerifyError")
+		return nil, ErrVerifyFailed
 	}
 
-	selfEphemeralKeyPair, err := generateEphemeralKeyPair()
+	selfEphemeralKeyPair, err := generateEphemeralKeyPair(e.random)
 	if err != nil {
-		return nil, errors.New("X25519KeyPairGenerateError")
+		return nil, ErrKeyPairGenerate
 	}
 
 	return &session{
@@ -459,7 +1253,10 @@ func (e *e2ee) initSession(remoteConnectionID string, preKeyBundle preKeyBundle)
 
 		remoteConnectionID:          remoteConnectionID,
 		remoteIdentityKey:           preKeyBundle.identityKey,
+		remoteSignedPreKeyID:        preKeyBundle.signedPreKeyID,
 		remoteSignedPreKey:          preKeyBundle.signedPreKey,
 		remoteSignedPreKeySignature: preKeyBundle.preKeySignature,
+		remoteOneTimePreKey:         preKeyBundle.oneTimePreKey,
+		remotePQPreKey:              preKeyBundle.pqPreKey,
 	}, nil
 }
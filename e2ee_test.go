@@ -1,7 +1,10 @@
 package e2ee
 
 import (
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -9,8 +12,8 @@ import (
 var version = "test"
 
 func TestE2EEVersion(t *testing.T) {
-	alice := newE2EE(version)
-	assert.NotNil(t, alice.getVersion())
+	alice := NewEngine(version)
+	assert.NotNil(t, alice.Version())
 }
 
 func TestE2EE(t *testing.T) {
@@ -18,76 +21,76 @@ func TestE2EE(t *testing.T) {
 
 	aliceConnectionID := "ALICE---------------------"
 
-	alice := newE2EE(version)
-	alice.init()
+	alice := NewEngine(version)
+	alice.Init()
 	assert.Equal(t, len(alice.secretKeyMaterial), 32)
 
-	alice.start(aliceConnectionID)
+	alice.Start(aliceConnectionID)
 	// 最初なので 0
 	assert.Equal(t, uint32(0), alice.keyID)
-	assert.NotNil(t, alice.selfFingerprint())
-	assert.Empty(t, alice.remoteFingerprints())
+	assert.NotNil(t, alice.SelfFingerprint())
+	assert.Empty(t, alice.RemoteFingerprints())
 
 	bobConnectionID := "BOB-----------------------"
 
-	bob := newE2EE(version)
-	bob.init()
+	bob := NewEngine(version)
+	bob.Init()
 	assert.Equal(t, len(bob.secretKeyMaterial), 32)
-	bob.start(bobConnectionID)
+	bob.Start(bobConnectionID)
 	// 最初なので 0
 	assert.Equal(t, uint32(0), bob.keyID)
-	assert.NotNil(t, bob.selfFingerprint())
-	assert.Empty(t, bob.remoteFingerprints())
+	assert.NotNil(t, bob.SelfFingerprint())
+	assert.Empty(t, bob.RemoteFingerprints())
 
-	result, err := alice.startSession(bobConnectionID, bob.selfPreKeyBundle.identityKey, bob.selfPreKeyBundle.signedPreKey[:], bob.selfPreKeyBundle.preKeySignature)
+	result, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
 	assert.Nil(t, err)
-	assert.NotEmpty(t, alice.remoteFingerprints())
-	assert.Equal(t, 1, len(alice.remoteFingerprints()))
+	assert.NotEmpty(t, alice.RemoteFingerprints())
+	assert.Equal(t, 1, len(alice.RemoteFingerprints()))
 	// 新しく参加者が来たので sender の alice は keyId++ する
-	assert.Equal(t, 2, len(result.messages))
-	assert.Equal(t, uint32(1), result.selfKeyID)
-	assert.Equal(t, aliceConnectionID, result.selfConnectionID)
+	assert.Equal(t, 2, len(result.Messages))
+	assert.Equal(t, uint32(1), result.SelfKeyID)
+	assert.Equal(t, aliceConnectionID, result.SelfConnectionID)
 	assert.Equal(t, uint32(1), alice.keyID)
 
 	// まだ SK と keyID を相手からもらっていない
-	_, ok := result.remoteSecretKeyMaterials[bobConnectionID]
+	_, ok := result.RemoteSecretKeyMaterials[bobConnectionID]
 	assert.False(t, ok)
 
-	err = bob.addPreKeyBundle(aliceConnectionID, alice.selfPreKeyBundle.identityKey, alice.selfPreKeyBundle.signedPreKey[:], alice.selfPreKeyBundle.preKeySignature)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
 	assert.Nil(t, err)
-	assert.NotEmpty(t, bob.remoteFingerprints())
-	assert.Equal(t, 1, len(bob.remoteFingerprints()))
+	assert.NotEmpty(t, bob.RemoteFingerprints())
+	assert.Equal(t, 1, len(bob.RemoteFingerprints()))
 
-	r0, err := bob.receiveMessage(result.messages[0])
+	r0, err := bob.ReceiveMessage(result.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r0.remoteSecretKeyMaterials))
-	assert.Equal(t, 0, len(r0.messages))
+	assert.Equal(t, 0, len(r0.RemoteSecretKeyMaterials))
+	assert.Equal(t, 0, len(r0.Messages))
 	// bob は reciever なので keyId++ しない
 	assert.Equal(t, uint32(0), bob.keyID)
 
 	// bob はまだ alice から sk をもらっていない
-	_, ok = r0.remoteSecretKeyMaterials[aliceConnectionID]
+	_, ok = r0.RemoteSecretKeyMaterials[aliceConnectionID]
 	assert.False(t, ok)
 
 	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
 
-	r1, err := bob.receiveMessage(result.messages[1])
+	r1, err := bob.ReceiveMessage(result.Messages[1])
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(r1.remoteSecretKeyMaterials))
-	assert.Equal(t, 1, len(r1.messages))
+	assert.Equal(t, 1, len(r1.RemoteSecretKeyMaterials))
+	assert.Equal(t, 1, len(r1.Messages))
 	assert.Equal(t, uint32(0), bob.keyID)
 	// alice の keyID は bob が参加したことにより sk が ratchet してるので 1
-	assert.Equal(t, uint32(1), r1.remoteSecretKeyMaterials[aliceConnectionID].keyID)
+	assert.Equal(t, uint32(1), r1.RemoteSecretKeyMaterials[aliceConnectionID].KeyID)
 
-	r2, err := alice.receiveMessage(r1.messages[0])
+	r2, err := alice.ReceiveMessage(r1.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(r2.remoteSecretKeyMaterials))
-	assert.Equal(t, 0, len(r2.messages))
+	assert.Equal(t, 1, len(r2.RemoteSecretKeyMaterials))
+	assert.Equal(t, 0, len(r2.Messages))
 	assert.Equal(t, uint32(1), alice.keyID)
 	// bob は新規参加者なので sk を ratchet してないので keyID は 0 のまま
-	assert.Equal(t, uint32(0), r2.remoteSecretKeyMaterials[bobConnectionID].keyID)
+	assert.Equal(t, uint32(0), r2.RemoteSecretKeyMaterials[bobConnectionID].KeyID)
 
-	assert.Equal(t, bob.secretKeyMaterial, r2.remoteSecretKeyMaterials[bobConnectionID].secretKeyMaterial)
+	assert.Equal(t, bob.secretKeyMaterial, r2.RemoteSecretKeyMaterials[bobConnectionID].SecretKeyMaterial)
 	assert.Equal(t, bob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
 
 	assert.Equal(t, uint32(1), alice.keyID)
@@ -96,61 +99,61 @@ func TestE2EE(t *testing.T) {
 	// Carol を登場させる
 	carolConnectionID := "CAROL---------------------"
 
-	carol := newE2EE(version)
-	carol.init()
-	carol.start(carolConnectionID)
+	carol := NewEngine(version)
+	carol.Init()
+	carol.Start(carolConnectionID)
 
-	err = carol.addPreKeyBundle(aliceConnectionID, alice.selfPreKeyBundle.identityKey, alice.selfPreKeyBundle.signedPreKey[:], alice.selfPreKeyBundle.preKeySignature)
+	_, err = carol.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
 	assert.Nil(t, err)
-	err = carol.addPreKeyBundle(bobConnectionID, bob.selfPreKeyBundle.identityKey, bob.selfPreKeyBundle.signedPreKey[:], bob.selfPreKeyBundle.preKeySignature)
+	_, err = carol.AddPreKeyBundle(bobConnectionID, bob.SelfPreKeyBundle())
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(carol.remoteFingerprints()))
+	assert.Equal(t, 2, len(carol.RemoteFingerprints()))
 
-	r3, err := alice.startSession(carolConnectionID, carol.selfPreKeyBundle.identityKey, carol.selfPreKeyBundle.signedPreKey[:], carol.selfPreKeyBundle.preKeySignature)
+	r3, err := alice.StartSession(carolConnectionID, carol.SelfPreKeyBundle())
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(alice.remoteFingerprints()))
-	assert.Equal(t, 2, len(r3.messages))
-	assert.Equal(t, aliceConnectionID, r3.selfConnectionID)
+	assert.Equal(t, 2, len(alice.RemoteFingerprints()))
+	assert.Equal(t, 2, len(r3.Messages))
+	assert.Equal(t, aliceConnectionID, r3.SelfConnectionID)
 	// carol がきたので key を ratchet したので 2 へ
 	assert.Equal(t, uint32(2), alice.keyID)
 
-	r4, err := carol.receiveMessage(r3.messages[0])
+	r4, err := carol.ReceiveMessage(r3.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r4.messages))
+	assert.Equal(t, 0, len(r4.Messages))
 	// carol は新規参加者なので key は 0 のまま
 	assert.Equal(t, uint32(0), carol.keyID)
 
-	r5, err := carol.receiveMessage(r3.messages[1])
+	r5, err := carol.ReceiveMessage(r3.Messages[1])
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(r5.messages))
+	assert.Equal(t, 1, len(r5.Messages))
 	// carol は新規参加者なので key は 0 のまま
 	assert.Equal(t, uint32(0), carol.keyID)
 
-	r6, err := bob.startSession(carolConnectionID, carol.selfPreKeyBundle.identityKey, carol.selfPreKeyBundle.signedPreKey[:], carol.selfPreKeyBundle.preKeySignature)
+	r6, err := bob.StartSession(carolConnectionID, carol.SelfPreKeyBundle())
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(bob.remoteFingerprints()))
-	assert.Equal(t, bobConnectionID, r6.selfConnectionID)
+	assert.Equal(t, 2, len(bob.RemoteFingerprints()))
+	assert.Equal(t, bobConnectionID, r6.SelfConnectionID)
 	// 新規参加者がきたので鍵を ratchet した
 	assert.Equal(t, uint32(1), bob.keyID)
 
-	r7, err := carol.receiveMessage(r6.messages[0])
+	r7, err := carol.ReceiveMessage(r6.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r7.messages))
+	assert.Equal(t, 0, len(r7.Messages))
 	assert.Equal(t, uint32(0), carol.keyID)
 
-	r8, err := carol.receiveMessage(r6.messages[1])
+	r8, err := carol.ReceiveMessage(r6.Messages[1])
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(r8.messages))
+	assert.Equal(t, 1, len(r8.Messages))
 	assert.Equal(t, uint32(0), carol.keyID)
 
-	r9, err := alice.receiveMessage(r5.messages[0])
+	r9, err := alice.ReceiveMessage(r5.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r9.messages))
+	assert.Equal(t, 0, len(r9.Messages))
 	assert.Equal(t, uint32(2), alice.keyID)
 
-	r10, err := bob.receiveMessage(r8.messages[0])
+	r10, err := bob.ReceiveMessage(r8.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r10.messages))
+	assert.Equal(t, 0, len(r10.Messages))
 	assert.Equal(t, uint32(1), bob.keyID)
 
 	assert.Equal(t, alice.secretKeyMaterial, bob.sessions[aliceConnectionID].remoteSecretKeyMaterial)
@@ -162,29 +165,29 @@ func TestE2EE(t *testing.T) {
 	assert.Equal(t, carol.secretKeyMaterial, alice.sessions[carolConnectionID].remoteSecretKeyMaterial)
 	assert.Equal(t, carol.secretKeyMaterial, bob.sessions[carolConnectionID].remoteSecretKeyMaterial)
 
-	r11, err := alice.stopSession(carolConnectionID)
+	r11, err := alice.StopSession(carolConnectionID)
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(alice.remoteFingerprints()))
-	assert.Equal(t, 1, len(r11.messages))
-	assert.Equal(t, aliceConnectionID, r11.selfConnectionID)
+	assert.Equal(t, 1, len(alice.RemoteFingerprints()))
+	assert.Equal(t, 1, len(r11.Messages))
+	assert.Equal(t, aliceConnectionID, r11.SelfConnectionID)
 	assert.Equal(t, uint32(3), alice.keyID)
-	assert.Equal(t, uint32(3), r11.selfKeyID)
+	assert.Equal(t, uint32(3), r11.SelfKeyID)
 
-	r12, err := bob.stopSession(carolConnectionID)
+	r12, err := bob.StopSession(carolConnectionID)
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(bob.remoteFingerprints()))
-	assert.Equal(t, 1, len(r12.messages))
-	assert.Equal(t, bobConnectionID, r12.selfConnectionID)
+	assert.Equal(t, 1, len(bob.RemoteFingerprints()))
+	assert.Equal(t, 1, len(r12.Messages))
+	assert.Equal(t, bobConnectionID, r12.SelfConnectionID)
 	assert.Equal(t, uint32(2), bob.keyID)
-	assert.Equal(t, uint32(2), r12.selfKeyID)
+	assert.Equal(t, uint32(2), r12.SelfKeyID)
 
-	r13, err := alice.receiveMessage(r12.messages[0])
+	r13, err := alice.ReceiveMessage(r12.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r13.messages))
+	assert.Equal(t, 0, len(r13.Messages))
 
-	r14, err := bob.receiveMessage(r11.messages[0])
+	r14, err := bob.ReceiveMessage(r11.Messages[0])
 	assert.Nil(t, err)
-	assert.Equal(t, 0, len(r14.messages))
+	assert.Equal(t, 0, len(r14.Messages))
 
 	assert.Equal(t, uint32(2), alice.sessions[bobConnectionID].remoteKeyID)
 	assert.Equal(t, uint32(3), bob.sessions[aliceConnectionID].remoteKeyID)
@@ -193,3 +196,723 @@ func TestE2EE(t *testing.T) {
 	assert.Equal(t, bob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
 
 }
+
+func TestE2EEOneTimePreKey(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	bobOneTimePreKeys := bob.OneTimePreKeys()
+	assert.Equal(t, oneTimePreKeyCount, len(bobOneTimePreKeys))
+	assert.Equal(t, uint32(1), bobOneTimePreKeys[0].ID)
+
+	bobPreKeyBundle := bob.SelfPreKeyBundle()
+	bobPreKeyBundle.OneTimePreKey = &bobOneTimePreKeys[0]
+
+	result, err := alice.StartSession(bobConnectionID, bobPreKeyBundle)
+	assert.Nil(t, err)
+
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	_, err = bob.ReceiveMessage(result.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+
+	// 利用した oneTimePreKey は破棄されている
+	assert.Equal(t, oneTimePreKeyCount-1, len(bob.OneTimePreKeys()))
+	assert.Equal(t, uint32(2), bob.OneTimePreKeys()[0].ID)
+
+	r1, err := bob.ReceiveMessage(result.Messages[1])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.secretKeyMaterial, r1.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+
+	// 同じ oneTimePreKey を使った preKeyMessage は受け付けない
+	_, err = bob.StopSession(aliceConnectionID)
+	assert.Nil(t, err)
+	_, err = alice.StopSession(bobConnectionID)
+	assert.Nil(t, err)
+
+	result, err = alice.StartSession(bobConnectionID, bobPreKeyBundle)
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(result.Messages[0])
+	assert.ErrorIs(t, err, ErrMissingOneTimePreKey)
+}
+
+func TestE2EEReplenishOneTimePreKeys(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	bob := NewEngine(version)
+	_, err := bob.ReplenishOneTimePreKeys()
+	assert.ErrorIs(t, err, ErrUninitialized)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	// 利用されていない場合は補充しない
+	oneTimePreKeys, err := bob.ReplenishOneTimePreKeys()
+	assert.Nil(t, err)
+	assert.Empty(t, oneTimePreKeys)
+
+	startSession := func(oneTimePreKey OneTimePreKey) {
+		alice := NewEngine(version)
+		assert.Nil(t, alice.Init())
+		_, err := alice.Start(aliceConnectionID)
+		assert.Nil(t, err)
+
+		bobPreKeyBundle := bob.SelfPreKeyBundle()
+		bobPreKeyBundle.OneTimePreKey = &oneTimePreKey
+		result, err := alice.StartSession(bobConnectionID, bobPreKeyBundle)
+		assert.Nil(t, err)
+		_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		_, err = bob.ReceiveMessage(result.Messages[0])
+		assert.Nil(t, err)
+		_, err = bob.StopSession(aliceConnectionID)
+		assert.Nil(t, err)
+	}
+	startSession(bob.OneTimePreKeys()[0])
+	startSession(bob.OneTimePreKeys()[0])
+	assert.Len(t, bob.OneTimePreKeys(), oneTimePreKeyCount-2)
+
+	// 利用された数だけ、利用された ID と重ならない ID で補充する
+	oneTimePreKeys, err = bob.ReplenishOneTimePreKeys()
+	assert.Nil(t, err)
+	assert.Len(t, oneTimePreKeys, 2)
+	assert.Equal(t, uint32(oneTimePreKeyCount+1), oneTimePreKeys[0].ID)
+	assert.Equal(t, uint32(oneTimePreKeyCount+2), oneTimePreKeys[1].ID)
+	assert.Len(t, bob.OneTimePreKeys(), oneTimePreKeyCount)
+	assert.Equal(t, oneTimePreKeys[1], bob.OneTimePreKeys()[oneTimePreKeyCount-1])
+
+	// 補充した oneTimePreKey も利用できる
+	startSession(oneTimePreKeys[0])
+	assert.Len(t, bob.OneTimePreKeys(), oneTimePreKeyCount-1)
+
+	// 採番した ID も export に含める
+	passphraseKey := []byte("passphrase-key")
+	blob, err := bob.Export(passphraseKey)
+	assert.Nil(t, err)
+	restored := NewEngine(version)
+	assert.Nil(t, restored.Import(passphraseKey, blob))
+	oneTimePreKeys, err = restored.ReplenishOneTimePreKeys()
+	assert.Nil(t, err)
+	assert.Len(t, oneTimePreKeys, 1)
+	assert.Equal(t, uint32(oneTimePreKeyCount+3), oneTimePreKeys[0].ID)
+}
+
+func TestE2EERotateSignedPreKey(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+	carolConnectionID := "CAROL---------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	carol := NewEngine(version)
+	assert.Nil(t, carol.Init())
+	_, err = carol.Start(carolConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	oldBobPreKeyBundle := bob.SelfPreKeyBundle()
+	assert.Equal(t, uint32(1), oldBobPreKeyBundle.SignedPreKeyID)
+
+	newBobPreKeyBundle, err := bob.RotateSignedPreKey()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), newBobPreKeyBundle.SignedPreKeyID)
+	assert.NotEqual(t, oldBobPreKeyBundle.SignedPreKey, newBobPreKeyBundle.SignedPreKey)
+	assert.Equal(t, *newBobPreKeyBundle, bob.SelfPreKeyBundle())
+
+	// 猶予期間中なので古い signedPreKey 宛の preKeyMessage も受け付ける
+	r1, err := alice.StartSession(bobConnectionID, oldBobPreKeyBundle)
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+	_, err = bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+
+	r2, err := carol.StartSession(bobConnectionID, *newBobPreKeyBundle)
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(carolConnectionID, carol.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r2.Messages[1])
+	assert.Nil(t, err)
+}
+
+func TestE2EERotateSignedPreKeyGracePeriodExpired(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	// 猶予期間なし
+	bob := NewEngine(version, WithSignedPreKeyGracePeriod(0))
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	oldBobPreKeyBundle := bob.SelfPreKeyBundle()
+	_, err = bob.RotateSignedPreKey()
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, oldBobPreKeyBundle)
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.ErrorIs(t, err, ErrMissingSignedPreKey)
+	assert.Empty(t, bob.previousPreKeyPairs)
+}
+
+func newTestEnginePair(t testing.TB, options ...Option) (*Engine, *Engine) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version, options...)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version, options...)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	r2, err := bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+	_, err = alice.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+
+	return alice, bob
+}
+
+// テスト用の Sora の代わり、メッセージを宛先の参加者に送る
+// 宛先がすべて 0 のグループモードのメッセージは送信元以外の全員に送る
+type testRoom struct {
+	t       *testing.T
+	options []Option
+	engines map[string]*Engine
+	// 結果から受け取った相手の SK
+	remotes map[string]map[string]RemoteSecretKeyMaterial
+	queue   [][]byte
+	// 送ったメッセージの数と、コミットに含まれる path secret の暗号文の数
+	messageCount    int
+	ciphertextCount int
+}
+
+func newTestRoom(t *testing.T, options ...Option) *testRoom {
+	return &testRoom{
+		t:       t,
+		options: options,
+		engines: make(map[string]*Engine),
+		remotes: make(map[string]map[string]RemoteSecretKeyMaterial),
+	}
+}
+
+func (r *testRoom) send(messages [][]byte) {
+	for _, message := range messages {
+		r.messageCount++
+		if message[0] == typeGroupCommitMessage {
+			header, buf, err := decodeMessageHeader(message)
+			assert.Nil(r.t, err)
+			m, err := decodeGroupCommitMessage(*header, buf)
+			assert.Nil(r.t, err)
+			for _, n := range m.path {
+				r.ciphertextCount += len(n.ciphertexts)
+			}
+		}
+	}
+	r.queue = append(r.queue, messages...)
+}
+
+func (r *testRoom) setRemotes(connectionID string, remoteSecretKeyMaterials map[string]RemoteSecretKeyMaterial) {
+	for remoteConnectionID, remoteSecretKeyMaterial := range remoteSecretKeyMaterials {
+		r.remotes[connectionID][remoteConnectionID] = remoteSecretKeyMaterial
+	}
+}
+
+func (r *testRoom) deliver() {
+	for len(r.queue) > 0 {
+		message := r.queue[0]
+		r.queue = r.queue[1:]
+
+		src := string(message[4:30])
+		dst := string(message[30:56])
+		for connectionID, e := range r.engines {
+			if connectionID == src || (dst != broadcastConnectionID && dst != connectionID) {
+				continue
+			}
+			result, err := e.ReceiveMessage(message)
+			assert.Nil(r.t, err)
+			r.setRemotes(connectionID, result.RemoteSecretKeyMaterials)
+			r.send(result.Messages)
+		}
+	}
+}
+
+func (r *testRoom) newEngine(connectionID string) *Engine {
+	e := NewEngine(version, r.options...)
+	assert.Nil(r.t, e.Init())
+	_, err := e.Start(connectionID)
+	assert.Nil(r.t, err)
+	r.remotes[connectionID] = make(map[string]RemoteSecretKeyMaterial)
+	return e
+}
+
+// 入室した参加者に、既存の参加者全員が StartSession する
+func (r *testRoom) join(connectionID string) *Engine {
+	e := r.newEngine(connectionID)
+	for remoteConnectionID, remote := range r.engines {
+		result, err := remote.StartSession(connectionID, e.SelfPreKeyBundle())
+		assert.Nil(r.t, err)
+		r.setRemotes(remoteConnectionID, result.RemoteSecretKeyMaterials)
+		r.send(result.Messages)
+
+		_, err = e.AddPreKeyBundle(remoteConnectionID, remote.SelfPreKeyBundle())
+		assert.Nil(r.t, err)
+	}
+	r.engines[connectionID] = e
+	return e
+}
+
+// 入室した参加者を、既存の参加者全員がキューに入れる
+func (r *testRoom) queueJoin(connectionID string) *Engine {
+	e := r.newEngine(connectionID)
+	for remoteConnectionID, remote := range r.engines {
+		_, err := remote.QueueStartSession(connectionID, e.SelfPreKeyBundle())
+		assert.Nil(r.t, err)
+
+		_, err = e.AddPreKeyBundle(remoteConnectionID, remote.SelfPreKeyBundle())
+		assert.Nil(r.t, err)
+	}
+	r.engines[connectionID] = e
+	return e
+}
+
+func (r *testRoom) leave(connectionID string) {
+	delete(r.engines, connectionID)
+	delete(r.remotes, connectionID)
+	for remoteConnectionID, remote := range r.engines {
+		delete(r.remotes[remoteConnectionID], connectionID)
+		result, err := remote.StopSession(connectionID)
+		assert.Nil(r.t, err)
+		r.setRemotes(remoteConnectionID, result.RemoteSecretKeyMaterials)
+		r.send(result.Messages)
+	}
+}
+
+func (r *testRoom) queueLeave(connectionID string) {
+	delete(r.engines, connectionID)
+	delete(r.remotes, connectionID)
+	for remoteConnectionID, remote := range r.engines {
+		delete(r.remotes[remoteConnectionID], connectionID)
+		_, err := remote.QueueStopSession(connectionID)
+		assert.Nil(r.t, err)
+	}
+}
+
+// 全員がキューに入れた入退室をコミットする
+func (r *testRoom) commit() {
+	for connectionID, e := range r.engines {
+		result, err := e.CommitMembershipChanges()
+		assert.Nil(r.t, err)
+		r.setRemotes(connectionID, result.RemoteSecretKeyMaterials)
+		r.send(result.Messages)
+	}
+}
+
+// 受け取った相手の SK が相手の SK と一致する
+// グループモードでは全員が同じエポックになる、MLS では KeyID に葉の位置が含まれるので参加者ごとに異なる
+func (r *testRoom) assertKeyAgreement() {
+	var epoch *uint32
+	for connectionID, e := range r.engines {
+		if e.groupMode {
+			if epoch == nil {
+				epoch = &e.group.epoch
+			}
+			assert.Equal(r.t, *epoch, e.group.epoch, connectionID)
+			if e.mls {
+				assert.Equal(r.t, mlsSFrameKeyID(e.group.epoch, e.group.selfLeafIndex), e.keyID, connectionID)
+			} else {
+				assert.Equal(r.t, e.group.epoch, e.keyID, connectionID)
+			}
+		} else {
+			assert.Equal(r.t, len(r.engines)-1, len(e.sessions), connectionID)
+		}
+		assert.Equal(r.t, len(r.engines)-1, len(r.remotes[connectionID]), connectionID)
+		for remoteConnectionID, remote := range r.engines {
+			if remoteConnectionID == connectionID {
+				continue
+			}
+			remoteSecretKeyMaterial := r.remotes[connectionID][remoteConnectionID]
+			assert.Equal(r.t, remote.keyID, remoteSecretKeyMaterial.KeyID, connectionID)
+			assert.Equal(r.t, remote.secretKeyMaterial, remoteSecretKeyMaterial.SecretKeyMaterial, connectionID)
+		}
+	}
+}
+
+func testGroupConnectionID(i int) string {
+	return fmt.Sprintf("%-26s", fmt.Sprintf("MEMBER%d", i))
+}
+
+func TestE2EEResetSession(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+	aliceKeyID, aliceSecretKeyMaterial := alice.keyID, alice.secretKeyMaterial
+	bobKeyID, bobSecretKeyMaterial := bob.keyID, bob.secretKeyMaterial
+	oldRootKey := bob.sessions[aliceConnectionID].rootKey
+
+	r1, err := alice.ResetSession(bobConnectionID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(r1.Messages))
+	assert.True(t, alice.sessions[bobConnectionID].resetPending)
+
+	r2, err := bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, aliceKeyID, r2.RemoteSecretKeyMaterials[aliceConnectionID].KeyID)
+	assert.Equal(t, aliceSecretKeyMaterial, r2.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.Equal(t, 1, len(r2.Messages))
+	assert.NotEqual(t, oldRootKey, bob.sessions[aliceConnectionID].rootKey)
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+
+	// 同じ resetMessage は破棄する
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.ErrorIs(t, err, ErrDiscardMessage)
+
+	r3, err := alice.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, bobKeyID, r3.RemoteSecretKeyMaterials[bobConnectionID].KeyID)
+	assert.Equal(t, bobSecretKeyMaterial, r3.RemoteSecretKeyMaterials[bobConnectionID].SecretKeyMaterial)
+	assert.False(t, alice.sessions[bobConnectionID].resetPending)
+
+	// SK と KeyID は変更しない
+	assert.Equal(t, aliceKeyID, alice.keyID)
+	assert.Equal(t, aliceSecretKeyMaterial, alice.secretKeyMaterial)
+	assert.Equal(t, bobKeyID, bob.keyID)
+	assert.Equal(t, bobSecretKeyMaterial, bob.secretKeyMaterial)
+
+	// 逆向きでも作り直せる
+	r4, err := bob.ResetSession(aliceConnectionID, nil)
+	assert.Nil(t, err)
+	r5, err := alice.ReceiveMessage(r4.Messages[0])
+	assert.Nil(t, err)
+	r6, err := bob.ReceiveMessage(r5.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, aliceSecretKeyMaterial, r6.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.False(t, bob.sessions[aliceConnectionID].resetPending)
+}
+
+func TestE2EEResetSessionInvalidMessage(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+	oldRootKey := bob.sessions[aliceConnectionID].rootKey
+
+	r1, err := alice.ResetSession(bobConnectionID, nil)
+	assert.Nil(t, err)
+
+	// 改ざんされた resetMessage ではセッションを置き換えない
+	message := append([]byte{}, r1.Messages[0]...)
+	message[len(message)-1] ^= 0xff
+	_, err = bob.ReceiveMessage(message)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+	var messageError *MessageError
+	assert.ErrorAs(t, err, &messageError)
+	assert.Equal(t, MessageTypeReset, messageError.MessageType)
+	assert.Equal(t, oldRootKey, bob.sessions[aliceConnectionID].rootKey)
+
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+}
+
+func TestE2EEResetSessionBothSides(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+
+	r1, err := alice.ResetSession(bobConnectionID, nil)
+	assert.Nil(t, err)
+	r2, err := bob.ResetSession(aliceConnectionID, nil)
+	assert.Nil(t, err)
+
+	// ConnectionID が小さい alice のセッションを利用する
+	_, err = alice.ReceiveMessage(r2.Messages[0])
+	assert.ErrorIs(t, err, ErrDiscardMessage)
+
+	r3, err := bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+
+	_, err = alice.ReceiveMessage(r3.Messages[0])
+	assert.Nil(t, err)
+	assert.False(t, alice.sessions[bobConnectionID].resetPending)
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+}
+
+func FuzzReceiveMessage(f *testing.F) {
+	carolConnectionID := "CAROL---------------------"
+	passphraseKey := []byte("passphrase")
+
+	alice, bob := newTestEnginePair(f)
+
+	carol := NewEngine(version)
+	assert.Nil(f, carol.Init())
+	_, err := carol.Start(carolConnectionID)
+	assert.Nil(f, err)
+	_, err = bob.AddPreKeyBundle(carolConnectionID, carol.SelfPreKeyBundle())
+	assert.Nil(f, err)
+
+	// bob はこの状態から毎回メッセージを受け取る
+	blob, err := bob.Export(passphraseKey)
+	assert.Nil(f, err)
+
+	r1, err := carol.StartSession(bob.connectionID, bob.SelfPreKeyBundle())
+	assert.Nil(f, err)
+	for _, message := range r1.Messages {
+		f.Add(message)
+	}
+	messages, err := alice.messages()
+	assert.Nil(f, err)
+	for _, message := range messages {
+		f.Add(message)
+	}
+	r2, err := alice.ResetSession(bob.connectionID, nil)
+	assert.Nil(f, err)
+	for _, message := range r2.Messages {
+		f.Add(message)
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		bob := NewEngine(version)
+		assert.Nil(t, bob.Import(passphraseKey, blob))
+
+		result, err := bob.ReceiveMessage(data)
+		if err != nil {
+			assert.Nil(t, result)
+			// 相手から届いたメッセージのエラーは js の code で判別できる必要がある
+			assert.NotEqual(t, unknownErrorCode, ErrorCode(err), err.Error())
+			return
+		}
+		assert.NotNil(t, result)
+	})
+}
+
+// 同じ乱数と時刻を指定した Engine は同じメッセージと状態を生成する
+func TestE2EEDeterministic(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	run := func() ([][]byte, []byte) {
+		var messages [][]byte
+
+		alice := NewEngine(version, WithRandom(newTestRandom("alice")), WithClock(clock))
+		assert.Nil(t, alice.Init())
+		_, err := alice.Start(aliceConnectionID)
+		assert.Nil(t, err)
+
+		bob := NewEngine(version, WithRandom(newTestRandom("bob")), WithClock(clock))
+		assert.Nil(t, bob.Init())
+		_, err = bob.Start(bobConnectionID)
+		assert.Nil(t, err)
+
+		r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		messages = append(messages, r1.Messages...)
+		_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		_, err = bob.ReceiveMessage(r1.Messages[0])
+		assert.Nil(t, err)
+		r2, err := bob.ReceiveMessage(r1.Messages[1])
+		assert.Nil(t, err)
+		messages = append(messages, r2.Messages...)
+		// DH ratchet で生成する鍵ペアも同じになる
+		_, err = alice.ReceiveMessage(r2.Messages[0])
+		assert.Nil(t, err)
+		r3, err := alice.StopSession(bobConnectionID)
+		assert.Nil(t, err)
+		assert.Empty(t, r3.Messages)
+		messages = append(messages, r3.SelfSecretKeyMaterial)
+
+		blob, err := bob.Export([]byte("passphrase"))
+		assert.Nil(t, err)
+		return messages, blob
+	}
+
+	messages1, blob1 := run()
+	messages2, blob2 := run()
+	assert.Equal(t, messages1, messages2)
+	assert.Equal(t, blob1, blob2)
+}
+
+func TestE2EEClock(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version, WithSignedPreKeyGracePeriod(time.Minute), WithClock(func() time.Time { return now }))
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	oldBobPreKeyBundle := bob.SelfPreKeyBundle()
+	_, err = bob.RotateSignedPreKey()
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, oldBobPreKeyBundle)
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	// 猶予期間が過ぎた
+	now = now.Add(time.Minute)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.ErrorIs(t, err, ErrMissingSignedPreKey)
+	assert.Empty(t, bob.previousPreKeyPairs)
+}
+
+func TestE2EEKeyIDWrap(t *testing.T) {
+	alice := "ALICE---------------------"
+	r := newTestRoom(t)
+	for _, connectionID := range []string{alice, "BOB-----------------------", "CAROL---------------------"} {
+		r.join(connectionID)
+		r.deliver()
+	}
+
+	// 他の参加者が予測している KeyID も一周する直前にする
+	setMaxKeyID := func() {
+		r.engines[alice].keyID = math.MaxUint32
+		for connectionID, e := range r.engines {
+			if connectionID != alice {
+				e.sessions[alice].remoteKeyID = math.MaxUint32
+				remote := r.remotes[connectionID][alice]
+				remote.KeyID = math.MaxUint32
+				r.remotes[connectionID][alice] = remote
+			}
+		}
+		r.assertKeyAgreement()
+	}
+
+	// 以前の SK を ratchet した SK ではなく、新しく生成した SK を全員に送る
+	setMaxKeyID()
+	secretKeyMaterial, err := ratchetSecretKeyMaterial(r.engines[alice].secretKeyMaterial)
+	assert.Nil(t, err)
+	r.join(testGroupConnectionID(0))
+	assert.Equal(t, uint32(0), r.engines[alice].keyID)
+	assert.NotEqual(t, secretKeyMaterial, r.engines[alice].secretKeyMaterial)
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// キューに入れた場合はコミットで新しい SK にする
+	setMaxKeyID()
+	secretKeyMaterial, err = ratchetSecretKeyMaterial(r.engines[alice].secretKeyMaterial)
+	assert.Nil(t, err)
+	r.queueJoin(testGroupConnectionID(1))
+	assert.Equal(t, uint32(math.MaxUint32), r.engines[alice].keyID)
+	result, err := r.engines[alice].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), result.SelfKeyID)
+	assert.NotEqual(t, secretKeyMaterial, result.SelfSecretKeyMaterial)
+	r.send(result.Messages)
+	r.commit()
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// コミットする前に取り消した場合は SK を変えない
+	setMaxKeyID()
+	r.queueJoin(testGroupConnectionID(2))
+	r.queueLeave(testGroupConnectionID(2))
+	result, err = r.engines[alice].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(math.MaxUint32), result.SelfKeyID)
+	assert.Empty(t, result.Messages)
+	r.assertKeyAgreement()
+
+	// StopSession も同じように KeyID を 0 に戻す
+	setMaxKeyID()
+	r.leave(testGroupConnectionID(0))
+	assert.Equal(t, uint32(0), r.engines[alice].keyID)
+	r.deliver()
+	r.assertKeyAgreement()
+}
+
+// 送信の上限に達したセッションがある場合は、途中で失敗せずに何も変更しない
+func TestE2EESendLimitKeepsState(t *testing.T) {
+	alice := "ALICE---------------------"
+	bob := "BOB-----------------------"
+	carol := "CAROL---------------------"
+	r := newTestRoom(t)
+	for _, connectionID := range []string{alice, bob, carol, "DAVE----------------------", "EVE-----------------------"} {
+		r.join(connectionID)
+		r.deliver()
+	}
+
+	// KeyID が一周する StartSession は全員に送るので、carol のセッションで失敗する
+	e := r.engines[alice]
+	e.keyID = math.MaxUint32
+	e.sessions[carol].ratchetState.selfN = maxChainMessages
+	state := e.state()
+
+	remote := NewEngine(version)
+	assert.Nil(t, remote.Init())
+	_, err := e.StartSession(testGroupConnectionID(0), remote.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrRejoinRequired)
+	assert.Equal(t, state, e.state())
+	assert.NotContains(t, e.remotePreKeyBundles, testGroupConnectionID(0))
+
+	// StopSession も残りの参加者全員に送るので同じ
+	_, err = e.StopSession(bob)
+	assert.ErrorIs(t, err, ErrRejoinRequired)
+	assert.Equal(t, state, e.state())
+
+	// CommitMembershipChanges もキューとセッションを変更しない
+	_, err = e.QueueStartSession(testGroupConnectionID(0), remote.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	state = e.state()
+	_, err = e.CommitMembershipChanges()
+	assert.ErrorIs(t, err, ErrRejoinRequired)
+	assert.Equal(t, state, e.state())
+}
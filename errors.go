@@ -0,0 +1,186 @@
+package e2ee
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors.Is で判定できるようにエラーは必ずここで定義したものを返す
+// エラーメッセージはそのまま js の Error の code として利用するため変更しないこと
+var (
+	ErrInit                         = errors.New("InitError")
+	ErrUninitialized                = errors.New("UninitializedError")
+	ErrUnexpectedSelfConnectionID   = errors.New("UnexpectedSelfConnectionIDError")
+	ErrUnexpectedRemoteConnectionID = errors.New("UnexpectedRemoteConnectionIDError")
+
+	ErrVerifyFailed              = errors.New("VerifyFailedError")
+	ErrInvalidPublicKey          = errors.New("Ed25519ToCurve25519PublicKeyConvertError")
+	ErrKeyPairGenerate           = errors.New("X25519KeyPairGenerateError")
+	ErrInvalidOneTimePreKey      = errors.New("InvalidOneTimePreKeyError")
+	ErrRemotePreKeyBundleExists  = errors.New("AlreadyExistRemotePreKeyBundle")
+	ErrMissingRemotePreKeyBundle = errors.New("MissingRemotePreKeyBundle")
+	ErrUnmatchIdentityKey        = errors.New("UnmatchIdentityKey")
+	ErrMissingSignedPreKey       = errors.New("MissingSignedPreKey")
+	ErrMissingOneTimePreKey      = errors.New("MissingOneTimePreKey")
+	ErrInvalidPQPreKey           = errors.New("InvalidPQPreKeyError")
+	ErrUnsupportedPQXDH          = errors.New("UnsupportedPQXDHError")
+	ErrInvalidKeyPackage         = errors.New("InvalidKeyPackageError")
+
+	ErrSessionAlreadyExists = errors.New("SessionAlreadyExists")
+	ErrMissingSession       = errors.New("MissingSession")
+
+	ErrDecodeMessage  = errors.New("ReceiveMessageDecodeError")
+	ErrUnknownMessage = errors.New("UnknownMessageError")
+	ErrDiscardMessage = errors.New("DiscardMessage")
+	ErrDecryptMessage = errors.New("DecryptMessageError")
+
+	// 1 つのチェインでスキップするメッセージキーが maxSkip を超えた
+	// このセッションでは以降のメッセージを復号できないため、StopSession してセッションを作り直すこと
+	ErrTooManySkippedMessages = errors.New("TooManySkippedMessagesError")
+	// 鍵や KeyID の利用回数が上限に達したので、これ以上安全に暗号化できない
+	// 切断して参加し直すこと
+	ErrRejoinRequired = errors.New("RejoinRequiredError")
+
+	ErrUnsupportedProtocolVersion = errors.New("UnsupportedProtocolVersionError")
+	// 相手が古いクライアントで対応していない
+	ErrUnsupportedByRemote = errors.New("UnsupportedByRemoteError")
+
+	ErrInvalidState            = errors.New("InvalidStateError")
+	ErrUnsupportedStateVersion = errors.New("UnsupportedStateVersionError")
+	ErrStateDecrypt            = errors.New("StateDecryptError")
+	ErrEmptyPassphraseKey      = errors.New("EmptyPassphraseKeyError")
+
+	ErrUnsupportedSFrameCipherSuite = errors.New("UnsupportedSFrameCipherSuiteError")
+	ErrInvalidSFrameHeader          = errors.New("InvalidSFrameHeaderError")
+	ErrMissingSFrameKey             = errors.New("MissingSFrameKeyError")
+	ErrSFrameDecrypt                = errors.New("SFrameDecryptError")
+	ErrSFrameCounterExhausted       = errors.New("SFrameCounterExhaustedError")
+
+	ErrInvalidSafetyNumber = errors.New("InvalidSafetyNumberError")
+	ErrIdentityKeyChanged  = errors.New("IdentityKeyChangedError")
+	ErrMissingIdentity     = errors.New("MissingIdentityError")
+	// IdentityStore の実装が例外を投げたか、同期的に完了しなかった
+	ErrIdentityStore = errors.New("IdentityStoreError")
+
+	// グループモードで、まだ受け取っていないエポックのコミットか welcome が必要
+	ErrMissingGroupEpoch = errors.New("MissingGroupEpochError")
+	// MLS では KeyID に葉の位置を 16 ビットで含めるので、2^16 人を超えて追加できない
+	ErrTooManyGroupMembers = errors.New("TooManyGroupMembersError")
+)
+
+// ErrorCode で探索する順番に並べる
+var codedErrors = []error{
+	ErrInit,
+	ErrUninitialized,
+	ErrUnexpectedSelfConnectionID,
+	ErrUnexpectedRemoteConnectionID,
+
+	ErrVerifyFailed,
+	ErrInvalidPublicKey,
+	ErrKeyPairGenerate,
+	ErrInvalidOneTimePreKey,
+	ErrRemotePreKeyBundleExists,
+	ErrMissingRemotePreKeyBundle,
+	ErrUnmatchIdentityKey,
+	ErrMissingSignedPreKey,
+	ErrMissingOneTimePreKey,
+	ErrInvalidPQPreKey,
+	ErrUnsupportedPQXDH,
+	ErrInvalidKeyPackage,
+
+	ErrSessionAlreadyExists,
+	ErrMissingSession,
+
+	ErrDecodeMessage,
+	ErrUnknownMessage,
+	ErrDiscardMessage,
+	ErrDecryptMessage,
+	ErrTooManySkippedMessages,
+	ErrRejoinRequired,
+	ErrUnsupportedProtocolVersion,
+	ErrUnsupportedByRemote,
+
+	ErrInvalidState,
+	ErrUnsupportedStateVersion,
+	ErrStateDecrypt,
+	ErrEmptyPassphraseKey,
+
+	ErrUnsupportedSFrameCipherSuite,
+	ErrInvalidSFrameHeader,
+	ErrMissingSFrameKey,
+	ErrSFrameDecrypt,
+	ErrSFrameCounterExhausted,
+
+	ErrInvalidSafetyNumber,
+	ErrIdentityKeyChanged,
+	ErrMissingIdentity,
+	ErrIdentityStore,
+
+	ErrMissingGroupEpoch,
+	ErrTooManyGroupMembers,
+}
+
+// 上記以外のエラーの code
+const unknownErrorCode = "UnknownError"
+
+// ErrorCode はエラーに対応する変わらない文字列を返す
+// js の Error の code と同じ値になる
+func ErrorCode(err error) string {
+	for _, codedError := range codedErrors {
+		if errors.Is(err, codedError) {
+			return codedError.Error()
+		}
+	}
+	return unknownErrorCode
+}
+
+// MessageType は ReceiveMessage で受け取るメッセージの種類
+type MessageType uint8
+
+const (
+	MessageTypePreKey MessageType = MessageType(typePreKeyMessage)
+	MessageTypeCipher MessageType = MessageType(typeCipherMessage)
+	MessageTypeReset  MessageType = MessageType(typeResetMessage)
+
+	MessageTypeGroupCommit  MessageType = MessageType(typeGroupCommitMessage)
+	MessageTypeGroupWelcome MessageType = MessageType(typeGroupWelcomeMessage)
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageTypePreKey:
+		return "preKeyMessage"
+	case MessageTypeCipher:
+		return "cipherMessage"
+	case MessageTypeReset:
+		return "resetMessage"
+	case MessageTypeGroupCommit:
+		return "groupCommitMessage"
+	case MessageTypeGroupWelcome:
+		return "groupWelcomeMessage"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// MessageError は ReceiveMessage でメッセージの処理に失敗した時のエラー
+// errors.As で取り出し、Err を errors.Is で判定する
+type MessageError struct {
+	Err                error
+	RemoteConnectionID string
+	MessageType        MessageType
+	// cipherMessage と resetMessage の場合のみ、メッセージのヘッダーに含まれる Double Ratchet のカウンター
+	PN uint32
+	N  uint32
+}
+
+func (e *MessageError) Error() string {
+	if e.MessageType == MessageTypeCipher || e.MessageType == MessageTypeReset {
+		return fmt.Sprintf("%s: remoteConnectionID=%s messageType=%s PN=%d N=%d", e.Err, e.RemoteConnectionID, e.MessageType, e.PN, e.N)
+	}
+	return fmt.Sprintf("%s: remoteConnectionID=%s messageType=%s", e.Err, e.RemoteConnectionID, e.MessageType)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,76 @@
+package e2ee
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, "MissingSession", ErrorCode(ErrMissingSession))
+	assert.Equal(t, "MissingSession", ErrorCode(fmt.Errorf("wrap: %w", ErrMissingSession)))
+	assert.Equal(t, "MissingSession", ErrorCode(&MessageError{Err: ErrMissingSession}))
+	assert.Equal(t, unknownErrorCode, ErrorCode(errors.New("unknown")))
+
+	// code は重複してはいけない
+	codes := make(map[string]struct{})
+	for _, codedError := range codedErrors {
+		code := ErrorCode(codedError)
+		_, ok := codes[code]
+		assert.False(t, ok, code)
+		codes[code] = struct{}{}
+	}
+}
+
+func TestMessageError(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	// 保留せずにエラーを返す
+	bob := NewEngine(version, WithMaxPendingMessages(0))
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	_, err = bob.Start("SHORT")
+	assert.ErrorIs(t, err, ErrUnexpectedSelfConnectionID)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	_, err = alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrSessionAlreadyExists)
+
+	// preKeyMessage より先に cipherMessage が届いた
+	_, err = bob.ReceiveMessage(r1.Messages[1])
+	assert.ErrorIs(t, err, ErrMissingSession)
+
+	var messageError *MessageError
+	assert.True(t, errors.As(err, &messageError))
+	assert.Equal(t, aliceConnectionID, messageError.RemoteConnectionID)
+	assert.Equal(t, MessageTypeCipher, messageError.MessageType)
+	assert.Equal(t, uint32(0), messageError.PN)
+	assert.Equal(t, uint32(0), messageError.N)
+
+	// preKeyBundle を受け取っていない
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.ErrorIs(t, err, ErrMissingRemotePreKeyBundle)
+	assert.True(t, errors.As(err, &messageError))
+	assert.Equal(t, MessageTypePreKey, messageError.MessageType)
+
+	_, err = bob.ReceiveMessage([]byte{0x00})
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+
+	_, err = bob.ReceiveMessage([]byte{0xff, 0x00, 0x00, 0x00})
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+
+	_, err = bob.StopSession(aliceConnectionID)
+	assert.ErrorIs(t, err, ErrMissingSession)
+}
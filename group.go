@@ -0,0 +1,1063 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// グループモード
+// https://www.rfc-editor.org/rfc/rfc9420.html の TreeKEM を簡略化したもの
+//
+// 参加者ごとのセッションで SK を送る代わりに、ratchet tree で全員が同じエポックの秘密を共有し、
+// そこから参加者ごとの SecretKeyMaterial を導出する、KeyID はエポックになる
+// 入退室 1 回につき 1 人の参加者がコミットを全員宛に 1 つ送るだけでよく、
+// コミットに含まれる暗号文の数は木が埋まっていれば O(log n) になる
+// 追加した参加者にはエポックの秘密と木を含む welcome を signedPreKey 宛に暗号化して送る
+//
+// コミットするのは groupCommitter で決まる 1 人だけで、それ以外の参加者はコミットが届くのを待つ
+// Double Ratchet のセッションは作らないため、X3DH と ResetSession は利用しない
+
+type group struct {
+	id    [groupIDLength]byte
+	suite groupCipherSuite
+	epoch uint32
+	tree  *ratchetTree
+	// 木の中の自分の葉、削除されない限り変わらない
+	selfLeafIndex uint32
+
+	// 次のエポックの導出に利用する
+	initSecret []byte
+	// このエポックの参加者の SecretKeyMaterial を導出する
+	epochSecret []byte
+
+	// このエポックのコミットを送った参加者、自分で作ったグループの場合は空
+	committer string
+	// 直前のエポック、同じエポックのコミットが入れ違った場合に巻き戻す
+	// 保存はしない
+	previous *group
+	// このエポックのコミットに含まれていたので忘れた追加する参加者と削除する参加者、巻き戻した場合に戻す
+	committedJoiners []string
+	committedLeavers []string
+}
+
+// 32 バイトなので失敗しない
+func groupExpand(secret []byte, label string, context []byte) []byte {
+	info := append([]byte(label), context...)
+	out := make([]byte, 32)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, info), out)
+	return out
+}
+
+// path secret から親のノードの path secret を導出する
+// MLS の場合は path_secret[n] = DeriveSecret(path_secret[n-1], "path")
+func (s groupCipherSuite) nextPathSecret(pathSecret []byte) []byte {
+	switch s {
+	case groupCipherSuiteMLS:
+		return mlsDeriveSecret(pathSecret, "path")
+	default:
+		return groupExpand(pathSecret, "SoraGroupPath", nil)
+	}
+}
+
+// path secret からノードの鍵を導出する
+// MLS の場合は KEM.DeriveKeyPair(DeriveSecret(path_secret, "node"))
+func (s groupCipherSuite) nodeKeyPair(pathSecret []byte) (*x25519KeyPair, error) {
+	switch s {
+	case groupCipherSuiteMLS:
+		return hpkeDeriveKeyPair(mlsDeriveSecret(pathSecret, "node"))
+	default:
+		return generateX25519KeyPair(bytes.NewReader(groupExpand(pathSecret, "SoraGroupNode", nil)))
+	}
+}
+
+// 公開鍵に対して暗号化する、MLS の場合は EncryptWithLabel で label を利用する
+func (s groupCipherSuite) seal(random io.Reader, publicKey x25519PublicKey, label string, plaintext []byte, ad []byte) (x25519PublicKey, []byte, error) {
+	switch s {
+	case groupCipherSuiteMLS:
+		return mlsEncryptWithLabel(random, publicKey, label, ad, plaintext)
+	default:
+		return groupSeal(random, publicKey, plaintext, ad)
+	}
+}
+
+func (s groupCipherSuite) open(keyPair x25519KeyPair, ephemeralKey x25519PublicKey, label string, ciphertext []byte, ad []byte) ([]byte, error) {
+	switch s {
+	case groupCipherSuiteMLS:
+		return mlsDecryptWithLabel(keyPair, ephemeralKey, label, ad, ciphertext)
+	default:
+		return groupOpen(keyPair, ephemeralKey, ciphertext, ad)
+	}
+}
+
+// コミットと welcome の署名、MLS の場合は SignWithLabel で label を利用する
+func (s groupCipherSuite) sign(privateKey ed25519.PrivateKey, label string, content []byte) []byte {
+	switch s {
+	case groupCipherSuiteMLS:
+		return mlsSignWithLabel(privateKey, label, content)
+	default:
+		return ed25519.Sign(privateKey, content)
+	}
+}
+
+func (s groupCipherSuite) verify(publicKey []byte, label string, content []byte, signature []byte) bool {
+	switch s {
+	case groupCipherSuiteMLS:
+		return mlsVerifyWithLabel(publicKey, label, content, signature)
+	default:
+		return ed25519.Verify(publicKey, content, signature)
+	}
+}
+
+// 公開鍵に対して暗号化する
+// 使い捨ての鍵との DH から HKDF-SHA256(DH, <<EphemeralKey/binary, PublicKey/binary>>, "SoraGroupSeal") で
+// 鍵と nonce を導出して AES-256-GCM で暗号化する
+func groupSeal(random io.Reader, publicKey x25519PublicKey, plaintext []byte, ad []byte) (x25519PublicKey, []byte, error) {
+	ephemeralKeyPair, err := generateX25519KeyPair(random)
+	if err != nil {
+		return x25519PublicKey{}, nil, ErrKeyPairGenerate
+	}
+
+	key, nonce, err := groupSealKey(dh(ephemeralKeyPair.privateKey, publicKey), ephemeralKeyPair.publicKey, publicKey)
+	if err != nil {
+		return x25519PublicKey{}, nil, err
+	}
+
+	ciphertext, err := encrypt(key, nonce, plaintext, ad)
+	if err != nil {
+		return x25519PublicKey{}, nil, err
+	}
+
+	return ephemeralKeyPair.publicKey, ciphertext, nil
+}
+
+func groupOpen(keyPair x25519KeyPair, ephemeralKey x25519PublicKey, ciphertext []byte, ad []byte) ([]byte, error) {
+	key, nonce, err := groupSealKey(dh(keyPair.privateKey, ephemeralKey), ephemeralKey, keyPair.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decrypt(key, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecryptMessage
+	}
+
+	return plaintext, nil
+}
+
+func groupSealKey(sharedSecret [32]byte, ephemeralKey x25519PublicKey, publicKey x25519PublicKey) ([]byte, []byte, error) {
+	salt := append(append([]byte{}, ephemeralKey[:]...), publicKey[:]...)
+	hkdf := hkdf.New(sha256.New, sharedSecret[:], salt, []byte("SoraGroupSeal"))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf, key); err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return key, nonce, nil
+}
+
+// 自分だけのグループを作る
+func newGroup(random io.Reader, suite groupCipherSuite, connectionID string, identityKey []byte) (*group, error) {
+	g := &group{suite: suite}
+	if _, err := io.ReadFull(random, g.id[:]); err != nil {
+		return nil, err
+	}
+
+	leafKeyPair, err := generateX25519KeyPair(random)
+	if err != nil {
+		return nil, ErrKeyPairGenerate
+	}
+	g.tree = newRatchetTree(treeNode{
+		publicKey:    leafKeyPair.publicKey,
+		connectionID: connectionID,
+		identityKey:  identityKey,
+	}, *leafKeyPair)
+
+	joinerSecret := make([]byte, 32)
+	if _, err := io.ReadFull(random, joinerSecret); err != nil {
+		return nil, err
+	}
+	g.setEpochSecret(joinerSecret)
+
+	return g, nil
+}
+
+// <<GroupID:32/binary, Epoch:32, TreeHash:32/binary>>
+// MLS の場合は GroupContext で、confirmed_transcript_hash と extensions は空にする
+func (g *group) context() []byte {
+	treeHash := g.tree.hash()
+	buf := new(bytes.Buffer)
+	if g.suite == groupCipherSuiteMLS {
+		binary.Write(buf, binary.BigEndian, mlsProtocolVersion)
+		binary.Write(buf, binary.BigEndian, mlsCipherSuite)
+		mlsWriteOpaque(buf, g.id[:])
+		binary.Write(buf, binary.BigEndian, uint64(g.epoch))
+		mlsWriteOpaque(buf, treeHash[:])
+		mlsWriteOpaque(buf, nil)
+		mlsWriteOpaque(buf, nil)
+		return buf.Bytes()
+	}
+	buf.Write(g.id[:])
+	binary.Write(buf, binary.BigEndian, g.epoch)
+	buf.Write(treeHash[:])
+	return buf.Bytes()
+}
+
+// epochSecret = HKDF-Expand(JoinerSecret, <<"SoraGroupEpoch", Context/binary>>, 32)
+// initSecret = HKDF-Expand(epochSecret, "SoraGroupInit", 32)
+// MLS の場合は PSK を利用しないので
+// epoch_secret = ExpandWithLabel(KDF.Extract(joiner_secret, 0), "epoch", GroupContext, KDF.Nh)
+// init_secret = DeriveSecret(epoch_secret, "init")
+func (g *group) setEpochSecret(joinerSecret []byte) {
+	if g.suite == groupCipherSuiteMLS {
+		pskSecret := make([]byte, mlsHashLength)
+		g.epochSecret = mlsExpandWithLabel(hkdf.Extract(sha256.New, pskSecret, joinerSecret), "epoch", g.context(), mlsHashLength)
+		g.initSecret = mlsDeriveSecret(g.epochSecret, "init")
+		return
+	}
+	g.epochSecret = groupExpand(joinerSecret, "SoraGroupEpoch", g.context())
+	g.initSecret = groupExpand(g.epochSecret, "SoraGroupInit", nil)
+}
+
+// コミットした後の木と、根の path secret から導出した commitSecret で次のエポックに進める
+// JoinerSecret = HKDF-Extract(initSecret, commitSecret)
+// MLS の場合は joiner_secret = ExpandWithLabel(KDF.Extract(init_secret, commit_secret), "joiner", GroupContext, KDF.Nh)
+func (g *group) next(tree *ratchetTree, commitSecret []byte) (*group, []byte) {
+	next := &group{
+		id:            g.id,
+		suite:         g.suite,
+		epoch:         g.epoch + 1,
+		tree:          tree,
+		selfLeafIndex: g.selfLeafIndex,
+	}
+	joinerSecret := hkdf.Extract(sha256.New, commitSecret, g.initSecret)
+	if g.suite == groupCipherSuiteMLS {
+		joinerSecret = mlsExpandWithLabel(joinerSecret, "joiner", next.context(), mlsHashLength)
+	}
+	next.setEpochSecret(joinerSecret)
+	return next, joinerSecret
+}
+
+// 葉の参加者の KeyID と SecretKeyMaterial
+// SecretKeyMaterial = HKDF-Expand(epochSecret, <<"SoraGroupSecretKeyMaterial", ConnectionID/binary>>, 32) で、KeyID はエポック
+// MLS の場合は exporter から RFC 9605 の方法で導出し、KeyID は葉のインデックスとエポックから決める
+func (g *group) remoteSecretKeyMaterial(leafIndex uint32) RemoteSecretKeyMaterial {
+	if g.suite == groupCipherSuiteMLS {
+		return RemoteSecretKeyMaterial{
+			KeyID:             mlsSFrameKeyID(g.epoch, leafIndex),
+			SecretKeyMaterial: mlsSFrameBaseKey(mlsDeriveSecret(g.epochSecret, "exporter"), leafIndex),
+		}
+	}
+	return RemoteSecretKeyMaterial{
+		KeyID:             g.epoch,
+		SecretKeyMaterial: groupExpand(g.epochSecret, "SoraGroupSecretKeyMaterial", []byte(g.tree.leaf(leafIndex).connectionID)),
+	}
+}
+
+// 次のエポックのコミットに含めて、どのエポックから分岐したコミットかを判別する
+// MLS の場合は epoch_authenticator = DeriveSecret(epoch_secret, "authentication")
+func (g *group) authenticator() [32]byte {
+	var authenticator [32]byte
+	if g.suite == groupCipherSuiteMLS {
+		copy(authenticator[:], mlsDeriveSecret(g.epochSecret, "authentication"))
+	} else {
+		copy(authenticator[:], groupExpand(g.epochSecret, "SoraGroupAuthenticator", nil))
+	}
+	return authenticator
+}
+
+// 同じエポックのコミットが入れ違って分岐した場合に、全員が同じ方に揃えるための順序
+// 相手のコミットした参加者を削除している方を優先する、退室した参加者のコミットは届かない場合があるため
+// どちらでもない場合はコミットした参加者の ConnectionID が小さい方を優先する
+func (g *group) precedes(other *group) bool {
+	_, ok := g.tree.findLeaf(other.committer)
+	removesOther := !ok
+	_, ok = other.tree.findLeaf(g.committer)
+	removedByOther := !ok
+	if removesOther != removedByOther {
+		return removesOther
+	}
+	return g.committer < other.committer
+}
+
+// HMAC-SHA256(HKDF-Expand(epochSecret, "SoraGroupConfirm", 32), Content)
+// MLS の場合は confirmation_key = DeriveSecret(epoch_secret, "confirm") を利用する
+func (g *group) confirmationTag(content []byte) []byte {
+	key := groupExpand(g.epochSecret, "SoraGroupConfirm", nil)
+	if g.suite == groupCipherSuiteMLS {
+		key = mlsDeriveSecret(g.epochSecret, "confirm")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+// コミットの削除と追加を木に反映する、追加した葉のインデックスを返す
+func (g *group) applyProposals(m *groupCommitMessage) (*ratchetTree, []uint32, error) {
+	tree := g.tree.clone()
+
+	for _, leafIndex := range m.removes {
+		if leafIndex == m.committerLeafIndex || tree.leaf(leafIndex) == nil {
+			return nil, nil, ErrVerifyFailed
+		}
+		tree.removeLeaf(leafIndex)
+	}
+
+	var addedLeaves []uint32
+	for _, a := range m.adds {
+		n, err := a.treeNode()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := tree.findLeaf(n.connectionID); ok {
+			return nil, nil, ErrVerifyFailed
+		}
+		leafIndex := tree.addLeaf(*n)
+		if g.suite == groupCipherSuiteMLS && leafIndex >= mlsMaxLeaves {
+			return nil, nil, ErrTooManyGroupMembers
+		}
+		addedLeaves = append(addedLeaves, leafIndex)
+	}
+
+	return tree, addedLeaves, nil
+}
+
+// path secret を暗号化する相手のノード、追加した参加者には welcome で送るので含めない
+func (t *ratchetTree) pathRecipients(x uint32, addedLeaves []uint32) []uint32 {
+	var recipients []uint32
+	for _, r := range t.resolution(x) {
+		added := false
+		for _, leafIndex := range addedLeaves {
+			if r == 2*leafIndex {
+				added = true
+			}
+		}
+		if !added {
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients
+}
+
+// 次にコミットする参加者
+// 退室していない参加者のうち、自分の葉から根までに空のノードか unmergedLeaves を持つノードが一番多い参加者にする
+// コミットした参加者の葉から根までは埋まるので、コミットするたびに木が埋まっていく
+// 同じ場合は ConnectionID が小さい方にする
+func (e *Engine) groupCommitter() string {
+	tree := e.group.tree
+
+	var committer string
+	best := -1
+	for i := uint32(0); i < tree.leafCount(); i++ {
+		leaf := tree.leaf(i)
+		if leaf == nil || e.groupLeavers[leaf.connectionID] {
+			continue
+		}
+		score := 0
+		for _, x := range tree.directPath(2 * i) {
+			if n := tree.nodes[x]; n == nil || len(n.unmergedLeaves) > 0 {
+				score++
+			}
+		}
+		if score > best || (score == best && leaf.connectionID < committer) {
+			best = score
+			committer = leaf.connectionID
+		}
+	}
+	return committer
+}
+
+// 新しいエポックのグループに置き換えて、他の参加者の SecretKeyMaterial を返す
+func (e *Engine) setGroup(g *group) map[string]RemoteSecretKeyMaterial {
+	// 分岐を判別するのに必要なのは 1 つ前のエポックだけなので、それより前は保持しない
+	if g.previous != nil {
+		g.previous.previous = nil
+	}
+	e.group = g
+	self := g.remoteSecretKeyMaterial(g.selfLeafIndex)
+	e.keyID = self.KeyID
+	e.secretKeyMaterial = self.SecretKeyMaterial
+
+	remoteSecretKeyMaterials := make(map[string]RemoteSecretKeyMaterial)
+	for i := uint32(0); i < g.tree.leafCount(); i++ {
+		leaf := g.tree.leaf(i)
+		// StopSession した参加者はまだ木に残っていても返さない
+		if leaf == nil || i == g.selfLeafIndex || e.groupLeavers[leaf.connectionID] {
+			continue
+		}
+		remoteSecretKeyMaterials[leaf.connectionID] = g.remoteSecretKeyMaterial(i)
+	}
+
+	// コミットに含まれた参加者は忘れる
+	for connectionID := range e.groupJoiners {
+		if _, ok := g.tree.findLeaf(connectionID); ok {
+			delete(e.groupJoiners, connectionID)
+			g.committedJoiners = append(g.committedJoiners, connectionID)
+		}
+	}
+	for connectionID := range e.groupLeavers {
+		if _, ok := g.tree.findLeaf(connectionID); !ok {
+			delete(e.groupLeavers, connectionID)
+			g.committedLeavers = append(g.committedLeavers, connectionID)
+		}
+	}
+
+	return remoteSecretKeyMaterials
+}
+
+// 自分がコミットする参加者で、退室した参加者か追加する参加者がいる場合はまとめてコミットする
+// 全員宛のコミットと、追加した参加者ごとの welcome を返す
+// コミットしなかった場合は nil を返す
+func (e *Engine) commitGroup() ([][]byte, map[string]RemoteSecretKeyMaterial, error) {
+	g := e.group
+	if e.groupCommitter() != e.connectionID {
+		return nil, nil, nil
+	}
+
+	var removes []uint32
+	for connectionID := range e.groupLeavers {
+		if leafIndex, ok := g.tree.findLeaf(connectionID); ok {
+			removes = append(removes, leafIndex)
+		}
+	}
+	var joiners []string
+	for connectionID := range e.groupJoiners {
+		if _, ok := g.tree.findLeaf(connectionID); !ok {
+			joiners = append(joiners, connectionID)
+		}
+	}
+	if len(removes) == 0 && len(joiners) == 0 {
+		return nil, nil, nil
+	}
+	// エポックが一周すると古いエポックのコミットと区別できなくなる
+	if g.epoch == math.MaxUint32 {
+		return nil, nil, ErrRejoinRequired
+	}
+	sort.Slice(removes, func(i, j int) bool { return removes[i] < removes[j] })
+	sort.Strings(joiners)
+
+	m := &groupCommitMessage{
+		protocolVersion:     protocolVersion,
+		groupID:             g.id,
+		cipherSuite:         g.suite,
+		epoch:               g.epoch + 1,
+		parentAuthenticator: g.authenticator(),
+		committerLeafIndex:  g.selfLeafIndex,
+		removes:             removes,
+	}
+	copy(m.selfConnectionID[:], e.connectionID)
+	for _, connectionID := range joiners {
+		a, err := newGroupAdd(g.suite, connectionID, e.remotePreKeyBundles[connectionID])
+		if err != nil {
+			return nil, nil, err
+		}
+		m.adds = append(m.adds, *a)
+	}
+
+	tree, addedLeaves, err := g.applyProposals(m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 自分の葉を新しい鍵にして、根までの path secret を生成する
+	leafSecret := make([]byte, 32)
+	if _, err := io.ReadFull(e.random, leafSecret); err != nil {
+		return nil, nil, err
+	}
+	leafKeyPair, err := g.suite.nodeKeyPair(leafSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	self := 2 * g.selfLeafIndex
+	m.leafKey = leafKeyPair.publicKey
+	tree.nodes[self].publicKey = leafKeyPair.publicKey
+	tree.privateKeys[self] = *leafKeyPair
+
+	ad := g.context()
+	directPath := tree.directPath(self)
+	copath := tree.copath(self)
+	pathSecrets := make([][]byte, len(directPath))
+	pathSecret := leafSecret
+	for i, x := range directPath {
+		pathSecret = g.suite.nextPathSecret(pathSecret)
+		pathSecrets[i] = pathSecret
+		keyPair, err := g.suite.nodeKeyPair(pathSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		node := groupPathNode{publicKey: keyPair.publicKey}
+		for _, recipient := range tree.pathRecipients(copath[i], addedLeaves) {
+			ephemeralKey, ciphertext, err := g.suite.seal(e.random, tree.nodes[recipient].publicKey, "UpdatePathNode", pathSecret, ad)
+			if err != nil {
+				return nil, nil, err
+			}
+			node.ciphertexts = append(node.ciphertexts, groupPathCiphertext{
+				recipient:    recipient,
+				ephemeralKey: ephemeralKey,
+				ciphertext:   ciphertext,
+			})
+		}
+		m.path = append(m.path, node)
+
+		// 根までの鍵を全員が知ったので unmergedLeaves は無くなる
+		tree.nodes[x] = &treeNode{publicKey: keyPair.publicKey}
+		tree.privateKeys[x] = *keyPair
+	}
+
+	next, joinerSecret := g.next(tree, g.suite.nextPathSecret(pathSecret))
+	next.committer = e.connectionID
+	next.previous = g
+
+	m.confirmationTag = next.confirmationTag(m.content())
+	m.signature = g.suite.sign(e.identityKeyPair.privateKey, "SoraGroupCommitTBS", m.signedContent())
+	messages := [][]byte{m.encode()}
+
+	for i, leafIndex := range addedLeaves {
+		welcome, err := e.groupWelcome(next, joinerSecret, pathSecrets, leafIndex, m.adds[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, welcome)
+	}
+
+	// キューに入れた入退室もまとめてコミットした
+	e.membershipChangeQueuedAt = time.Time{}
+
+	return messages, e.setGroup(next), nil
+}
+
+// 追加した参加者に、木と JoinerSecret と共通の祖先の path secret を signedPreKey 宛に暗号化して送る
+func (e *Engine) groupWelcome(g *group, joinerSecret []byte, pathSecrets [][]byte, leafIndex uint32, add groupAdd) ([]byte, error) {
+	joiner := g.tree.leaf(leafIndex)
+
+	var pathSecret []byte
+	for i, x := range g.tree.directPath(2 * g.selfLeafIndex) {
+		if treeInSubtree(2*leafIndex, x) {
+			pathSecret = pathSecrets[i]
+			break
+		}
+	}
+
+	m := &groupWelcomeMessage{
+		protocolVersion: protocolVersion,
+		groupID:         g.id,
+		cipherSuite:     g.suite,
+		epoch:           g.epoch,
+		signedPreKeyID:  add.signedPreKeyID,
+	}
+	copy(m.selfConnectionID[:], e.connectionID)
+	copy(m.remoteConnectionID[:], joiner.connectionID)
+
+	plaintext := new(bytes.Buffer)
+	plaintext.Write(joinerSecret)
+	plaintext.Write(pathSecret)
+	plaintext.Write(g.tree.encode())
+
+	ephemeralKey, encrypted, err := g.suite.seal(e.random, add.signedPreKey, "Welcome", plaintext.Bytes(), m.ad())
+	if err != nil {
+		return nil, err
+	}
+	m.ephemeralKey = ephemeralKey
+	m.encrypted = encrypted
+	m.signature = g.suite.sign(e.identityKeyPair.privateKey, "SoraGroupWelcomeTBS", m.signedContent())
+
+	return m.encode(), nil
+}
+
+// 受け取った木の参加者の identityKey が、preKeyBundle を受け取っている参加者のものと一致するかを確認する
+func (e *Engine) checkGroupIdentityKey(connectionID string, identityKey []byte) error {
+	preKeyBundle, ok := e.remotePreKeyBundles[connectionID]
+	if ok && !bytes.Equal(preKeyBundle.identityKey, identityKey) {
+		return ErrUnmatchIdentityKey
+	}
+	return nil
+}
+
+// 追加する参加者にするだけで、コミットはしない
+func (e *Engine) groupQueueStartSession(remoteConnectionID string, remotePreKeyBundle PreKeyBundle) error {
+	if e.group == nil {
+		return ErrUninitialized
+	}
+	// エポックが一周するのでコミットできない、キューに入れる前に返して状態を変更しない
+	if e.group.epoch == math.MaxUint32 {
+		return ErrRejoinRequired
+	}
+	if remotePreKeyBundle.Capabilities&capabilityGroupMode == 0 {
+		return ErrUnsupportedByRemote
+	}
+	// MLS では追加する参加者の KeyPackage が必要になる
+	if e.mls && (remotePreKeyBundle.Capabilities&capabilityMLS == 0 || remotePreKeyBundle.KeyPackage == nil) {
+		return ErrUnsupportedByRemote
+	}
+
+	// コミットが先に届いていれば追加済み
+	leafIndex, inTree := e.group.tree.findLeaf(remoteConnectionID)
+	if inTree && !bytes.Equal(e.group.tree.leaf(leafIndex).identityKey, remotePreKeyBundle.IdentityKey) {
+		return ErrUnmatchIdentityKey
+	}
+
+	if e.mls && !inTree && e.groupMemberCount()+1 > mlsMaxLeaves {
+		return ErrTooManyGroupMembers
+	}
+
+	if err := e.addPreKeyBundle(remoteConnectionID, remotePreKeyBundle); err != nil {
+		return err
+	}
+	if !inTree {
+		e.groupJoiners[remoteConnectionID] = true
+	}
+	return nil
+}
+
+// 削除する参加者にするだけで、コミットはしない
+func (e *Engine) groupQueueStopSession(remoteConnectionID string) error {
+	if e.group == nil {
+		return ErrUninitialized
+	}
+	// エポックが一周するのでコミットできない、キューに入れる前に返して状態を変更しない
+	if e.group.epoch == math.MaxUint32 {
+		return ErrRejoinRequired
+	}
+
+	_, ok := e.remotePreKeyBundles[remoteConnectionID]
+	_, inTree := e.group.tree.findLeaf(remoteConnectionID)
+	if !ok && !inTree {
+		return ErrMissingSession
+	}
+	delete(e.remotePreKeyBundles, remoteConnectionID)
+	delete(e.remoteIdentifiers, remoteConnectionID)
+	delete(e.groupJoiners, remoteConnectionID)
+	// 木に無い場合も、後から届くコミットや welcome で追加されていれば削除する
+	e.groupLeavers[remoteConnectionID] = true
+	return nil
+}
+
+// キューに入れる前の相手の状態、StartSession と StopSession のコミットに失敗した場合に戻す
+type groupQueueSnapshot struct {
+	connectionID    string
+	preKeyBundle    preKeyBundle
+	hasPreKeyBundle bool
+	identifier      string
+	hasIdentifier   bool
+	joiner          bool
+	leaver          bool
+}
+
+func (e *Engine) groupQueueSnapshot(remoteConnectionID string) groupQueueSnapshot {
+	s := groupQueueSnapshot{
+		connectionID: remoteConnectionID,
+		joiner:       e.groupJoiners[remoteConnectionID],
+		leaver:       e.groupLeavers[remoteConnectionID],
+	}
+	s.preKeyBundle, s.hasPreKeyBundle = e.remotePreKeyBundles[remoteConnectionID]
+	s.identifier, s.hasIdentifier = e.remoteIdentifiers[remoteConnectionID]
+	return s
+}
+
+func (e *Engine) restoreGroupQueue(s groupQueueSnapshot) {
+	delete(e.remotePreKeyBundles, s.connectionID)
+	if s.hasPreKeyBundle {
+		e.remotePreKeyBundles[s.connectionID] = s.preKeyBundle
+	}
+	delete(e.remoteIdentifiers, s.connectionID)
+	if s.hasIdentifier {
+		e.remoteIdentifiers[s.connectionID] = s.identifier
+	}
+	delete(e.groupJoiners, s.connectionID)
+	if s.joiner {
+		e.groupJoiners[s.connectionID] = true
+	}
+	delete(e.groupLeavers, s.connectionID)
+	if s.leaver {
+		e.groupLeavers[s.connectionID] = true
+	}
+}
+
+// キューに入っている入退室をコミットした後の参加者の数
+func (e *Engine) groupMemberCount() int {
+	tree := e.group.tree
+	count := 0
+	for i := uint32(0); i < tree.leafCount(); i++ {
+		if leaf := tree.leaf(i); leaf != nil && !e.groupLeavers[leaf.connectionID] {
+			count++
+		}
+	}
+	for connectionID := range e.groupJoiners {
+		if _, ok := tree.findLeaf(connectionID); !ok {
+			count++
+		}
+	}
+	return count
+}
+
+// コミットする参加者ではない場合は何もしない
+func (e *Engine) groupCommitMembershipChanges() (*CommitMembershipChangesResult, error) {
+	if e.group == nil {
+		return nil, ErrUninitialized
+	}
+
+	messages, remoteSecretKeyMaterials, err := e.commitGroup()
+	if err != nil {
+		return nil, err
+	}
+	if remoteSecretKeyMaterials == nil {
+		remoteSecretKeyMaterials = make(map[string]RemoteSecretKeyMaterial)
+	}
+
+	return &CommitMembershipChangesResult{
+		SelfConnectionID:         e.connectionID,
+		SelfKeyID:                e.keyID,
+		SelfSecretKeyMaterial:    e.secretKeyMaterial,
+		RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+		Messages:                 messages,
+	}, nil
+}
+
+func (e *Engine) groupStartSession(remoteConnectionID string, remotePreKeyBundle PreKeyBundle) (*StartSessionResult, error) {
+	// コミットに失敗した場合は相手をキューに入れる前の状態に戻す
+	snapshot := e.groupQueueSnapshot(remoteConnectionID)
+	if err := e.groupQueueStartSession(remoteConnectionID, remotePreKeyBundle); err != nil {
+		return nil, err
+	}
+
+	messages, remoteSecretKeyMaterials, err := e.commitGroup()
+	if err != nil {
+		e.restoreGroupQueue(snapshot)
+		return nil, err
+	}
+	if remoteSecretKeyMaterials == nil {
+		remoteSecretKeyMaterials = make(map[string]RemoteSecretKeyMaterial)
+	}
+
+	return &StartSessionResult{
+		SelfConnectionID:         e.connectionID,
+		SelfKeyID:                e.keyID,
+		SelfSecretKeyMaterial:    e.secretKeyMaterial,
+		RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+		Messages:                 messages,
+	}, nil
+}
+
+func (e *Engine) groupStopSession(remoteConnectionID string) (*StopSessionResult, error) {
+	// コミットに失敗した場合は相手をキューに入れる前の状態に戻す
+	snapshot := e.groupQueueSnapshot(remoteConnectionID)
+	if err := e.groupQueueStopSession(remoteConnectionID); err != nil {
+		return nil, err
+	}
+
+	messages, remoteSecretKeyMaterials, err := e.commitGroup()
+	if err != nil {
+		e.restoreGroupQueue(snapshot)
+		return nil, err
+	}
+
+	return &StopSessionResult{
+		SelfConnectionID:         e.connectionID,
+		SelfKeyID:                e.keyID,
+		SelfSecretKeyMaterial:    e.secretKeyMaterial,
+		RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+		Messages:                 messages,
+	}, nil
+}
+
+func (e *Engine) groupCommitMessage(m groupCommitMessage) (*ReceiveMessageResult, error) {
+	g := e.group
+	remoteConnectionID := string(m.selfConnectionID[:])
+
+	// welcome がまだ届いていない
+	if g == nil || g.id != m.groupID {
+		return nil, ErrMissingGroupEpoch
+	}
+
+	base := g
+	switch {
+	case m.epoch == g.epoch+1 && m.parentAuthenticator == g.authenticator():
+	case m.epoch == g.epoch+1 || m.epoch > g.epoch+1:
+		// 分岐した別のエポックからのコミットは、巻き戻した後に処理できる場合がある
+		return nil, ErrMissingGroupEpoch
+	case m.epoch == g.epoch && g.previous != nil && m.parentAuthenticator == g.previous.authenticator():
+		// 直前のエポックから分岐したコミット
+		base = g.previous
+	default:
+		return nil, ErrDiscardMessage
+	}
+
+	next, err := e.applyGroupCommit(base, m)
+	if err != nil {
+		return nil, err
+	}
+	next.committer = remoteConnectionID
+	next.previous = base
+
+	if base != g {
+		if !next.precedes(g) {
+			return nil, ErrDiscardMessage
+		}
+		e.rollbackGroup(g)
+	}
+
+	result := &ReceiveMessageResult{
+		RemoteSecretKeyMaterials: e.setGroup(next),
+	}
+	if err := e.commitPendingGroupChanges(result); err != nil {
+		return nil, err
+	}
+	result.SelfKeyID = e.keyID
+	result.SelfSecretKeyMaterial = e.secretKeyMaterial
+	return result, nil
+}
+
+// 巻き戻すエポックのコミットに含まれていた入退室を、まだコミットされていないものに戻す
+// その後に StopSession した参加者は追加しない
+func (e *Engine) rollbackGroup(g *group) {
+	for _, connectionID := range g.committedJoiners {
+		if !e.groupLeavers[connectionID] {
+			e.groupJoiners[connectionID] = true
+		}
+	}
+	for _, connectionID := range g.committedLeavers {
+		e.groupLeavers[connectionID] = true
+	}
+}
+
+// コミットを受け取ってコミットする参加者が自分に変わった場合は、まだコミットされていない入退室をコミットする
+func (e *Engine) commitPendingGroupChanges(result *ReceiveMessageResult) error {
+	messages, remoteSecretKeyMaterials, err := e.commitGroup()
+	if err != nil {
+		return err
+	}
+	result.merge(&ReceiveMessageResult{
+		RemoteSecretKeyMaterials: remoteSecretKeyMaterials,
+		Messages:                 messages,
+	})
+	return nil
+}
+
+func (e *Engine) applyGroupCommit(base *group, m groupCommitMessage) (*group, error) {
+	committer := base.tree.leaf(m.committerLeafIndex)
+	if committer == nil || committer.connectionID != string(m.selfConnectionID[:]) {
+		return nil, ErrVerifyFailed
+	}
+	if m.cipherSuite != base.suite || !base.suite.verify(committer.identityKey, "SoraGroupCommitTBS", m.signedContent(), m.signature) {
+		return nil, ErrVerifyFailed
+	}
+
+	for _, r := range m.removes {
+		// 自分が削除された場合は、このグループでは続けられない
+		if r == base.selfLeafIndex {
+			return nil, ErrDiscardMessage
+		}
+	}
+	for _, a := range m.adds {
+		if err := e.checkGroupIdentityKey(string(a.connectionID[:]), a.identityKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	tree, addedLeaves, err := base.applyProposals(&m)
+	if err != nil {
+		return nil, err
+	}
+
+	committerNode := 2 * m.committerLeafIndex
+	tree.nodes[committerNode].publicKey = m.leafKey
+
+	directPath := tree.directPath(committerNode)
+	copath := tree.copath(committerNode)
+	if len(m.path) != len(directPath) {
+		return nil, ErrVerifyFailed
+	}
+
+	// 自分とコミットした参加者の共通の祖先の path secret を、自分が秘密鍵を知っているノード宛の暗号文から復号する
+	self := 2 * base.selfLeafIndex
+	index := -1
+	var pathSecret []byte
+	for i, x := range directPath {
+		recipients := tree.pathRecipients(copath[i], addedLeaves)
+		if len(recipients) != len(m.path[i].ciphertexts) {
+			return nil, ErrVerifyFailed
+		}
+		for j, c := range m.path[i].ciphertexts {
+			if c.recipient != recipients[j] {
+				return nil, ErrVerifyFailed
+			}
+		}
+
+		if index >= 0 || !treeInSubtree(self, x) {
+			continue
+		}
+		index = i
+		for _, c := range m.path[i].ciphertexts {
+			keyPair, ok := tree.privateKeys[c.recipient]
+			if !ok {
+				continue
+			}
+			pathSecret, err = base.suite.open(keyPair, c.ephemeralKey, "UpdatePathNode", c.ciphertext, base.context())
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if pathSecret == nil {
+		return nil, ErrDecryptMessage
+	}
+
+	// 共通の祖先から根までの鍵を導出して、コミットに含まれる公開鍵と一致するかを確認する
+	for i := index; i < len(directPath); i++ {
+		if i > index {
+			pathSecret = base.suite.nextPathSecret(pathSecret)
+		}
+		keyPair, err := base.suite.nodeKeyPair(pathSecret)
+		if err != nil {
+			return nil, err
+		}
+		if keyPair.publicKey != m.path[i].publicKey {
+			return nil, ErrVerifyFailed
+		}
+		tree.privateKeys[directPath[i]] = *keyPair
+	}
+	for i, x := range directPath {
+		tree.nodes[x] = &treeNode{publicKey: m.path[i].publicKey}
+	}
+
+	next, _ := base.next(tree, base.suite.nextPathSecret(pathSecret))
+	if !hmac.Equal(next.confirmationTag(m.content()), m.confirmationTag) {
+		return nil, ErrVerifyFailed
+	}
+
+	return next, nil
+}
+
+func (e *Engine) groupWelcomeMessage(m groupWelcomeMessage) (*ReceiveMessageResult, error) {
+	remoteConnectionID := string(m.selfConnectionID[:])
+
+	preKeyBundle, ok := e.remotePreKeyBundles[remoteConnectionID]
+	if !ok {
+		return nil, ErrMissingRemotePreKeyBundle
+	}
+	// 自分と異なる暗号スイートのグループには参加できない
+	suite := m.cipherSuite
+	if suite != e.groupCipherSuite() {
+		return nil, ErrUnsupportedByRemote
+	}
+	if !suite.verify(preKeyBundle.identityKey, "SoraGroupWelcomeTBS", m.signedContent(), m.signature) {
+		return nil, ErrVerifyFailed
+	}
+	// 同じグループの古いエポックの welcome は受け付けない
+	sameGroup := e.group != nil && e.group.id == m.groupID
+	if sameGroup && m.epoch < e.group.epoch {
+		return nil, ErrDiscardMessage
+	}
+
+	keyPair, err := e.signedPreKeyPair(m.signedPreKeyID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := suite.open(*keyPair, m.ephemeralKey, "Welcome", m.encrypted, m.ad())
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < 64 {
+		return nil, ErrDecodeMessage
+	}
+	joinerSecret := plaintext[:32]
+	pathSecret := plaintext[32:64]
+	buf := bytes.NewReader(plaintext[64:])
+	tree, err := decodeRatchetTree(buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() != 0 {
+		return nil, ErrDecodeMessage
+	}
+
+	// MLS では葉の鍵は KeyPackage の encryptionKey になる
+	leafKeyPair := *keyPair
+	if suite == groupCipherSuiteMLS {
+		encryptionKeyPair, err := e.signedMLSEncryptionKeyPair(m.signedPreKeyID)
+		if err != nil {
+			return nil, err
+		}
+		leafKeyPair = *encryptionKeyPair
+	}
+	selfLeafIndex, ok := tree.findLeaf(e.connectionID)
+	if !ok || tree.leaf(selfLeafIndex).publicKey != leafKeyPair.publicKey {
+		return nil, ErrVerifyFailed
+	}
+	committerLeafIndex, ok := tree.findLeaf(remoteConnectionID)
+	if !ok || committerLeafIndex == selfLeafIndex {
+		return nil, ErrVerifyFailed
+	}
+	for i := uint32(0); i < tree.leafCount(); i++ {
+		if leaf := tree.leaf(i); leaf != nil {
+			if err := e.checkGroupIdentityKey(leaf.connectionID, leaf.identityKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 共通の祖先から根までの鍵を導出して、木の公開鍵と一致するかを確認する
+	self := 2 * selfLeafIndex
+	tree.privateKeys[self] = leafKeyPair
+	first := true
+	for _, x := range tree.directPath(2 * committerLeafIndex) {
+		if !treeInSubtree(self, x) {
+			continue
+		}
+		if !first {
+			pathSecret = suite.nextPathSecret(pathSecret)
+		}
+		first = false
+		nodeKeyPair, err := suite.nodeKeyPair(pathSecret)
+		if err != nil {
+			return nil, err
+		}
+		if tree.nodes[x] == nil || tree.nodes[x].publicKey != nodeKeyPair.publicKey {
+			return nil, ErrVerifyFailed
+		}
+		tree.privateKeys[x] = *nodeKeyPair
+	}
+
+	g := &group{
+		id:            m.groupID,
+		suite:         suite,
+		epoch:         m.epoch,
+		tree:          tree,
+		selfLeafIndex: selfLeafIndex,
+		committer:     remoteConnectionID,
+	}
+	g.setEpochSecret(joinerSecret)
+
+	// 同じエポックの welcome が入れ違った場合は、コミットと同じ順序で揃える
+	if sameGroup && m.epoch == e.group.epoch {
+		if !g.precedes(e.group) {
+			return nil, ErrDiscardMessage
+		}
+		e.rollbackGroup(e.group)
+	}
+
+	result := &ReceiveMessageResult{
+		RemoteSecretKeyMaterials: e.setGroup(g),
+	}
+	if err := e.commitPendingGroupChanges(result); err != nil {
+		return nil, err
+	}
+	result.SelfKeyID = e.keyID
+	result.SelfSecretKeyMaterial = e.secretKeyMaterial
+	return result, nil
+}
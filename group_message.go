@@ -0,0 +1,470 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+)
+
+const (
+	// 全員に送るメッセージの DstConnectionID、Sora JavaScript SDK は送信元以外の全員に送る
+	broadcastConnectionID = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+	groupIDLength = 32
+	// 32 バイトの path secret を AES-256-GCM で暗号化したもの
+	groupPathCiphertextLength = 32 + 16
+)
+
+// ```erlang
+// <<?E2EE_GROUP_COMMIT_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
+//   SrcConnectionID:26/binary,
+//   ## 全員宛なのですべて 0
+//   DstConnectionID:26/binary,
+//   GroupID:32/binary,
+//   ## 0 はグループモードの独自の方式、1 は MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519
+//   CipherSuite:16,
+//   ## コミットした後のエポック
+//   Epoch:32,
+//   ## コミットする前のエポックの authenticator、同じエポックで分岐した場合にどちらのコミットかを判別する
+//   ParentAuthenticator:32/binary,
+//   CommitterLeafIndex:32,
+//   RemoveCount:16, RemoveLeafIndex:32...,
+//   AddCount:16, Add/binary...,
+//   LeafKey:32/binary,
+//   PathLength:16, PathNode/binary...,
+//   ## 新しいエポックの鍵で計算した HMAC-SHA256、ここまでが対象
+//   ConfirmationTag:32/binary,
+//   ## ConfirmationTag までをコミットした参加者の identityKey で署名したもの
+//   Signature:64/binary>>
+//
+// ## 追加する参加者の preKeyBundle の一部、CipherSuite が 1 の場合は KeyPackage を含める
+// Add = <<ConnectionID:26/binary, IdentityKey:32/binary,
+//         SignedPreKeyID:32, SignedPreKey:32/binary, PreKeySignature:64/binary>>
+// Add = <<ConnectionID:26/binary, SignedPreKeyID:32, KeyPackageLength:16, KeyPackage/binary>>
+//
+// ## コミットした参加者の葉から根までのノードの新しい公開鍵と、そのノードの path secret を
+// ## 反対側の子の resolution のノードごとに暗号化したもの
+// PathNode = <<PublicKey:32/binary, CiphertextCount:16,
+//              (RecipientNodeIndex:32, EphemeralKey:32/binary, Ciphertext:48/binary)...>>
+// ## CipherSuite が 1 の場合、EphemeralKey は HPKE の enc で、Ciphertext は AES-128-GCM で暗号化したもの
+// ```
+
+type groupCommitMessage struct {
+	protocolVersion     uint8
+	selfConnectionID    [26]byte
+	groupID             [groupIDLength]byte
+	cipherSuite         groupCipherSuite
+	epoch               uint32
+	parentAuthenticator [32]byte
+	committerLeafIndex  uint32
+	removes             []uint32
+	adds                []groupAdd
+	leafKey             x25519PublicKey
+	path                []groupPathNode
+	confirmationTag     []byte
+	signature           []byte
+}
+
+type groupAdd struct {
+	connectionID    [26]byte
+	identityKey     [32]byte
+	signedPreKeyID  uint32
+	signedPreKey    x25519PublicKey
+	preKeySignature [64]byte
+	// MLS の場合のみ、identityKey と signedPreKey は KeyPackage から取り出す
+	keyPackage    []byte
+	encryptionKey x25519PublicKey
+}
+
+type groupPathNode struct {
+	publicKey   x25519PublicKey
+	ciphertexts []groupPathCiphertext
+}
+
+type groupPathCiphertext struct {
+	recipient    uint32
+	ephemeralKey x25519PublicKey
+	ciphertext   []byte
+}
+
+func newGroupAdd(cipherSuite groupCipherSuite, connectionID string, p preKeyBundle) (*groupAdd, error) {
+	a := &groupAdd{
+		signedPreKeyID: p.signedPreKeyID,
+		signedPreKey:   p.signedPreKey,
+	}
+	copy(a.connectionID[:], connectionID)
+	copy(a.identityKey[:], p.identityKey)
+	copy(a.preKeySignature[:], p.preKeySignature)
+
+	if cipherSuite == groupCipherSuiteMLS {
+		if err := a.setKeyPackage(p.keyPackage); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// KeyPackage の署名を確認して、identityKey と signedPreKey を取り出す
+func (a *groupAdd) setKeyPackage(keyPackage []byte) error {
+	k, err := decodeMLSKeyPackage(keyPackage)
+	if err != nil {
+		return err
+	}
+	a.keyPackage = keyPackage
+	copy(a.identityKey[:], k.signatureKey)
+	a.signedPreKey = k.initKey
+	a.encryptionKey = k.encryptionKey
+	return nil
+}
+
+// 追加する葉、signedPreKey が identityKey で署名されていることを確認する
+// MLS の場合は KeyPackage の署名を確認済みなので、KeyPackage の encryption_key を葉の鍵にする
+func (a groupAdd) treeNode() (*treeNode, error) {
+	if a.keyPackage != nil {
+		return &treeNode{
+			publicKey:    a.encryptionKey,
+			connectionID: string(a.connectionID[:]),
+			identityKey:  append([]byte(nil), a.identityKey[:]...),
+		}, nil
+	}
+	if !ed25519.Verify(a.identityKey[:], a.signedPreKey[:], a.preKeySignature[:]) {
+		return nil, ErrVerifyFailed
+	}
+	return &treeNode{
+		publicKey:    a.signedPreKey,
+		connectionID: string(a.connectionID[:]),
+		identityKey:  append([]byte(nil), a.identityKey[:]...),
+	}, nil
+}
+
+// 全員宛のメッセージと welcome で共通の DstConnectionID までを書き込む
+func groupMessageBuffer(packetType uint8, version uint8, selfConnectionID []byte, remoteConnectionID string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(packetType)
+	buf.WriteByte(version)
+	// 長さが 64 KiB を超える場合があるので CiphertextLength は利用しない
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	buf.Write(selfConnectionID)
+	buf.WriteString(remoteConnectionID)
+	return buf
+}
+
+// ConfirmationTag の対象
+func (m *groupCommitMessage) content() []byte {
+	buf := groupMessageBuffer(typeGroupCommitMessage, m.protocolVersion, m.selfConnectionID[:], broadcastConnectionID)
+	buf.Write(m.groupID[:])
+	binary.Write(buf, binary.BigEndian, m.cipherSuite)
+	binary.Write(buf, binary.BigEndian, m.epoch)
+	buf.Write(m.parentAuthenticator[:])
+	binary.Write(buf, binary.BigEndian, m.committerLeafIndex)
+
+	binary.Write(buf, binary.BigEndian, uint16(len(m.removes)))
+	binary.Write(buf, binary.BigEndian, m.removes)
+
+	binary.Write(buf, binary.BigEndian, uint16(len(m.adds)))
+	for _, a := range m.adds {
+		buf.Write(a.connectionID[:])
+		if m.cipherSuite == groupCipherSuiteMLS {
+			binary.Write(buf, binary.BigEndian, a.signedPreKeyID)
+			binary.Write(buf, binary.BigEndian, uint16(len(a.keyPackage)))
+			buf.Write(a.keyPackage)
+			continue
+		}
+		buf.Write(a.identityKey[:])
+		binary.Write(buf, binary.BigEndian, a.signedPreKeyID)
+		buf.Write(a.signedPreKey[:])
+		buf.Write(a.preKeySignature[:])
+	}
+
+	buf.Write(m.leafKey[:])
+
+	binary.Write(buf, binary.BigEndian, uint16(len(m.path)))
+	for _, n := range m.path {
+		buf.Write(n.publicKey[:])
+		binary.Write(buf, binary.BigEndian, uint16(len(n.ciphertexts)))
+		for _, c := range n.ciphertexts {
+			binary.Write(buf, binary.BigEndian, c.recipient)
+			buf.Write(c.ephemeralKey[:])
+			buf.Write(c.ciphertext)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Signature の対象
+func (m *groupCommitMessage) signedContent() []byte {
+	return append(m.content(), m.confirmationTag...)
+}
+
+func (m *groupCommitMessage) encode() []byte {
+	return append(m.signedContent(), m.signature...)
+}
+
+func decodeGroupCommitMessage(header messageHeader, buf *bytes.Reader) (*groupCommitMessage, error) {
+	if header.ciphertextLength != 0 {
+		return nil, ErrDecodeMessage
+	}
+	m := &groupCommitMessage{protocolVersion: header.protocolVersion}
+
+	var remoteConnectionID [26]byte
+	if err := binary.Read(buf, binary.BigEndian, &m.selfConnectionID); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &remoteConnectionID); err != nil {
+		return nil, err
+	}
+	if string(remoteConnectionID[:]) != broadcastConnectionID {
+		return nil, ErrDecodeMessage
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.groupID); err != nil {
+		return nil, err
+	}
+	if err := readGroupCipherSuite(buf, &m.cipherSuite); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.epoch); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.parentAuthenticator); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.committerLeafIndex); err != nil {
+		return nil, err
+	}
+
+	// 相手が送ってきた数をそのまま信用して確保しない
+	var removeCount uint16
+	if err := binary.Read(buf, binary.BigEndian, &removeCount); err != nil {
+		return nil, err
+	}
+	if buf.Len() < int(removeCount)*4 {
+		return nil, ErrDecodeMessage
+	}
+	m.removes = make([]uint32, removeCount)
+	if err := binary.Read(buf, binary.BigEndian, m.removes); err != nil {
+		return nil, err
+	}
+
+	var addCount uint16
+	if err := binary.Read(buf, binary.BigEndian, &addCount); err != nil {
+		return nil, err
+	}
+	addLength := 26 + 32 + 4 + 32 + 64
+	if m.cipherSuite == groupCipherSuiteMLS {
+		addLength = 26 + 4 + 2
+	}
+	if buf.Len() < int(addCount)*addLength {
+		return nil, ErrDecodeMessage
+	}
+	m.adds = make([]groupAdd, addCount)
+	for i := range m.adds {
+		a := &m.adds[i]
+		if err := binary.Read(buf, binary.BigEndian, &a.connectionID); err != nil {
+			return nil, err
+		}
+		if m.cipherSuite == groupCipherSuiteMLS {
+			if err := decodeGroupAddKeyPackage(buf, a); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := binary.Read(buf, binary.BigEndian, &a.identityKey); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &a.signedPreKeyID); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &a.signedPreKey); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &a.preKeySignature); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &m.leafKey); err != nil {
+		return nil, err
+	}
+
+	var pathLength uint16
+	if err := binary.Read(buf, binary.BigEndian, &pathLength); err != nil {
+		return nil, err
+	}
+	if buf.Len() < int(pathLength)*(32+2) {
+		return nil, ErrDecodeMessage
+	}
+	m.path = make([]groupPathNode, pathLength)
+	for i := range m.path {
+		n := &m.path[i]
+		if err := binary.Read(buf, binary.BigEndian, &n.publicKey); err != nil {
+			return nil, err
+		}
+		var ciphertextCount uint16
+		if err := binary.Read(buf, binary.BigEndian, &ciphertextCount); err != nil {
+			return nil, err
+		}
+		if buf.Len() < int(ciphertextCount)*(4+32+groupPathCiphertextLength) {
+			return nil, ErrDecodeMessage
+		}
+		n.ciphertexts = make([]groupPathCiphertext, ciphertextCount)
+		for j := range n.ciphertexts {
+			c := &n.ciphertexts[j]
+			if err := binary.Read(buf, binary.BigEndian, &c.recipient); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(buf, binary.BigEndian, &c.ephemeralKey); err != nil {
+				return nil, err
+			}
+			c.ciphertext = make([]byte, groupPathCiphertextLength)
+			if err := binary.Read(buf, binary.BigEndian, c.ciphertext); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if buf.Len() != 32+ed25519.SignatureSize {
+		return nil, ErrDecodeMessage
+	}
+	m.confirmationTag = make([]byte, 32)
+	if err := binary.Read(buf, binary.BigEndian, m.confirmationTag); err != nil {
+		return nil, err
+	}
+	m.signature = make([]byte, ed25519.SignatureSize)
+	if err := binary.Read(buf, binary.BigEndian, m.signature); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// 対応していない CipherSuite はエラーにする
+func readGroupCipherSuite(buf *bytes.Reader, cipherSuite *groupCipherSuite) error {
+	if err := binary.Read(buf, binary.BigEndian, cipherSuite); err != nil {
+		return err
+	}
+	if *cipherSuite != groupCipherSuiteSora && *cipherSuite != groupCipherSuiteMLS {
+		return ErrDecodeMessage
+	}
+	return nil
+}
+
+// <<SignedPreKeyID:32, KeyPackageLength:16, KeyPackage/binary>>
+func decodeGroupAddKeyPackage(buf *bytes.Reader, a *groupAdd) error {
+	if err := binary.Read(buf, binary.BigEndian, &a.signedPreKeyID); err != nil {
+		return err
+	}
+	var keyPackageLength uint16
+	if err := binary.Read(buf, binary.BigEndian, &keyPackageLength); err != nil {
+		return err
+	}
+	if buf.Len() < int(keyPackageLength) {
+		return ErrDecodeMessage
+	}
+	keyPackage := make([]byte, keyPackageLength)
+	if err := binary.Read(buf, binary.BigEndian, keyPackage); err != nil {
+		return err
+	}
+	return a.setKeyPackage(keyPackage)
+}
+
+// ```erlang
+// <<?E2EE_GROUP_WELCOME_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
+//   SrcConnectionID:26/binary, DstConnectionID:26/binary,
+//   GroupID:32/binary, CipherSuite:16, Epoch:32,
+//   ## 暗号化に利用した追加する参加者の signedPreKey の ID
+//   SignedPreKeyID:32,
+//   EphemeralKey:32/binary,
+//   ## SignedPreKeyID までを AD にして暗号化したもの
+//   EncryptedLength:32, Encrypted/binary,
+//   ## Encrypted までをコミットした参加者の identityKey で署名したもの
+//   Signature:64/binary>>
+//
+// ## CipherSuite が 1 の場合は KeyPackage の init_key に HPKE で暗号化し、EphemeralKey は HPKE の enc になる
+// ## Encrypted の中身、PathSecret はコミットした参加者と追加する参加者の共通の祖先のもの
+// <<JoinerSecret:32/binary, PathSecret:32/binary, RatchetTree/binary>>
+// ```
+
+type groupWelcomeMessage struct {
+	protocolVersion    uint8
+	selfConnectionID   [26]byte
+	remoteConnectionID [26]byte
+	groupID            [groupIDLength]byte
+	cipherSuite        groupCipherSuite
+	epoch              uint32
+	signedPreKeyID     uint32
+	ephemeralKey       x25519PublicKey
+	encrypted          []byte
+	signature          []byte
+}
+
+// 暗号化の AD
+func (m *groupWelcomeMessage) ad() []byte {
+	buf := groupMessageBuffer(typeGroupWelcomeMessage, m.protocolVersion, m.selfConnectionID[:], string(m.remoteConnectionID[:]))
+	buf.Write(m.groupID[:])
+	binary.Write(buf, binary.BigEndian, m.cipherSuite)
+	binary.Write(buf, binary.BigEndian, m.epoch)
+	binary.Write(buf, binary.BigEndian, m.signedPreKeyID)
+	return buf.Bytes()
+}
+
+// Signature の対象
+func (m *groupWelcomeMessage) signedContent() []byte {
+	buf := bytes.NewBuffer(m.ad())
+	buf.Write(m.ephemeralKey[:])
+	binary.Write(buf, binary.BigEndian, uint32(len(m.encrypted)))
+	buf.Write(m.encrypted)
+	return buf.Bytes()
+}
+
+func (m *groupWelcomeMessage) encode() []byte {
+	return append(m.signedContent(), m.signature...)
+}
+
+func decodeGroupWelcomeMessage(header messageHeader, buf *bytes.Reader) (*groupWelcomeMessage, error) {
+	if header.ciphertextLength != 0 {
+		return nil, ErrDecodeMessage
+	}
+	m := &groupWelcomeMessage{protocolVersion: header.protocolVersion}
+
+	if err := binary.Read(buf, binary.BigEndian, &m.selfConnectionID); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.remoteConnectionID); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.groupID); err != nil {
+		return nil, err
+	}
+	if err := readGroupCipherSuite(buf, &m.cipherSuite); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.epoch); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.signedPreKeyID); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &m.ephemeralKey); err != nil {
+		return nil, err
+	}
+
+	var encryptedLength uint32
+	if err := binary.Read(buf, binary.BigEndian, &encryptedLength); err != nil {
+		return nil, err
+	}
+	// 相手が送ってきた長さをそのまま信用して確保しない
+	if buf.Len() < ed25519.SignatureSize || encryptedLength != uint32(buf.Len()-ed25519.SignatureSize) {
+		return nil, ErrDecodeMessage
+	}
+	m.encrypted = make([]byte, encryptedLength)
+	if err := binary.Read(buf, binary.BigEndian, m.encrypted); err != nil {
+		return nil, err
+	}
+	m.signature = make([]byte, ed25519.SignatureSize)
+	if err := binary.Read(buf, binary.BigEndian, m.signature); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
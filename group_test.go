@@ -0,0 +1,304 @@
+package e2ee
+
+import (
+	"crypto/rand"
+	"errors"
+	"math"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupMode(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode())
+
+	for i := 0; i < 8; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+		r.assertKeyAgreement()
+	}
+
+	// 退室はコミットする 1 人が全員宛に 1 つ送るだけ
+	for _, i := range []int{3, 0, 6} {
+		r.messageCount = 0
+		r.ciphertextCount = 0
+		r.leave(testGroupConnectionID(i))
+		r.deliver()
+		r.assertKeyAgreement()
+		assert.Equal(t, 1, r.messageCount)
+		assert.Less(t, r.ciphertextCount, len(r.engines))
+	}
+
+	// 空いた葉に入る
+	r.join(testGroupConnectionID(8))
+	r.deliver()
+	r.assertKeyAgreement()
+	leafIndex, ok := r.engines[testGroupConnectionID(8)].group.tree.findLeaf(testGroupConnectionID(8))
+	assert.True(t, ok)
+	assert.Less(t, leafIndex, uint32(8))
+}
+
+func TestGroupModeSimultaneousLeave(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode())
+	for i := 0; i < 6; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+	}
+
+	// 配送する前に複数人が退室した
+	r.leave(testGroupConnectionID(1))
+	r.leave(testGroupConnectionID(4))
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// 入室と同時に退室する
+	r.join(testGroupConnectionID(6))
+	r.leave(testGroupConnectionID(0))
+	r.deliver()
+	r.assertKeyAgreement()
+}
+
+func TestGroupModeUnsupportedRemote(t *testing.T) {
+	alice := NewEngine(version, WithGroupMode())
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start("ALICE---------------------")
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+
+	_, err = alice.StartSession("BOB-----------------------", bob.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+
+	// グループモードではない Engine はグループモードのメッセージを扱えない
+	carol := NewEngine(version, WithGroupMode())
+	assert.Nil(t, carol.Init())
+	_, err = carol.Start("CAROL---------------------")
+	assert.Nil(t, err)
+	result, err := alice.StartSession("CAROL---------------------", carol.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(result.Messages[0])
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+}
+
+func TestGroupModeTampered(t *testing.T) {
+	alice := NewEngine(version, WithGroupMode())
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start("ALICE---------------------")
+	assert.Nil(t, err)
+	bob := NewEngine(version, WithGroupMode())
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start("BOB-----------------------")
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle("ALICE---------------------", alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	result, err := alice.StartSession("BOB-----------------------", bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	assert.Len(t, result.Messages, 2)
+	welcome := result.Messages[1]
+
+	tampered := append([]byte{}, welcome...)
+	tampered[len(tampered)-100] ^= 1
+	_, err = bob.ReceiveMessage(tampered)
+	assert.ErrorIs(t, err, ErrVerifyFailed)
+
+	received, err := bob.ReceiveMessage(welcome)
+	assert.Nil(t, err)
+	assert.Equal(t, alice.keyID, received.SelfKeyID)
+	assert.Equal(t, alice.secretKeyMaterial, received.RemoteSecretKeyMaterials["ALICE---------------------"].SecretKeyMaterial)
+	assert.Equal(t, bob.secretKeyMaterial, result.RemoteSecretKeyMaterials["BOB-----------------------"].SecretKeyMaterial)
+}
+
+func TestGroupModeExportImport(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode())
+	for i := 0; i < 4; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+	}
+
+	passphraseKey := []byte("passphrase-key")
+	connectionID := testGroupConnectionID(2)
+	blob, err := r.engines[connectionID].Export(passphraseKey)
+	assert.Nil(t, err)
+
+	restored := NewEngine(version)
+	assert.Nil(t, restored.Import(passphraseKey, blob))
+	assert.True(t, restored.groupMode)
+	assert.Equal(t, r.engines[connectionID].group.tree.encode(), restored.group.tree.encode())
+	r.engines[connectionID] = restored
+
+	// 復元した後もコミットを処理できる
+	r.leave(testGroupConnectionID(0))
+	r.join(testGroupConnectionID(4))
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// グループモードではない状態はグループモードで復元できない
+	pairwise := NewEngine(version)
+	assert.Nil(t, pairwise.Init())
+	_, err = pairwise.Start("ALICE---------------------")
+	assert.Nil(t, err)
+	blob, err = pairwise.Export(passphraseKey)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, NewEngine(version, WithGroupMode()).Import(passphraseKey, blob), ErrInvalidState)
+
+	// 失敗した場合はグループモードや MLS に切り替えない
+	for _, options := range [][]Option{{WithGroupMode()}, {WithGroupMode(), WithMLS()}} {
+		rr := newTestRoom(t, options...)
+		for i := 0; i < 2; i++ {
+			rr.join(testGroupConnectionID(i))
+			rr.deliver()
+		}
+		state := rr.engines[testGroupConnectionID(0)].state()
+		state.MembershipChanges = []membershipChangeState{{ConnectionID: "UNKNOWN-------------------", Stop: true}}
+		e := NewEngine(version)
+		assert.Nil(t, e.Init())
+		assert.ErrorIs(t, e.restore(state, time.Now()), ErrInvalidState)
+		assert.False(t, e.groupMode)
+		assert.False(t, e.mls)
+	}
+}
+
+func TestGroupModeMLS(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode(), WithMLS())
+	for i := 0; i < 6; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+		r.assertKeyAgreement()
+	}
+	for _, i := range []int{2, 0} {
+		r.leave(testGroupConnectionID(i))
+		r.deliver()
+		r.assertKeyAgreement()
+	}
+	r.join(testGroupConnectionID(6))
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// 参加者ごとに KeyID と SK が異なる
+	keyIDs := make(map[uint32]bool)
+	secretKeyMaterials := make(map[string]bool)
+	for _, e := range r.engines {
+		assert.Equal(t, groupCipherSuiteMLS, e.group.suite)
+		keyIDs[e.keyID] = true
+		secretKeyMaterials[string(e.secretKeyMaterial)] = true
+	}
+	assert.Len(t, keyIDs, len(r.engines))
+	assert.Len(t, secretKeyMaterials, len(r.engines))
+
+	// 復元した後も MLS のまま続けられる
+	passphraseKey := []byte("passphrase-key")
+	connectionID := testGroupConnectionID(3)
+	blob, err := r.engines[connectionID].Export(passphraseKey)
+	assert.Nil(t, err)
+	restored := NewEngine(version)
+	assert.Nil(t, restored.Import(passphraseKey, blob))
+	assert.True(t, restored.mls)
+	// 葉の鍵も保存するので、復元しても同じ KeyPackage を配布する
+	assert.Equal(t, r.engines[connectionID].SelfPreKeyBundle().KeyPackage, restored.SelfPreKeyBundle().KeyPackage)
+	r.engines[connectionID] = restored
+	r.leave(testGroupConnectionID(1))
+	r.join(testGroupConnectionID(7))
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// Sora 独自のグループは MLS では復元できない
+	sora := newTestRoom(t, WithGroupMode())
+	sora.join(testGroupConnectionID(0))
+	blob, err = sora.engines[testGroupConnectionID(0)].Export(passphraseKey)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, NewEngine(version, WithMLS()).Import(passphraseKey, blob), ErrInvalidState)
+}
+
+func TestGroupModeMLSUnsupportedRemote(t *testing.T) {
+	alice := NewEngine(version, WithMLS())
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start("ALICE---------------------")
+	assert.Nil(t, err)
+
+	// MLS に対応していないグループモードの相手は追加できない
+	bob := NewEngine(version, WithGroupMode())
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start("BOB-----------------------")
+	assert.Nil(t, err)
+	_, err = alice.StartSession("BOB-----------------------", bob.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+
+	// MLS の相手が Sora 独自のグループに追加された場合は welcome を受け付けない
+	_, err = alice.AddPreKeyBundle("BOB-----------------------", bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	result, err := bob.StartSession("ALICE---------------------", alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	assert.Len(t, result.Messages, 2)
+	_, err = alice.ReceiveMessage(result.Messages[1])
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+}
+
+func TestGroupModeEpochWrap(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode())
+	for i := 0; i < 3; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+	}
+
+	// エポックが一周する場合はコミットできないので参加し直す必要がある
+	leaver := testGroupConnectionID(2)
+	for connectionID, e := range r.engines {
+		if connectionID == leaver {
+			continue
+		}
+		e.group.epoch = math.MaxUint32
+		_, err := e.StopSession(leaver)
+		assert.ErrorIs(t, err, ErrRejoinRequired, connectionID)
+		_, err = e.QueueStopSession(leaver)
+		assert.ErrorIs(t, err, ErrRejoinRequired, connectionID)
+
+		// 失敗した場合は状態を変更しない
+		_, ok := e.remotePreKeyBundles[leaver]
+		assert.True(t, ok, connectionID)
+		assert.False(t, e.groupLeavers[leaver], connectionID)
+	}
+}
+
+func TestGroupModeCommitFailure(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode())
+	for i := 0; i < 3; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+	}
+
+	var committer *Engine
+	for connectionID, e := range r.engines {
+		if e.groupCommitter() == connectionID {
+			committer = e
+		}
+	}
+	var leaver string
+	for connectionID := range r.engines {
+		if connectionID != committer.connectionID {
+			leaver = connectionID
+		}
+	}
+	joiner := r.newEngine(testGroupConnectionID(3))
+
+	// コミットに失敗した場合はキューに入れる前の状態に戻す
+	committer.random = iotest.ErrReader(errors.New("random"))
+	state := committer.state()
+	_, err := committer.StartSession(joiner.connectionID, joiner.SelfPreKeyBundle())
+	assert.NotNil(t, err)
+	assert.Equal(t, state, committer.state())
+	_, err = committer.StopSession(leaver)
+	assert.NotNil(t, err)
+	assert.Equal(t, state, committer.state())
+
+	// 戻した後はもう一度同じ入退室をコミットできる
+	committer.random = rand.Reader
+	result, err := committer.StartSession(joiner.connectionID, joiner.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Messages)
+	_, err = committer.StopSession(leaver)
+	assert.Nil(t, err)
+}
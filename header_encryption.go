@@ -0,0 +1,181 @@
+package e2ee
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Double Ratchet のヘッダー暗号化
+// https://signal.org/docs/specifications/doubleratchet/#double-ratchet-with-header-encryption
+//
+// ヘッダーを暗号化すると Sora から RatchetKey、PN、N が見えなくなり、
+// メッセージの数や DH ratchet のタイミングがわからなくなる
+
+const (
+	ratchetHeaderLength = 32 + 4 + 4
+	headerNonceLength   = 12
+	headerTagLength     = 16
+
+	// <<Nonce:12/binary, EncryptedRatchetHeader:40/binary, Tag:16/binary>>
+	encryptedHeaderLength = headerNonceLength + ratchetHeaderLength + headerTagLength
+)
+
+// X3DH の rootKey から sender と receiver で共有するヘッダーキーを求める
+// sender の最初のヘッダーキーと、receiver の最初の次のヘッダーキーになる
+func sharedHeaderKeys(sk []byte) ([]byte, []byte, error) {
+	hash := sha256.New
+	salt := make([]byte, hash().Size())
+	info := []byte("SoraHeaderKeys")
+	hkdf := hkdf.New(hash, sk, salt, info)
+
+	headerKey := make([]byte, 32)
+	nextHeaderKey := make([]byte, 32)
+
+	if _, err := io.ReadFull(hkdf, headerKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(hkdf, nextHeaderKey); err != nil {
+		return nil, nil, err
+	}
+
+	return headerKey, nextHeaderKey, nil
+}
+
+func senderRatchetInitHE(random io.Reader, sk []byte, preKeyBundle preKeyBundle) (*ratchetState, error) {
+	sharedHeaderKey, sharedNextHeaderKey, err := sharedHeaderKeys(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	ratchetKeyPair, err := generateRatchetKeyPair(random)
+	if err != nil {
+		return nil, err
+	}
+
+	rootKey, chainKey, nextHeaderKey, err := kdfRkHE(sk, ratchetKeyPair.privateKey, preKeyBundle.signedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ratchetState{
+		selfDH:              *ratchetKeyPair,
+		remoteDH:            preKeyBundle.signedPreKey,
+		rootKey:             rootKey,
+		selfChainKey:        chainKey,
+		mkskipped:           make(map[mkskippedKey]messageKey),
+		selfHeaderKey:       sharedHeaderKey,
+		selfNextHeaderKey:   nextHeaderKey,
+		remoteNextHeaderKey: sharedNextHeaderKey,
+	}, nil
+}
+
+func receiverRatchetInitHE(sk []byte, signedPreKeyPublic x25519PublicKey, signedPreKeyPrivate x25519PrivateKey) (*ratchetState, error) {
+	sharedHeaderKey, sharedNextHeaderKey, err := sharedHeaderKeys(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := receiverRatchetInit(sk, signedPreKeyPublic, signedPreKeyPrivate)
+	rs.selfNextHeaderKey = sharedNextHeaderKey
+	rs.remoteNextHeaderKey = sharedHeaderKey
+	return rs, nil
+}
+
+func (rs *ratchetState) headerEncryption() bool {
+	return rs.selfNextHeaderKey != nil
+}
+
+// HENCRYPT
+// ヘッダーキーはチェインの間は変わらないので、nonce はヘッダーキーとヘッダーから求めて先頭に付ける
+// ヘッダーはチェインの中で N が必ず異なるため、同じヘッダーキーで nonce が重複しない
+func encryptHeader(aead aeadAlgorithm, headerKey []byte, header []byte, ad []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, headerKey)
+	mac.Write([]byte("SoraHeaderNonce"))
+	mac.Write(header)
+	nonce := mac.Sum(nil)[:headerNonceLength]
+
+	ciphertext, err := aead.encrypt(headerKey, nonce, header, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, ciphertext...), nil
+}
+
+// HDECRYPT
+func decryptHeader(aead aeadAlgorithm, headerKey []byte, encryptedHeader []byte, ad []byte) (*ratchetHeader, bool) {
+	if headerKey == nil || len(encryptedHeader) != encryptedHeaderLength {
+		return nil, false
+	}
+
+	header, err := aead.decrypt(headerKey, encryptedHeader[:headerNonceLength], encryptedHeader[headerNonceLength:], ad)
+	if err != nil {
+		return nil, false
+	}
+
+	ratchetHeader, err := parseHeader(header)
+	if err != nil {
+		return nil, false
+	}
+	return ratchetHeader, true
+}
+
+// ヘッダーを暗号化している場合の RatchetDecrypt
+// 今のヘッダーキーで復号できたら今のチェイン、次のヘッダーキーで復号できたら相手の新しいチェインのメッセージ
+func (rs *ratchetState) ratchetDecryptHE(encryptedHeader []byte, ciphertext []byte, ad []byte, maxSkip uint32, now time.Time, random io.Reader) ([]byte, error) {
+	aad := append(append([]byte{}, ad...), encryptedHeader...)
+
+	plaintext, err := rs.trySkippedMessageKeysHE(encryptedHeader, ciphertext, ad, aad)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext != nil {
+		return plaintext, nil
+	}
+
+	if ratchetHeader, ok := decryptHeader(rs.aead, rs.remoteHeaderKey, encryptedHeader, ad); ok {
+		return rs.decryptMessage(ratchetHeader, false, ciphertext, aad, maxSkip, now, random)
+	}
+	if ratchetHeader, ok := decryptHeader(rs.aead, rs.remoteNextHeaderKey, encryptedHeader, ad); ok {
+		return rs.decryptMessage(ratchetHeader, true, ciphertext, aad, maxSkip, now, random)
+	}
+
+	// 古いセッションのメッセージか改ざんされたメッセージ
+	return nil, ErrDecryptMessage
+}
+
+// スキップしたメッセージキーはヘッダーキーごとに保存しているので、ヘッダーキーごとにヘッダーの復号を試す
+func (rs *ratchetState) trySkippedMessageKeysHE(encryptedHeader []byte, ciphertext []byte, ad []byte, aad []byte) ([]byte, error) {
+	tried := make(map[[32]byte]bool)
+	for k := range rs.mkskipped {
+		if tried[k.DH] {
+			continue
+		}
+		tried[k.DH] = true
+
+		headerKey := k.DH
+		ratchetHeader, ok := decryptHeader(rs.aead, headerKey[:], encryptedHeader, ad)
+		if !ok {
+			continue
+		}
+
+		mkskippedKey := mkskippedKey{DH: k.DH, N: ratchetHeader.N}
+		messageKey, ok := rs.mkskipped[mkskippedKey]
+		if !ok {
+			// スキップしていないメッセージなので、今のチェインのメッセージとして復号する
+			return nil, nil
+		}
+
+		plaintext, err := rs.aead.decrypt(messageKey.key, messageKey.nonce, ciphertext, aad)
+		if err != nil {
+			return nil, ErrDecryptMessage
+		}
+		// 改ざんされたメッセージで破棄しないように、復号できてから破棄する
+		delete(rs.mkskipped, mkskippedKey)
+		return plaintext, nil
+	}
+	return nil, nil
+}
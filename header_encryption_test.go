@@ -0,0 +1,246 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderEncryption(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t, WithHeaderEncryption())
+	aliceSession := alice.sessions[bobConnectionID]
+	bobSession := bob.sessions[aliceConnectionID]
+	assert.True(t, aliceSession.headerEncryption())
+	assert.True(t, bobSession.headerEncryption())
+	assert.Equal(t, bob.secretKeyMaterial, aliceSession.remoteSecretKeyMaterial)
+	assert.Equal(t, alice.secretKeyMaterial, bobSession.remoteSecretKeyMaterial)
+
+	// alice からのメッセージを 1 つ飛ばして受け取る
+	delayed, err := alice.messages()
+	assert.Nil(t, err)
+	latest, err := alice.messages()
+	assert.Nil(t, err)
+	for _, message := range [][]byte{delayed[0], latest[0]} {
+		assert.Equal(t, typeEncryptedCipherMessage, message[0])
+		assert.Equal(t, 4+26+26+encryptedHeaderLength+4+32+1+4+16, len(message))
+		// ratchetKey はメッセージに含まれない
+		assert.False(t, bytes.Contains(message, aliceSession.ratchetState.selfDH.publicKey[:]))
+	}
+
+	_, err = bob.ReceiveMessage(latest[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(bobSession.ratchetState.mkskipped))
+
+	// 返信で DH ratchet した後でも、スキップしたメッセージキーで復号できる
+	replies, err := bob.messages()
+	assert.Nil(t, err)
+	_, err = alice.ReceiveMessage(replies[0])
+	assert.Nil(t, err)
+	next, err := alice.messages()
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(next[0])
+	assert.Nil(t, err)
+
+	r, err := bob.ReceiveMessage(delayed[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.keyID, r.RemoteSecretKeyMaterials[aliceConnectionID].KeyID)
+	assert.Equal(t, 0, len(bobSession.ratchetState.mkskipped))
+
+	// 同じメッセージは 2 回復号できない
+	_, err = bob.ReceiveMessage(delayed[0])
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+	_, err = bob.ReceiveMessage(latest[0])
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+}
+
+func TestHeaderEncryptionNegotiation(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	for _, tc := range []struct {
+		name             string
+		alice            []Option
+		bob              []Option
+		headerEncryption bool
+	}{
+		{name: "both", alice: []Option{WithHeaderEncryption()}, bob: []Option{WithHeaderEncryption()}, headerEncryption: true},
+		{name: "sender only", alice: []Option{WithHeaderEncryption()}},
+		{name: "receiver only", bob: []Option{WithHeaderEncryption()}},
+		{name: "none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			alice := NewEngine(version, tc.alice...)
+			assert.Nil(t, alice.Init())
+			_, err := alice.Start(aliceConnectionID)
+			assert.Nil(t, err)
+
+			bob := NewEngine(version, tc.bob...)
+			assert.Nil(t, bob.Init())
+			_, err = bob.Start(bobConnectionID)
+			assert.Nil(t, err)
+
+			r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+			assert.Nil(t, err)
+			_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+			assert.Nil(t, err)
+			_, err = bob.ReceiveMessage(r1.Messages[0])
+			assert.Nil(t, err)
+			r2, err := bob.ReceiveMessage(r1.Messages[1])
+			assert.Nil(t, err)
+			_, err = alice.ReceiveMessage(r2.Messages[0])
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.headerEncryption, alice.sessions[bobConnectionID].headerEncryption())
+			assert.Equal(t, tc.headerEncryption, bob.sessions[aliceConnectionID].headerEncryption())
+			packetType := typeCipherMessage
+			if tc.headerEncryption {
+				packetType = typeEncryptedCipherMessage
+			}
+			assert.Equal(t, packetType, r1.Messages[1][0])
+			assert.Equal(t, packetType, r2.Messages[0][0])
+			assert.Equal(t, bob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
+		})
+	}
+}
+
+func TestHeaderEncryptionUnmatchedMessage(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t, WithHeaderEncryption())
+
+	// ヘッダーを暗号化していないメッセージは受け付けない
+	message := testVersionedCipherMessage(t, alice, bobConnectionID, protocolVersion, false)
+	message[0] = typeCipherMessage
+	_, err := bob.ReceiveMessage(message)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+
+	// 暗号化したヘッダーが改ざんされたメッセージで状態を変更しない
+	messages, err := alice.messages()
+	assert.Nil(t, err)
+	tampered := append([]byte(nil), messages[0]...)
+	tampered[4+26+26+headerNonceLength] ^= 1
+	previous := *bob.sessions[aliceConnectionID].ratchetState
+	_, err = bob.ReceiveMessage(tampered)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+	assert.Equal(t, previous.remoteN, bob.sessions[aliceConnectionID].ratchetState.remoteN)
+	assert.Equal(t, previous.remoteHeaderKey, bob.sessions[aliceConnectionID].ratchetState.remoteHeaderKey)
+
+	_, err = bob.ReceiveMessage(messages[0])
+	assert.Nil(t, err)
+}
+
+func TestHeaderEncryptionResetSession(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t, WithHeaderEncryption())
+	oldHeaderKey := bob.sessions[aliceConnectionID].ratchetState.remoteHeaderKey
+
+	r1, err := alice.ResetSession(bobConnectionID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, typeExtendedResetMessage, r1.Messages[0][0])
+
+	r2, err := bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.secretKeyMaterial, r2.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.True(t, bob.sessions[aliceConnectionID].headerEncryption())
+	assert.NotEqual(t, oldHeaderKey, bob.sessions[aliceConnectionID].ratchetState.remoteHeaderKey)
+	assert.Equal(t, typeEncryptedCipherMessage, r2.Messages[0][0])
+
+	_, err = alice.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+	assert.False(t, alice.sessions[bobConnectionID].resetPending)
+}
+
+func TestHeaderEncryptionExportImport(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	passphraseKey := []byte("passphrase-key")
+
+	alice, bob := newTestEnginePair(t, WithHeaderEncryption())
+
+	delayed, err := alice.messages()
+	assert.Nil(t, err)
+	latest, err := alice.messages()
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(latest[0])
+	assert.Nil(t, err)
+
+	blob, err := bob.Export(passphraseKey)
+	assert.Nil(t, err)
+
+	restoredBob := NewEngine(version, WithHeaderEncryption())
+	assert.Nil(t, restoredBob.Import(passphraseKey, blob))
+	assert.True(t, restoredBob.sessions[aliceConnectionID].headerEncryption())
+	assert.Equal(t, bob.remotePreKeyBundles[aliceConnectionID].capabilities, restoredBob.remotePreKeyBundles[aliceConnectionID].capabilities)
+
+	// ヘッダーキーごとに保存したスキップしたメッセージキーも復元されている
+	_, err = restoredBob.ReceiveMessage(delayed[0])
+	assert.Nil(t, err)
+
+	messages, err := restoredBob.messages()
+	assert.Nil(t, err)
+	_, err = alice.ReceiveMessage(messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, restoredBob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
+}
+
+// sender と receiver の ratchetState だけで、DH ratchet をまたいで順番が入れ替わっても復号できる
+func TestRatchetHeaderEncryption(t *testing.T) {
+	sk := make([]byte, 32)
+	_, err := rand.Read(sk)
+	assert.Nil(t, err)
+	bobPreKeyPair, err := generatePreKeyPair(rand.Reader)
+	assert.Nil(t, err)
+	ad := []byte("ad")
+
+	alice, err := senderRatchetInitHE(rand.Reader, sk, preKeyBundle{signedPreKey: bobPreKeyPair.publicKey})
+	assert.Nil(t, err)
+	bob, err := receiverRatchetInitHE(sk, bobPreKeyPair.publicKey, bobPreKeyPair.privateKey)
+	assert.Nil(t, err)
+
+	type message struct {
+		header     []byte
+		ciphertext []byte
+		plaintext  []byte
+	}
+	encrypt := func(rs *ratchetState, plaintext string) message {
+		header, ciphertext, err := rs.ratchetEncrypt([]byte(plaintext), ad)
+		assert.Nil(t, err)
+		assert.Equal(t, encryptedHeaderLength, len(header))
+		return message{header: header, ciphertext: ciphertext, plaintext: []byte(plaintext)}
+	}
+	decrypt := func(rs *ratchetState, m message) {
+		plaintext, err := rs.ratchetDecrypt(m.header, m.ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
+		assert.Nil(t, err)
+		assert.Equal(t, m.plaintext, plaintext)
+	}
+
+	a1 := encrypt(alice, "a1")
+	a2 := encrypt(alice, "a2")
+	decrypt(bob, a2)
+
+	b1 := encrypt(bob, "b1")
+	decrypt(alice, b1)
+
+	a3 := encrypt(alice, "a3")
+	a4 := encrypt(alice, "a4")
+	decrypt(bob, a4)
+	decrypt(bob, a1)
+	decrypt(bob, a3)
+	assert.Equal(t, 0, len(bob.mkskipped))
+
+	// 同じヘッダーでも nonce が異なるヘッダーキーでは別の値になる
+	assert.NotEqual(t, a1.header[:headerNonceLength], b1.header[:headerNonceLength])
+
+	_, err = bob.ratchetDecrypt(a3.header, a3.ciphertext, ad, defaultMaxSkip, time.Now(), rand.Reader)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+}
@@ -0,0 +1,122 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9180.html の HPKE
+// MLS の暗号スイート MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519 で利用する
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM の Base モードのみに対応する
+// 1 回の暗号化ごとに鍵を作り直すので、シーケンス番号は常に 0 になる
+
+const hpkeModeBase = 0x00
+
+var (
+	// "KEM" || I2OSP(kem_id, 2)
+	hpkeKEMSuiteID = []byte{'K', 'E', 'M', 0x00, 0x20}
+	// "HPKE" || I2OSP(kem_id, 2) || I2OSP(kdf_id, 2) || I2OSP(aead_id, 2)
+	hpkeSuiteID = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+// LabeledExtract(salt, label, ikm) = Extract(salt, "HPKE-v1" || suite_id || label || ikm)
+func hpkeLabeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := new(bytes.Buffer)
+	labeledIKM.WriteString("HPKE-v1")
+	labeledIKM.Write(suiteID)
+	labeledIKM.WriteString(label)
+	labeledIKM.Write(ikm)
+	return hkdf.Extract(sha256.New, labeledIKM.Bytes(), salt)
+}
+
+// LabeledExpand(prk, label, info, L) = Expand(prk, I2OSP(L, 2) || "HPKE-v1" || suite_id || label || info, L)
+// 長さは 255 * 32 バイト以下なので失敗しない
+func hpkeLabeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := new(bytes.Buffer)
+	binary.Write(labeledInfo, binary.BigEndian, uint16(length))
+	labeledInfo.WriteString("HPKE-v1")
+	labeledInfo.Write(suiteID)
+	labeledInfo.WriteString(label)
+	labeledInfo.Write(info)
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo.Bytes()), out)
+	return out
+}
+
+// ikm から鍵ペアを導出する
+// sk = LabeledExpand(LabeledExtract("", "dkp_prk", ikm), "sk", "", 32)
+func hpkeDeriveKeyPair(ikm []byte) (*x25519KeyPair, error) {
+	prk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "dkp_prk", ikm)
+	sk := hpkeLabeledExpand(hpkeKEMSuiteID, prk, "sk", nil, 32)
+	return generateX25519KeyPair(bytes.NewReader(sk))
+}
+
+// DH の結果がすべて 0 の場合は相手の公開鍵が不正
+func hpkeDH(privateKey x25519PrivateKey, publicKey x25519PublicKey) ([]byte, error) {
+	sharedSecret := dh(privateKey, publicKey)
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(sharedSecret[:], zero[:]) == 1 {
+		return nil, ErrInvalidPublicKey
+	}
+	return sharedSecret[:], nil
+}
+
+// shared_secret = LabeledExpand(LabeledExtract("", "eae_prk", dh), "shared_secret", enc || pkR, 32)
+func hpkeExtractAndExpand(dh []byte, enc x25519PublicKey, publicKey x25519PublicKey) []byte {
+	prk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	kemContext := append(append([]byte{}, enc[:]...), publicKey[:]...)
+	return hpkeLabeledExpand(hpkeKEMSuiteID, prk, "shared_secret", kemContext, 32)
+}
+
+// Base モードの鍵と nonce を導出する
+func hpkeKeySchedule(sharedSecret []byte, info []byte) ([]byte, []byte) {
+	keyScheduleContext := []byte{hpkeModeBase}
+	keyScheduleContext = append(keyScheduleContext, hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)...)
+	keyScheduleContext = append(keyScheduleContext, hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)...)
+
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, aeadAES128GCM.keyLength())
+	nonce := hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, aeadAES128GCM.nonceLength())
+	return key, nonce
+}
+
+// SealBase(pkR, info, aad, pt) で暗号化して、カプセル化した enc と暗号文を返す
+func hpkeSeal(random io.Reader, publicKey x25519PublicKey, info []byte, aad []byte, plaintext []byte) (x25519PublicKey, []byte, error) {
+	ephemeralKeyPair, err := generateX25519KeyPair(random)
+	if err != nil {
+		return x25519PublicKey{}, nil, ErrKeyPairGenerate
+	}
+	dh, err := hpkeDH(ephemeralKeyPair.privateKey, publicKey)
+	if err != nil {
+		return x25519PublicKey{}, nil, err
+	}
+
+	key, nonce := hpkeKeySchedule(hpkeExtractAndExpand(dh, ephemeralKeyPair.publicKey, publicKey), info)
+	ciphertext, err := aeadAES128GCM.encrypt(key, nonce, plaintext, aad)
+	if err != nil {
+		return x25519PublicKey{}, nil, err
+	}
+
+	return ephemeralKeyPair.publicKey, ciphertext, nil
+}
+
+// OpenBase(enc, skR, info, aad, ct)
+func hpkeOpen(keyPair x25519KeyPair, enc x25519PublicKey, info []byte, aad []byte, ciphertext []byte) ([]byte, error) {
+	dh, err := hpkeDH(keyPair.privateKey, enc)
+	if err != nil {
+		return nil, ErrDecryptMessage
+	}
+
+	key, nonce := hpkeKeySchedule(hpkeExtractAndExpand(dh, enc, keyPair.publicKey), info)
+	plaintext, err := aeadAES128GCM.decrypt(key, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrDecryptMessage
+	}
+
+	return plaintext, nil
+}
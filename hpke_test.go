@@ -0,0 +1,54 @@
+//go:build go1.26
+
+package e2ee
+
+import (
+	"crypto/ecdh"
+	"crypto/hpke"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crypto/hpke が Go 1.26 以降にしかないため、相互に暗号化と復号ができることを確認する
+func TestHPKE(t *testing.T) {
+	kem := hpke.DHKEM(ecdh.X25519())
+	info := []byte("info")
+	aad := []byte("aad")
+	plaintext := []byte("plaintext")
+
+	// DeriveKeyPair が同じ鍵ペアになる
+	ikm := []byte("input keying material for hpke derive key pair")
+	keyPair, err := hpkeDeriveKeyPair(ikm)
+	assert.Nil(t, err)
+	privateKey, err := kem.DeriveKeyPair(ikm)
+	assert.Nil(t, err)
+	assert.Equal(t, privateKey.PublicKey().Bytes(), keyPair.publicKey[:])
+
+	// こちらで暗号化して crypto/hpke で復号する
+	enc, ciphertext, err := hpkeSeal(newTestRandom("hpke"), keyPair.publicKey, info, aad, plaintext)
+	assert.Nil(t, err)
+	recipient, err := hpke.NewRecipient(enc[:], privateKey, hpke.HKDFSHA256(), hpke.AES128GCM(), info)
+	assert.Nil(t, err)
+	opened, err := recipient.Open(aad, ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintext, opened)
+
+	// crypto/hpke で暗号化してこちらで復号する
+	encapsulated, sender, err := hpke.NewSender(privateKey.PublicKey(), hpke.HKDFSHA256(), hpke.AES128GCM(), info)
+	assert.Nil(t, err)
+	ciphertext, err = sender.Seal(aad, plaintext)
+	assert.Nil(t, err)
+	copy(enc[:], encapsulated)
+	opened, err = hpkeOpen(*keyPair, enc, info, aad, ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintext, opened)
+
+	// info が異なる場合は復号できない
+	_, err = hpkeOpen(*keyPair, enc, []byte("other"), aad, ciphertext)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+
+	// すべて 0 の公開鍵には暗号化できない
+	_, _, err = hpkeSeal(newTestRandom("hpke"), x25519PublicKey{}, info, aad, plaintext)
+	assert.ErrorIs(t, err, ErrInvalidPublicKey)
+}
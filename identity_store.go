@@ -0,0 +1,181 @@
+package e2ee
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Trust On First Use
+//
+// ConnectionID は接続するたびに変わるため、Sora のメタデータなどから得たアプリケーションの変わらない識別子ごとに
+// 最初に受け取った identityKey を IdentityStore に保存し、次回以降に異なる identityKey を受け取ったら
+// IdentityKeyChangedError を返す
+//
+// SetRemoteIdentifier で ConnectionID と識別子を結びつけた相手のみ確認する
+
+// IdentityStore は識別子ごとの相手の identityKey を保存する
+// ブラウザでは IndexedDB、ネイティブのクライアントではファイルなどで永続化する
+// Engine のロック中に呼び出すため、実装から Engine のメソッドを呼び出してはいけない
+type IdentityStore interface {
+	// 保存されていない場合は nil, nil を返す
+	LoadIdentity(identifier string) (*Identity, error)
+	SaveIdentity(identifier string, identity Identity) error
+}
+
+// Identity は IdentityStore に保存する相手の identityKey
+type Identity struct {
+	IdentityKey []byte
+	FirstSeenAt time.Time
+	// セーフティナンバーなどで本人であることを確認済み
+	Verified bool
+}
+
+// MemoryIdentityStore はメモリに保存する IdentityStore
+// WithIdentityStore を指定しない場合に利用する、Engine を破棄すると忘れる
+type MemoryIdentityStore struct {
+	mu         sync.Mutex
+	identities map[string]Identity
+}
+
+// NewMemoryIdentityStore は空の MemoryIdentityStore を生成する
+func NewMemoryIdentityStore() *MemoryIdentityStore {
+	return &MemoryIdentityStore{
+		identities: make(map[string]Identity),
+	}
+}
+
+// LoadIdentity は保存した Identity を返す
+func (s *MemoryIdentityStore) LoadIdentity(identifier string) (*Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identity, ok := s.identities[identifier]
+	if !ok {
+		return nil, nil
+	}
+	return &identity, nil
+}
+
+// SaveIdentity は Identity を保存する
+func (s *MemoryIdentityStore) SaveIdentity(identifier string, identity Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.identities[identifier] = identity
+	return nil
+}
+
+// IdentityKeyChangedError は保存した identityKey と異なる identityKey を受け取った時のエラー
+// errors.As で取り出し、Err は errors.Is で ErrIdentityKeyChanged と判定できる
+// 新しい identityKey を受け入れる場合は TrustIdentity で保存し直してから、もう一度呼び出す
+type IdentityKeyChangedError struct {
+	Identifier         string
+	RemoteConnectionID string
+	// 保存していた Identity
+	Previous    Identity
+	IdentityKey []byte
+}
+
+func (e *IdentityKeyChangedError) Error() string {
+	return fmt.Sprintf("%s: identifier=%s remoteConnectionID=%s verified=%t", ErrIdentityKeyChanged, e.Identifier, e.RemoteConnectionID, e.Previous.Verified)
+}
+
+func (e *IdentityKeyChangedError) Unwrap() error {
+	return ErrIdentityKeyChanged
+}
+
+// SetRemoteIdentifier は相手の ConnectionID とアプリケーションの変わらない識別子を結びつける
+// 相手の preKeyBundle を受け取る前に呼ぶこと
+// 既に preKeyBundle を受け取っている場合はその identityKey を確認し、異なる場合は結びつけずに IdentityKeyChangedError を返す
+// Init か Import をする前は ErrUninitialized を返す
+func (e *Engine) SetRemoteIdentifier(remoteConnectionID string, identifier string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.remoteIdentifiers == nil {
+		return ErrUninitialized
+	}
+
+	if len(remoteConnectionID) != connectionIDLength {
+		return ErrUnexpectedRemoteConnectionID
+	}
+
+	if preKeyBundle, ok := e.remotePreKeyBundles[remoteConnectionID]; ok {
+		if err := e.checkIdentifierIdentity(identifier, remoteConnectionID, preKeyBundle.identityKey); err != nil {
+			return err
+		}
+	}
+	e.remoteIdentifiers[remoteConnectionID] = identifier
+	return nil
+}
+
+// RemoteIdentity は識別子に保存されている Identity を返す、保存されていない場合は nil を返す
+func (e *Engine) RemoteIdentity(identifier string) (*Identity, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.identityStore.LoadIdentity(identifier)
+}
+
+// TrustIdentity は識別子の identityKey を置き換える、確認済みの印は外れる
+// IdentityKeyChangedError を受け取った後に、新しい identityKey を受け入れる場合に利用する
+func (e *Engine) TrustIdentity(identifier string, identityKey []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.identityStore.SaveIdentity(identifier, Identity{
+		IdentityKey: identityKey,
+		FirstSeenAt: e.now(),
+	})
+}
+
+// SetIdentityVerified は識別子の identityKey に確認済みの印を付けるか外す
+func (e *Engine) SetIdentityVerified(identifier string, verified bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	identity, err := e.identityStore.LoadIdentity(identifier)
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return ErrMissingIdentity
+	}
+	identity.Verified = verified
+	return e.identityStore.SaveIdentity(identifier, *identity)
+}
+
+// 識別子が結びついている相手の場合のみ identityKey を確認する
+func (e *Engine) checkIdentity(remoteConnectionID string, identityKey []byte) error {
+	identifier, ok := e.remoteIdentifiers[remoteConnectionID]
+	if !ok {
+		return nil
+	}
+	return e.checkIdentifierIdentity(identifier, remoteConnectionID, identityKey)
+}
+
+// 識別子に保存されている identityKey と比べる、初めての識別子の場合は identityKey を保存する
+func (e *Engine) checkIdentifierIdentity(identifier string, remoteConnectionID string, identityKey []byte) error {
+	identity, err := e.identityStore.LoadIdentity(identifier)
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return e.identityStore.SaveIdentity(identifier, Identity{
+			IdentityKey: identityKey,
+			FirstSeenAt: e.now(),
+		})
+	}
+
+	if !bytes.Equal(identity.IdentityKey, identityKey) {
+		return &IdentityKeyChangedError{
+			Identifier:         identifier,
+			RemoteConnectionID: remoteConnectionID,
+			Previous:           *identity,
+			IdentityKey:        identityKey,
+		}
+	}
+	return nil
+}
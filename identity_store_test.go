@@ -0,0 +1,135 @@
+package e2ee
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityStore(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+	newBobConnectionID := "BOB2----------------------"
+
+	store := NewMemoryIdentityStore()
+	alice := NewEngine(version, WithIdentityStore(store))
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	// 最初に受け取った identityKey を保存する
+	assert.Nil(t, alice.SetRemoteIdentifier(bobConnectionID, "bob"))
+	_, err = alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	identity, err := alice.RemoteIdentity("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, bob.identityKeyPair.publicKey, identity.IdentityKey)
+	assert.False(t, identity.Verified)
+
+	assert.Nil(t, alice.SetIdentityVerified("bob", true))
+	identity, err = alice.RemoteIdentity("bob")
+	assert.Nil(t, err)
+	assert.True(t, identity.Verified)
+
+	// 再接続して ConnectionID が変わっても同じ identityKey なら受け付ける
+	_, err = alice.StopSession(bobConnectionID)
+	assert.Nil(t, err)
+	assert.Nil(t, alice.SetRemoteIdentifier(newBobConnectionID, "bob"))
+	_, err = alice.AddPreKeyBundle(newBobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	// 同じ識別子で別の identityKey を受け取った
+	mallory := NewEngine(version)
+	assert.Nil(t, mallory.Init())
+	assert.Nil(t, alice.SetRemoteIdentifier(bobConnectionID, "bob"))
+	_, err = alice.StartSession(bobConnectionID, mallory.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrIdentityKeyChanged)
+	var identityKeyChangedError *IdentityKeyChangedError
+	assert.True(t, errors.As(err, &identityKeyChangedError))
+	assert.Equal(t, "bob", identityKeyChangedError.Identifier)
+	assert.Equal(t, bobConnectionID, identityKeyChangedError.RemoteConnectionID)
+	assert.True(t, identityKeyChangedError.Previous.Verified)
+	assert.Equal(t, mallory.identityKeyPair.publicKey, identityKeyChangedError.IdentityKey)
+	assert.Equal(t, "IdentityKeyChangedError", ErrorCode(err))
+	_, ok := alice.remotePreKeyBundles[bobConnectionID]
+	assert.False(t, ok)
+	_, ok = alice.sessions[bobConnectionID]
+	assert.False(t, ok)
+
+	// 受け入れる場合は保存し直してからやり直す
+	assert.Nil(t, alice.TrustIdentity("bob", identityKeyChangedError.IdentityKey))
+	_, err = alice.StartSession(bobConnectionID, mallory.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	identity, err = store.LoadIdentity("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, mallory.identityKeyPair.publicKey, identity.IdentityKey)
+	assert.False(t, identity.Verified)
+
+	assert.ErrorIs(t, alice.SetIdentityVerified("carol", true), ErrMissingIdentity)
+}
+
+func TestIdentityStoreSetRemoteIdentifierAfterPreKeyBundle(t *testing.T) {
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+
+	// 識別子を結びつけていない相手は確認しない
+	identity, err := alice.RemoteIdentity("bob")
+	assert.Nil(t, err)
+	assert.Nil(t, identity)
+
+	// 既に受け取っている preKeyBundle の identityKey を保存する
+	assert.Nil(t, alice.SetRemoteIdentifier(bobConnectionID, "bob"))
+	identity, err = alice.RemoteIdentity("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, bob.identityKeyPair.publicKey, identity.IdentityKey)
+
+	// 保存した identityKey と異なる
+	assert.Nil(t, alice.TrustIdentity("bob", make([]byte, 32)))
+	err = alice.SetRemoteIdentifier(bobConnectionID, "bob")
+	assert.ErrorIs(t, err, ErrIdentityKeyChanged)
+
+	// 確認に失敗した識別子は結びつけない
+	assert.Nil(t, alice.TrustIdentity("mallory", make([]byte, 32)))
+	err = alice.SetRemoteIdentifier(bobConnectionID, "mallory")
+	assert.ErrorIs(t, err, ErrIdentityKeyChanged)
+	assert.Equal(t, "bob", alice.remoteIdentifiers[bobConnectionID])
+}
+
+func TestIdentityStoreSetRemoteIdentifierUninitialized(t *testing.T) {
+	e := NewEngine(version)
+	err := e.SetRemoteIdentifier("BOB-----------------------", "bob")
+	assert.ErrorIs(t, err, ErrUninitialized)
+}
+
+func TestIdentityStoreExportImport(t *testing.T) {
+	bobConnectionID := "BOB-----------------------"
+
+	passphraseKey := []byte("passphrase-key")
+
+	store := NewMemoryIdentityStore()
+	alice, _ := newTestEnginePair(t, WithIdentityStore(store))
+	assert.Nil(t, alice.SetRemoteIdentifier(bobConnectionID, "bob"))
+
+	blob, err := alice.Export(passphraseKey)
+	assert.Nil(t, err)
+
+	restoredAlice := NewEngine(version, WithIdentityStore(store))
+	assert.Nil(t, restoredAlice.Import(passphraseKey, blob))
+	assert.Equal(t, "bob", restoredAlice.remoteIdentifiers[bobConnectionID])
+
+	// 復元した後も IdentityStore に保存した identityKey で確認する
+	_, err = restoredAlice.StopSession(bobConnectionID)
+	assert.Nil(t, err)
+	assert.Nil(t, restoredAlice.SetRemoteIdentifier(bobConnectionID, "bob"))
+	mallory := NewEngine(version)
+	assert.Nil(t, mallory.Init())
+	_, err = restoredAlice.AddPreKeyBundle(bobConnectionID, mallory.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrIdentityKeyChanged)
+}
@@ -0,0 +1,215 @@
+package e2ee
+
+import (
+	"time"
+)
+
+// QueueStartSession と QueueStopSession でキューに入れた入退室
+// StartSession と異なり oneTimePreKey は preKeyBundle に保持しないので、コミットするまでここに保持する
+type membershipChange struct {
+	connectionID  string
+	stop          bool
+	oneTimePreKey *oneTimePreKey
+}
+
+// QueueStartSession は相手とのセッションの開始をキューに入れる
+// キューに入れるだけで、相手とのセッションの開始と SK の更新は CommitMembershipChanges で行う
+// 他の参加者も QueueStartSession と QueueStopSession を利用する必要がある
+func (e *Engine) QueueStartSession(remoteConnectionID string, remotePreKeyBundle PreKeyBundle) (*QueueSessionResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(remoteConnectionID) != connectionIDLength {
+		return nil, ErrUnexpectedRemoteConnectionID
+	}
+
+	if e.groupMode {
+		if err := e.groupQueueStartSession(remoteConnectionID, remotePreKeyBundle); err != nil {
+			return nil, err
+		}
+		return e.queueSessionResult(), nil
+	}
+
+	if _, ok := e.sessions[remoteConnectionID]; ok {
+		return nil, ErrSessionAlreadyExists
+	}
+
+	preKeyBundle, err := newPreKeyBundle(remotePreKeyBundle)
+	if err != nil {
+		return nil, err
+	}
+	// キューに入っている場合も preKeyBundle があるのでエラーになる
+	if err := e.addPreKeyBundle(remoteConnectionID, remotePreKeyBundle); err != nil {
+		return nil, err
+	}
+
+	e.membershipChanges = append(e.membershipChanges, membershipChange{
+		connectionID:  remoteConnectionID,
+		oneTimePreKey: preKeyBundle.oneTimePreKey,
+	})
+	return e.queueSessionResult(), nil
+}
+
+// QueueStopSession は相手とのセッションの破棄をキューに入れる
+// まだコミットしていない QueueStartSession の相手の場合は取り消すだけ
+func (e *Engine) QueueStopSession(remoteConnectionID string) (*QueueSessionResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(remoteConnectionID) != connectionIDLength {
+		return nil, ErrUnexpectedRemoteConnectionID
+	}
+
+	if e.groupMode {
+		if err := e.groupQueueStopSession(remoteConnectionID); err != nil {
+			return nil, err
+		}
+		return e.queueSessionResult(), nil
+	}
+
+	for i, c := range e.membershipChanges {
+		if c.connectionID != remoteConnectionID {
+			continue
+		}
+		if c.stop {
+			// すでにキューに入っている
+			return e.queueSessionResult(), nil
+		}
+		// 相手とはまだセッションを開始していないので、キューから取り除くだけでよい
+		e.membershipChanges = append(e.membershipChanges[:i], e.membershipChanges[i+1:]...)
+		delete(e.remotePreKeyBundles, remoteConnectionID)
+		delete(e.remoteIdentifiers, remoteConnectionID)
+		if len(e.membershipChanges) == 0 {
+			e.membershipChangeQueuedAt = time.Time{}
+			return &QueueSessionResult{}, nil
+		}
+		return e.queueSessionResult(), nil
+	}
+
+	if _, ok := e.sessions[remoteConnectionID]; !ok {
+		return nil, ErrMissingSession
+	}
+	e.membershipChanges = append(e.membershipChanges, membershipChange{
+		connectionID: remoteConnectionID,
+		stop:         true,
+	})
+	return e.queueSessionResult(), nil
+}
+
+func (e *Engine) queueSessionResult() *QueueSessionResult {
+	return &QueueSessionResult{
+		Deadline: e.membershipChangeDeadline(e.now()),
+	}
+}
+
+// 最後にキューに入れてから debounce の期間が経つか、最初にキューに入れてから最大の待ち時間が経った時刻
+func (e *Engine) membershipChangeDeadline(now time.Time) time.Time {
+	if e.membershipChangeQueuedAt.IsZero() {
+		e.membershipChangeQueuedAt = now
+	}
+	deadline := now.Add(e.membershipChangeDebounce)
+	if max := e.membershipChangeQueuedAt.Add(e.maxMembershipChangeDelay); max.Before(deadline) {
+		deadline = max
+	}
+	return deadline
+}
+
+// CommitMembershipChanges はキューに入れた入退室をまとめて、自分の SK を 1 回だけ更新する
+// 入室した参加者とはここでセッションを開始して、更新した SK を参加者全員に送る
+// 他の参加者はそれぞれのタイミングでコミットするので、相手の SK は予測せずに相手から送られてくる SK を利用する
+// 退室が含まれる場合は StopSession と同様に、退室した参加者が導出できない新しい SK を生成する
+// 戻り値の Messages はそれぞれの宛先に送る必要がある、キューが空の場合は何もしない
+func (e *Engine) CommitMembershipChanges() (*CommitMembershipChangesResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.groupMode {
+		result, err := e.groupCommitMembershipChanges()
+		if err != nil {
+			return nil, err
+		}
+		e.membershipChangeQueuedAt = time.Time{}
+		return result, nil
+	}
+
+	// 失敗した場合にキューとセッションを変更しないように、入室する参加者のセッションを先に生成する
+	joinerSessions := make(map[string]*session)
+	var messages [][]byte
+	stopped := make(map[string]bool)
+	for _, c := range e.membershipChanges {
+		if c.stop {
+			// キューに入れた後に StopSession した場合は何もしない
+			if _, ok := e.sessions[c.connectionID]; ok {
+				stopped[c.connectionID] = true
+			}
+			continue
+		}
+
+		preKeyBundle, ok := e.remotePreKeyBundles[c.connectionID]
+		if !ok {
+			return nil, ErrMissingRemotePreKeyBundle
+		}
+		preKeyBundle.oneTimePreKey = c.oneTimePreKey
+		session, err := e.senderSession(c.connectionID, preKeyBundle)
+		if err != nil {
+			return nil, err
+		}
+		preKeyMessage, err := session.preKeyMessage()
+		if err != nil {
+			return nil, err
+		}
+		joinerSessions[c.connectionID] = session
+		messages = append(messages, preKeyMessage)
+	}
+
+	// 取り消されたり StopSession 済みだったりで、何も変わらない場合は SK を更新しない
+	rekey := len(stopped) > 0 || len(joinerSessions) > 0
+	keyID, secretKeyMaterial := e.keyID, e.secretKeyMaterial
+	if rekey {
+		// 残りの参加者全員に送れることを先に確認する、入室した参加者のセッションは新しいので確認しない
+		if err := e.checkSendLimit(stopped); err != nil {
+			return nil, err
+		}
+		// 入室だけの場合は ratchet でよい、KeyID が一周する場合は新しく生成される
+		var err error
+		keyID, secretKeyMaterial, err = e.nextSecretKeyMaterial(len(stopped) > 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// ここから先は上限を確認済みなので失敗しない、キューを空にしてセッションを入れ替える
+	for _, c := range e.membershipChanges {
+		if c.stop {
+			if !stopped[c.connectionID] {
+				continue
+			}
+			delete(e.sessions, c.connectionID)
+			delete(e.remotePreKeyBundles, c.connectionID)
+			delete(e.remoteIdentifiers, c.connectionID)
+			continue
+		}
+		e.sessions[c.connectionID] = joinerSessions[c.connectionID]
+	}
+	e.membershipChanges = nil
+	e.membershipChangeQueuedAt = time.Time{}
+	e.keyID = keyID
+	e.secretKeyMaterial = secretKeyMaterial
+
+	if rekey {
+		// 入室した参加者への preKeyMessage の後に、参加者全員に SK を送る
+		sessionMessages, err := e.messages()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, sessionMessages...)
+	}
+
+	return &CommitMembershipChangesResult{
+		SelfConnectionID:         e.connectionID,
+		SelfKeyID:                e.keyID,
+		SelfSecretKeyMaterial:    e.secretKeyMaterial,
+		RemoteSecretKeyMaterials: make(map[string]RemoteSecretKeyMaterial),
+		Messages:                 messages,
+	}, nil
+}
@@ -0,0 +1,276 @@
+package e2ee
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitMembershipChanges(t *testing.T) {
+	alice := "ALICE---------------------"
+	bob := "BOB-----------------------"
+	r := newTestRoom(t)
+	r.join(alice)
+	r.join(bob)
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// キューに入れるだけでは自分の SK も相手の SK も更新しない
+	keyID := r.engines[alice].keyID
+	remoteKeyID := r.engines[alice].sessions[bob].remoteKeyID
+	for i := 0; i < 5; i++ {
+		r.queueJoin(testGroupConnectionID(i))
+		r.deliver()
+	}
+	assert.Equal(t, keyID, r.engines[alice].keyID)
+	assert.Equal(t, remoteKeyID, r.engines[alice].sessions[bob].remoteKeyID)
+
+	// コミットごとに KeyID は 1 回だけ進む
+	result, err := r.engines[alice].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, keyID+1, result.SelfKeyID)
+	assert.Empty(t, result.RemoteSecretKeyMaterials)
+	// 入室した参加者への preKeyMessage と、参加者全員への cipherMessage
+	assert.Len(t, result.Messages, 5+len(r.engines)-1)
+	r.send(result.Messages)
+	r.deliver()
+
+	// 他の参加者は後からコミットしても、送られてくる SK で一致する
+	result, err = r.engines[bob].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, remoteKeyID+1, result.SelfKeyID)
+	r.send(result.Messages)
+	r.commit()
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// 退室は新しい SK を 1 回だけ生成して残りの参加者全員に送る
+	r.queueLeave(testGroupConnectionID(1))
+	r.queueLeave(testGroupConnectionID(3))
+	keyID = r.engines[alice].keyID
+	secretKeyMaterial, err := ratchetSecretKeyMaterial(r.engines[alice].secretKeyMaterial)
+	assert.Nil(t, err)
+	result, err = r.engines[alice].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, keyID+1, result.SelfKeyID)
+	assert.NotEqual(t, secretKeyMaterial, result.SelfSecretKeyMaterial)
+	assert.Len(t, result.Messages, len(r.engines)-1)
+	r.send(result.Messages)
+	r.commit()
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// 入室と退室が混ざっている場合も、退室した参加者の知らない SK を 1 回だけ生成する
+	r.queueLeave(testGroupConnectionID(0))
+	r.queueJoin(testGroupConnectionID(5))
+	keyID = r.engines[alice].keyID
+	result, err = r.engines[alice].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, keyID+1, result.SelfKeyID)
+	// 入室した参加者への preKeyMessage と、残りの参加者全員への cipherMessage
+	assert.Len(t, result.Messages, 1+len(r.engines)-1)
+	r.send(result.Messages)
+	r.commit()
+	r.deliver()
+	r.assertKeyAgreement()
+
+	// キューが空の場合は何もしない
+	keyID = r.engines[alice].keyID
+	result, err = r.engines[alice].CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, keyID, result.SelfKeyID)
+	assert.Empty(t, result.Messages)
+}
+
+func TestQueueStopSessionCancelsStartSession(t *testing.T) {
+	alice, bob := newTestEnginePair(t)
+	carol := NewEngine(version)
+	assert.Nil(t, carol.Init())
+
+	carolConnectionID := "CAROL---------------------"
+	_, err := alice.QueueStartSession(carolConnectionID, carol.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = alice.QueueStartSession(carolConnectionID, carol.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrRemotePreKeyBundleExists)
+
+	// コミットする前に退室した場合は取り消すだけ
+	queueResult, err := alice.QueueStopSession(carolConnectionID)
+	assert.Nil(t, err)
+	assert.True(t, queueResult.Deadline.IsZero())
+	_, ok := alice.remotePreKeyBundles[carolConnectionID]
+	assert.False(t, ok)
+
+	keyID := alice.keyID
+	result, err := alice.CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, keyID, result.SelfKeyID)
+	assert.Empty(t, result.Messages)
+
+	_, err = alice.QueueStopSession(carolConnectionID)
+	assert.ErrorIs(t, err, ErrMissingSession)
+
+	// キューに入れた後に StopSession した場合はコミットで何もしない
+	_, err = alice.QueueStopSession(bob.connectionID)
+	assert.Nil(t, err)
+	_, err = alice.StopSession(bob.connectionID)
+	assert.Nil(t, err)
+	keyID = alice.keyID
+	result, err = alice.CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Equal(t, keyID, result.SelfKeyID)
+	assert.Empty(t, result.Messages)
+}
+
+// コミットに失敗した場合はキューとセッションを変更しないので、やり直せる
+func TestCommitMembershipChangesFailure(t *testing.T) {
+	alice := "ALICE---------------------"
+	bob := "BOB-----------------------"
+	carol := "CAROL---------------------"
+	r := newTestRoom(t)
+	r.join(alice)
+	r.join(bob)
+	r.deliver()
+
+	r.queueLeave(bob)
+	r.queueJoin(carol)
+
+	e := r.engines[alice]
+	keyID := e.keyID
+	secretKeyMaterial := e.secretKeyMaterial
+	signature := e.remotePreKeyBundles[carol].preKeySignature
+	e.remotePreKeyBundles[carol].preKeySignature[0] ^= 0xff
+
+	_, err := e.CommitMembershipChanges()
+	assert.ErrorIs(t, err, ErrVerifyFailed)
+	assert.Len(t, e.membershipChanges, 2)
+	assert.False(t, e.membershipChangeQueuedAt.IsZero())
+	assert.Contains(t, e.sessions, bob)
+	assert.NotContains(t, e.sessions, carol)
+	assert.Equal(t, keyID, e.keyID)
+	assert.Equal(t, secretKeyMaterial, e.secretKeyMaterial)
+
+	signature[0] ^= 0xff
+	result, err := e.CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Empty(t, e.membershipChanges)
+	assert.NotContains(t, e.sessions, bob)
+	assert.Equal(t, keyID+1, result.SelfKeyID)
+	r.send(result.Messages)
+	r.deliver()
+	r.assertKeyAgreement()
+}
+
+func TestMembershipChangeDeadline(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice := NewEngine(version, WithClock(func() time.Time { return now }), WithMembershipChangeDebounce(time.Second), WithMaxMembershipChangeDelay(5*time.Second))
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start("ALICE---------------------")
+	assert.Nil(t, err)
+
+	queueStartSession := func(i int) time.Time {
+		remote := NewEngine(version)
+		assert.Nil(t, remote.Init())
+		result, err := alice.QueueStartSession(testGroupConnectionID(i), remote.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		return result.Deadline
+	}
+
+	start := now
+	assert.Equal(t, start.Add(time.Second), queueStartSession(0))
+	// 入退室が続く間は後ろにずれる
+	now = start.Add(3 * time.Second)
+	assert.Equal(t, start.Add(4*time.Second), queueStartSession(1))
+	// 最初にキューに入れてから最大の期間を超えない
+	now = start.Add(4500 * time.Millisecond)
+	assert.Equal(t, start.Add(5*time.Second), queueStartSession(2))
+
+	// コミットした後は新しく数える
+	_, err = alice.CommitMembershipChanges()
+	assert.Nil(t, err)
+	now = start.Add(10 * time.Second)
+	assert.Equal(t, now.Add(time.Second), queueStartSession(3))
+}
+
+func TestCommitMembershipChangesExportImport(t *testing.T) {
+	alice, bob := newTestEnginePair(t)
+	carol := NewEngine(version)
+	assert.Nil(t, carol.Init())
+	carolConnectionID := "CAROL---------------------"
+	_, err := carol.Start(carolConnectionID)
+	assert.Nil(t, err)
+	_, err = carol.AddPreKeyBundle(alice.connectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	// oneTimePreKey もコミットするまで保持する
+	p := carol.SelfPreKeyBundle()
+	oneTimePreKey := carol.OneTimePreKeys()[0]
+	p.OneTimePreKey = &oneTimePreKey
+	_, err = alice.QueueStartSession(carolConnectionID, p)
+	assert.Nil(t, err)
+	_, err = alice.QueueStopSession(bob.connectionID)
+	assert.Nil(t, err)
+
+	passphraseKey := []byte("passphrase-key")
+	blob, err := alice.Export(passphraseKey)
+	assert.Nil(t, err)
+	restored := NewEngine(version)
+	assert.Nil(t, restored.Import(passphraseKey, blob))
+	assert.Equal(t, alice.membershipChanges, restored.membershipChanges)
+	assert.Equal(t, alice.membershipChangeQueuedAt.UTC(), restored.membershipChangeQueuedAt.UTC())
+
+	result, err := restored.CommitMembershipChanges()
+	assert.Nil(t, err)
+	assert.Len(t, result.Messages, 2)
+	for _, message := range result.Messages {
+		_, err := carol.ReceiveMessage(message)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, restored.secretKeyMaterial, carol.sessions[alice.connectionID].remoteSecretKeyMaterial)
+	_, ok := carol.oneTimePreKeyPairs[oneTimePreKey.ID]
+	assert.False(t, ok)
+}
+
+func TestGroupModeCommitMembershipChanges(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode())
+	for i := 0; i < 3; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+	}
+	epoch := r.engines[testGroupConnectionID(0)].group.epoch
+
+	// 全員がキューに入れて、コミットする参加者だけがまとめてコミットする
+	for i := 3; i < 8; i++ {
+		connectionID := testGroupConnectionID(i)
+		e := NewEngine(version, WithGroupMode())
+		assert.Nil(t, e.Init())
+		_, err := e.Start(connectionID)
+		assert.Nil(t, err)
+		r.remotes[connectionID] = make(map[string]RemoteSecretKeyMaterial)
+		for remoteConnectionID, remote := range r.engines {
+			if remote.group.epoch == epoch {
+				_, err := remote.QueueStartSession(connectionID, e.SelfPreKeyBundle())
+				assert.Nil(t, err)
+			}
+			_, err = e.AddPreKeyBundle(remoteConnectionID, remote.SelfPreKeyBundle())
+			assert.Nil(t, err)
+		}
+		r.engines[connectionID] = e
+	}
+
+	r.messageCount = 0
+	for connectionID, e := range r.engines {
+		if e.group.epoch != epoch {
+			continue
+		}
+		result, err := e.CommitMembershipChanges()
+		assert.Nil(t, err)
+		r.setRemotes(connectionID, result.RemoteSecretKeyMaterials)
+		r.send(result.Messages)
+	}
+	// コミットと 5 人分の welcome
+	assert.Equal(t, 1+5, r.messageCount)
+	r.deliver()
+	r.assertKeyAgreement()
+	assert.Equal(t, epoch+1, r.engines[testGroupConnectionID(0)].group.epoch)
+}
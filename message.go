@@ -3,12 +3,15 @@ package e2ee
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 )
 
+// 各メッセージのエンコード結果は testdata/vectors/messages.json と handshake.json にある
+// 他の実装はこのテストベクターとバイト単位で一致させること
+
 type messageHeader struct {
 	packetType uint8
-	reserved   uint8
+	// 古いクライアントは 0 を送ってくる
+	protocolVersion uint8
 	// 0 もありえる
 	ciphertextLength uint16
 }
@@ -16,7 +19,7 @@ type messageHeader struct {
 func decodeMessageHeader(data []byte) (*messageHeader, *bytes.Reader, error) {
 	if len(data) < 4 {
 		// パケットが 4 バイト以下なのでパースできない
-		return nil, nil, errors.New("invalid data")
+		return nil, nil, ErrDecodeMessage
 	}
 
 	h := &messageHeader{}
@@ -25,7 +28,7 @@ func decodeMessageHeader(data []byte) (*messageHeader, *bytes.Reader, error) {
 		return nil, nil, err
 	}
 
-	if err := binary.Read(buf, binary.BigEndian, &h.reserved); err != nil {
+	if err := binary.Read(buf, binary.BigEndian, &h.protocolVersion); err != nil {
 		return nil, nil, err
 	}
 
@@ -37,9 +40,18 @@ func decodeMessageHeader(data []byte) (*messageHeader, *bytes.Reader, error) {
 }
 
 // ```erlang
-// <<?E2EE_PRE_KEY_MESSAGE_TYPE:8, Reserved:8, CiphertextLength:16,
+// <<?E2EE_PRE_KEY_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
 //   SrcConnectionID:26/binary, DstConnectionID:26/binary,
-//   IdentityKey:32/binary, EphemeralKey:32/binary>>
+//   IdentityKey:32/binary, EphemeralKey:32/binary,
+//   ## 0 の場合は oneTimePreKey を利用していない
+//   OneTimePreKeyID:32,
+//   ## 0 の場合は現在の signedPreKey を利用する
+//   SignedPreKeyID:32,
+//   ## このセッションで利用する機能、0 の場合は省略する
+//   ## 古いクライアントは送ってこないし、読まずに無視する
+//   Capabilities:32,
+//   ## Capabilities で PQXDH を利用する場合のみ、相手の pqPreKey でカプセル化した ML-KEM-768 の暗号文
+//   PQCiphertext:1088/binary>>
 // ```
 
 type preKeyMessage struct {
@@ -48,6 +60,14 @@ type preKeyMessage struct {
 	// ここで渡す identityKey は ed25519
 	identityKey  [32]byte
 	ephemeralKey x25519PublicKey
+	// 0 の場合は oneTimePreKey を利用していない
+	oneTimePreKeyID uint32
+	// 0 の場合は現在の signedPreKey を利用する
+	signedPreKeyID uint32
+	// このセッションで利用する機能
+	capabilities uint32
+	// PQXDH を利用する場合のみ設定される
+	pqCiphertext []byte
 }
 
 func decodePreKeyMessage(header messageHeader, buf *bytes.Reader) (*preKeyMessage, error) {
@@ -69,30 +89,86 @@ func decodePreKeyMessage(header messageHeader, buf *bytes.Reader) (*preKeyMessag
 		return nil, err
 	}
 
+	// OneTimePreKeyID を送ってこない古いクライアントもいるため、無い場合は 0 として扱う
+	if buf.Len() > 0 {
+		if err := binary.Read(buf, binary.BigEndian, &m.oneTimePreKeyID); err != nil {
+			return nil, err
+		}
+	}
+
+	// SignedPreKeyID も同様に無い場合は 0 として扱う
+	if buf.Len() > 0 {
+		if err := binary.Read(buf, binary.BigEndian, &m.signedPreKeyID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Capabilities も同様に無い場合は 0 として扱う
+	if buf.Len() > 0 {
+		if err := binary.Read(buf, binary.BigEndian, &m.capabilities); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decodePQCiphertext(buf, m); err != nil {
+		return nil, err
+	}
+
 	return m, nil
 }
 
-// <<?E2EE_CIPHER_MESSAGE_TYPE:8, Reserved:8, CiphertextLength:16,
+// Capabilities で PQXDH を利用する場合のみ PQCiphertext を読む
+func decodePQCiphertext(buf *bytes.Reader, m *preKeyMessage) error {
+	if m.capabilities&capabilityPQXDH == 0 {
+		return nil
+	}
+
+	// 相手が送ってきた長さをそのまま信用して確保しない
+	if buf.Len() < pqCiphertextLength {
+		return ErrDecodeMessage
+	}
+
+	m.pqCiphertext = make([]byte, pqCiphertextLength)
+	if err := binary.Read(buf, binary.BigEndian, m.pqCiphertext); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// <<?E2EE_CIPHER_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
 //   SrcConnectionID:26/binary, DstConnectionID:26/binary,
 //   ## CipherMessage のここはヘッダー
 //   RachetKey:32/binary, N:32, NP:32,
 //   ## 本体
 //   Ciphertext/binary>>
 
+// ヘッダーを暗号化している場合はヘッダーの代わりに暗号化したヘッダーが入る
+// <<?E2EE_ENCRYPTED_CIPHER_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
+//   SrcConnectionID:26/binary, DstConnectionID:26/binary,
+//   ## AEAD(HeaderKey, Nonce, <<RachetKey:32/binary, N:32, NP:32>>)、AEAD はセッションで利用するもの
+//   Nonce:12/binary, EncryptedHeader:40/binary, Tag:16/binary,
+//   Ciphertext/binary>>
+
 // Ciphertext 中身
-// <<KeyId:32, SecretKeyMaterial:32/binary>>
+// <<KeyId:32, SecretKeyMaterial:32/binary,
+//   ## 古いクライアントは送ってこないし、読まずに無視する
+//   ProtocolVersion:8, Capabilities:32>>
 
 type cipherMessage struct {
+	protocolVersion    uint8
 	selfConnectionID   [26]byte
 	remoteConnectionID [26]byte
 	ratchetKey         x25519PublicKey
 	PN                 uint32
 	N                  uint32
-	ciphertext         []byte
+	// ヘッダーを暗号化している場合のみ設定され、ratchetKey、PN、N は 0 になる
+	encryptedHeader []byte
+	ciphertext      []byte
 }
 
 func decodeCipherMessage(header messageHeader, buf *bytes.Reader) (*cipherMessage, error) {
-	m := &cipherMessage{}
+	m := &cipherMessage{protocolVersion: header.protocolVersion}
 
 	if err := binary.Read(buf, binary.BigEndian, &m.selfConnectionID); err != nil {
 		return nil, err
@@ -102,26 +178,131 @@ func decodeCipherMessage(header messageHeader, buf *bytes.Reader) (*cipherMessag
 		return nil, err
 	}
 
-	if err := binary.Read(buf, binary.BigEndian, &m.ratchetKey); err != nil {
+	if err := decodeCipherMessageBody(header, header.packetType == typeEncryptedCipherMessage, buf, m); err != nil {
 		return nil, err
 	}
 
-	if err := binary.Read(buf, binary.BigEndian, &m.PN); err != nil {
-		return nil, err
+	return m, nil
+}
+
+// cipherMessage と resetMessage で共通のヘッダーと本体を読む
+func decodeCipherMessageBody(header messageHeader, headerEncryption bool, buf *bytes.Reader, m *cipherMessage) error {
+	if headerEncryption {
+		// 相手が送ってきた長さをそのまま信用して確保しない
+		if buf.Len() < encryptedHeaderLength {
+			return ErrDecodeMessage
+		}
+		m.encryptedHeader = make([]byte, encryptedHeaderLength)
+		if err := binary.Read(buf, binary.BigEndian, m.encryptedHeader); err != nil {
+			return err
+		}
+	} else {
+		if err := binary.Read(buf, binary.BigEndian, &m.ratchetKey); err != nil {
+			return err
+		}
+
+		if err := binary.Read(buf, binary.BigEndian, &m.PN); err != nil {
+			return err
+		}
+
+		if err := binary.Read(buf, binary.BigEndian, &m.N); err != nil {
+			return err
+		}
 	}
 
-	if err := binary.Read(buf, binary.BigEndian, &m.N); err != nil {
-		return nil, err
+	// 相手が送ってきた長さをそのまま信用して確保しない
+	if buf.Len() < int(header.ciphertextLength) {
+		return ErrDecodeMessage
 	}
 
 	var ciphertext = make([]byte, header.ciphertextLength)
 
 	if err := binary.Read(buf, binary.BigEndian, ciphertext); err != nil {
-		return nil, err
+		return err
 	}
 
 	m.ciphertext = ciphertext
 
+	return nil
+}
+
+// ```erlang
+// <<?E2EE_RESET_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
+//   SrcConnectionID:26/binary, DstConnectionID:26/binary,
+//   ## ここは preKeyMessage と同じ
+//   IdentityKey:32/binary, EphemeralKey:32/binary,
+//   OneTimePreKeyID:32, SignedPreKeyID:32,
+//   ## ここは cipherMessage と同じ
+//   RachetKey:32/binary, N:32, NP:32,
+//   Ciphertext/binary>>
+// ```
+
+// 新しいセッションで利用する機能がある場合は、preKeyMessage と同じく Capabilities を含める
+// Capabilities でヘッダーを暗号化する場合は、encryptedCipherMessage と同じく暗号化したヘッダーが入る
+// ```erlang
+// <<?E2EE_EXTENDED_RESET_MESSAGE_TYPE:8, ProtocolVersion:8, CiphertextLength:16,
+//   SrcConnectionID:26/binary, DstConnectionID:26/binary,
+//   IdentityKey:32/binary, EphemeralKey:32/binary,
+//   OneTimePreKeyID:32, SignedPreKeyID:32, Capabilities:32,
+//   ## Capabilities で PQXDH を利用する場合のみ
+//   PQCiphertext:1088/binary,
+//   Nonce:12/binary, EncryptedHeader:40/binary, Tag:16/binary,
+//   Ciphertext/binary>>
+// ```
+
+// 新しいセッションで暗号化した cipherMessage を含めて、復号できた場合のみセッションを置き換える
+type resetMessage struct {
+	preKeyMessage preKeyMessage
+	cipherMessage cipherMessage
+}
+
+func decodeResetMessage(header messageHeader, buf *bytes.Reader) (*resetMessage, error) {
+	m := &resetMessage{}
+	p := &m.preKeyMessage
+	c := &m.cipherMessage
+
+	if err := binary.Read(buf, binary.BigEndian, &p.selfConnectionID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &p.remoteConnectionID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &p.identityKey); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &p.ephemeralKey); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &p.oneTimePreKeyID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &p.signedPreKeyID); err != nil {
+		return nil, err
+	}
+
+	if header.packetType == typeExtendedResetMessage {
+		if err := binary.Read(buf, binary.BigEndian, &p.capabilities); err != nil {
+			return nil, err
+		}
+
+		if err := decodePQCiphertext(buf, p); err != nil {
+			return nil, err
+		}
+	}
+
+	c.protocolVersion = header.protocolVersion
+	c.selfConnectionID = p.selfConnectionID
+	c.remoteConnectionID = p.remoteConnectionID
+
+	if err := decodeCipherMessageBody(header, p.capabilities&capabilityHeaderEncryption != 0, buf, c); err != nil {
+		return nil, err
+	}
+
 	return m, nil
 }
 
@@ -129,18 +310,33 @@ func decodeCipherMessage(header messageHeader, buf *bytes.Reader) (*cipherMessag
 type senderKeyMessage struct {
 	keyID             uint32
 	secretKeyMaterial [32]byte
+	// 古いクライアントからのメッセージには含まれない
+	hasCapabilities bool
+	protocolVersion uint8
+	capabilities    uint32
 }
 
+// 復号した後に読むため receiveMessage では ErrDecodeMessage に変換されないので、ここで変換する
 func decodeSenderKeyMessage(plaintext []byte) (*senderKeyMessage, error) {
 	buf := bytes.NewReader(plaintext)
 	m := &senderKeyMessage{}
 
 	if err := binary.Read(buf, binary.BigEndian, &m.keyID); err != nil {
-		return nil, err
+		return nil, ErrDecodeMessage
 	}
 
 	if err := binary.Read(buf, binary.BigEndian, &m.secretKeyMaterial); err != nil {
-		return nil, err
+		return nil, ErrDecodeMessage
+	}
+
+	if buf.Len() > 0 {
+		if err := binary.Read(buf, binary.BigEndian, &m.protocolVersion); err != nil {
+			return nil, ErrDecodeMessage
+		}
+		if err := binary.Read(buf, binary.BigEndian, &m.capabilities); err != nil {
+			return nil, ErrDecodeMessage
+		}
+		m.hasCapabilities = true
 	}
 
 	return m, nil
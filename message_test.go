@@ -0,0 +1,276 @@
+package e2ee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// alice から bob に送る preKeyMessage、cipherMessage、resetMessage を生成する
+func testMessages(t testing.TB) (preKeyMessage, cipherMessage, resetMessage []byte) {
+	alice, bob := newTestEnginePair(t)
+	session := alice.sessions[bob.connectionID]
+
+	preKeyMessage, err := session.preKeyMessage()
+	assert.Nil(t, err)
+
+	plaintext, err := alice.plaintext()
+	assert.Nil(t, err)
+	header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.messageAD(session.protocolVersion))
+	assert.Nil(t, err)
+
+	cipherMessage, err = session.cipherMessage(header, ciphertext)
+	assert.Nil(t, err)
+	resetMessage, err = session.resetMessage(header, ciphertext)
+	assert.Nil(t, err)
+
+	return preKeyMessage, cipherMessage, resetMessage
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	alice, bob := newTestEnginePair(t)
+	session := alice.sessions[bob.connectionID]
+	session.protocolVersion = protocolVersion
+
+	data, err := session.preKeyMessage()
+	assert.Nil(t, err)
+	header, buf, err := decodeMessageHeader(data)
+	assert.Nil(t, err)
+	assert.Equal(t, typePreKeyMessage, header.packetType)
+	assert.Equal(t, protocolVersion, header.protocolVersion)
+	p, err := decodePreKeyMessage(*header, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, alice.connectionID, string(p.selfConnectionID[:]))
+	assert.Equal(t, bob.connectionID, string(p.remoteConnectionID[:]))
+	assert.Equal(t, []byte(session.selfIdenityKeyPair.publicKey), p.identityKey[:])
+	assert.Equal(t, session.selfEphemeralKeyPair.publicKey, p.ephemeralKey)
+	assert.Equal(t, session.remoteSignedPreKeyID, p.signedPreKeyID)
+	assert.Equal(t, 0, buf.Len())
+
+	ratchetHeader, err := session.ratchetState.header()
+	assert.Nil(t, err)
+	ciphertext := []byte("ciphertext")
+
+	data, err = session.cipherMessage(ratchetHeader, ciphertext)
+	assert.Nil(t, err)
+	header, buf, err = decodeMessageHeader(data)
+	assert.Nil(t, err)
+	assert.Equal(t, typeCipherMessage, header.packetType)
+	c, err := decodeCipherMessage(*header, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, protocolVersion, c.protocolVersion)
+	assert.Equal(t, alice.connectionID, string(c.selfConnectionID[:]))
+	assert.Equal(t, bob.connectionID, string(c.remoteConnectionID[:]))
+	assert.Equal(t, session.ratchetState.selfDH.publicKey, c.ratchetKey)
+	assert.Equal(t, session.ratchetState.PN, c.PN)
+	assert.Equal(t, session.ratchetState.selfN, c.N)
+	assert.Equal(t, ciphertext, c.ciphertext)
+	assert.Equal(t, 0, buf.Len())
+
+	data, err = session.resetMessage(ratchetHeader, ciphertext)
+	assert.Nil(t, err)
+	header, buf, err = decodeMessageHeader(data)
+	assert.Nil(t, err)
+	assert.Equal(t, typeResetMessage, header.packetType)
+	r, err := decodeResetMessage(*header, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, *p, r.preKeyMessage)
+	assert.Equal(t, *c, r.cipherMessage)
+	assert.Equal(t, 0, buf.Len())
+
+	plaintext, err := alice.plaintext()
+	assert.Nil(t, err)
+	s, err := decodeSenderKeyMessage(plaintext)
+	assert.Nil(t, err)
+	assert.Equal(t, alice.keyID, s.keyID)
+	assert.Equal(t, alice.secretKeyMaterial, s.secretKeyMaterial[:])
+	assert.True(t, s.hasCapabilities)
+	assert.Equal(t, protocolVersion, s.protocolVersion)
+	assert.Equal(t, selfCapabilities, s.capabilities)
+}
+
+func TestDecodeCipherMessageTruncated(t *testing.T) {
+	_, cipherMessage, resetMessage := testMessages(t)
+
+	for _, data := range [][]byte{cipherMessage, resetMessage} {
+		// 本体が CiphertextLength より短い
+		header, buf, err := decodeMessageHeader(data[:len(data)-1])
+		assert.Nil(t, err)
+		switch header.packetType {
+		case typeCipherMessage:
+			_, err = decodeCipherMessage(*header, buf)
+		case typeResetMessage:
+			_, err = decodeResetMessage(*header, buf)
+		}
+		assert.ErrorIs(t, err, ErrDecodeMessage)
+
+		// CiphertextLength を最大にしても本体の長さしか確保しない
+		forged := append([]byte(nil), data...)
+		binary.BigEndian.PutUint16(forged[2:4], 0xffff)
+		header, buf, err = decodeMessageHeader(forged)
+		assert.Nil(t, err)
+		switch header.packetType {
+		case typeCipherMessage:
+			_, err = decodeCipherMessage(*header, buf)
+		case typeResetMessage:
+			_, err = decodeResetMessage(*header, buf)
+		}
+		assert.ErrorIs(t, err, ErrDecodeMessage)
+	}
+}
+
+// デコードできたメッセージは入力より長い ciphertext を持たない
+func fuzzDecodeMessage(t *testing.T, data []byte) {
+	header, buf, err := decodeMessageHeader(data)
+	if err != nil {
+		assert.Nil(t, header)
+		return
+	}
+
+	switch header.packetType {
+	case typePreKeyMessage:
+		m, err := decodePreKeyMessage(*header, buf)
+		if err == nil {
+			assert.NotNil(t, m)
+		}
+	case typeCipherMessage, typeEncryptedCipherMessage:
+		m, err := decodeCipherMessage(*header, buf)
+		if err == nil {
+			assert.Equal(t, int(header.ciphertextLength), len(m.ciphertext))
+			assert.LessOrEqual(t, len(m.ciphertext), len(data))
+			assert.Equal(t, header.packetType == typeEncryptedCipherMessage, m.encryptedHeader != nil)
+		}
+	case typeResetMessage, typeExtendedResetMessage:
+		m, err := decodeResetMessage(*header, buf)
+		if err == nil {
+			assert.Equal(t, int(header.ciphertextLength), len(m.cipherMessage.ciphertext))
+			assert.LessOrEqual(t, len(m.cipherMessage.ciphertext), len(data))
+		}
+	case typeGroupCommitMessage:
+		m, err := decodeGroupCommitMessage(*header, buf)
+		if err == nil {
+			assert.Equal(t, data, m.encode())
+		}
+	case typeGroupWelcomeMessage:
+		m, err := decodeGroupWelcomeMessage(*header, buf)
+		if err == nil {
+			assert.Equal(t, data, m.encode())
+		}
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	preKeyMessage, cipherMessage, resetMessage := testMessages(f)
+	f.Add(preKeyMessage)
+	f.Add(cipherMessage)
+	f.Add(resetMessage)
+	// OneTimePreKeyID と SignedPreKeyID を送ってこない古いクライアント
+	f.Add(preKeyMessage[:len(preKeyMessage)-8])
+	// ヘッダーを暗号化したメッセージ
+	encryptedCipherMessage := append([]byte{typeEncryptedCipherMessage}, cipherMessage[1:4+26+26]...)
+	encryptedCipherMessage = append(encryptedCipherMessage, make([]byte, encryptedHeaderLength)...)
+	f.Add(append(encryptedCipherMessage, cipherMessage[4+26+26+32+4+4:]...))
+	extendedResetMessage := append([]byte{typeExtendedResetMessage}, resetMessage[1:4+26+26+32+32+4+4]...)
+	extendedResetMessage = append(extendedResetMessage, 0, 0, 0, byte(capabilityHeaderEncryption))
+	extendedResetMessage = append(extendedResetMessage, make([]byte, encryptedHeaderLength)...)
+	f.Add(append(extendedResetMessage, resetMessage[4+26+26+32+32+4+4+32+4+4:]...))
+	// PQXDH の暗号文を含む preKeyMessage
+	pqPreKeyMessage := append(append([]byte(nil), preKeyMessage...), 0, 0, 0, byte(capabilityPQXDH))
+	f.Add(append(pqPreKeyMessage, make([]byte, pqCiphertextLength)...))
+	// グループモードのコミットと welcome
+	alice := NewEngine(version, WithGroupMode())
+	assert.Nil(f, alice.Init())
+	_, err := alice.Start("ALICE---------------------")
+	assert.Nil(f, err)
+	bob := NewEngine(version, WithGroupMode())
+	assert.Nil(f, bob.Init())
+	result, err := alice.StartSession("BOB-----------------------", bob.SelfPreKeyBundle())
+	assert.Nil(f, err)
+	for _, message := range result.Messages {
+		f.Add(message)
+	}
+	// MLS のコミットと KeyPackage を含む welcome
+	carol := NewEngine(version, WithMLS())
+	assert.Nil(f, carol.Init())
+	_, err = carol.Start("CAROL---------------------")
+	assert.Nil(f, err)
+	dave := NewEngine(version, WithMLS())
+	assert.Nil(f, dave.Init())
+	result, err = carol.StartSession("DAVE----------------------", dave.SelfPreKeyBundle())
+	assert.Nil(f, err)
+	for _, message := range result.Messages {
+		f.Add(message)
+	}
+
+	f.Fuzz(fuzzDecodeMessage)
+}
+
+func FuzzDecodeSenderKeyMessage(f *testing.F) {
+	f.Add(make([]byte, 4+32))
+	f.Add(make([]byte, 4+32+1+4))
+
+	f.Fuzz(func(t *testing.T, plaintext []byte) {
+		m, err := decodeSenderKeyMessage(plaintext)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, binary.BigEndian.Uint32(plaintext), m.keyID)
+		assert.Equal(t, plaintext[4:4+32], m.secretKeyMaterial[:])
+		assert.Equal(t, len(plaintext) > 4+32, m.hasCapabilities)
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add(make([]byte, 32+4+4))
+
+	f.Fuzz(func(t *testing.T, header []byte) {
+		h, err := parseHeader(header)
+		if err != nil {
+			assert.Less(t, len(header), 32+4+4)
+			return
+		}
+		assert.Equal(t, header[:32], h.DH[:])
+		assert.Equal(t, binary.BigEndian.Uint32(header[32:36]), h.PN)
+		assert.Equal(t, binary.BigEndian.Uint32(header[36:40]), h.N)
+	})
+}
+
+// 任意の値をエンコードしてデコードすると同じ値に戻る
+func FuzzCipherMessageRoundTrip(f *testing.F) {
+	f.Add(uint8(0), make([]byte, 32), uint32(0), uint32(0), []byte("ciphertext"))
+	f.Add(protocolVersion, bytes.Repeat([]byte{0xff}, 32), uint32(0xffffffff), uint32(1), []byte{})
+
+	f.Fuzz(func(t *testing.T, version uint8, ratchetKey []byte, PN, N uint32, ciphertext []byte) {
+		if len(ratchetKey) != 32 || len(ciphertext) > 0xffff {
+			return
+		}
+
+		s := &session{
+			protocolVersion:    version,
+			selfConnectionID:   "ALICE---------------------",
+			remoteConnectionID: "BOB-----------------------",
+		}
+		rs := &ratchetState{PN: PN, selfN: N}
+		copy(rs.selfDH.publicKey[:], ratchetKey)
+		ratchetHeader, err := rs.header()
+		assert.Nil(t, err)
+
+		data, err := s.cipherMessage(ratchetHeader, ciphertext)
+		assert.Nil(t, err)
+
+		header, buf, err := decodeMessageHeader(data)
+		assert.Nil(t, err)
+		m, err := decodeCipherMessage(*header, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, version, m.protocolVersion)
+		assert.Equal(t, s.selfConnectionID, string(m.selfConnectionID[:]))
+		assert.Equal(t, s.remoteConnectionID, string(m.remoteConnectionID[:]))
+		assert.Equal(t, ratchetKey, m.ratchetKey[:])
+		assert.Equal(t, PN, m.PN)
+		assert.Equal(t, N, m.N)
+		assert.Equal(t, len(ciphertext), len(m.ciphertext))
+		assert.True(t, bytes.Equal(ciphertext, m.ciphertext))
+	})
+}
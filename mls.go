@@ -0,0 +1,352 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9420.html の MLS を元にしたグループモード
+// 暗号スイートは MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519 のみに対応する
+//
+// グループモードの鍵スケジュール、path secret の暗号化、署名、KeyPackage を MLS のものにする
+// コミットと welcome のメッセージ形式、木のハッシュはグループモードのものを利用し、
+// GroupContext の confirmed_transcript_hash は空のままなので、エポックの秘密も RFC 9420 とは一致しない
+// RFC 9420 の MLS ではなく、他の MLS の実装とは相互接続できない
+//
+// KeyPackage の init_key は signedPreKey、葉の鍵は X3DH と鍵を共有しないように signedPreKey とは別に生成する
+
+const (
+	mlsProtocolVersion uint16 = 1
+	mlsCipherSuite     uint16 = 0x0001
+
+	mlsCredentialTypeBasic   uint16 = 1
+	mlsLeafNodeSourceKeyPack uint8  = 1
+
+	// KDF.Nh
+	mlsHashLength = sha256.Size
+)
+
+// グループの鍵スケジュールと暗号化の方式
+// コミットと welcome の CipherSuite に入れる
+type groupCipherSuite uint16
+
+const (
+	// グループモードの独自の方式
+	groupCipherSuiteSora groupCipherSuite = 0
+	// MLS の鍵スケジュールと HPKE を利用し、SK を MLS の exporter から RFC 9605 の方法で導出する
+	groupCipherSuiteMLS = groupCipherSuite(mlsCipherSuite)
+)
+
+// <<Length:varint, Data/binary>>
+// https://www.rfc-editor.org/rfc/rfc9420.html#section-2.1.2
+func mlsWriteOpaque(buf *bytes.Buffer, data []byte) {
+	n := len(data)
+	switch {
+	case n < 1<<6:
+		buf.WriteByte(byte(n))
+	case n < 1<<14:
+		binary.Write(buf, binary.BigEndian, uint16(n)|0x4000)
+	default:
+		binary.Write(buf, binary.BigEndian, uint32(n)|0x80000000)
+	}
+	buf.Write(data)
+}
+
+// 最小のバイト数で表現されていない長さはエラーにする
+func mlsReadOpaque(buf *bytes.Reader) ([]byte, error) {
+	first, err := buf.ReadByte()
+	if err != nil {
+		return nil, ErrDecodeMessage
+	}
+	n := uint32(first & 0x3f)
+	var min uint32
+	switch first >> 6 {
+	case 0:
+	case 1:
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, ErrDecodeMessage
+		}
+		n = n<<8 | uint32(b)
+		min = 1 << 6
+	case 2:
+		var b [3]byte
+		if _, err := io.ReadFull(buf, b[:]); err != nil {
+			return nil, ErrDecodeMessage
+		}
+		n = n<<24 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		min = 1 << 14
+	default:
+		return nil, ErrDecodeMessage
+	}
+	if n < min || int64(n) > int64(buf.Len()) {
+		return nil, ErrDecodeMessage
+	}
+	data := make([]byte, n)
+	io.ReadFull(buf, data)
+	return data, nil
+}
+
+// ExpandWithLabel(Secret, Label, Context, Length) = KDF.Expand(Secret, KDFLabel, Length)
+// KDFLabel = <<Length:16, Label<V> = "MLS 1.0 " + Label, Context<V>>>
+// 長さは 255 * 32 バイト以下なので失敗しない
+func mlsExpandWithLabel(secret []byte, label string, context []byte, length int) []byte {
+	kdfLabel := new(bytes.Buffer)
+	binary.Write(kdfLabel, binary.BigEndian, uint16(length))
+	mlsWriteOpaque(kdfLabel, []byte("MLS 1.0 "+label))
+	mlsWriteOpaque(kdfLabel, context)
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, kdfLabel.Bytes()), out)
+	return out
+}
+
+// DeriveSecret(Secret, Label) = ExpandWithLabel(Secret, Label, "", KDF.Nh)
+func mlsDeriveSecret(secret []byte, label string) []byte {
+	return mlsExpandWithLabel(secret, label, nil, mlsHashLength)
+}
+
+// SignContent = <<Label<V> = "MLS 1.0 " + Label, Content<V>>>
+func mlsSignContent(label string, content []byte) []byte {
+	buf := new(bytes.Buffer)
+	mlsWriteOpaque(buf, []byte("MLS 1.0 "+label))
+	mlsWriteOpaque(buf, content)
+	return buf.Bytes()
+}
+
+func mlsSignWithLabel(privateKey ed25519.PrivateKey, label string, content []byte) []byte {
+	return ed25519.Sign(privateKey, mlsSignContent(label, content))
+}
+
+func mlsVerifyWithLabel(publicKey []byte, label string, content []byte, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, mlsSignContent(label, content), signature)
+}
+
+// EncryptWithLabel(PublicKey, Label, Context, Plaintext) = SealBase(PublicKey, EncryptContext, "", Plaintext)
+// EncryptContext = <<Label<V> = "MLS 1.0 " + Label, Context<V>>>
+func mlsEncryptWithLabel(random io.Reader, publicKey x25519PublicKey, label string, context []byte, plaintext []byte) (x25519PublicKey, []byte, error) {
+	return hpkeSeal(random, publicKey, mlsSignContent(label, context), nil, plaintext)
+}
+
+func mlsDecryptWithLabel(keyPair x25519KeyPair, enc x25519PublicKey, label string, context []byte, ciphertext []byte) ([]byte, error) {
+	return hpkeOpen(keyPair, enc, mlsSignContent(label, context), nil, ciphertext)
+}
+
+// MLS-Exporter(Label, Context, Length) = ExpandWithLabel(DeriveSecret(exporter_secret, Label), "exported", Hash(Context), Length)
+func mlsExport(exporterSecret []byte, label string, context []byte, length int) []byte {
+	hash := sha256.Sum256(context)
+	return mlsExpandWithLabel(mlsDeriveSecret(exporterSecret, label), "exported", hash[:], length)
+}
+
+// https://www.rfc-editor.org/rfc/rfc9420.html#section-10
+//
+// KeyPackage = <<Version:16, CipherSuite:16, InitKey<V>, LeafNode/binary, Extensions<V>, Signature<V>>>
+// LeafNode = <<EncryptionKey<V>, SignatureKey<V>,
+//
+//	CredentialType:16, Identity<V>,
+//	Capabilities/binary, LeafNodeSource:8, NotBefore:64, NotAfter:64, Extensions<V>, Signature<V>>>
+//
+// initKey は signedPreKey、encryptionKey は別に生成した鍵、signatureKey は identityKey にする
+// ConnectionID は Init の時点では決まらないので、BasicCredential の identity は空にする
+// signedPreKey を更新すると KeyPackage も変わるので有効期限は設けず、確認もしない
+type mlsKeyPackage struct {
+	initKey       x25519PublicKey
+	encryptionKey x25519PublicKey
+	signatureKey  []byte
+}
+
+// <<Versions<V>, CipherSuites<V>, Extensions<V>, Proposals<V>, Credentials<V>>>
+func mlsWriteCapabilities(buf *bytes.Buffer) {
+	uint16s := func(v uint16) []byte {
+		return []byte{byte(v >> 8), byte(v)}
+	}
+	mlsWriteOpaque(buf, uint16s(mlsProtocolVersion))
+	mlsWriteOpaque(buf, uint16s(mlsCipherSuite))
+	mlsWriteOpaque(buf, nil)
+	mlsWriteOpaque(buf, nil)
+	mlsWriteOpaque(buf, uint16s(mlsCredentialTypeBasic))
+}
+
+// LeafNode の Signature の前まで
+func (k *mlsKeyPackage) leafNodeTBS() []byte {
+	buf := new(bytes.Buffer)
+	mlsWriteOpaque(buf, k.encryptionKey[:])
+	mlsWriteOpaque(buf, k.signatureKey)
+	binary.Write(buf, binary.BigEndian, mlsCredentialTypeBasic)
+	mlsWriteOpaque(buf, nil)
+	mlsWriteCapabilities(buf)
+	buf.WriteByte(mlsLeafNodeSourceKeyPack)
+	binary.Write(buf, binary.BigEndian, uint64(0))
+	binary.Write(buf, binary.BigEndian, ^uint64(0))
+	mlsWriteOpaque(buf, nil)
+	return buf.Bytes()
+}
+
+// KeyPackage の Signature の前まで
+func (k *mlsKeyPackage) keyPackageTBS(leafNodeSignature []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, mlsProtocolVersion)
+	binary.Write(buf, binary.BigEndian, mlsCipherSuite)
+	mlsWriteOpaque(buf, k.initKey[:])
+	buf.Write(k.leafNodeTBS())
+	mlsWriteOpaque(buf, leafNodeSignature)
+	mlsWriteOpaque(buf, nil)
+	return buf.Bytes()
+}
+
+// signedPreKey を init_key、encryptionKeyPair を葉の鍵にした KeyPackage を生成する
+func generateMLSKeyPackage(identityKeyPair ed25519KeyPair, preKeyPair x25519KeyPair, encryptionKeyPair x25519KeyPair) ([]byte, error) {
+	k := &mlsKeyPackage{
+		initKey:       preKeyPair.publicKey,
+		encryptionKey: encryptionKeyPair.publicKey,
+		signatureKey:  identityKeyPair.publicKey,
+	}
+
+	leafNodeSignature := mlsSignWithLabel(identityKeyPair.privateKey, "LeafNodeTBS", k.leafNodeTBS())
+	tbs := k.keyPackageTBS(leafNodeSignature)
+	buf := bytes.NewBuffer(tbs)
+	mlsWriteOpaque(buf, mlsSignWithLabel(identityKeyPair.privateKey, "KeyPackageTBS", tbs))
+	return buf.Bytes(), nil
+}
+
+// KeyPackage を読み込んで LeafNode と KeyPackage の署名を確認する
+// 自分が生成するものと同じ形式のみ受け付ける
+func decodeMLSKeyPackage(data []byte) (*mlsKeyPackage, error) {
+	buf := bytes.NewReader(data)
+
+	var version, cipherSuite uint16
+	if err := binary.Read(buf, binary.BigEndian, &version); err != nil {
+		return nil, ErrInvalidKeyPackage
+	}
+	if err := binary.Read(buf, binary.BigEndian, &cipherSuite); err != nil {
+		return nil, ErrInvalidKeyPackage
+	}
+	if version != mlsProtocolVersion || cipherSuite != mlsCipherSuite {
+		return nil, ErrInvalidKeyPackage
+	}
+
+	k := &mlsKeyPackage{}
+	initKey, err := mlsReadOpaque(buf)
+	if err != nil || len(initKey) != 32 {
+		return nil, ErrInvalidKeyPackage
+	}
+	copy(k.initKey[:], initKey)
+	encryptionKey, err := mlsReadOpaque(buf)
+	if err != nil || len(encryptionKey) != 32 {
+		return nil, ErrInvalidKeyPackage
+	}
+	copy(k.encryptionKey[:], encryptionKey)
+	if k.initKey == k.encryptionKey {
+		return nil, ErrInvalidKeyPackage
+	}
+	k.signatureKey, err = mlsReadOpaque(buf)
+	if err != nil || len(k.signatureKey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKeyPackage
+	}
+
+	// 残りの LeafNode の署名の対象は自分が生成するものと一致する必要がある
+	leafNodeTBS := k.leafNodeTBS()
+	rest := make([]byte, len(leafNodeTBS)-(1+32)-(1+ed25519.PublicKeySize))
+	if _, err := io.ReadFull(buf, rest); err != nil {
+		return nil, ErrInvalidKeyPackage
+	}
+	if !bytes.HasSuffix(leafNodeTBS, rest) {
+		return nil, ErrInvalidKeyPackage
+	}
+
+	leafNodeSignature, err := mlsReadOpaque(buf)
+	if err != nil {
+		return nil, ErrInvalidKeyPackage
+	}
+	extensions, err := mlsReadOpaque(buf)
+	if err != nil || len(extensions) != 0 {
+		return nil, ErrInvalidKeyPackage
+	}
+	signature, err := mlsReadOpaque(buf)
+	if err != nil || buf.Len() != 0 {
+		return nil, ErrInvalidKeyPackage
+	}
+
+	if !mlsVerifyWithLabel(k.signatureKey, "LeafNodeTBS", leafNodeTBS, leafNodeSignature) {
+		return nil, ErrVerifyFailed
+	}
+	if !mlsVerifyWithLabel(k.signatureKey, "KeyPackageTBS", k.keyPackageTBS(leafNodeSignature), signature) {
+		return nil, ErrVerifyFailed
+	}
+
+	return k, nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc9605.html#section-5.2
+// sframe_epoch_secret = MLS-Exporter("SFrame 1.0", "", 32)
+// base_key = HKDF-Expand(sframe_epoch_secret, encode_big_endian(index, 4), 32)
+// SFrame の暗号スイートは SDK が決めるので、SK と同じ 32 バイトにする
+func mlsSFrameBaseKey(exporterSecret []byte, leafIndex uint32) []byte {
+	sframeEpochSecret := mlsExport(exporterSecret, "SFrame 1.0", nil, 32)
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], leafIndex)
+	out := make([]byte, 32)
+	io.ReadFull(hkdf.Expand(sha256.New, sframeEpochSecret, index[:]), out)
+	return out
+}
+
+// KID = (index << E) + (epoch % 2^E)
+// KeyID は 32 ビットなので E は 16 にする、context_id は利用しない
+const mlsSFrameEpochBits = 16
+
+// 葉の位置も 16 ビットなので、超えると異なる参加者が同じ KeyID と nonce を利用してしまう
+const mlsMaxLeaves = 1 << (32 - mlsSFrameEpochBits)
+
+func mlsSFrameKeyID(epoch uint32, leafIndex uint32) uint32 {
+	return leafIndex<<mlsSFrameEpochBits | epoch&(1<<mlsSFrameEpochBits-1)
+}
+
+// 葉の鍵は X3DH の signedPreKey と鍵を共有しないように、signedPreKey とは別に生成する
+// WithMLS を指定していない場合は nil を返す
+func (e *Engine) generateMLSEncryptionKeyPair() (*x25519KeyPair, error) {
+	if !e.mls {
+		return nil, nil
+	}
+	return generateX25519KeyPair(e.random)
+}
+
+// WithMLS を指定した場合に preKeyBundle に含める KeyPackage を生成する
+func (e *Engine) generateKeyPackage(identityKeyPair ed25519KeyPair, preKeyPair x25519KeyPair, encryptionKeyPair *x25519KeyPair) ([]byte, error) {
+	if encryptionKeyPair == nil {
+		return nil, nil
+	}
+	return generateMLSKeyPackage(identityKeyPair, preKeyPair, *encryptionKeyPair)
+}
+
+// welcome で指定された signedPreKey と同じ ID の KeyPackage の葉の鍵を探す
+func (e *Engine) signedMLSEncryptionKeyPair(signedPreKeyID uint32) (*x25519KeyPair, error) {
+	if signedPreKeyID == 0 || signedPreKeyID == e.signedPreKeyID {
+		if e.mlsEncryptionKeyPair == nil {
+			return nil, ErrMissingSignedPreKey
+		}
+		return e.mlsEncryptionKeyPair, nil
+	}
+
+	e.removeExpiredPreKeyPairs(e.now())
+
+	previousPreKeyPair, ok := e.previousPreKeyPairs[signedPreKeyID]
+	if !ok || previousPreKeyPair.mlsEncryptionKeyPair == nil {
+		return nil, ErrMissingSignedPreKey
+	}
+	return previousPreKeyPair.mlsEncryptionKeyPair, nil
+}
+
+// WithMLS を指定した場合は MLS の方式でグループを作る
+func (e *Engine) groupCipherSuite() groupCipherSuite {
+	if e.mls {
+		return groupCipherSuiteMLS
+	}
+	return groupCipherSuiteSora
+}
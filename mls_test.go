@@ -0,0 +1,147 @@
+package e2ee
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMLSOpaque(t *testing.T) {
+	for _, n := range []int{0, 63, 64, 16383, 16384} {
+		buf := new(bytes.Buffer)
+		mlsWriteOpaque(buf, make([]byte, n))
+		data, err := mlsReadOpaque(bytes.NewReader(buf.Bytes()))
+		assert.Nil(t, err, n)
+		assert.Len(t, data, n)
+	}
+
+	// 最小のバイト数ではない長さ
+	_, err := mlsReadOpaque(bytes.NewReader([]byte{0x40, 0x01, 0x00}))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+	// 長さが足りない
+	_, err = mlsReadOpaque(bytes.NewReader([]byte{0x02, 0x00}))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+	// 4 バイトを超える長さには対応しない
+	_, err = mlsReadOpaque(bytes.NewReader([]byte{0xc0}))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+}
+
+func TestMLSKeyPackage(t *testing.T) {
+	random := newTestRandom("mls-key-package")
+	identityKeyPair, err := generateIdentityKeyPair(random)
+	assert.Nil(t, err)
+	preKeyPair, err := generatePreKeyPair(random)
+	assert.Nil(t, err)
+
+	encryptionKeyPair, err := generateX25519KeyPair(random)
+	assert.Nil(t, err)
+
+	keyPackage, err := generateMLSKeyPackage(*identityKeyPair, *preKeyPair, *encryptionKeyPair)
+	assert.Nil(t, err)
+	k, err := decodeMLSKeyPackage(keyPackage)
+	assert.Nil(t, err)
+	assert.Equal(t, preKeyPair.publicKey, k.initKey)
+	assert.Equal(t, identityKeyPair.publicKey, k.signatureKey)
+	assert.Equal(t, encryptionKeyPair.publicKey, k.encryptionKey)
+	assert.NotEqual(t, preKeyPair.publicKey, k.encryptionKey)
+
+	// 署名の対象を書き換えると検証に失敗する
+	tampered := append([]byte{}, keyPackage...)
+	tampered[10] ^= 1
+	_, err = decodeMLSKeyPackage(tampered)
+	assert.ErrorIs(t, err, ErrVerifyFailed)
+
+	// 余分なデータや自分が生成しない形式は受け付けない
+	_, err = decodeMLSKeyPackage(append(append([]byte{}, keyPackage...), 0))
+	assert.ErrorIs(t, err, ErrInvalidKeyPackage)
+	tampered = append([]byte{}, keyPackage...)
+	tampered[3] = 2
+	_, err = decodeMLSKeyPackage(tampered)
+	assert.ErrorIs(t, err, ErrInvalidKeyPackage)
+	_, err = decodeMLSKeyPackage(keyPackage[:len(keyPackage)-1])
+	assert.ErrorIs(t, err, ErrInvalidKeyPackage)
+}
+
+func TestMLSPreKeyBundle(t *testing.T) {
+	alice := NewEngine(version, WithMLS())
+	assert.Nil(t, alice.Init())
+	assert.NotNil(t, alice.SelfPreKeyBundle().KeyPackage)
+	assert.NotZero(t, alice.SelfPreKeyBundle().Capabilities&capabilityMLS)
+
+	bob := NewEngine(version, WithMLS())
+	assert.Nil(t, bob.Init())
+	_, err := bob.Start("BOB-----------------------")
+	assert.Nil(t, err)
+
+	// 他の参加者の KeyPackage は受け付けない
+	carol := NewEngine(version, WithMLS())
+	assert.Nil(t, carol.Init())
+	p := alice.SelfPreKeyBundle()
+	p.KeyPackage = carol.SelfPreKeyBundle().KeyPackage
+	_, err = bob.AddPreKeyBundle("ALICE---------------------", p)
+	assert.ErrorIs(t, err, ErrInvalidKeyPackage)
+
+	// signedPreKey を更新すると KeyPackage も更新する
+	keyPackage := alice.SelfPreKeyBundle().KeyPackage
+	_, err = alice.RotateSignedPreKey()
+	assert.Nil(t, err)
+	assert.NotEqual(t, keyPackage, alice.SelfPreKeyBundle().KeyPackage)
+	// 葉の鍵は signedPreKey とは別に生成して、古いものは猶予期間の間残す
+	assert.NotEqual(t, alice.preKeyPair.publicKey, alice.mlsEncryptionKeyPair.publicKey)
+	assert.NotNil(t, alice.previousPreKeyPairs[1].mlsEncryptionKeyPair)
+	_, err = bob.AddPreKeyBundle("ALICE---------------------", alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	// WithMLS を指定しない場合は含めない
+	dave := NewEngine(version, WithGroupMode())
+	assert.Nil(t, dave.Init())
+	assert.Nil(t, dave.SelfPreKeyBundle().KeyPackage)
+}
+
+func TestMLSSFrameKeyID(t *testing.T) {
+	assert.Equal(t, uint32(0x00030005), mlsSFrameKeyID(5, 3))
+	// エポックは下位 16 ビットのみ
+	assert.Equal(t, uint32(0x00030001), mlsSFrameKeyID(0x10001, 3))
+
+	// 参加者ごとに異なる SK になる
+	exporterSecret := bytes.Repeat([]byte{1}, 32)
+	assert.NotEqual(t, mlsSFrameBaseKey(exporterSecret, 0), mlsSFrameBaseKey(exporterSecret, 1))
+	assert.Len(t, mlsSFrameBaseKey(exporterSecret, 0), 32)
+}
+
+func TestMLSMaxLeaves(t *testing.T) {
+	r := newTestRoom(t, WithGroupMode(), WithMLS())
+	for i := 0; i < 2; i++ {
+		r.join(testGroupConnectionID(i))
+		r.deliver()
+	}
+	e := r.engines[testGroupConnectionID(0)]
+
+	// 葉が 2^16 個埋まっている木にする
+	leaf := e.group.tree.leaf(1)
+	tree := &ratchetTree{nodes: make([]*treeNode, 2*mlsMaxLeaves-1)}
+	for i := 0; i < mlsMaxLeaves; i++ {
+		tree.nodes[2*i] = leaf
+	}
+	e.group.tree = tree
+
+	remote := NewEngine(version, WithMLS())
+	assert.Nil(t, remote.Init())
+	connectionID := testGroupConnectionID(2)
+
+	// キューに入れる前に返して状態を変更しない
+	_, err := e.QueueStartSession(connectionID, remote.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrTooManyGroupMembers)
+	_, ok := e.remotePreKeyBundles[connectionID]
+	assert.False(t, ok)
+	assert.False(t, e.groupJoiners[connectionID])
+
+	// 他の参加者のコミットでも KeyID が重複する葉には追加しない
+	p, err := newPreKeyBundle(remote.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	a, err := newGroupAdd(e.group.suite, connectionID, *p)
+	assert.Nil(t, err)
+	_, _, err = e.group.applyProposals(&groupCommitMessage{adds: []groupAdd{*a}})
+	assert.ErrorIs(t, err, ErrTooManyGroupMembers)
+}
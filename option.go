@@ -0,0 +1,192 @@
+package e2ee
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// RotateSignedPreKey 後に古い signedPreKey を保持する期間のデフォルト
+	defaultSignedPreKeyGracePeriod = 5 * time.Minute
+
+	// セッションや preKeyBundle が揃う前に届いたメッセージを保留する期間と数のデフォルト
+	defaultPendingMessageTTL  = 30 * time.Second
+	defaultMaxPendingMessages = 16
+
+	// 1 つのチェインでスキップできるメッセージキーの最大数のデフォルト
+	defaultMaxSkip = 1000
+	// 全セッションで保持するスキップしたメッセージキーの最大数と期間のデフォルト
+	defaultMaxSkippedMessageKeys = 2000
+	defaultSkippedMessageKeyTTL  = 10 * time.Minute
+
+	// QueueStartSession と QueueStopSession の入退室をまとめる期間と、最初の入退室から待つ最大の期間のデフォルト
+	defaultMembershipChangeDebounce = time.Second
+	defaultMaxMembershipChangeDelay = 5 * time.Second
+)
+
+// Option は NewEngine に指定する設定
+type Option func(*Engine)
+
+// WithSignedPreKeyGracePeriod は RotateSignedPreKey 後に古い signedPreKey を保持する期間を指定する
+// この期間内に届いた古い signedPreKey 宛の preKeyMessage は受け付ける
+func WithSignedPreKeyGracePeriod(d time.Duration) Option {
+	return func(e *Engine) {
+		e.signedPreKeyGracePeriod = d
+	}
+}
+
+// WithPendingMessageTTL はセッションや preKeyBundle が揃う前に届いたメッセージを保留する期間を指定する
+func WithPendingMessageTTL(d time.Duration) Option {
+	return func(e *Engine) {
+		e.pendingMessageTTL = d
+	}
+}
+
+// WithMaxPendingMessages は相手ごとに保留するメッセージの最大数を指定する
+// 0 を指定した場合は保留しない
+func WithMaxPendingMessages(n int) Option {
+	return func(e *Engine) {
+		e.maxPendingMessages = n
+	}
+}
+
+// WithMaxSkip は 1 つのチェインでスキップできるメッセージキーの最大数を指定する
+// 超えた場合は ErrTooManySkippedMessages を返すので、セッションを作り直す必要がある
+func WithMaxSkip(n uint32) Option {
+	return func(e *Engine) {
+		e.maxSkip = n
+	}
+}
+
+// WithMaxSkippedMessageKeys は全セッションで保持するスキップしたメッセージキーの最大数を指定する
+// 超えた場合は古いものから破棄する
+func WithMaxSkippedMessageKeys(n int) Option {
+	return func(e *Engine) {
+		e.maxSkippedMessageKeys = n
+	}
+}
+
+// WithSkippedMessageKeyTTL はスキップしたメッセージキーを保持する期間を指定する
+// 0 を指定した場合は期間では破棄しない
+func WithSkippedMessageKeyTTL(d time.Duration) Option {
+	return func(e *Engine) {
+		e.skippedMessageKeyTTL = d
+	}
+}
+
+// WithMembershipChangeDebounce は QueueStartSession と QueueStopSession の入退室をまとめる期間を指定する
+// 最後にキューに入れてからこの期間に次の入退室が無ければ CommitMembershipChanges を呼ぶ
+func WithMembershipChangeDebounce(d time.Duration) Option {
+	return func(e *Engine) {
+		e.membershipChangeDebounce = d
+	}
+}
+
+// WithMaxMembershipChangeDelay は最初にキューに入れてから CommitMembershipChanges を呼ぶまでの最大の期間を指定する
+// 入退室が続いても、退室した参加者が SK を知ったままの期間はこれを超えない
+func WithMaxMembershipChangeDelay(d time.Duration) Option {
+	return func(e *Engine) {
+		e.maxMembershipChangeDelay = d
+	}
+}
+
+// WithRandom は鍵や nonce の生成に利用する乱数を指定する
+// 同じ値を返す io.Reader を指定すると、同じ鍵とメッセージを生成するので相互接続の検証やログの再現に利用できる
+// ハードウェアの乱数生成器を利用する場合にも指定する
+// 暗号論的に安全ではない io.Reader は指定しないこと
+// WithPQXDH と同時に指定する場合、ML-KEM のカプセル化の乱数を指定できない Go 1.26 より前では Init が ErrUnsupportedPQXDH を返す
+// 異なる相手の cipherMessage は並行して処理するため、random は Engine の中で排他して読む
+func WithRandom(random io.Reader) Option {
+	return func(e *Engine) {
+		e.random = &lockedReader{reader: random}
+	}
+}
+
+// WithRandom で指定された io.Reader は goroutine-safe とは限らないので、読み込みを排他する
+type lockedReader struct {
+	mu     sync.Mutex
+	reader io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reader.Read(p)
+}
+
+// WithClock は signedPreKey の猶予期間、保留したメッセージやスキップしたメッセージキーの期限の判定に利用する現在時刻を指定する
+func WithClock(now func() time.Time) Option {
+	return func(e *Engine) {
+		e.now = now
+	}
+}
+
+// WithHeaderEncryption は Double Ratchet のヘッダーを暗号化する
+// preKeyBundle の capabilities で公開して、相手も指定している場合のみ利用する
+// ヘッダーを暗号化したメッセージは、Sora からは送信元と宛先の ConnectionID 以外がわからなくなる
+func WithHeaderEncryption() Option {
+	return func(e *Engine) {
+		e.headerEncryption = true
+	}
+}
+
+// WithChaCha20Poly1305 は Double Ratchet の AEAD に AES-256-GCM の代わりに ChaCha20-Poly1305 を利用する
+// preKeyBundle の capabilities で公開して、相手も指定している場合のみ利用する
+// AES の命令を持たない端末では AES-256-GCM より速い
+func WithChaCha20Poly1305() Option {
+	return func(e *Engine) {
+		e.chaCha20Poly1305 = true
+	}
+}
+
+// WithPQXDH は X3DH に ML-KEM-768 を組み合わせた PQXDH を行う
+// pqPreKey を preKeyBundle で配布して、相手も指定している場合のみ利用する
+// Go 1.24 より古い Go でビルドした場合は指定しても公開しない
+// capabilities と同じく pqPreKey を取り除かれた場合は PQXDH を利用しないセッションになる
+func WithPQXDH() Option {
+	return func(e *Engine) {
+		e.pqxdh = true
+	}
+}
+
+// WithRequirePQXDH は WithPQXDH に加えて、PQXDH を利用しないセッションを開始しない
+// capabilities や pqPreKey を取り除かれて X3DH に戻されるのを防ぐ、相手も全員が WithPQXDH を指定している場合に利用する
+// PQXDH を利用しない preKeyBundle と preKeyMessage は ErrUnsupportedByRemote になる、グループモードでは PQXDH を利用しないので確認しない
+// PQXDH に対応していない Go でビルドした場合は Init が ErrUnsupportedPQXDH を返す
+func WithRequirePQXDH() Option {
+	return func(e *Engine) {
+		e.pqxdh = true
+		e.requirePQXDH = true
+	}
+}
+
+// WithIdentityStore は相手の識別子ごとに最初に受け取った identityKey を保存する IdentityStore を指定する
+// 指定しない場合はメモリに保存するため、Engine を破棄すると忘れる
+func WithIdentityStore(store IdentityStore) Option {
+	return func(e *Engine) {
+		e.identityStore = store
+	}
+}
+
+// WithGroupMode は参加者ごとのセッションで SK を送る代わりに、ratchet tree で全員の SK を導出するグループモードにする
+// 入退室のたびに送るメッセージが参加者数に比例しなくなる、参加者全員が指定している必要がある
+// KeyID はグループのエポックになり、全員が同じ KeyID に揃う
+// 宛先の ConnectionID がすべて 0 のメッセージは送信元以外の全員に送ること
+func WithGroupMode() Option {
+	return func(e *Engine) {
+		e.groupMode = true
+	}
+}
+
+// WithMLS はグループモードの鍵スケジュールと暗号化を RFC 9420 の MLS を元にしたものにする、WithGroupMode も指定したことになる
+// コミットと welcome は独自の形式なので、他の MLS の実装とは相互接続できない
+// preKeyBundle に signedPreKey を init_key にした KeyPackage を含め、SK は MLS の exporter から RFC 9605 の方法で導出する
+// KeyID は参加者ごとに異なり、木の中の葉のインデックスとエポックから決まる
+// 参加者全員が指定している必要がある
+func WithMLS() Option {
+	return func(e *Engine) {
+		e.groupMode = true
+		e.mls = true
+	}
+}
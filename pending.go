@@ -0,0 +1,105 @@
+package e2ee
+
+import (
+	"errors"
+	"time"
+)
+
+// 全体で保留するメッセージの最大数
+// 存在しない ConnectionID を大量に送られてもメモリを使い切らないようにする
+const maxTotalPendingMessages = 256
+
+type pendingMessage struct {
+	data       []byte
+	receivedAt time.Time
+}
+
+// セッションや preKeyBundle、グループモードの前のエポックが揃えば処理できるエラー
+func isPendingError(err error) bool {
+	return errors.Is(err, ErrMissingSession) || errors.Is(err, ErrMissingRemotePreKeyBundle) || errors.Is(err, ErrMissingGroupEpoch)
+}
+
+func (e *Engine) totalPendingMessages() int {
+	total := 0
+	for _, pendingMessages := range e.pendingMessages {
+		total += len(pendingMessages)
+	}
+	return total
+}
+
+// 呼び出し側がバッファを再利用しても変わらないように、data はコピーして保留する
+// 保留できなかった場合は false を返す
+func (e *Engine) addPendingMessage(remoteConnectionID string, data []byte, now time.Time) bool {
+	if e.pendingMessages == nil {
+		return false
+	}
+
+	e.removeExpiredPendingMessages(now)
+
+	if len(e.pendingMessages[remoteConnectionID]) >= e.maxPendingMessages {
+		return false
+	}
+	if e.totalPendingMessages() >= maxTotalPendingMessages {
+		return false
+	}
+
+	e.pendingMessages[remoteConnectionID] = append(e.pendingMessages[remoteConnectionID], pendingMessage{
+		data:       append([]byte(nil), data...),
+		receivedAt: now,
+	})
+	return true
+}
+
+func (e *Engine) removeExpiredPendingMessages(now time.Time) {
+	for remoteConnectionID, pendingMessages := range e.pendingMessages {
+		var remaining []pendingMessage
+		for _, pendingMessage := range pendingMessages {
+			if now.Sub(pendingMessage.receivedAt) < e.pendingMessageTTL {
+				remaining = append(remaining, pendingMessage)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(e.pendingMessages, remoteConnectionID)
+		} else {
+			e.pendingMessages[remoteConnectionID] = remaining
+		}
+	}
+}
+
+// 保留しているメッセージを届いた順に処理する
+// まだ処理できないメッセージは保留したままにして、次のメッセージを処理する
+// 処理に失敗したメッセージは破棄する
+func (e *Engine) drainPendingMessages(now time.Time) *ReceiveMessageResult {
+	result := &ReceiveMessageResult{}
+
+	e.removeExpiredPendingMessages(now)
+
+	// preKeyMessage を処理するとその相手の cipherMessage を処理できるようになるので、進まなくなるまで繰り返す
+	for progress := true; progress; {
+		progress = false
+		for remoteConnectionID, pendingMessages := range e.pendingMessages {
+			var remaining []pendingMessage
+			for _, pendingMessage := range pendingMessages {
+				r, err := e.receiveMessage(pendingMessage.data)
+				if isPendingError(err) {
+					remaining = append(remaining, pendingMessage)
+					continue
+				}
+				progress = true
+				if err != nil {
+					continue
+				}
+				result.merge(r)
+			}
+
+			if len(remaining) == 0 {
+				delete(e.pendingMessages, remoteConnectionID)
+			} else {
+				e.pendingMessages[remoteConnectionID] = remaining
+			}
+		}
+	}
+
+	return result
+}
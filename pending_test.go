@@ -0,0 +1,120 @@
+package e2ee
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingMessages(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	// preKeyBundle が届く前に cipherMessage と preKeyMessage が逆順で届く
+	preKeyMessage := append([]byte{}, r1.Messages[0]...)
+	cipherMessage := append([]byte{}, r1.Messages[1]...)
+	r2, err := bob.ReceiveMessage(cipherMessage)
+	assert.Nil(t, err)
+	assert.Empty(t, r2.RemoteSecretKeyMaterials)
+	assert.Empty(t, r2.Messages)
+
+	r3, err := bob.ReceiveMessage(preKeyMessage)
+	assert.Nil(t, err)
+	assert.Empty(t, r3.RemoteSecretKeyMaterials)
+	assert.Equal(t, 2, len(bob.pendingMessages[aliceConnectionID]))
+
+	// 呼び出し側がバッファを再利用しても保留したメッセージは変わらない
+	for _, b := range [][]byte{preKeyMessage, cipherMessage} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+
+	// preKeyBundle が届いたら保留していたメッセージを処理する
+	// 先に届いた cipherMessage は preKeyMessage の処理後に再度処理される
+	r4, err := bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(r4.RemoteSecretKeyMaterials))
+	assert.Equal(t, alice.secretKeyMaterial, r4.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.Equal(t, 1, len(r4.Messages))
+	assert.Empty(t, bob.pendingMessages)
+
+	r5, err := alice.ReceiveMessage(r4.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, bob.secretKeyMaterial, r5.RemoteSecretKeyMaterials[bobConnectionID].SecretKeyMaterial)
+}
+
+func TestPendingMessagesBeforePreKeyMessage(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	// preKeyMessage より先に cipherMessage が届く
+	r2, err := bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+	assert.Empty(t, r2.RemoteSecretKeyMaterials)
+
+	// preKeyMessage の結果に保留していた cipherMessage の結果が含まれる
+	r3, err := bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.secretKeyMaterial, r3.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.Equal(t, 1, len(r3.Messages))
+	assert.Empty(t, bob.pendingMessages)
+}
+
+func TestPendingMessagesLimit(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version, WithMaxPendingMessages(1), WithPendingMessageTTL(time.Minute))
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+
+	// 上限を超えたので保留せずにエラーを返す
+	_, err = bob.ReceiveMessage(r1.Messages[1])
+	assert.ErrorIs(t, err, ErrMissingSession)
+
+	// 期限が切れたメッセージは破棄する
+	bob.removeExpiredPendingMessages(time.Now().Add(time.Minute))
+	assert.Empty(t, bob.pendingMessages)
+}
@@ -0,0 +1,152 @@
+package e2ee
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// PQXDH
+// https://signal.org/docs/specifications/pqxdh/
+//
+// X3DH の DH に加えて ML-KEM-768 でカプセル化した共有秘密を rootKey の HKDF の入力に含める
+// 記録されたハンドシェイクが将来量子計算機で解読されても rootKey はわからない
+//
+// signedPreKey と同じ ID で pqPreKey を生成して preKeyBundle で配布し、
+// sender は相手の pqPreKey でカプセル化した暗号文を preKeyMessage で送る
+//
+// ML-KEM は Go 1.24 以降の crypto/mlkem を利用するため、それより古い Go でビルドした場合は対応しない
+
+const (
+	// ML-KEM-768 の encapsulation key
+	pqPreKeyLength = 1184
+	// ML-KEM-768 の暗号文
+	pqCiphertextLength = 1088
+	// ML-KEM-768 の decapsulation key を生成する seed
+	pqSeedLength = 64
+)
+
+// pqPreKey の秘密鍵は seed で保持する
+type pqPreKeyPair struct {
+	seed      []byte
+	publicKey []byte
+}
+
+func generatePQPreKeyPair(random io.Reader) (*pqPreKeyPair, error) {
+	seed := make([]byte, pqSeedLength)
+	if _, err := io.ReadFull(random, seed); err != nil {
+		return nil, err
+	}
+	return newPQPreKeyPair(seed)
+}
+
+func newPQPreKeyPair(seed []byte) (*pqPreKeyPair, error) {
+	publicKey, err := pqPublicKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &pqPreKeyPair{
+		seed:      seed,
+		publicKey: publicKey,
+	}, nil
+}
+
+// signedPreKey と入れ替えられないように signedPreKey の ID も署名対象に含める
+// <<SignedPreKeyID:32, PQPreKey:1184/binary>>
+func pqPreKeySignedData(signedPreKeyID uint32, publicKey []byte) []byte {
+	data := make([]byte, 4, 4+len(publicKey))
+	binary.BigEndian.PutUint32(data, signedPreKeyID)
+	return append(data, publicKey...)
+}
+
+func signPQPreKey(identityKeyPair ed25519KeyPair, signedPreKeyID uint32, publicKey []byte) []byte {
+	return ed25519.Sign(identityKeyPair.privateKey, pqPreKeySignedData(signedPreKeyID, publicKey))
+}
+
+func verifyPQPreKey(identityKey []byte, signedPreKeyID uint32, publicKey []byte, signature []byte) error {
+	if len(publicKey) != pqPreKeyLength {
+		return ErrInvalidPQPreKey
+	}
+	if !ed25519.Verify(identityKey, pqPreKeySignedData(signedPreKeyID, publicKey), signature) {
+		return ErrVerifyFailed
+	}
+	return nil
+}
+
+// WithPQXDH を指定していない場合や PQXDH に対応していない場合は nil を返す
+func (e *Engine) generatePQPreKeyPair() (*pqPreKeyPair, error) {
+	if !e.pqxdh || !pqxdhSupported {
+		return nil, nil
+	}
+	return generatePQPreKeyPair(e.random)
+}
+
+// WithRandom を指定した場合のみ、カプセル化の乱数も WithRandom の乱数から読む
+// 指定していない場合は nil を返し、crypto/mlkem が乱数を生成する
+func (e *Engine) pqRandom() io.Reader {
+	if e.random == rand.Reader {
+		return nil
+	}
+	return e.random
+}
+
+// WithRandom を指定しても乱数を指定してカプセル化できない場合は、
+// 同じ鍵から同じメッセージを生成できないので PQXDH を利用させない
+// WithRequirePQXDH を指定しても PQXDH に対応していない場合は、どの相手ともセッションを開始できない
+func (e *Engine) checkPQXDH() error {
+	if e.pqxdh && pqxdhSupported && !pqxdhDerandomized && e.pqRandom() != nil {
+		return ErrUnsupportedPQXDH
+	}
+	if e.requirePQXDH && !pqxdhSupported {
+		return ErrUnsupportedPQXDH
+	}
+	return nil
+}
+
+// WithRequirePQXDH を指定している場合、PQXDH を利用しない preKeyBundle や preKeyMessage を受け付けない
+func (e *Engine) checkRequirePQXDH(capabilities uint32) error {
+	if e.requirePQXDH && !e.groupMode && capabilities&capabilityPQXDH == 0 {
+		return ErrUnsupportedByRemote
+	}
+	return nil
+}
+
+// SessionPQXDH は相手とのセッションを PQXDH で開始したかどうかを返す
+// 相手とのセッションが無い場合は ErrMissingSession を返す
+func (e *Engine) SessionPQXDH(remoteConnectionID string) (bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	session, ok := e.sessions[remoteConnectionID]
+	if !ok {
+		return false, ErrMissingSession
+	}
+	return session.pqxdh(), nil
+}
+
+// 自分が公開している pqPreKey を返す、PQXDH を公開していない場合は nil
+func (e *Engine) selfPQPreKeyPair() *pqPreKeyPair {
+	if e.capabilities()&capabilityPQXDH == 0 {
+		return nil
+	}
+	return e.pqPreKeyPair
+}
+
+// preKeyMessage で指定された signedPreKey と同じ ID の pqPreKey を探す
+func (e *Engine) signedPQPreKeyPair(signedPreKeyID uint32) (*pqPreKeyPair, error) {
+	if signedPreKeyID == 0 || signedPreKeyID == e.signedPreKeyID {
+		if e.pqPreKeyPair == nil {
+			return nil, ErrMissingSignedPreKey
+		}
+		return e.pqPreKeyPair, nil
+	}
+
+	e.removeExpiredPreKeyPairs(e.now())
+
+	previousPreKeyPair, ok := e.previousPreKeyPairs[signedPreKeyID]
+	if !ok || previousPreKeyPair.pqPreKeyPair == nil {
+		return nil, ErrMissingSignedPreKey
+	}
+	return previousPreKeyPair.pqPreKeyPair, nil
+}
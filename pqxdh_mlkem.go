@@ -0,0 +1,45 @@
+//go:build go1.24
+
+package e2ee
+
+import (
+	"crypto/mlkem"
+	"io"
+)
+
+// crypto/mlkem が利用できるので PQXDH に対応する
+const pqxdhSupported = true
+
+func pqPublicKey(seed []byte) ([]byte, error) {
+	decapsulationKey, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, ErrInvalidPQPreKey
+	}
+	return decapsulationKey.EncapsulationKey().Bytes(), nil
+}
+
+// random が nil の場合はカプセル化の乱数を crypto/mlkem が生成する
+// WithRandom を指定した場合は random から読んだ乱数でカプセル化して、同じ暗号文になるようにする
+func pqEncapsulate(random io.Reader, publicKey []byte) ([]byte, []byte, error) {
+	encapsulationKey, err := mlkem.NewEncapsulationKey768(publicKey)
+	if err != nil {
+		return nil, nil, ErrInvalidPQPreKey
+	}
+	if random != nil {
+		return pqEncapsulateDerandomized(random, encapsulationKey)
+	}
+	sharedSecret, ciphertext := encapsulationKey.Encapsulate()
+	return sharedSecret, ciphertext, nil
+}
+
+func pqDecapsulate(seed []byte, ciphertext []byte) ([]byte, error) {
+	decapsulationKey, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, ErrInvalidPQPreKey
+	}
+	sharedSecret, err := decapsulationKey.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, ErrDecodeMessage
+	}
+	return sharedSecret, nil
+}
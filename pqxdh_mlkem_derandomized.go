@@ -0,0 +1,28 @@
+//go:build go1.26
+
+package e2ee
+
+import (
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"io"
+)
+
+// ML-KEM の乱数を指定してカプセル化できるのは Go 1.26 以降の crypto/mlkem/mlkemtest のみ
+const pqxdhDerandomized = true
+
+// ML-KEM.Encaps_internal の乱数
+const pqEncapsulationRandomLength = 32
+
+// FIPS 140-only モードでは乱数を指定できないので ErrUnsupportedPQXDH を返す
+func pqEncapsulateDerandomized(random io.Reader, encapsulationKey *mlkem.EncapsulationKey768) ([]byte, []byte, error) {
+	m := make([]byte, pqEncapsulationRandomLength)
+	if _, err := io.ReadFull(random, m); err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, ciphertext, err := mlkemtest.Encapsulate768(encapsulationKey, m)
+	if err != nil {
+		return nil, nil, ErrUnsupportedPQXDH
+	}
+	return sharedSecret, ciphertext, nil
+}
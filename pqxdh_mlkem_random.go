@@ -0,0 +1,16 @@
+//go:build go1.24 && !go1.26
+
+package e2ee
+
+import (
+	"crypto/mlkem"
+	"io"
+)
+
+// Go 1.26 より前の crypto/mlkem はカプセル化の乱数を指定できない
+// WithRandom と WithPQXDH を同時に指定すると同じ暗号文にならないので、Init と Import で ErrUnsupportedPQXDH を返す
+const pqxdhDerandomized = false
+
+func pqEncapsulateDerandomized(random io.Reader, encapsulationKey *mlkem.EncapsulationKey768) ([]byte, []byte, error) {
+	return nil, nil, ErrUnsupportedPQXDH
+}
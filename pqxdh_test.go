@@ -0,0 +1,338 @@
+//go:build go1.24
+
+package e2ee
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPQXDH(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version, WithPQXDH())
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version, WithPQXDH())
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	bobPreKeyBundle := bob.SelfPreKeyBundle()
+	assert.Equal(t, pqPreKeyLength, len(bobPreKeyBundle.PQPreKey))
+	assert.NotEqual(t, uint32(0), bobPreKeyBundle.Capabilities&capabilityPQXDH)
+
+	r1, err := alice.StartSession(bobConnectionID, bobPreKeyBundle)
+	assert.Nil(t, err)
+	assert.True(t, alice.sessions[bobConnectionID].pqxdh())
+	// 4+26+26+32+32+4+4 の後ろに Capabilities と PQCiphertext が続く
+	assert.Equal(t, 4+26+26+32+32+4+4+4+pqCiphertextLength, len(r1.Messages[0]))
+
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	r2, err := bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.secretKeyMaterial, r2.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.True(t, bob.sessions[aliceConnectionID].pqxdh())
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+
+	_, err = alice.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, bob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
+}
+
+func TestPQXDHNegotiation(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	for _, tc := range []struct {
+		name  string
+		alice []Option
+		bob   []Option
+		// bob の PreKeyBundle から pqPreKey を取り除く
+		stripPQPreKey bool
+		pqxdh         bool
+	}{
+		{name: "both", alice: []Option{WithPQXDH()}, bob: []Option{WithPQXDH()}, pqxdh: true},
+		{name: "sender only", alice: []Option{WithPQXDH()}},
+		{name: "receiver only", bob: []Option{WithPQXDH()}},
+		{name: "stripped pqPreKey", alice: []Option{WithPQXDH()}, bob: []Option{WithPQXDH()}, stripPQPreKey: true},
+		{name: "none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			alice := NewEngine(version, tc.alice...)
+			assert.Nil(t, alice.Init())
+			_, err := alice.Start(aliceConnectionID)
+			assert.Nil(t, err)
+
+			bob := NewEngine(version, tc.bob...)
+			assert.Nil(t, bob.Init())
+			_, err = bob.Start(bobConnectionID)
+			assert.Nil(t, err)
+
+			bobPreKeyBundle := bob.SelfPreKeyBundle()
+			if tc.stripPQPreKey {
+				bobPreKeyBundle.PQPreKey = nil
+				bobPreKeyBundle.PQPreKeySignature = nil
+			}
+
+			r1, err := alice.StartSession(bobConnectionID, bobPreKeyBundle)
+			assert.Nil(t, err)
+			_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+			assert.Nil(t, err)
+			_, err = bob.ReceiveMessage(r1.Messages[0])
+			assert.Nil(t, err)
+			r2, err := bob.ReceiveMessage(r1.Messages[1])
+			assert.Nil(t, err)
+			_, err = alice.ReceiveMessage(r2.Messages[0])
+			assert.Nil(t, err)
+
+			pqxdh, err := alice.SessionPQXDH(bobConnectionID)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.pqxdh, pqxdh)
+			pqxdh, err = bob.SessionPQXDH(aliceConnectionID)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.pqxdh, pqxdh)
+			assert.Equal(t, bob.secretKeyMaterial, alice.sessions[bobConnectionID].remoteSecretKeyMaterial)
+		})
+	}
+}
+
+// WithRequirePQXDH では pqPreKey や capabilities を取り除かれても X3DH に戻さない
+func TestPQXDHRequire(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	newEngine := func(connectionID string, options ...Option) *Engine {
+		e := NewEngine(version, options...)
+		assert.Nil(t, e.Init())
+		_, err := e.Start(connectionID)
+		assert.Nil(t, err)
+		return e
+	}
+	strip := func(p PreKeyBundle) PreKeyBundle {
+		p.PQPreKey = nil
+		p.PQPreKeySignature = nil
+		return p
+	}
+
+	// sender は pqPreKey を取り除かれた preKeyBundle ではセッションを開始しない
+	alice := newEngine(aliceConnectionID, WithRequirePQXDH())
+	bob := newEngine(bobConnectionID, WithPQXDH())
+	_, err := alice.StartSession(bobConnectionID, strip(bob.SelfPreKeyBundle()))
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+	_, err = alice.QueueStartSession(bobConnectionID, strip(bob.SelfPreKeyBundle()))
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+	assert.Empty(t, alice.remotePreKeyBundles)
+	assert.Empty(t, alice.membershipChanges)
+	_, err = alice.SessionPQXDH(bobConnectionID)
+	assert.ErrorIs(t, err, ErrMissingSession)
+
+	// capabilities を取り除かれた場合も同じ
+	p := bob.SelfPreKeyBundle()
+	p.Capabilities &^= capabilityPQXDH
+	_, err = alice.StartSession(bobConnectionID, p)
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+
+	// receiver は PQXDH を利用しない preKeyBundle を受け付けない
+	plain := newEngine(aliceConnectionID)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, plain.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	strict := newEngine(bobConnectionID, WithRequirePQXDH())
+	_, err = strict.AddPreKeyBundle(aliceConnectionID, plain.SelfPreKeyBundle())
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+
+	// PQXDH を利用しない preKeyMessage も受け付けない
+	downgraded := newEngine(aliceConnectionID, WithPQXDH())
+	r, err := downgraded.StartSession(bobConnectionID, strip(strict.SelfPreKeyBundle()))
+	assert.Nil(t, err)
+	_, err = strict.AddPreKeyBundle(aliceConnectionID, downgraded.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = strict.ReceiveMessage(r.Messages[0])
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+	assert.Empty(t, strict.sessions)
+
+	// 両方が PQXDH を利用する場合はセッションを開始できる
+	bob = newEngine(bobConnectionID, WithRequirePQXDH())
+	r, err = alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	for _, message := range r.Messages {
+		_, err = bob.ReceiveMessage(message)
+		assert.Nil(t, err)
+	}
+	pqxdh, err := bob.SessionPQXDH(aliceConnectionID)
+	assert.Nil(t, err)
+	assert.True(t, pqxdh)
+}
+
+func TestPQXDHPreKeyBundle(t *testing.T) {
+	bob := NewEngine(version, WithPQXDH())
+	assert.Nil(t, bob.Init())
+
+	p := bob.SelfPreKeyBundle()
+	_, err := newPreKeyBundle(p)
+	assert.Nil(t, err)
+
+	// 署名と一致しない pqPreKey は受け付けない
+	tampered := p
+	tampered.PQPreKey = append([]byte(nil), p.PQPreKey...)
+	tampered.PQPreKey[0] ^= 1
+	_, err = newPreKeyBundle(tampered)
+	assert.ErrorIs(t, err, ErrVerifyFailed)
+
+	// signedPreKey の ID も署名対象なので、別の ID では受け付けない
+	tampered = p
+	tampered.SignedPreKeyID++
+	_, err = newPreKeyBundle(tampered)
+	assert.ErrorIs(t, err, ErrVerifyFailed)
+
+	tampered = p
+	tampered.PQPreKey = p.PQPreKey[:pqPreKeyLength-1]
+	_, err = newPreKeyBundle(tampered)
+	assert.ErrorIs(t, err, ErrInvalidPQPreKey)
+
+	// 短い PQCiphertext は受け付けない
+	alice := NewEngine(version, WithPQXDH())
+	assert.Nil(t, alice.Init())
+	_, err = alice.Start("ALICE---------------------")
+	assert.Nil(t, err)
+	r, err := alice.StartSession("BOB-----------------------", p)
+	assert.Nil(t, err)
+	header, buf, err := decodeMessageHeader(r.Messages[0][:len(r.Messages[0])-1])
+	assert.Nil(t, err)
+	_, err = decodePreKeyMessage(*header, buf)
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+}
+
+func TestPQXDHResetSession(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t, WithPQXDH())
+	oldRootKey := bob.sessions[aliceConnectionID].rootKey
+
+	r1, err := alice.ResetSession(bobConnectionID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, typeExtendedResetMessage, r1.Messages[0][0])
+	assert.True(t, bytes.Contains(r1.Messages[0], alice.sessions[bobConnectionID].pqCiphertext))
+
+	r2, err := bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.secretKeyMaterial, r2.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+	assert.True(t, bob.sessions[aliceConnectionID].pqxdh())
+	assert.NotEqual(t, oldRootKey, bob.sessions[aliceConnectionID].rootKey)
+
+	_, err = alice.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+	assert.False(t, alice.sessions[bobConnectionID].resetPending)
+}
+
+func TestPQXDHRotateSignedPreKey(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	bob := NewEngine(version, WithPQXDH(), WithClock(func() time.Time { return now }))
+	assert.Nil(t, bob.Init())
+	_, err := bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	oldPreKeyBundle := bob.SelfPreKeyBundle()
+	newPreKeyBundle, err := bob.RotateSignedPreKey()
+	assert.Nil(t, err)
+	assert.NotEqual(t, oldPreKeyBundle.PQPreKey, newPreKeyBundle.PQPreKey)
+
+	// 古い preKeyBundle を持っている相手とも、猶予期間内なら PQXDH でセッションを作れる
+	alice := NewEngine(version, WithPQXDH())
+	assert.Nil(t, alice.Init())
+	_, err = alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+	r1, err := alice.StartSession(bobConnectionID, oldPreKeyBundle)
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.True(t, bob.sessions[aliceConnectionID].pqxdh())
+	assert.Equal(t, alice.sessions[bobConnectionID].rootKey, bob.sessions[aliceConnectionID].rootKey)
+}
+
+func TestPQXDHExportImport(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	passphraseKey := []byte("passphrase-key")
+
+	alice, bob := newTestEnginePair(t, WithPQXDH())
+	_, err := bob.RotateSignedPreKey()
+	assert.Nil(t, err)
+
+	blob, err := bob.Export(passphraseKey)
+	assert.Nil(t, err)
+
+	restoredBob := NewEngine(version, WithPQXDH())
+	assert.Nil(t, restoredBob.Import(passphraseKey, blob))
+	assert.Equal(t, bob.SelfPreKeyBundle(), restoredBob.SelfPreKeyBundle())
+	assert.Equal(t, bob.previousPreKeyPairs[1].pqPreKeyPair, restoredBob.previousPreKeyPairs[1].pqPreKeyPair)
+	assert.Equal(t, bob.remotePreKeyBundles[aliceConnectionID].pqPreKey, restoredBob.remotePreKeyBundles[aliceConnectionID].pqPreKey)
+	assert.True(t, restoredBob.sessions[aliceConnectionID].pqxdh())
+
+	// 復元した相手の preKeyBundle で PQXDH のセッションを作り直せる
+	r1, err := restoredBob.ResetSession(aliceConnectionID, nil)
+	assert.Nil(t, err)
+	r2, err := alice.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	assert.True(t, alice.sessions[bobConnectionID].pqxdh())
+	_, err = restoredBob.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+
+	// WithPQXDH を指定していない状態から復元した場合は pqPreKey を生成する
+	plain, _ := newTestEnginePair(t)
+	blob, err = plain.Export(passphraseKey)
+	assert.Nil(t, err)
+	restored := NewEngine(version, WithPQXDH())
+	assert.Nil(t, restored.Import(passphraseKey, blob))
+	assert.Equal(t, pqPreKeyLength, len(restored.SelfPreKeyBundle().PQPreKey))
+}
+
+// WithRandom を指定した場合は ML-KEM のカプセル化も含めて同じメッセージを生成する
+func TestPQXDHWithRandom(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	if !pqxdhDerandomized {
+		// カプセル化の乱数を指定できない場合は PQXDH を利用させない
+		alice := NewEngine(version, WithPQXDH(), WithRandom(newTestRandom("pqxdh alice")))
+		assert.ErrorIs(t, alice.Init(), ErrUnsupportedPQXDH)
+		return
+	}
+
+	var messages [][]byte
+	for i := 0; i < 2; i++ {
+		alice := NewEngine(version, WithPQXDH(), WithRandom(newTestRandom("pqxdh alice")))
+		assert.Nil(t, alice.Init())
+		_, err := alice.Start(aliceConnectionID)
+		assert.Nil(t, err)
+
+		bob := NewEngine(version, WithPQXDH(), WithRandom(newTestRandom("pqxdh bob")))
+		assert.Nil(t, bob.Init())
+		_, err = bob.Start(bobConnectionID)
+		assert.Nil(t, err)
+
+		r, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+		assert.Nil(t, err)
+		assert.True(t, alice.sessions[bobConnectionID].pqxdh())
+		messages = append(messages, r.Messages[0])
+	}
+	assert.Equal(t, messages[0], messages[1])
+}
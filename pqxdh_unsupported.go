@@ -0,0 +1,23 @@
+//go:build !go1.24
+
+package e2ee
+
+import "io"
+
+// crypto/mlkem が無いので PQXDH には対応しない
+// WithPQXDH を指定しても capabilities で公開しないため、相手も PQXDH を利用しない
+const pqxdhSupported = false
+
+const pqxdhDerandomized = false
+
+func pqPublicKey(seed []byte) ([]byte, error) {
+	return nil, ErrUnsupportedPQXDH
+}
+
+func pqEncapsulate(random io.Reader, publicKey []byte) ([]byte, []byte, error) {
+	return nil, nil, ErrUnsupportedPQXDH
+}
+
+func pqDecapsulate(seed []byte, ciphertext []byte) ([]byte, error) {
+	return nil, ErrUnsupportedPQXDH
+}
@@ -0,0 +1,127 @@
+package e2ee
+
+// このライブラリが扱えるプロトコルバージョン
+// メッセージヘッダーの Reserved だった 1 バイトに入れる
+//
+// 0: バージョンを持たない古いクライアント
+// 1: メッセージヘッダーのバージョンを Double Ratchet の AD に含める、SK のメッセージで capabilities を交換する
+const protocolVersion uint8 = 1
+
+// 相手と交換する capabilities
+// 相手が対応していない機能は利用しない
+const (
+	capabilityResetMessage uint32 = 1 << iota
+	// Double Ratchet のヘッダーを暗号化する、WithHeaderEncryption を指定した場合のみ公開する
+	capabilityHeaderEncryption
+	// Double Ratchet の AEAD に ChaCha20-Poly1305 を利用する、WithChaCha20Poly1305 を指定した場合のみ公開する
+	capabilityChaCha20Poly1305
+	// X3DH に ML-KEM-768 を組み合わせた PQXDH を行う、WithPQXDH を指定して pqPreKey を公開している場合のみ公開する
+	capabilityPQXDH
+	// ratchet tree で SK を共有するグループモード、WithGroupMode を指定した場合のみ公開する
+	// 全員が指定している必要があるため、セッションごとには合わせない
+	capabilityGroupMode
+	// グループモードで MLS の鍵スケジュールと KeyPackage を利用する、WithMLS を指定した場合のみ公開する
+	capabilityMLS
+)
+
+// セッションごとに sender と receiver で合わせる capabilities
+const sessionCapabilityMask = capabilityHeaderEncryption | capabilityChaCha20Poly1305 | capabilityPQXDH
+
+// 自分が対応している capabilities
+const selfCapabilities = capabilityResetMessage
+
+// 自分が公開する capabilities
+// preKeyBundle と SK のメッセージで相手に伝える
+func (e *Engine) capabilities() uint32 {
+	capabilities := selfCapabilities
+	if e.headerEncryption {
+		capabilities |= capabilityHeaderEncryption
+	}
+	if e.chaCha20Poly1305 {
+		capabilities |= capabilityChaCha20Poly1305
+	}
+	if e.pqxdh && e.pqPreKeyPair != nil {
+		capabilities |= capabilityPQXDH
+	}
+	if e.groupMode {
+		capabilities |= capabilityGroupMode
+	}
+	if e.mls {
+		capabilities |= capabilityMLS
+	}
+	return capabilities
+}
+
+// セッションで利用する機能は sender が自分の設定と相手の preKeyBundle の capabilities から決めて、
+// preKeyMessage で receiver に伝える
+// preKeyBundle を受け取る前に SK のメッセージを交換することはできないため、SK のメッセージの capabilities は利用しない
+// capabilities は署名の対象ではないため、pqPreKey を含まない preKeyBundle では PQXDH を利用しない
+func (e *Engine) sessionCapabilities(preKeyBundle preKeyBundle) uint32 {
+	capabilities := e.capabilities() & preKeyBundle.capabilities & sessionCapabilityMask
+	if preKeyBundle.pqPreKey == nil {
+		capabilities &^= capabilityPQXDH
+	}
+	return capabilities
+}
+
+func (s *session) headerEncryption() bool {
+	return s.capabilities&capabilityHeaderEncryption != 0
+}
+
+func (s *session) pqxdh() bool {
+	return s.capabilities&capabilityPQXDH != 0
+}
+
+func (s *session) aead() aeadAlgorithm {
+	if s.capabilities&capabilityChaCha20Poly1305 != 0 {
+		return aeadChaCha20Poly1305
+	}
+	return aeadAES256GCM
+}
+
+// セッションの開始時は相手のバージョンがわからないため 0 で送り、
+// SK のメッセージで相手のバージョンと capabilities を受け取ってから上げる
+// 古いクライアントは SK のメッセージの末尾を無視するので 0 のままになる
+func negotiateProtocolVersion(remoteProtocolVersion uint8) uint8 {
+	if remoteProtocolVersion < protocolVersion {
+		return remoteProtocolVersion
+	}
+	return protocolVersion
+}
+
+// バージョン 1 以降は AD にメッセージヘッダーのバージョンを含めて、書き換えられたら復号できないようにする
+func (s *session) messageAD(version uint8) []byte {
+	if version == 0 {
+		return s.ad
+	}
+	ad := make([]byte, 0, len(s.ad)+1)
+	ad = append(ad, s.ad...)
+	return append(ad, version)
+}
+
+func (s *session) hasRemoteCapability(capability uint32) bool {
+	return s.remoteCapabilities&capability != 0
+}
+
+// 自分が扱えないバージョンと、相手が一度上げたバージョンより小さいメッセージは受け付けない
+func (s *session) checkProtocolVersion(version uint8) error {
+	if version > protocolVersion || version < s.remoteProtocolVersion {
+		return ErrUnsupportedProtocolVersion
+	}
+	return nil
+}
+
+// 復号できたメッセージのバージョンと、SK のメッセージに含まれる相手のバージョンと capabilities を反映する
+func (s *session) updateProtocolVersion(version uint8, m *senderKeyMessage) {
+	if version > s.remoteProtocolVersion {
+		s.remoteProtocolVersion = version
+	}
+	if !m.hasCapabilities {
+		return
+	}
+	s.remoteCapabilities = m.capabilities
+	// バージョンは下げない
+	if negotiated := negotiateProtocolVersion(m.protocolVersion); negotiated > s.protocolVersion {
+		s.protocolVersion = negotiated
+	}
+}
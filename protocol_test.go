@@ -0,0 +1,148 @@
+package e2ee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// remote から self に指定したバージョンで cipherMessage を送る
+// legacy の場合は古いクライアントと同じく capabilities を含めない
+func testVersionedCipherMessage(t *testing.T, remote *Engine, selfConnectionID string, version uint8, legacy bool) []byte {
+	session := remote.sessions[selfConnectionID]
+	plaintext, err := remote.plaintext()
+	assert.Nil(t, err)
+	if legacy {
+		plaintext = plaintext[:4+32]
+	}
+
+	sessionProtocolVersion := session.protocolVersion
+	session.protocolVersion = version
+	defer func() { session.protocolVersion = sessionProtocolVersion }()
+
+	header, ciphertext, err := session.ratchetState.ratchetEncrypt(plaintext, session.messageAD(version))
+	assert.Nil(t, err)
+	message, err := session.cipherMessage(header, ciphertext)
+	assert.Nil(t, err)
+	return message
+}
+
+func TestProtocolVersionNegotiation(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+
+	aliceSession := alice.sessions[bobConnectionID]
+	assert.Equal(t, protocolVersion, aliceSession.protocolVersion)
+	assert.Equal(t, protocolVersion, aliceSession.remoteProtocolVersion)
+	assert.Equal(t, selfCapabilities, aliceSession.remoteCapabilities)
+
+	bobSession := bob.sessions[aliceConnectionID]
+	assert.Equal(t, protocolVersion, bobSession.protocolVersion)
+	// alice からはまだ 0 のメッセージしか届いていない
+	assert.Equal(t, uint8(0), bobSession.remoteProtocolVersion)
+	assert.Equal(t, selfCapabilities, bobSession.remoteCapabilities)
+
+	// 一度上がったら下げたメッセージは受け付けない
+	_, err := bob.ReceiveMessage(testVersionedCipherMessage(t, alice, bobConnectionID, protocolVersion, false))
+	assert.Nil(t, err)
+	assert.Equal(t, protocolVersion, bobSession.remoteProtocolVersion)
+
+	_, err = bob.ReceiveMessage(testVersionedCipherMessage(t, alice, bobConnectionID, 0, false))
+	assert.ErrorIs(t, err, ErrUnsupportedProtocolVersion)
+
+	// 扱えないバージョン
+	_, err = bob.ReceiveMessage(testVersionedCipherMessage(t, alice, bobConnectionID, protocolVersion+1, false))
+	assert.ErrorIs(t, err, ErrUnsupportedProtocolVersion)
+}
+
+func TestProtocolVersionTampered(t *testing.T) {
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+
+	message := testVersionedCipherMessage(t, alice, bobConnectionID, protocolVersion, false)
+
+	// ヘッダーのバージョンを書き換えると AD が変わるので復号できない
+	tampered := append([]byte{}, message...)
+	tampered[1] = 0
+	_, err := bob.ReceiveMessage(tampered)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+
+	_, err = bob.ReceiveMessage(message)
+	assert.Nil(t, err)
+}
+
+func TestProtocolVersionLegacyRemote(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	// 相手のバージョンがわからないので 0 で送る
+	for _, message := range r1.Messages {
+		assert.Equal(t, uint8(0), message[1])
+	}
+
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+
+	// bob が古いクライアントの場合の返信
+	r2, err := alice.ReceiveMessage(testVersionedCipherMessage(t, bob, aliceConnectionID, 0, true))
+	assert.Nil(t, err)
+	assert.Equal(t, bob.secretKeyMaterial, r2.RemoteSecretKeyMaterials[bobConnectionID].SecretKeyMaterial)
+
+	aliceSession := alice.sessions[bobConnectionID]
+	assert.Equal(t, uint8(0), aliceSession.protocolVersion)
+	assert.Equal(t, uint32(0), aliceSession.remoteCapabilities)
+
+	// 古いクライアントは resetMessage を処理できない
+	_, err = alice.ResetSession(bobConnectionID, nil)
+	assert.ErrorIs(t, err, ErrUnsupportedByRemote)
+}
+
+func TestDecodeSenderKeyMessage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, uint32(1)))
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, make([]byte, 32)))
+
+	// 古いクライアント
+	m, err := decodeSenderKeyMessage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), m.keyID)
+	assert.False(t, m.hasCapabilities)
+
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, uint8(2)))
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, uint32(3)))
+
+	m, err = decodeSenderKeyMessage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.True(t, m.hasCapabilities)
+	assert.Equal(t, uint8(2), m.protocolVersion)
+	assert.Equal(t, uint32(3), m.capabilities)
+	// 扱えるバージョンまで下げる
+	assert.Equal(t, protocolVersion, negotiateProtocolVersion(m.protocolVersion))
+
+	// 途中で切れている場合は他のメッセージと同じエラーにする
+	for _, n := range []int{0, 3, 35, 37, buf.Len() - 1} {
+		_, err = decodeSenderKeyMessage(buf.Bytes()[:n])
+		assert.ErrorIs(t, err, ErrDecodeMessage, n)
+	}
+}
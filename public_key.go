@@ -1,10 +1,8 @@
 package e2ee
 
 import (
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"io"
 	"strings"
 
@@ -33,9 +31,9 @@ type x25519KeyPair struct {
 	privateKey x25519PrivateKey
 }
 
-func generateX25519KeyPair() (*x25519KeyPair, error) {
+func generateX25519KeyPair(random io.Reader) (*x25519KeyPair, error) {
 	privateKey := make([]byte, curve25519.ScalarSize)
-	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+	if _, err := io.ReadFull(random, privateKey); err != nil {
 		return nil, err
 	}
 	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
@@ -60,8 +58,8 @@ type ed25519KeyPair struct {
 	privateKey []byte
 }
 
-func generateEd25519KeyPair() (*ed25519KeyPair, error) {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+func generateEd25519KeyPair(random io.Reader) (*ed25519KeyPair, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(random)
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +82,7 @@ func publicEd25519KeyToCurve25519(edPubKey ed25519PublicKey) (x25519PublicKey, e
 	var curveKey [32]byte
 	copy(edPk[:], edPubKey)
 	if !extra25519.PublicKeyToCurve25519(&curveKey, &edPk) {
-		return curveKey, errors.New("Ed25519ToCurve25519PublicKeyConvertError")
+		return curveKey, ErrInvalidPublicKey
 	}
 
 	return curveKey, nil
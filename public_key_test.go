@@ -11,10 +11,10 @@ import (
 )
 
 func TestEd25519ToX25519(t *testing.T) {
-	ed25519KeyPair1, err := generateEd25519KeyPair()
+	ed25519KeyPair1, err := generateEd25519KeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	ed25519KeyPair2, err := generateEd25519KeyPair()
+	ed25519KeyPair2, err := generateEd25519KeyPair(rand.Reader)
 	assert.Nil(t, err)
 
 	x25519PrivateKey1 := ed25519KeyPair1.privateEd25519KeyToCurve25519()
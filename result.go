@@ -0,0 +1,75 @@
+package e2ee
+
+import "time"
+
+// RemoteSecretKeyMaterial は相手の KeyID と SecretKeyMaterial の組
+type RemoteSecretKeyMaterial struct {
+	KeyID             uint32
+	SecretKeyMaterial []byte
+}
+
+// StartSessionResult は StartSession の結果
+type StartSessionResult struct {
+	SelfConnectionID         string
+	SelfKeyID                uint32
+	SelfSecretKeyMaterial    []byte
+	RemoteSecretKeyMaterials map[string]RemoteSecretKeyMaterial
+	Messages                 [][]byte
+}
+
+// StopSessionResult は StopSession の結果
+type StopSessionResult struct {
+	SelfConnectionID      string
+	SelfKeyID             uint32
+	SelfSecretKeyMaterial []byte
+	// グループモードの場合のみ、残りの参加者の新しいエポックの SK
+	RemoteSecretKeyMaterials map[string]RemoteSecretKeyMaterial
+	Messages                 [][]byte
+}
+
+// QueueSessionResult は QueueStartSession と QueueStopSession の結果
+// Deadline は CommitMembershipChanges を呼ぶ時刻で、キューに入れるたびに後ろにずれる、キューが空になった場合はゼロ値
+type QueueSessionResult struct {
+	Deadline time.Time
+}
+
+// CommitMembershipChangesResult は CommitMembershipChanges の結果
+// RemoteSecretKeyMaterials はグループモードの場合のみ、全員の新しいエポックの SK
+type CommitMembershipChangesResult struct {
+	SelfConnectionID         string
+	SelfKeyID                uint32
+	SelfSecretKeyMaterial    []byte
+	RemoteSecretKeyMaterials map[string]RemoteSecretKeyMaterial
+	Messages                 [][]byte
+}
+
+// ResetSessionResult は ResetSession の結果
+// 自分の KeyID と SecretKeyMaterial は変更しない
+type ResetSessionResult struct {
+	SelfConnectionID string
+	Messages         [][]byte
+}
+
+// ReceiveMessageResult は ReceiveMessage の結果
+type ReceiveMessageResult struct {
+	RemoteSecretKeyMaterials map[string]RemoteSecretKeyMaterial
+	Messages                 [][]byte
+	// グループモードでエポックが進んだ場合のみ、自分の新しい KeyID と SecretKeyMaterial
+	SelfKeyID             uint32
+	SelfSecretKeyMaterial []byte
+}
+
+// 後の結果で上書きする
+func (r *ReceiveMessageResult) merge(other *ReceiveMessageResult) {
+	if len(other.RemoteSecretKeyMaterials) > 0 && r.RemoteSecretKeyMaterials == nil {
+		r.RemoteSecretKeyMaterials = make(map[string]RemoteSecretKeyMaterial)
+	}
+	for connectionID, remoteSecretKeyMaterial := range other.RemoteSecretKeyMaterials {
+		r.RemoteSecretKeyMaterials[connectionID] = remoteSecretKeyMaterial
+	}
+	r.Messages = append(r.Messages, other.Messages...)
+	if other.SelfSecretKeyMaterial != nil {
+		r.SelfKeyID = other.SelfKeyID
+		r.SelfSecretKeyMaterial = other.SelfSecretKeyMaterial
+	}
+}
@@ -0,0 +1,176 @@
+package e2ee
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// セーフティナンバー
+// https://signal.org/docs/specifications/fingerprint/
+//
+// 自分と相手の identityKey から、どちらから求めても同じになる値を生成する
+// 会議の参加者同士で数字や絵文字を読み上げたり、QR コードを読み取ったりして相手の identityKey を確認する
+//
+// ConnectionID は接続するたびに変わるため、アプリケーションが管理する変わらない識別子を identifier として指定する
+// identifier を指定しない場合は identityKey だけから生成する
+
+const (
+	safetyNumberVersion uint16 = 0
+	// 総当たりで同じ値になる identityKey を探すのを難しくするための繰り返し回数
+	safetyNumberIterations = 5200
+	// 1 人分のハッシュの長さ、QR コードにはこの長さで含める
+	safetyNumberFingerprintLength = 32
+	// 1 人分の数字は 5 桁 x 6 グループ
+	safetyNumberGroups     = 6
+	safetyNumberGroupBytes = 5
+	// 絵文字は 1 つで 6 ビットを表す
+	safetyNumberEmojiCount = 10
+
+	safetyNumberPayloadVersion uint8 = 0
+	// <<Version:8, SelfFingerprint:32/binary, RemoteFingerprint:32/binary>>
+	safetyNumberPayloadLength = 1 + safetyNumberFingerprintLength*2
+)
+
+// 読み間違えにくく、多くの環境で表示できる 64 個の絵文字
+var safetyNumberEmoji = [64]string{
+	"🐶", "🐱", "🐭", "🐹", "🐰", "🦊", "🐻", "🐼",
+	"🐨", "🐯", "🦁", "🐮", "🐷", "🐸", "🐵", "🐔",
+	"🐧", "🐦", "🦆", "🦉", "🐴", "🦄", "🐝", "🐛",
+	"🦋", "🐌", "🐞", "🐢", "🐍", "🐙", "🦀", "🐬",
+	"🐳", "🦈", "🐘", "🦒", "🌵", "🌲", "🌻", "🍄",
+	"🌙", "⭐", "🔥", "🌈", "⛄", "☔", "🍎", "🍋",
+	"🍌", "🍉", "🍇", "🍓", "🍒", "🍍", "🥕", "🌽",
+	"🍞", "🧀", "🍩", "🍪", "🎂", "☕", "🎈", "🔑",
+}
+
+// SafetyNumber は自分と相手の identityKey から生成したセーフティナンバー
+// 自分と相手のどちらで生成しても Numeric と Emoji は同じ値になる
+type SafetyNumber struct {
+	// 5 桁の数字 12 グループを空白で区切ったもの
+	Numeric string
+	Emoji   []string
+	// QR コードに含める値、相手の VerifySafetyNumber に渡す
+	Payload []byte
+}
+
+// SafetyNumber は相手とのセーフティナンバーを返す
+// selfIdentifier と remoteIdentifier は相手も同じ値を逆にして指定すること
+func (e *Engine) SafetyNumber(remoteConnectionID string, selfIdentifier string, remoteIdentifier string) (*SafetyNumber, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	remotePreKeyBundle, ok := e.remotePreKeyBundles[remoteConnectionID]
+	if !ok {
+		return nil, ErrMissingRemotePreKeyBundle
+	}
+
+	self := safetyNumberFingerprint(e.identityKeyPair.publicKey, selfIdentifier)
+	remote := safetyNumberFingerprint(remotePreKeyBundle.identityKey, remoteIdentifier)
+	return newSafetyNumber(self, remote), nil
+}
+
+// VerifySafetyNumber は相手の SafetyNumber の Payload と自分のセーフティナンバーが一致するかを返す
+// Payload の形式が正しくない場合は ErrInvalidSafetyNumber を返す
+func (e *Engine) VerifySafetyNumber(remoteConnectionID string, selfIdentifier string, remoteIdentifier string, payload []byte) (bool, error) {
+	self, remote, err := decodeSafetyNumberPayload(payload)
+	if err != nil {
+		return false, err
+	}
+
+	safetyNumber, err := e.SafetyNumber(remoteConnectionID, selfIdentifier, remoteIdentifier)
+	if err != nil {
+		return false, err
+	}
+
+	// 相手の Payload は自分と相手が逆になっている
+	expectedSelf, expectedRemote, err := decodeSafetyNumberPayload(safetyNumber.Payload)
+	if err != nil {
+		return false, err
+	}
+	selfMatched := subtle.ConstantTimeCompare(self, expectedRemote)
+	remoteMatched := subtle.ConstantTimeCompare(remote, expectedSelf)
+	return selfMatched&remoteMatched == 1, nil
+}
+
+// SHA-512(<<Version:16, IdentityKey/binary, Identifier/binary>>) から始めて、
+// SHA-512(<<Hash/binary, IdentityKey/binary>>) を繰り返した先頭 32 バイト
+func safetyNumberFingerprint(identityKey []byte, identifier string) []byte {
+	hash := sha512.New()
+	buf := make([]byte, 2, 2+len(identityKey)+len(identifier))
+	binary.BigEndian.PutUint16(buf, safetyNumberVersion)
+	buf = append(buf, identityKey...)
+	buf = append(buf, identifier...)
+
+	for i := 0; i < safetyNumberIterations; i++ {
+		hash.Reset()
+		hash.Write(buf)
+		buf = append(hash.Sum(buf[:0]), identityKey...)
+	}
+
+	return buf[:safetyNumberFingerprintLength]
+}
+
+func newSafetyNumber(self []byte, remote []byte) *SafetyNumber {
+	payload := make([]byte, 0, safetyNumberPayloadLength)
+	payload = append(payload, safetyNumberPayloadVersion)
+	payload = append(payload, self...)
+	payload = append(payload, remote...)
+
+	// どちらから求めても同じになるように、数字の小さい方を先に並べる
+	selfNumeric := safetyNumberNumeric(self)
+	remoteNumeric := safetyNumberNumeric(remote)
+	first, second := self, remote
+	numeric := append(selfNumeric, remoteNumeric...)
+	if strings.Join(remoteNumeric, "") < strings.Join(selfNumeric, "") {
+		first, second = remote, self
+		numeric = append(remoteNumeric, selfNumeric...)
+	}
+
+	return &SafetyNumber{
+		Numeric: strings.Join(numeric, " "),
+		Emoji:   safetyNumberEmojiSequence(first, second),
+		Payload: payload,
+	}
+}
+
+// 5 バイトずつ 100000 で割った余りを 5 桁の数字にする
+func safetyNumberNumeric(fingerprint []byte) []string {
+	groups := make([]string, 0, safetyNumberGroups)
+	for i := 0; i < safetyNumberGroups; i++ {
+		chunk := fingerprint[i*safetyNumberGroupBytes : (i+1)*safetyNumberGroupBytes]
+		var n uint64
+		for _, b := range chunk {
+			n = n<<8 | uint64(b)
+		}
+		groups = append(groups, fmt.Sprintf("%05d", n%100000))
+	}
+	return groups
+}
+
+// SHA-256(<<First/binary, Second/binary>>) の先頭から 6 ビットずつ絵文字にする
+func safetyNumberEmojiSequence(first []byte, second []byte) []string {
+	sum := sha256.Sum256(append(append([]byte{}, first...), second...))
+
+	emoji := make([]string, 0, safetyNumberEmojiCount)
+	var bits uint64
+	for _, b := range sum[:8] {
+		bits = bits<<8 | uint64(b)
+	}
+	for i := 0; i < safetyNumberEmojiCount; i++ {
+		emoji = append(emoji, safetyNumberEmoji[(bits>>(64-6*(i+1)))&0x3f])
+	}
+	return emoji
+}
+
+func decodeSafetyNumberPayload(payload []byte) ([]byte, []byte, error) {
+	if len(payload) != safetyNumberPayloadLength || payload[0] != safetyNumberPayloadVersion {
+		return nil, nil, ErrInvalidSafetyNumber
+	}
+	self := payload[1 : 1+safetyNumberFingerprintLength]
+	remote := payload[1+safetyNumberFingerprintLength:]
+	return self, remote, nil
+}
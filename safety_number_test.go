@@ -0,0 +1,92 @@
+package e2ee
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+
+	aliceSafetyNumber, err := alice.SafetyNumber(bobConnectionID, "alice", "bob")
+	assert.Nil(t, err)
+	bobSafetyNumber, err := bob.SafetyNumber(aliceConnectionID, "bob", "alice")
+	assert.Nil(t, err)
+
+	// どちらから求めても同じ値になる
+	assert.Regexp(t, regexp.MustCompile(`^[0-9]{5}( [0-9]{5}){11}$`), aliceSafetyNumber.Numeric)
+	assert.Equal(t, aliceSafetyNumber.Numeric, bobSafetyNumber.Numeric)
+	assert.Equal(t, safetyNumberEmojiCount, len(aliceSafetyNumber.Emoji))
+	assert.Equal(t, aliceSafetyNumber.Emoji, bobSafetyNumber.Emoji)
+	assert.Equal(t, safetyNumberPayloadLength, len(aliceSafetyNumber.Payload))
+	assert.NotEqual(t, aliceSafetyNumber.Payload, bobSafetyNumber.Payload)
+
+	// 相手の Payload を読み取って確認する
+	ok, err := alice.VerifySafetyNumber(bobConnectionID, "alice", "bob", bobSafetyNumber.Payload)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = bob.VerifySafetyNumber(aliceConnectionID, "bob", "alice", aliceSafetyNumber.Payload)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// 自分の Payload は相手のものではない
+	ok, err = alice.VerifySafetyNumber(bobConnectionID, "alice", "bob", aliceSafetyNumber.Payload)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// identifier が異なる場合は一致しない
+	other, err := bob.SafetyNumber(aliceConnectionID, "bob", "mallory")
+	assert.Nil(t, err)
+	assert.NotEqual(t, aliceSafetyNumber.Numeric, other.Numeric)
+	ok, err = alice.VerifySafetyNumber(bobConnectionID, "alice", "bob", other.Payload)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = alice.VerifySafetyNumber(bobConnectionID, "alice", "bob", bobSafetyNumber.Payload[1:])
+	assert.ErrorIs(t, err, ErrInvalidSafetyNumber)
+	_, err = alice.SafetyNumber("CAROL---------------------", "alice", "carol")
+	assert.ErrorIs(t, err, ErrMissingRemotePreKeyBundle)
+}
+
+// identityKey が変わった場合はセーフティナンバーも変わる
+func TestSafetyNumberIdentityKeyChanged(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice, bob := newTestEnginePair(t)
+	before, err := alice.SafetyNumber(bobConnectionID, "", "")
+	assert.Nil(t, err)
+
+	// 同じ ConnectionID で別の identityKey を持つ相手に置き換わる
+	mallory, _ := newTestEnginePair(t)
+	_, err = alice.StopSession(bobConnectionID)
+	assert.Nil(t, err)
+	_, err = alice.StartSession(bobConnectionID, mallory.SelfPreKeyBundle())
+	assert.Nil(t, err)
+
+	after, err := alice.SafetyNumber(bobConnectionID, "", "")
+	assert.Nil(t, err)
+	assert.NotEqual(t, before.Numeric, after.Numeric)
+
+	bobSafetyNumber, err := bob.SafetyNumber(aliceConnectionID, "", "")
+	assert.Nil(t, err)
+	ok, err := alice.VerifySafetyNumber(bobConnectionID, "", "", bobSafetyNumber.Payload)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestSafetyNumberFingerprint(t *testing.T) {
+	// 同じ入力からは常に同じ値になる
+	identityKey := make([]byte, 32)
+	assert.Equal(t, safetyNumberFingerprint(identityKey, "alice"), safetyNumberFingerprint(identityKey, "alice"))
+	assert.NotEqual(t, safetyNumberFingerprint(identityKey, "alice"), safetyNumberFingerprint(identityKey, "bob"))
+	assert.Equal(t, safetyNumberFingerprintLength, len(safetyNumberFingerprint(identityKey, "")))
+
+	numeric := safetyNumberNumeric(make([]byte, safetyNumberFingerprintLength))
+	assert.Equal(t, []string{"00000", "00000", "00000", "00000", "00000", "00000"}, numeric)
+}
@@ -3,6 +3,9 @@ package e2ee
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"math"
+	"sync"
 )
 
 type role uint
@@ -13,21 +16,38 @@ const (
 )
 
 type session struct {
+	// Engine の読み込みロック中に ratchetState などを変更する場合に取る
+	// Engine の書き込みロック中は取る必要はない
+	mu sync.Mutex
+
 	role             role
 	selfConnectionID string
 
 	selfIdenityKeyPair   ed25519KeyPair
 	selfPreKeyPair       x25519KeyPair
 	selfEphemeralKeyPair x25519KeyPair
+	// receiver の場合のみ、相手が oneTimePreKey を利用した場合に設定される
+	selfOneTimePreKeyPair *x25519KeyPair
 
 	remoteConnectionID      string
 	remoteKeyID             uint32
 	remoteSecretKeyMaterial []byte
 
 	remoteIdentityKey           []byte
+	remoteSignedPreKeyID        uint32
 	remoteSignedPreKey          x25519PublicKey
 	remoteSignedPreKeySignature []byte
 	remoteEphemeralKey          x25519PublicKey
+	// sender の場合のみ、相手の oneTimePreKey を利用する場合に設定される
+	remoteOneTimePreKey *oneTimePreKey
+	// sender の場合のみ、相手が PQXDH に対応している場合に設定される
+	remotePQPreKey []byte
+	// receiver の場合のみ、PQXDH を利用する場合に設定される
+	selfPQPreKeyPair *pqPreKeyPair
+
+	// PQXDH の暗号文、sender は preKeyMessage で送り receiver は preKeyMessage から受け取る
+	// rootKey を導出した後は利用しないので保存しない
+	pqCiphertext []byte
 
 	// X3DH の戻り値
 	rootKey []byte
@@ -36,21 +56,48 @@ type session struct {
 	ad []byte
 
 	ratchetState *ratchetState
+
+	// ResetSession で作り直してから、相手のメッセージをまだ復号できていない
+	resetPending bool
+
+	// 相手に送るメッセージのプロトコルバージョン
+	protocolVersion uint8
+	// 相手から届いたメッセージの最大のプロトコルバージョン、これより小さいメッセージは受け付けない
+	remoteProtocolVersion uint8
+	remoteCapabilities    uint32
+
+	// このセッションで利用する機能、sender が決めて preKeyMessage で receiver に伝える
+	capabilities uint32
 }
 
 func (s *session) x25519RemoteIdentityKey() (x25519PublicKey, error) {
 	return publicEd25519KeyToCurve25519(s.remoteIdentityKey)
 }
 
-func (s *session) senderRootKey() error {
+func (s *session) senderRootKey(random io.Reader) error {
 	remoteIdentityKey, err := s.x25519RemoteIdentityKey()
 	if err != nil {
 		return err
 	}
 
+	var remoteOneTimePreKey *x25519PublicKey
+	if s.remoteOneTimePreKey != nil {
+		remoteOneTimePreKey = &s.remoteOneTimePreKey.publicKey
+	}
+
+	var pqSharedSecret []byte
+	if s.pqxdh() {
+		sharedSecret, ciphertext, err := pqEncapsulate(random, s.remotePQPreKey)
+		if err != nil {
+			return err
+		}
+		pqSharedSecret = sharedSecret
+		s.pqCiphertext = ciphertext
+	}
+
 	rootKey, err := senderRootKey(
 		s.selfIdenityKeyPair.privateEd25519KeyToCurve25519(), s.selfEphemeralKeyPair.privateKey,
-		remoteIdentityKey, s.remoteSignedPreKey)
+		remoteIdentityKey, s.remoteSignedPreKey, remoteOneTimePreKey, pqSharedSecret)
 	if err != nil {
 		return err
 	}
@@ -68,9 +115,26 @@ func (s *session) receiverRootKey() error {
 		return err
 	}
 
+	var selfOneTimePrePrivateKey *x25519PrivateKey
+	if s.selfOneTimePreKeyPair != nil {
+		selfOneTimePrePrivateKey = &s.selfOneTimePreKeyPair.privateKey
+	}
+
+	var pqSharedSecret []byte
+	if s.pqxdh() {
+		if s.selfPQPreKeyPair == nil {
+			return ErrMissingSignedPreKey
+		}
+		sharedSecret, err := pqDecapsulate(s.selfPQPreKeyPair.seed, s.pqCiphertext)
+		if err != nil {
+			return err
+		}
+		pqSharedSecret = sharedSecret
+	}
+
 	rootKey, err := receiverRootKey(
 		s.selfIdenityKeyPair.privateEd25519KeyToCurve25519(), s.selfPreKeyPair.privateKey,
-		remoteIdentityKey, s.remoteEphemeralKey)
+		remoteIdentityKey, s.remoteEphemeralKey, selfOneTimePrePrivateKey, pqSharedSecret)
 	if err != nil {
 		return err
 	}
@@ -82,43 +146,95 @@ func (s *session) receiverRootKey() error {
 	return nil
 }
 
-func (s *session) senderRatchetInit(sk []byte, preKeyBundle preKeyBundle) error {
-	ratchetState, err := senderRatchetInit(sk, preKeyBundle)
+func (s *session) senderRatchetInit(random io.Reader, sk []byte, preKeyBundle preKeyBundle) error {
+	var ratchetState *ratchetState
+	var err error
+	if s.headerEncryption() {
+		ratchetState, err = senderRatchetInitHE(random, sk, preKeyBundle)
+	} else {
+		ratchetState, err = senderRatchetInit(random, sk, preKeyBundle)
+	}
 	if err != nil {
 		return err
 	}
+	ratchetState.aead = s.aead()
 	s.ratchetState = ratchetState
 
 	return nil
 }
 
-func (s *session) receiverRatchetInit() {
-	s.ratchetState = receiverRatchetInit(s.rootKey, s.selfPreKeyPair.publicKey, s.selfPreKeyPair.privateKey)
+func (s *session) receiverRatchetInit() error {
+	if !s.headerEncryption() {
+		s.ratchetState = receiverRatchetInit(s.rootKey, s.selfPreKeyPair.publicKey, s.selfPreKeyPair.privateKey)
+		s.ratchetState.aead = s.aead()
+		return nil
+	}
+
+	ratchetState, err := receiverRatchetInitHE(s.rootKey, s.selfPreKeyPair.publicKey, s.selfPreKeyPair.privateKey)
+	if err != nil {
+		return err
+	}
+	ratchetState.aead = s.aead()
+	s.ratchetState = ratchetState
+
+	return nil
 }
 
-func (s *session) ratchetSecretKeymaterial() error {
+// 相手が StartSession で ratchet した次の KeyID と SK を返す、状態は変更しない
+func (s *session) nextRemoteSecretKeyMaterial() (uint32, []byte, error) {
+	// KeyID が一周する場合、相手は新しく生成した SK を送ってくるので予測しない
+	if s.remoteKeyID == math.MaxUint32 {
+		return s.remoteKeyID, s.remoteSecretKeyMaterial, nil
+	}
 	newRemoteSecretKeyMaterial, err := ratchetSecretKeyMaterial(s.remoteSecretKeyMaterial)
 	if err != nil {
+		return 0, nil, err
+	}
+	return s.remoteKeyID + 1, newRemoteSecretKeyMaterial, nil
+}
+
+func (s *session) preKeyMessage() ([]byte, error) {
+	// 暗号メッセージサイズは 0 なので
+	buf, err := s.preKeyMessageBuffer(typePreKeyMessage, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// このセッションで利用する機能を伝える、古いクライアントは読まずに無視する
+	// 利用する機能が無い場合は今までと同じメッセージにする
+	if s.capabilities != 0 {
+		if err := s.writeCapabilities(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Capabilities と、PQXDH を利用する場合は PQCiphertext を書き込む
+func (s *session) writeCapabilities(buf *bytes.Buffer) error {
+	if err := binary.Write(buf, binary.BigEndian, s.capabilities); err != nil {
 		return err
 	}
-	s.remoteKeyID++
-	s.remoteSecretKeyMaterial = newRemoteSecretKeyMaterial
+
+	if s.pqxdh() {
+		if err := binary.Write(buf, binary.BigEndian, s.pqCiphertext); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (s *session) preKeyMessage() ([]byte, error) {
+// preKeyMessage と resetMessage で共通の SignedPreKeyID までを書き込む
+func (s *session) preKeyMessageBuffer(packetType uint8, length uint16) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
 
-	reserved := uint8(0)
-	// 暗号メッセージサイズは 0 なので
-	length := uint16(0)
-
-	if err := binary.Write(buf, binary.BigEndian, typePreKeyMessage); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, packetType); err != nil {
 		return nil, err
 	}
 
-	if err := binary.Write(buf, binary.BigEndian, reserved); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, s.protocolVersion); err != nil {
 		return nil, err
 	}
 
@@ -142,21 +258,40 @@ func (s *session) preKeyMessage() ([]byte, error) {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	// 利用した相手の oneTimePreKey の ID を送る、利用していない場合は 0
+	oneTimePreKeyID := uint32(0)
+	if s.remoteOneTimePreKey != nil {
+		oneTimePreKeyID = s.remoteOneTimePreKey.id
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, oneTimePreKeyID); err != nil {
+		return nil, err
+	}
 
+	// 利用した相手の signedPreKey の ID を送る
+	if err := binary.Write(buf, binary.BigEndian, s.remoteSignedPreKeyID); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
 }
 
 func (s *session) cipherMessage(ratchetHeader []byte, ciphertext []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
-	reserved := uint8(0)
 	length := uint16(len(ciphertext))
 
-	if err := binary.Write(buf, binary.BigEndian, typeCipherMessage); err != nil {
+	// ヘッダーを暗号化している場合は種類を分ける
+	packetType := typeCipherMessage
+	if s.headerEncryption() {
+		packetType = typeEncryptedCipherMessage
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, packetType); err != nil {
 		return nil, err
 	}
 
-	if err := binary.Write(buf, binary.BigEndian, reserved); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, s.protocolVersion); err != nil {
 		return nil, err
 	}
 
@@ -183,7 +318,42 @@ func (s *session) cipherMessage(ratchetHeader []byte, ciphertext []byte) ([]byte
 	return buf.Bytes(), nil
 }
 
+// preKeyMessage の後ろに新しいセッションで暗号化した cipherMessage のヘッダーと本体を続ける
+// 新しいセッションで利用する機能がある場合は、capabilities を含む extendedResetMessage にする
+func (s *session) resetMessage(ratchetHeader []byte, ciphertext []byte) ([]byte, error) {
+	packetType := typeResetMessage
+	if s.capabilities != 0 {
+		packetType = typeExtendedResetMessage
+	}
+
+	buf, err := s.preKeyMessageBuffer(packetType, uint16(len(ciphertext)))
+	if err != nil {
+		return nil, err
+	}
+
+	if packetType == typeExtendedResetMessage {
+		if err := s.writeCapabilities(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, ratchetHeader); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, ciphertext); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ヘッダーを暗号化している場合は暗号化したヘッダーを返す
 func cipherMessageHeader(m cipherMessage) ([]byte, error) {
+	if m.encryptedHeader != nil {
+		return m.encryptedHeader, nil
+	}
+
 	buf := new(bytes.Buffer)
 
 	if err := binary.Write(buf, binary.BigEndian, m.ratchetKey); err != nil {
@@ -1,8 +1,15 @@
 package e2ee
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
 	"io"
+	"sync"
 
 	"golang.org/x/crypto/hkdf"
 )
@@ -22,3 +29,447 @@ func ratchetSecretKeyMaterial(secretKeyMaterial []byte) ([]byte, error) {
 
 	return newSecretKeyMaterial, nil
 }
+
+// SFrameCipherSuite は RFC 9605 の暗号スイート
+type SFrameCipherSuite uint16
+
+// https://www.rfc-editor.org/rfc/rfc9605#section-4.5
+const (
+	SFrameCipherSuiteAES128CTRHMACSHA256_80 SFrameCipherSuite = 0x0001
+	SFrameCipherSuiteAES128CTRHMACSHA256_64 SFrameCipherSuite = 0x0002
+	SFrameCipherSuiteAES128CTRHMACSHA256_32 SFrameCipherSuite = 0x0003
+	SFrameCipherSuiteAES128GCMSHA256_128    SFrameCipherSuite = 0x0004
+	SFrameCipherSuiteAES256GCMSHA512_128    SFrameCipherSuite = 0x0005
+)
+
+const (
+	// AES-CTR の暗号鍵の長さ (Nka)
+	sframeAESCTRKeyLength = 16
+	// nonce の長さ (Nn) はどの暗号スイートでも 12
+	sframeNonceLength = 12
+
+	// 1 つの鍵で暗号化できるフレームの最大数
+	// RFC 9001 の AES-GCM の機密性の上限と同じ 2^23 にする、AES-CTR + HMAC も同じ上限にする
+	// 超えた場合は SetKey で鍵を更新する必要がある
+	sframeMaxEncryptions = 1 << 23
+
+	// 受信側で保持する鍵の数
+	// 鍵が更新された直後は古い鍵で暗号化されたフレームが届くため、いくつか保持しておく
+	sframeMaxReceiverKeys = 4
+)
+
+type sframeCipherSuiteParameters struct {
+	hash func() hash.Hash
+	// Nk
+	keyLength int
+	// Nt
+	tagLength int
+	gcm       bool
+}
+
+func (cs SFrameCipherSuite) parameters() (*sframeCipherSuiteParameters, error) {
+	switch cs {
+	case SFrameCipherSuiteAES128CTRHMACSHA256_80:
+		return &sframeCipherSuiteParameters{hash: sha256.New, keyLength: 48, tagLength: 10}, nil
+	case SFrameCipherSuiteAES128CTRHMACSHA256_64:
+		return &sframeCipherSuiteParameters{hash: sha256.New, keyLength: 48, tagLength: 8}, nil
+	case SFrameCipherSuiteAES128CTRHMACSHA256_32:
+		return &sframeCipherSuiteParameters{hash: sha256.New, keyLength: 48, tagLength: 4}, nil
+	case SFrameCipherSuiteAES128GCMSHA256_128:
+		return &sframeCipherSuiteParameters{hash: sha256.New, keyLength: 16, tagLength: 16, gcm: true}, nil
+	case SFrameCipherSuiteAES256GCMSHA512_128:
+		return &sframeCipherSuiteParameters{hash: sha512.New, keyLength: 32, tagLength: 16, gcm: true}, nil
+	default:
+		return nil, ErrUnsupportedSFrameCipherSuite
+	}
+}
+
+// https://www.rfc-editor.org/rfc/rfc9605#section-4.3
+//
+//	 0 1 2 3 4 5 6 7
+//	+-+-+-+-+-+-+-+-+------------+------------+
+//	|X|  K  |Y|  C  |   KID...   |   CTR...   |
+//	+-+-+-+-+-+-+-+-+------------+------------+
+//
+// X が 0 の場合は K が KID そのもの、1 の場合は K+1 が KID のバイト数
+// Y が 0 の場合は C が CTR そのもの、1 の場合は C+1 が CTR のバイト数
+type sframeHeader struct {
+	keyID   uint64
+	counter uint64
+}
+
+// 値を表現するのに必要な最小のバイト数
+func sframeValueLength(v uint64) int {
+	n := 1
+	for v > 0xff {
+		v >>= 8
+		n++
+	}
+	return n
+}
+
+func appendSFrameValue(b []byte, v uint64, length int) []byte {
+	for i := length - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+func encodeSFrameHeader(h sframeHeader) []byte {
+	header := make([]byte, 1, 17)
+
+	if h.keyID < 8 {
+		header[0] |= byte(h.keyID) << 4
+	} else {
+		keyIDLength := sframeValueLength(h.keyID)
+		header[0] |= 0x80 | byte(keyIDLength-1)<<4
+	}
+
+	if h.counter < 8 {
+		header[0] |= byte(h.counter)
+	} else {
+		counterLength := sframeValueLength(h.counter)
+		header[0] |= 0x08 | byte(counterLength-1)
+	}
+
+	if h.keyID >= 8 {
+		header = appendSFrameValue(header, h.keyID, sframeValueLength(h.keyID))
+	}
+	if h.counter >= 8 {
+		header = appendSFrameValue(header, h.counter, sframeValueLength(h.counter))
+	}
+
+	return header
+}
+
+// ヘッダーと、ヘッダーのバイト数を返す
+func decodeSFrameHeader(data []byte) (*sframeHeader, int, error) {
+	if len(data) < 1 {
+		return nil, 0, ErrInvalidSFrameHeader
+	}
+
+	h := &sframeHeader{}
+	config := data[0]
+	offset := 1
+
+	readValue := func(length int) (uint64, error) {
+		if len(data) < offset+length {
+			return 0, ErrInvalidSFrameHeader
+		}
+		var v uint64
+		for _, b := range data[offset : offset+length] {
+			v = v<<8 | uint64(b)
+		}
+		offset += length
+		return v, nil
+	}
+
+	if config&0x80 == 0 {
+		h.keyID = uint64(config>>4) & 0x07
+	} else {
+		keyID, err := readValue(int(config>>4)&0x07 + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		h.keyID = keyID
+	}
+
+	if config&0x08 == 0 {
+		h.counter = uint64(config & 0x07)
+	} else {
+		counter, err := readValue(int(config&0x07) + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		h.counter = counter
+	}
+
+	return h, offset, nil
+}
+
+type sframeKey struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+// https://www.rfc-editor.org/rfc/rfc9605#section-4.4.2
+// sframe_secret = HKDF-Extract("", base_key)
+// sframe_key = HKDF-Expand(sframe_secret, "SFrame 1.0 Secret key " + KID + cipher_suite, AEAD.Nk)
+// sframe_salt = HKDF-Expand(sframe_secret, "SFrame 1.0 Secret salt " + KID + cipher_suite, AEAD.Nn)
+func deriveSFrameKeyMaterial(cipherSuite SFrameCipherSuite, keyID uint64, baseKey []byte) ([]byte, []byte, error) {
+	parameters, err := cipherSuite.parameters()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	label := func(prefix string) []byte {
+		l := make([]byte, 0, len(prefix)+8+2)
+		l = append(l, prefix...)
+		l = binary.BigEndian.AppendUint64(l, keyID)
+		l = binary.BigEndian.AppendUint16(l, uint16(cipherSuite))
+		return l
+	}
+
+	secret := hkdf.Extract(parameters.hash, baseKey, nil)
+
+	key := make([]byte, parameters.keyLength)
+	if _, err := io.ReadFull(hkdf.Expand(parameters.hash, secret, label("SFrame 1.0 Secret key ")), key); err != nil {
+		return nil, nil, err
+	}
+
+	salt := make([]byte, sframeNonceLength)
+	if _, err := io.ReadFull(hkdf.Expand(parameters.hash, secret, label("SFrame 1.0 Secret salt ")), salt); err != nil {
+		return nil, nil, err
+	}
+
+	return key, salt, nil
+}
+
+func deriveSFrameKey(cipherSuite SFrameCipherSuite, keyID uint64, baseKey []byte) (*sframeKey, error) {
+	parameters, err := cipherSuite.parameters()
+	if err != nil {
+		return nil, err
+	}
+	key, salt, err := deriveSFrameKeyMaterial(cipherSuite, keyID, baseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	if parameters.gcm {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		aead, err = newAESCTRHMAC(key, parameters.tagLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &sframeKey{aead: aead, salt: salt}, nil
+}
+
+// nonce = sframe_salt XOR encode_big_endian(CTR, AEAD.Nn)
+func (k *sframeKey) nonce(counter uint64) []byte {
+	nonce := make([]byte, sframeNonceLength)
+	binary.BigEndian.PutUint64(nonce[sframeNonceLength-8:], counter)
+	for i := range nonce {
+		nonce[i] ^= k.salt[i]
+	}
+	return nonce
+}
+
+// https://www.rfc-editor.org/rfc/rfc9605#section-4.5.1
+type aesCTRHMAC struct {
+	block     cipher.Block
+	authKey   []byte
+	tagLength int
+}
+
+func newAESCTRHMAC(key []byte, tagLength int) (*aesCTRHMAC, error) {
+	block, err := aes.NewCipher(key[:sframeAESCTRKeyLength])
+	if err != nil {
+		return nil, err
+	}
+	return &aesCTRHMAC{
+		block:     block,
+		authKey:   key[sframeAESCTRKeyLength:],
+		tagLength: tagLength,
+	}, nil
+}
+
+func (a *aesCTRHMAC) NonceSize() int {
+	return sframeNonceLength
+}
+
+func (a *aesCTRHMAC) Overhead() int {
+	return a.tagLength
+}
+
+// initial_counter = nonce + 0x00000000
+func (a *aesCTRHMAC) xorKeyStream(dst, src, nonce []byte) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	cipher.NewCTR(a.block, iv).XORKeyStream(dst, src)
+}
+
+// auth_data = len(aad):64 + len(ct):64 + Nt:64 + nonce + aad + ct
+func (a *aesCTRHMAC) tag(nonce, aad, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, a.authKey)
+	var lengths [24]byte
+	binary.BigEndian.PutUint64(lengths[0:], uint64(len(aad)))
+	binary.BigEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	binary.BigEndian.PutUint64(lengths[16:], uint64(a.tagLength))
+	mac.Write(lengths[:])
+	mac.Write(nonce)
+	mac.Write(aad)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)[:a.tagLength]
+}
+
+func (a *aesCTRHMAC) Seal(dst, nonce, plaintext, aad []byte) []byte {
+	ciphertext := make([]byte, len(plaintext))
+	a.xorKeyStream(ciphertext, plaintext, nonce)
+	dst = append(dst, ciphertext...)
+	return append(dst, a.tag(nonce, aad, ciphertext)...)
+}
+
+func (a *aesCTRHMAC) Open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < a.tagLength {
+		return nil, ErrSFrameDecrypt
+	}
+	tag := ciphertext[len(ciphertext)-a.tagLength:]
+	ciphertext = ciphertext[:len(ciphertext)-a.tagLength]
+	if !hmac.Equal(tag, a.tag(nonce, aad, ciphertext)) {
+		return nil, ErrSFrameDecrypt
+	}
+	plaintext := make([]byte, len(ciphertext))
+	a.xorKeyStream(plaintext, ciphertext, nonce)
+	return append(dst, plaintext...), nil
+}
+
+// SFrameSender は自分の keyID と secretKeyMaterial を利用してフレームを暗号化する
+// StartSession や StopSession の SelfKeyID と SelfSecretKeyMaterial を SetKey に渡す
+// 複数の goroutine から同時に呼び出してもよい
+type SFrameSender struct {
+	mu          sync.Mutex
+	cipherSuite SFrameCipherSuite
+	keyID       uint64
+	key         *sframeKey
+	counter     uint64
+}
+
+// NewSFrameSender は SFrameSender を生成する
+func NewSFrameSender(cipherSuite SFrameCipherSuite) (*SFrameSender, error) {
+	if _, err := cipherSuite.parameters(); err != nil {
+		return nil, err
+	}
+	return &SFrameSender{cipherSuite: cipherSuite}, nil
+}
+
+// SetKey は暗号化に利用する鍵を更新する
+func (s *SFrameSender) SetKey(keyID uint32, secretKeyMaterial []byte) error {
+	key, err := deriveSFrameKey(s.cipherSuite, uint64(keyID), secretKeyMaterial)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyID = uint64(keyID)
+	s.key = key
+	// 鍵ごとに salt が変わるので CTR は 0 からで良い
+	s.counter = 0
+	return nil
+}
+
+// Encrypt はフレームを暗号化して SFrame ヘッダーを付与する
+// metadata は暗号化されないが改ざんは検知される
+func (s *SFrameSender) Encrypt(metadata, plaintext []byte) ([]byte, error) {
+	// CTR の採番だけロックして、暗号化はロックの外で行う
+	s.mu.Lock()
+	key := s.key
+	if key == nil {
+		s.mu.Unlock()
+		return nil, ErrMissingSFrameKey
+	}
+	if s.counter >= sframeMaxEncryptions {
+		s.mu.Unlock()
+		// 鍵の利用回数の上限に達したので鍵を更新する必要がある
+		return nil, ErrSFrameCounterExhausted
+	}
+	keyID, counter := s.keyID, s.counter
+	s.counter++
+	s.mu.Unlock()
+
+	header := encodeSFrameHeader(sframeHeader{keyID: keyID, counter: counter})
+	nonce := key.nonce(counter)
+
+	aad := make([]byte, 0, len(header)+len(metadata))
+	aad = append(aad, header...)
+	aad = append(aad, metadata...)
+
+	return key.aead.Seal(header, nonce, plaintext, aad), nil
+}
+
+// SFrameReceiver は相手の keyID と secretKeyMaterial を利用してフレームを復号する
+// 相手の ConnectionID ごとに用意し、RemoteSecretKeyMaterials の値を SetKey に渡す
+// 複数の goroutine から同時に呼び出してもよい
+type SFrameReceiver struct {
+	mu          sync.RWMutex
+	cipherSuite SFrameCipherSuite
+	keys        map[uint64]*sframeKey
+	// 追加した順
+	keyIDs []uint64
+}
+
+// NewSFrameReceiver は SFrameReceiver を生成する
+func NewSFrameReceiver(cipherSuite SFrameCipherSuite) (*SFrameReceiver, error) {
+	if _, err := cipherSuite.parameters(); err != nil {
+		return nil, err
+	}
+	return &SFrameReceiver{
+		cipherSuite: cipherSuite,
+		keys:        make(map[uint64]*sframeKey),
+	}, nil
+}
+
+// SetKey は復号に利用する鍵を追加する
+// 古い鍵は sframeMaxReceiverKeys を超えたら破棄する
+func (r *SFrameReceiver) SetKey(keyID uint32, secretKeyMaterial []byte) error {
+	key, err := deriveSFrameKey(r.cipherSuite, uint64(keyID), secretKeyMaterial)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[uint64(keyID)]; !ok {
+		r.keyIDs = append(r.keyIDs, uint64(keyID))
+	}
+	r.keys[uint64(keyID)] = key
+
+	for len(r.keyIDs) > sframeMaxReceiverKeys {
+		delete(r.keys, r.keyIDs[0])
+		r.keyIDs = r.keyIDs[1:]
+	}
+
+	return nil
+}
+
+// SetRemoteSecretKeyMaterial は StartSession や ReceiveMessage の結果をそのまま鍵として追加する
+func (r *SFrameReceiver) SetRemoteSecretKeyMaterial(m RemoteSecretKeyMaterial) error {
+	return r.SetKey(m.KeyID, m.SecretKeyMaterial)
+}
+
+// Decrypt は SFrame ヘッダーから鍵を選んでフレームを復号する
+func (r *SFrameReceiver) Decrypt(metadata, frame []byte) ([]byte, error) {
+	header, headerLength, err := decodeSFrameHeader(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	key, ok := r.keys[header.keyID]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrMissingSFrameKey
+	}
+
+	aad := make([]byte, 0, headerLength+len(metadata))
+	aad = append(aad, frame[:headerLength]...)
+	aad = append(aad, metadata...)
+
+	plaintext, err := key.aead.Open(nil, key.nonce(header.counter), frame[headerLength:], aad)
+	if err != nil {
+		return nil, ErrSFrameDecrypt
+	}
+	return plaintext, nil
+}
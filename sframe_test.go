@@ -0,0 +1,287 @@
+package e2ee
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSFrameHeader(t *testing.T) {
+	testCases := []struct {
+		keyID   uint64
+		counter uint64
+		header  string
+	}{
+		{keyID: 0, counter: 0, header: "00"},
+		{keyID: 7, counter: 7, header: "77"},
+		{keyID: 0, counter: 8, header: "0808"},
+		{keyID: 8, counter: 0, header: "8008"},
+		{keyID: 0x0100, counter: 0x01, header: "910100"},
+		{keyID: 0xff, counter: 0x010000, header: "8aff010000"},
+		{keyID: 0xffffffffffffffff, counter: 0xffffffffffffffff, header: "ff" + "ffffffffffffffff" + "ffffffffffffffff"},
+	}
+
+	for _, tc := range testCases {
+		header := encodeSFrameHeader(sframeHeader{keyID: tc.keyID, counter: tc.counter})
+		assert.Equal(t, tc.header, hex.EncodeToString(header))
+
+		h, length, err := decodeSFrameHeader(header)
+		assert.Nil(t, err)
+		assert.Equal(t, len(header), length)
+		assert.Equal(t, tc.keyID, h.keyID)
+		assert.Equal(t, tc.counter, h.counter)
+	}
+
+	// KID の長さが足りない
+	_, _, err := decodeSFrameHeader([]byte{0x90, 0x01})
+	assert.NotNil(t, err)
+
+	_, _, err = decodeSFrameHeader([]byte{})
+	assert.NotNil(t, err)
+}
+
+func TestSFrame(t *testing.T) {
+	cipherSuites := []SFrameCipherSuite{
+		SFrameCipherSuiteAES128CTRHMACSHA256_80,
+		SFrameCipherSuiteAES128CTRHMACSHA256_64,
+		SFrameCipherSuiteAES128CTRHMACSHA256_32,
+		SFrameCipherSuiteAES128GCMSHA256_128,
+		SFrameCipherSuiteAES256GCMSHA512_128,
+	}
+
+	secretKeyMaterial, err := generateSecretKeyMaterial(rand.Reader)
+	assert.Nil(t, err)
+
+	metadata := []byte("metadata")
+	plaintext := []byte("frame")
+
+	for _, cipherSuite := range cipherSuites {
+		sender, err := NewSFrameSender(cipherSuite)
+		assert.Nil(t, err)
+
+		// 鍵がない
+		_, err = sender.Encrypt(metadata, plaintext)
+		assert.NotNil(t, err)
+
+		assert.Nil(t, sender.SetKey(10, secretKeyMaterial))
+
+		receiver, err := NewSFrameReceiver(cipherSuite)
+		assert.Nil(t, err)
+		assert.Nil(t, receiver.SetKey(10, secretKeyMaterial))
+
+		for i := 0; i < 10; i++ {
+			frame, err := sender.Encrypt(metadata, plaintext)
+			assert.Nil(t, err)
+
+			decrypted, err := receiver.Decrypt(metadata, frame)
+			assert.Nil(t, err)
+			assert.Equal(t, plaintext, decrypted)
+
+			// metadata を改ざんすると復号できない
+			_, err = receiver.Decrypt([]byte("tampered"), frame)
+			assert.NotNil(t, err)
+
+			// ヘッダーを改ざんすると復号できない
+			frame[0] ^= 0x01
+			_, err = receiver.Decrypt(metadata, frame)
+			assert.NotNil(t, err)
+		}
+	}
+
+	_, err = NewSFrameSender(SFrameCipherSuite(0))
+	assert.NotNil(t, err)
+}
+
+// https://www.rfc-editor.org/rfc/rfc9605#appendix-C.4 のテストベクター
+func TestSFrameRFC9605Vectors(t *testing.T) {
+	keyID := uint64(0x0123)
+	counter := uint64(0x4567)
+	baseKey, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	metadata := []byte("IETF SFrame WG")
+	plaintext := []byte("draft-ietf-sframe-enc")
+	aad := "9901234567" + "4945544620534672616d65205747"
+
+	testCases := []struct {
+		cipherSuite SFrameCipherSuite
+		key         string
+		salt        string
+		nonce       string
+		ciphertext  string
+	}{
+		{
+			cipherSuite: SFrameCipherSuiteAES128CTRHMACSHA256_80,
+			key:         "3f7d9a7c83ae8e1c8a11ae695ab59314b367e359fadac7b9c46b2bc6f81f46e16b96f0811868d59402b7e870102720b3",
+			salt:        "50b29329a04dc0f184ac3168",
+			nonce:       "50b29329a04dc0f184ac740f",
+			ciphertext:  "9901234567449408b6f490086165b9d6f62b24ae1a59a56486b4ae8ed036b88912e24f11",
+		},
+		{
+			cipherSuite: SFrameCipherSuiteAES128CTRHMACSHA256_64,
+			key:         "e2ec5c797540310483b16bf6e7a570d2a27d192fe869c7ccd8584a8d9dab91549fbe553f5113461ec6aa83bf3865553e",
+			salt:        "e68ac8dd3d02fbcd368c5577",
+			nonce:       "e68ac8dd3d02fbcd368c1010",
+			ciphertext:  "99012345673f31438db4d09434e43afa0f8a2f00867a2be085046a9f5cb4f101d607",
+		},
+		{
+			cipherSuite: SFrameCipherSuiteAES128CTRHMACSHA256_32,
+			key:         "2c5703089cbb8c583475e4fc461d97d18809df79b6d550f78eb6d50ffa80d89211d57909934f46f5405e38cd583c69fe",
+			salt:        "38c16e4f5159700c00c7f350",
+			nonce:       "38c16e4f5159700c00c7b637",
+			ciphertext:  "990123456717fc8af28a5a695afcfc6c8df6358a17e26b2fcb3bae32e443",
+		},
+		{
+			cipherSuite: SFrameCipherSuiteAES128GCMSHA256_128,
+			key:         "d34f547f4ca4f9a7447006fe7fcbf768",
+			salt:        "75234edefe07819026751816",
+			nonce:       "75234edefe07819026755d71",
+			ciphertext:  "9901234567b7412c2513a1b66dbb48841bbaf17f598751176ad847681a69c6d0b091c07018ce4adb34eb",
+		},
+		{
+			cipherSuite: SFrameCipherSuiteAES256GCMSHA512_128,
+			key:         "d3e27b0d4a5ae9e55df01a70e6d4d28d969b246e2936f4b7a5d9b494da6b9633",
+			salt:        "84991c167b8cd23c93708ec7",
+			nonce:       "84991c167b8cd23c9370cba0",
+			ciphertext:  "990123456794f509d36e9beacb0e261d99c7d1e972f1fed787d4049f17ca21353c1cc24d56ceabced279",
+		},
+	}
+
+	for _, tc := range testCases {
+		key, salt, err := deriveSFrameKeyMaterial(tc.cipherSuite, keyID, baseKey)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.key, hex.EncodeToString(key))
+		assert.Equal(t, tc.salt, hex.EncodeToString(salt))
+
+		k, err := deriveSFrameKey(tc.cipherSuite, keyID, baseKey)
+		assert.Nil(t, err)
+		nonce := k.nonce(counter)
+		assert.Equal(t, tc.nonce, hex.EncodeToString(nonce))
+
+		header := encodeSFrameHeader(sframeHeader{keyID: keyID, counter: counter})
+		assert.Equal(t, aad, hex.EncodeToString(append(append([]byte{}, header...), metadata...)))
+		ciphertext := k.aead.Seal(header, nonce, plaintext, append(append([]byte{}, header...), metadata...))
+		assert.Equal(t, tc.ciphertext, hex.EncodeToString(ciphertext))
+
+		// 他の実装が暗号化したフレームとして復号できる
+		receiver, err := NewSFrameReceiver(tc.cipherSuite)
+		assert.Nil(t, err)
+		assert.Nil(t, receiver.SetKey(uint32(keyID), baseKey))
+		decrypted, err := receiver.Decrypt(metadata, ciphertext)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	}
+}
+
+func TestSFrameReceiverKeys(t *testing.T) {
+	sender, err := NewSFrameSender(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+	receiver, err := NewSFrameReceiver(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+
+	secretKeyMaterial, err := generateSecretKeyMaterial(rand.Reader)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.SetKey(0, secretKeyMaterial))
+	assert.Nil(t, receiver.SetKey(0, secretKeyMaterial))
+
+	oldFrame, err := sender.Encrypt(nil, []byte("old"))
+	assert.Nil(t, err)
+
+	for keyID := uint32(1); keyID < sframeMaxReceiverKeys; keyID++ {
+		secretKeyMaterial, err = ratchetSecretKeyMaterial(secretKeyMaterial)
+		assert.Nil(t, err)
+		assert.Nil(t, receiver.SetKey(keyID, secretKeyMaterial))
+	}
+
+	// 鍵が更新されても古い鍵で暗号化されたフレームは復号できる
+	_, err = receiver.Decrypt(nil, oldFrame)
+	assert.Nil(t, err)
+
+	secretKeyMaterial, err = ratchetSecretKeyMaterial(secretKeyMaterial)
+	assert.Nil(t, err)
+	assert.Nil(t, receiver.SetKey(sframeMaxReceiverKeys, secretKeyMaterial))
+
+	// 古すぎる鍵は破棄されている
+	_, err = receiver.Decrypt(nil, oldFrame)
+	assert.NotNil(t, err)
+}
+
+func TestSFrameE2EE(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	r2, err := bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+
+	sender, err := NewSFrameSender(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.SetKey(r1.SelfKeyID, r1.SelfSecretKeyMaterial))
+
+	receiver, err := NewSFrameReceiver(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+	assert.Nil(t, receiver.SetRemoteSecretKeyMaterial(r2.RemoteSecretKeyMaterials[aliceConnectionID]))
+
+	frame, err := sender.Encrypt(nil, []byte("hello"))
+	assert.Nil(t, err)
+	plaintext, err := receiver.Decrypt(nil, frame)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), plaintext)
+}
+
+func FuzzDecodeSFrameHeader(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x91, 0x01, 0x00})
+	f.Add(encodeSFrameHeader(sframeHeader{keyID: 0xffffffffffffffff, counter: 0xffffffffffffffff}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, length, err := decodeSFrameHeader(data)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrInvalidSFrameHeader)
+			return
+		}
+		assert.LessOrEqual(t, length, len(data))
+
+		// 最小のバイト数でエンコードしたものは元の長さを超えない
+		header := encodeSFrameHeader(*h)
+		assert.LessOrEqual(t, len(header), length)
+		decoded, _, err := decodeSFrameHeader(header)
+		assert.Nil(t, err)
+		assert.Equal(t, h, decoded)
+	})
+}
+
+func TestSFrameMaxEncryptions(t *testing.T) {
+	secretKeyMaterial, err := generateSecretKeyMaterial(rand.Reader)
+	assert.Nil(t, err)
+
+	sender, err := NewSFrameSender(SFrameCipherSuiteAES128GCMSHA256_128)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.SetKey(1, secretKeyMaterial))
+
+	sender.counter = sframeMaxEncryptions - 1
+	_, err = sender.Encrypt(nil, []byte("frame"))
+	assert.Nil(t, err)
+	_, err = sender.Encrypt(nil, []byte("frame"))
+	assert.ErrorIs(t, err, ErrSFrameCounterExhausted)
+
+	// 鍵を更新すると暗号化できる
+	assert.Nil(t, sender.SetKey(2, secretKeyMaterial))
+	_, err = sender.Encrypt(nil, []byte("frame"))
+	assert.Nil(t, err)
+}
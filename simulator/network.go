@@ -0,0 +1,135 @@
+package simulator
+
+const (
+	connectionIDLength = 26
+
+	// <<Type:8, ProtocolVersion:8, CiphertextLength:16,
+	//   SrcConnectionID:26/binary, DstConnectionID:26/binary, ...>>
+	// すべてのメッセージで共通
+	srcConnectionIDOffset = 4
+	dstConnectionIDOffset = srcConnectionIDOffset + connectionIDLength
+	messageHeaderLength   = dstConnectionIDOffset + connectionIDLength
+)
+
+// グループモードの全員宛のメッセージの DstConnectionID
+var broadcastConnectionID = string(make([]byte, connectionIDLength))
+
+// Sora が中継しているメッセージ
+type envelope struct {
+	// 送信した順番
+	seq  uint64
+	from string
+	to   string
+	data []byte
+	// この step 以降に配送する
+	deliverAt uint64
+	duplicate bool
+}
+
+// メッセージに含まれている送信元と宛先の ConnectionID を返す
+func routeOf(data []byte) (string, string, bool) {
+	if len(data) < messageHeaderLength {
+		return "", "", false
+	}
+	from := string(data[srcConnectionIDOffset:dstConnectionIDOffset])
+	to := string(data[dstConnectionIDOffset:messageHeaderLength])
+	return from, to, true
+}
+
+// ネットワークに送る、設定に応じて破棄、複製、遅延させる
+func (r *Room) send(messages [][]byte) error {
+	for _, data := range messages {
+		from, to, ok := routeOf(data)
+		if !ok {
+			return ErrUnroutableMessage
+		}
+
+		// 全員宛のメッセージは Sora が送信元以外の参加者ごとに中継する
+		recipients := []string{to}
+		if to == broadcastConnectionID {
+			recipients = nil
+			for _, p := range r.Peers() {
+				if p.ConnectionID != from {
+					recipients = append(recipients, p.ConnectionID)
+				}
+			}
+		}
+
+		for _, to := range recipients {
+			r.stats.Sent++
+
+			if r.dropRate > 0 && r.rand.Float64() < r.dropRate {
+				r.stats.Dropped++
+				continue
+			}
+
+			r.enqueue(from, to, data, false)
+
+			if r.duplicateRate > 0 && r.rand.Float64() < r.duplicateRate {
+				r.stats.Duplicated++
+				r.enqueue(from, to, data, true)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Room) enqueue(from, to string, data []byte, duplicate bool) {
+	var delay uint64
+	if r.maxDelay > 0 {
+		delay = uint64(r.rand.Intn(r.maxDelay + 1))
+	}
+
+	r.seq++
+	r.network = append(r.network, &envelope{
+		seq:       r.seq,
+		from:      from,
+		to:        to,
+		data:      append([]byte(nil), data...),
+		deliverAt: r.step + delay,
+		duplicate: duplicate,
+	})
+}
+
+// 次に配送するメッセージをネットワークから取り出す
+// 遅延しているメッセージしか無い場合は、一番早く配送できるところまで step を進める
+func (r *Room) dequeue() *envelope {
+	if len(r.network) == 0 {
+		return nil
+	}
+
+	var ready []int
+	for {
+		for i, e := range r.network {
+			if e.deliverAt <= r.step {
+				ready = append(ready, i)
+			}
+		}
+		if len(ready) > 0 {
+			break
+		}
+		r.step++
+	}
+
+	// 並び替えない場合は送信した順番に配送する
+	index := ready[0]
+	if r.reorder {
+		index = ready[r.rand.Intn(len(ready))]
+	}
+
+	e := r.network[index]
+	r.network = append(r.network[:index], r.network[index+1:]...)
+	return e
+}
+
+// 退出した参加者との間のメッセージは Sora が中継しない
+func (r *Room) discard(connectionID string) {
+	network := r.network[:0]
+	for _, e := range r.network {
+		if e.from == connectionID || e.to == connectionID {
+			continue
+		}
+		network = append(network, e)
+	}
+	r.network = network
+}
@@ -0,0 +1,81 @@
+package simulator
+
+import (
+	"bytes"
+
+	e2ee "github.com/shiguredo/sora-e2ee"
+)
+
+// Peer はルームの参加者
+// KeyID と SecretKeyMaterial は Engine の戻り値から取得した値で、SFrame に設定する値と同じになる
+type Peer struct {
+	ConnectionID string
+	Engine       *e2ee.Engine
+
+	// 自分の現在の KeyID と SecretKeyMaterial
+	KeyID             uint32
+	SecretKeyMaterial []byte
+	// 他の参加者の KeyID と SecretKeyMaterial
+	Remotes map[string]e2ee.RemoteSecretKeyMaterial
+
+	// 過去の SecretKeyMaterial も含めて KeyID ごとに保持する
+	history map[uint32][]byte
+}
+
+func newPeer(connectionID string, engine *e2ee.Engine, secretKeyMaterial []byte) *Peer {
+	p := &Peer{
+		ConnectionID: connectionID,
+		Engine:       engine,
+		Remotes:      make(map[string]e2ee.RemoteSecretKeyMaterial),
+		history:      make(map[uint32][]byte),
+	}
+	p.setSelf(engine.SelfKeyID(), secretKeyMaterial)
+	return p
+}
+
+func (p *Peer) setSelf(keyID uint32, secretKeyMaterial []byte) {
+	p.KeyID = keyID
+	p.SecretKeyMaterial = secretKeyMaterial
+	p.history[keyID] = secretKeyMaterial
+}
+
+func (p *Peer) setRemotes(remoteSecretKeyMaterials map[string]e2ee.RemoteSecretKeyMaterial) {
+	for connectionID, remoteSecretKeyMaterial := range remoteSecretKeyMaterials {
+		p.Remotes[connectionID] = remoteSecretKeyMaterial
+	}
+}
+
+// グループモードでエポックが進んだ場合は自分の SecretKeyMaterial も変わる
+func (p *Peer) setResult(result *e2ee.ReceiveMessageResult) {
+	if result.SelfSecretKeyMaterial != nil {
+		p.setSelf(result.SelfKeyID, result.SelfSecretKeyMaterial)
+	}
+	p.setRemotes(result.RemoteSecretKeyMaterials)
+}
+
+// 相手が過去に利用した、または現在利用している KeyID と SecretKeyMaterial の組かどうか
+// グループモードではコミットした参加者が、welcome やコミットを受け取る前の相手の次のエポックの SK を先に導出するので、
+// 相手がまだ利用していない KeyID は確認しない
+// また 1 回の ReceiveMessage で複数のエポックを進めた場合、途中のエポックの SK は戻り値に含まれないので確認しない
+func (p *Peer) used(remoteSecretKeyMaterial e2ee.RemoteSecretKeyMaterial) bool {
+	if remoteSecretKeyMaterial.KeyID > p.KeyID {
+		return true
+	}
+	secretKeyMaterial, ok := p.history[remoteSecretKeyMaterial.KeyID]
+	if !ok {
+		return p.skipped(remoteSecretKeyMaterial.KeyID)
+	}
+	return bytes.Equal(secretKeyMaterial, remoteSecretKeyMaterial.SecretKeyMaterial)
+}
+
+// 自分の KeyID の履歴の途中で飛ばした KeyID かどうか
+func (p *Peer) skipped(keyID uint32) bool {
+	var lower bool
+	for k := range p.history {
+		if k < keyID {
+			lower = true
+			break
+		}
+	}
+	return lower && keyID < p.KeyID
+}
@@ -0,0 +1,391 @@
+// Package simulator は Sora のルームをプロセス内で再現して、参加者間で鍵が一致するかを確認する
+//
+// 参加者の入室と退室に合わせて preKeyBundle を metadata_list と同様に配布し、
+// 戻り値の Messages を宛先の参加者に配送する
+// 配送するメッセージは破棄、複製、遅延、並び替えができる
+package simulator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	e2ee "github.com/shiguredo/sora-e2ee"
+)
+
+const engineVersion = "simulator"
+
+var (
+	ErrPeerAlreadyExists = errors.New("simulator: peer already exists")
+	ErrMissingPeer       = errors.New("simulator: missing peer")
+	ErrUnroutableMessage = errors.New("simulator: unroutable message")
+)
+
+// DivergenceError は参加者が持っている相手の KeyID と SecretKeyMaterial が、相手のものと一致しない場合のエラー
+type DivergenceError struct {
+	ConnectionID       string
+	RemoteConnectionID string
+	// ConnectionID の参加者が持っている値、受け取っていない場合は nil
+	Got *e2ee.RemoteSecretKeyMaterial
+	// RemoteConnectionID の参加者が利用している値
+	Want e2ee.RemoteSecretKeyMaterial
+}
+
+func (e *DivergenceError) Error() string {
+	if e.Got == nil {
+		return fmt.Sprintf("simulator: %s does not have secret key material of %s (want keyId %d)",
+			e.ConnectionID, e.RemoteConnectionID, e.Want.KeyID)
+	}
+	if e.Got.KeyID == e.Want.KeyID {
+		return fmt.Sprintf("simulator: %s has different secret key material of %s (keyId %d)",
+			e.ConnectionID, e.RemoteConnectionID, e.Got.KeyID)
+	}
+	return fmt.Sprintf("simulator: %s has keyId %d of %s, want keyId %d",
+		e.ConnectionID, e.Got.KeyID, e.RemoteConnectionID, e.Want.KeyID)
+}
+
+// DeliveryError は配送したメッセージの処理に失敗した記録
+// 複製したメッセージや遅延して不要になったメッセージでも発生する
+type DeliveryError struct {
+	From      string
+	To        string
+	Duplicate bool
+	Err       error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("simulator: %s -> %s: %v", e.From, e.To, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Stats は配送の統計
+type Stats struct {
+	Sent       int
+	Delivered  int
+	Dropped    int
+	Duplicated int
+}
+
+// Option は NewRoom に指定する設定
+type Option func(*Room)
+
+// WithSeed は破棄、複製、遅延、並び替えと、参加者の鍵の生成に利用する乱数のシードを指定する
+func WithSeed(seed int64) Option {
+	return func(r *Room) {
+		r.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithDropRate はメッセージを破棄する確率を指定する
+func WithDropRate(rate float64) Option {
+	return func(r *Room) {
+		r.dropRate = rate
+	}
+}
+
+// WithDuplicateRate はメッセージを複製する確率を指定する
+func WithDuplicateRate(rate float64) Option {
+	return func(r *Room) {
+		r.duplicateRate = rate
+	}
+}
+
+// WithMaxDelay はメッセージを遅延させる最大の step 数を指定する
+func WithMaxDelay(steps int) Option {
+	return func(r *Room) {
+		r.maxDelay = steps
+	}
+}
+
+// WithReorder は配送できるメッセージの中から送信順と関係なく選んで配送する
+func WithReorder() Option {
+	return func(r *Room) {
+		r.reorder = true
+	}
+}
+
+// WithEngineOptions は参加者の Engine に指定する設定
+func WithEngineOptions(opts ...e2ee.Option) Option {
+	return func(r *Room) {
+		r.engineOptions = append(r.engineOptions, opts...)
+	}
+}
+
+// Room は Sora のルーム
+type Room struct {
+	peers map[string]*Peer
+
+	network []*envelope
+	seq     uint64
+	step    uint64
+
+	rand          *rand.Rand
+	dropRate      float64
+	duplicateRate float64
+	maxDelay      int
+	reorder       bool
+	engineOptions []e2ee.Option
+
+	stats          Stats
+	deliveryErrors []*DeliveryError
+}
+
+// NewRoom は参加者のいないルームを作成する
+func NewRoom(opts ...Option) *Room {
+	r := &Room{
+		peers: make(map[string]*Peer),
+		rand:  rand.New(rand.NewSource(1)),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Peer は参加者を返す
+func (r *Room) Peer(connectionID string) (*Peer, bool) {
+	p, ok := r.peers[connectionID]
+	return p, ok
+}
+
+// Peers は参加者を ConnectionID の順番で返す
+func (r *Room) Peers() []*Peer {
+	peers := make([]*Peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ConnectionID < peers[j].ConnectionID
+	})
+	return peers
+}
+
+// InFlight は配送していないメッセージの数を返す
+func (r *Room) InFlight() int {
+	return len(r.network)
+}
+
+// Stats は配送の統計を返す
+func (r *Room) Stats() Stats {
+	return r.stats
+}
+
+// DeliveryErrors は配送したメッセージの処理に失敗した記録を返す
+func (r *Room) DeliveryErrors() []*DeliveryError {
+	return r.deliveryErrors
+}
+
+// Join は参加者を入室させる
+// 新しい参加者は既存の参加者の preKeyBundle を追加し、既存の参加者は新しい参加者とのセッションを開始する
+func (r *Room) Join(connectionID string) (*Peer, error) {
+	if _, ok := r.peers[connectionID]; ok {
+		return nil, ErrPeerAlreadyExists
+	}
+
+	// 同じシードであれば鍵とメッセージも含めて同じ結果になるように、シードから Engine の乱数を生成する
+	// 暗号論的に安全ではないので、シミュレーター以外では利用しないこと
+	random := rand.New(rand.NewSource(r.rand.Int63()))
+	opts := append([]e2ee.Option{e2ee.WithRandom(random)}, r.engineOptions...)
+	engine := e2ee.NewEngine(engineVersion, opts...)
+	if err := engine.Init(); err != nil {
+		return nil, err
+	}
+	secretKeyMaterial, err := engine.Start(connectionID)
+	if err != nil {
+		return nil, err
+	}
+	peer := newPeer(connectionID, engine, secretKeyMaterial)
+
+	// 新しい参加者は metadata_list から既存の参加者の preKeyBundle を受け取る
+	for _, p := range r.Peers() {
+		result, err := engine.AddPreKeyBundle(p.ConnectionID, p.Engine.SelfPreKeyBundle())
+		if err != nil {
+			return nil, err
+		}
+		peer.setResult(result)
+		if err := r.send(result.Messages); err != nil {
+			return nil, err
+		}
+	}
+
+	// 既存の参加者は通知から新しい参加者の preKeyBundle を受け取る
+	for _, p := range r.Peers() {
+		result, err := p.Engine.StartSession(connectionID, engine.SelfPreKeyBundle())
+		if err != nil {
+			return nil, err
+		}
+		p.setSelf(result.SelfKeyID, result.SelfSecretKeyMaterial)
+		p.setRemotes(result.RemoteSecretKeyMaterials)
+		if err := r.send(result.Messages); err != nil {
+			return nil, err
+		}
+	}
+
+	r.peers[connectionID] = peer
+	return peer, nil
+}
+
+// Leave は参加者を退室させる
+// 残りの参加者は退室した参加者とのセッションを破棄する
+func (r *Room) Leave(connectionID string) error {
+	if _, ok := r.peers[connectionID]; !ok {
+		return ErrMissingPeer
+	}
+	delete(r.peers, connectionID)
+	r.discard(connectionID)
+
+	for _, p := range r.Peers() {
+		result, err := p.Engine.StopSession(connectionID)
+		if err != nil {
+			return err
+		}
+		delete(p.Remotes, connectionID)
+		p.setSelf(result.SelfKeyID, result.SelfSecretKeyMaterial)
+		p.setRemotes(result.RemoteSecretKeyMaterials)
+		if err := r.send(result.Messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetSession は参加者の相手とのセッションを作り直す
+// メッセージを破棄した後に鍵を一致させるために利用する
+func (r *Room) ResetSession(connectionID, remoteConnectionID string) error {
+	p, ok := r.peers[connectionID]
+	if !ok {
+		return ErrMissingPeer
+	}
+	if _, ok := r.peers[remoteConnectionID]; !ok {
+		return ErrMissingPeer
+	}
+
+	result, err := p.Engine.ResetSession(remoteConnectionID, nil)
+	if err != nil {
+		return err
+	}
+	return r.send(result.Messages)
+}
+
+// Step はメッセージを 1 つ配送する
+// 配送するメッセージが無い場合は false を返す
+// 配送するたびに、参加者が持っている相手の SecretKeyMaterial が相手の利用したものであるかを確認し、
+// ネットワークが空になった時点で全員の鍵が一致しているかを確認する
+func (r *Room) Step() (bool, error) {
+	e := r.dequeue()
+	if e == nil {
+		return false, nil
+	}
+	r.step++
+
+	if err := r.deliver(e); err != nil {
+		return true, err
+	}
+
+	if err := r.checkHistory(); err != nil {
+		return true, err
+	}
+
+	if len(r.network) == 0 {
+		return true, r.Check()
+	}
+	return true, nil
+}
+
+// Run はネットワークが空になるまでメッセージを配送する
+func (r *Room) Run() error {
+	for {
+		ok, err := r.Step()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return r.Check()
+		}
+	}
+}
+
+func (r *Room) deliver(e *envelope) error {
+	p, ok := r.peers[e.to]
+	if !ok {
+		// 退室済み
+		return nil
+	}
+	r.stats.Delivered++
+
+	result, err := p.Engine.ReceiveMessage(e.data)
+	if err != nil {
+		r.deliveryErrors = append(r.deliveryErrors, &DeliveryError{
+			From:      e.from,
+			To:        e.to,
+			Duplicate: e.duplicate,
+			Err:       err,
+		})
+		return nil
+	}
+
+	p.setResult(result)
+	return r.send(result.Messages)
+}
+
+// 参加者が持っている相手の KeyID と SecretKeyMaterial は、相手が過去に利用したものと一致する必要がある
+func (r *Room) checkHistory() error {
+	for _, p := range r.Peers() {
+		for remoteConnectionID, remoteSecretKeyMaterial := range p.Remotes {
+			remote, ok := r.peers[remoteConnectionID]
+			if !ok {
+				continue
+			}
+			if !remote.used(remoteSecretKeyMaterial) {
+				got := remoteSecretKeyMaterial
+				return &DivergenceError{
+					ConnectionID:       p.ConnectionID,
+					RemoteConnectionID: remoteConnectionID,
+					Got:                &got,
+					Want: e2ee.RemoteSecretKeyMaterial{
+						KeyID:             remote.KeyID,
+						SecretKeyMaterial: remote.SecretKeyMaterial,
+					},
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Check は全員が他の参加者の現在の KeyID と SecretKeyMaterial を持っているかを確認する
+func (r *Room) Check() error {
+	for _, p := range r.Peers() {
+		for _, remote := range r.Peers() {
+			if p == remote {
+				continue
+			}
+			want := e2ee.RemoteSecretKeyMaterial{
+				KeyID:             remote.KeyID,
+				SecretKeyMaterial: remote.SecretKeyMaterial,
+			}
+			got, ok := p.Remotes[remote.ConnectionID]
+			if !ok {
+				return &DivergenceError{
+					ConnectionID:       p.ConnectionID,
+					RemoteConnectionID: remote.ConnectionID,
+					Want:               want,
+				}
+			}
+			if got.KeyID != want.KeyID || !bytes.Equal(got.SecretKeyMaterial, want.SecretKeyMaterial) {
+				return &DivergenceError{
+					ConnectionID:       p.ConnectionID,
+					RemoteConnectionID: remote.ConnectionID,
+					Got:                &got,
+					Want:               want,
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package simulator
+
+import (
+	"errors"
+	"testing"
+
+	e2ee "github.com/shiguredo/sora-e2ee"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	aliceConnectionID = "ALICE---------------------"
+	bobConnectionID   = "BOB-----------------------"
+	carolConnectionID = "CAROL---------------------"
+	daveConnectionID  = "DAVE----------------------"
+)
+
+func joinAndRun(t *testing.T, r *Room, connectionIDs ...string) {
+	for _, connectionID := range connectionIDs {
+		_, err := r.Join(connectionID)
+		assert.Nil(t, err)
+		assert.Nil(t, r.Run())
+	}
+}
+
+func TestRoom(t *testing.T) {
+	r := NewRoom()
+	joinAndRun(t, r, aliceConnectionID, bobConnectionID, carolConnectionID)
+
+	alice, ok := r.Peer(aliceConnectionID)
+	assert.True(t, ok)
+	// bob と carol が入室したので 2 回 ratchet している
+	assert.Equal(t, uint32(2), alice.KeyID)
+	assert.Equal(t, 2, len(alice.Remotes))
+
+	carol, ok := r.Peer(carolConnectionID)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), carol.KeyID)
+	assert.Equal(t, alice.SecretKeyMaterial, carol.Remotes[aliceConnectionID].SecretKeyMaterial)
+
+	assert.Nil(t, r.Leave(bobConnectionID))
+	assert.Nil(t, r.Run())
+	assert.Equal(t, uint32(3), alice.KeyID)
+	assert.Equal(t, 1, len(alice.Remotes))
+	assert.Empty(t, r.DeliveryErrors())
+
+	assert.ErrorIs(t, r.Leave(bobConnectionID), ErrMissingPeer)
+	_, err := r.Join(aliceConnectionID)
+	assert.ErrorIs(t, err, ErrPeerAlreadyExists)
+}
+
+func TestRoomDelayAndReorder(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		r := NewRoom(WithSeed(seed), WithMaxDelay(5), WithReorder())
+		joinAndRun(t, r, aliceConnectionID, bobConnectionID, carolConnectionID, daveConnectionID)
+
+		assert.Nil(t, r.Leave(carolConnectionID))
+		assert.Nil(t, r.Run())
+
+		// 保留されたメッセージは揃った時点で処理されるのでエラーにならない
+		assert.Empty(t, r.DeliveryErrors())
+	}
+}
+
+func TestRoomDuplicate(t *testing.T) {
+	r := NewRoom(WithDuplicateRate(1))
+	joinAndRun(t, r, aliceConnectionID, bobConnectionID, carolConnectionID)
+
+	stats := r.Stats()
+	assert.Equal(t, stats.Sent, stats.Duplicated)
+	assert.Equal(t, stats.Sent*2, stats.Delivered)
+
+	// 複製したメッセージだけが失敗する
+	assert.NotEmpty(t, r.DeliveryErrors())
+	for _, err := range r.DeliveryErrors() {
+		assert.True(t, err.Duplicate)
+	}
+}
+
+func TestRoomDropAndReset(t *testing.T) {
+	r := NewRoom()
+	joinAndRun(t, r, aliceConnectionID, bobConnectionID)
+
+	// carol 宛のメッセージを全部破棄する
+	r.dropRate = 1
+	_, err := r.Join(carolConnectionID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, r.InFlight())
+
+	var divergenceError *DivergenceError
+	assert.True(t, errors.As(r.Check(), &divergenceError))
+	assert.Nil(t, divergenceError.Got)
+
+	r.dropRate = 0
+	// セッションが無いので作り直せない
+	assert.ErrorIs(t, r.ResetSession(aliceConnectionID, carolConnectionID), e2ee.ErrUnsupportedByRemote)
+}
+
+func TestRoomCheck(t *testing.T) {
+	r := NewRoom()
+	joinAndRun(t, r, aliceConnectionID, bobConnectionID)
+
+	alice, _ := r.Peer(aliceConnectionID)
+	bob, _ := r.Peer(bobConnectionID)
+
+	got := alice.Remotes[bobConnectionID]
+	alice.Remotes[bobConnectionID] = e2ee.RemoteSecretKeyMaterial{
+		KeyID:             got.KeyID,
+		SecretKeyMaterial: make([]byte, 32),
+	}
+
+	var divergenceError *DivergenceError
+	assert.True(t, errors.As(r.Check(), &divergenceError))
+	assert.Equal(t, aliceConnectionID, divergenceError.ConnectionID)
+	assert.Equal(t, bobConnectionID, divergenceError.RemoteConnectionID)
+	assert.Equal(t, bob.KeyID, divergenceError.Want.KeyID)
+	assert.NotNil(t, r.checkHistory())
+}
+
+// 同じシードであれば参加者の鍵も同じになる
+func TestRoomReplay(t *testing.T) {
+	run := func() [][]byte {
+		r := NewRoom(WithSeed(42), WithMaxDelay(3), WithReorder())
+		joinAndRun(t, r, aliceConnectionID, bobConnectionID, carolConnectionID)
+
+		var secretKeyMaterials [][]byte
+		for _, p := range r.Peers() {
+			secretKeyMaterials = append(secretKeyMaterials, p.SecretKeyMaterial)
+		}
+		return secretKeyMaterials
+	}
+
+	assert.Equal(t, run(), run())
+}
+
+func TestRoomHeaderEncryption(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		r := NewRoom(WithSeed(seed), WithMaxDelay(5), WithReorder(), WithEngineOptions(e2ee.WithHeaderEncryption()))
+		joinAndRun(t, r, aliceConnectionID, bobConnectionID, carolConnectionID)
+
+		assert.Nil(t, r.ResetSession(aliceConnectionID, bobConnectionID))
+		assert.Nil(t, r.Run())
+		assert.Nil(t, r.Leave(carolConnectionID))
+		assert.Nil(t, r.Run())
+	}
+}
+
+func TestRoomGroupMode(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		r := NewRoom(WithSeed(seed), WithMaxDelay(5), WithReorder(), WithEngineOptions(e2ee.WithGroupMode()))
+		joinAndRun(t, r, aliceConnectionID, bobConnectionID, carolConnectionID, daveConnectionID)
+
+		// 全員が同じエポックになる
+		for _, p := range r.Peers() {
+			assert.Equal(t, uint32(3), p.KeyID)
+		}
+
+		// 退室はコミットする 1 人が全員宛に 1 つ送るだけ
+		before := r.Stats().Sent
+		assert.Nil(t, r.Leave(carolConnectionID))
+		assert.Nil(t, r.Run())
+		assert.Equal(t, 2, r.Stats().Sent-before)
+
+		// 入室と退室が重なる
+		_, err := r.Join(carolConnectionID)
+		assert.Nil(t, err)
+		assert.Nil(t, r.Leave(aliceConnectionID))
+		assert.Nil(t, r.Run())
+
+		assert.Empty(t, r.DeliveryErrors())
+	}
+}
@@ -0,0 +1,72 @@
+package e2ee
+
+import (
+	"sort"
+	"time"
+)
+
+type skippedMessageKey struct {
+	session  *session
+	key      mkskippedKey
+	storedAt time.Time
+}
+
+func (e *Engine) totalSkippedMessageKeys() int {
+	total := 0
+	for _, session := range e.sessions {
+		session.mu.Lock()
+		if session.ratchetState != nil {
+			total += len(session.ratchetState.mkskipped)
+		}
+		session.mu.Unlock()
+	}
+	return total
+}
+
+// 期限が切れたスキップしたメッセージキーを破棄して、
+// 全セッションで保持する数が上限を超えていたら古いものから破棄する
+// 読み込みロック中に呼ばれるため、セッションのロックは 1 つずつ取る
+func (e *Engine) evictSkippedMessageKeys(now time.Time) {
+	e.evictMu.Lock()
+	defer e.evictMu.Unlock()
+
+	var skippedMessageKeys []skippedMessageKey
+	for _, session := range e.sessions {
+		session.mu.Lock()
+		rs := session.ratchetState
+		if rs != nil {
+			for k, v := range rs.mkskipped {
+				if e.skippedMessageKeyTTL > 0 && now.Sub(v.storedAt) >= e.skippedMessageKeyTTL {
+					delete(rs.mkskipped, k)
+					continue
+				}
+				skippedMessageKeys = append(skippedMessageKeys, skippedMessageKey{
+					session:  session,
+					key:      k,
+					storedAt: v.storedAt,
+				})
+			}
+		}
+		session.mu.Unlock()
+	}
+
+	if len(skippedMessageKeys) <= e.maxSkippedMessageKeys {
+		return
+	}
+
+	// 同じ時刻に保存したものは N が小さいほうを古いとみなす
+	sort.Slice(skippedMessageKeys, func(i, j int) bool {
+		a, b := skippedMessageKeys[i], skippedMessageKeys[j]
+		if !a.storedAt.Equal(b.storedAt) {
+			return a.storedAt.Before(b.storedAt)
+		}
+		return a.key.N < b.key.N
+	})
+
+	for _, skippedMessageKey := range skippedMessageKeys[:len(skippedMessageKeys)-e.maxSkippedMessageKeys] {
+		session := skippedMessageKey.session
+		session.mu.Lock()
+		delete(session.ratchetState.mkskipped, skippedMessageKey.key)
+		session.mu.Unlock()
+	}
+}
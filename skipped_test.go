@@ -0,0 +1,115 @@
+package e2ee
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRatchetStates(t *testing.T) (*ratchetState, *ratchetState, []byte) {
+	alice, err := generateIdentityKeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bob, err := generateIdentityKeyPair(rand.Reader)
+	assert.Nil(t, err)
+
+	aliceEphemeralKeyPair, err := generateX25519KeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bobPreKeyPair, err := generateX25519KeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bobPreKeyBundle := generatePreKeyBundle(*bob, *bobPreKeyPair, 1, selfCapabilities, nil)
+
+	aliceX25519IdentityPublicKey, err := alice.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+	bobX25519IdentityPublicKey, err := bob.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+
+	aliceRootKey, err := senderRootKey(alice.privateEd25519KeyToCurve25519(), aliceEphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey, nil, nil)
+	assert.Nil(t, err)
+	bobRootKey, err := receiverRootKey(bob.privateEd25519KeyToCurve25519(), bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceEphemeralKeyPair.publicKey, nil, nil)
+	assert.Nil(t, err)
+
+	ad := append(alice.publicKey[:], bobPreKeyBundle.identityKey[:]...)
+
+	aliceRatchetState, err := senderRatchetInit(rand.Reader, aliceRootKey, *bobPreKeyBundle)
+	assert.Nil(t, err)
+	bobRatchetState := receiverRatchetInit(bobRootKey, bobPreKeyBundle.signedPreKey, bobPreKeyPair.privateKey)
+
+	return aliceRatchetState, bobRatchetState, ad
+}
+
+func TestSkippedMessageKeysMaxSkip(t *testing.T) {
+	alice, bob, ad := newTestRatchetStates(t)
+	plaintext := []byte("hello world")
+	now := time.Now()
+
+	var headers, ciphertexts [][]byte
+	for i := 0; i < 5; i++ {
+		header, ciphertext, err := alice.ratchetEncrypt(plaintext, ad)
+		assert.Nil(t, err)
+		headers = append(headers, header)
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+
+	// 4 つスキップする必要があるので maxSkip が 3 では復号できない
+	_, err := bob.ratchetDecrypt(headers[4], ciphertexts[4], ad, 3, now, rand.Reader)
+	assert.ErrorIs(t, err, ErrTooManySkippedMessages)
+	// 状態は変更しない
+	assert.Equal(t, uint32(0), bob.remoteN)
+	assert.Empty(t, bob.mkskipped)
+
+	p, err := bob.ratchetDecrypt(headers[4], ciphertexts[4], ad, 4, now, rand.Reader)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintext, p)
+	assert.Equal(t, 4, len(bob.mkskipped))
+
+	// スキップしたメッセージは後から復号できる
+	for i := 0; i < 4; i++ {
+		p, err := bob.ratchetDecrypt(headers[i], ciphertexts[i], ad, 0, now, rand.Reader)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext, p)
+	}
+	assert.Empty(t, bob.mkskipped)
+}
+
+func TestEvictSkippedMessageKeys(t *testing.T) {
+	alice, bob, ad := newTestRatchetStates(t)
+	plaintext := []byte("hello world")
+	now := time.Now()
+
+	var headers, ciphertexts [][]byte
+	for i := 0; i < 6; i++ {
+		header, ciphertext, err := alice.ratchetEncrypt(plaintext, ad)
+		assert.Nil(t, err)
+		headers = append(headers, header)
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+
+	// N=0,1 を一分前にスキップ、N=3,4 を今スキップ
+	_, err := bob.ratchetDecrypt(headers[2], ciphertexts[2], ad, defaultMaxSkip, now.Add(-time.Minute), rand.Reader)
+	assert.Nil(t, err)
+	_, err = bob.ratchetDecrypt(headers[5], ciphertexts[5], ad, defaultMaxSkip, now, rand.Reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(bob.mkskipped))
+
+	e := NewEngine(version, WithMaxSkippedMessageKeys(3), WithSkippedMessageKeyTTL(time.Hour))
+	e.sessions = map[string]*session{
+		"ALICE---------------------": {ratchetState: bob},
+	}
+
+	// 上限を超えた分は古いものから破棄する
+	e.evictSkippedMessageKeys(now)
+	assert.Equal(t, 3, e.totalSkippedMessageKeys())
+	_, err = bob.ratchetDecrypt(headers[0], ciphertexts[0], ad, defaultMaxSkip, now, rand.Reader)
+	assert.ErrorIs(t, err, ErrDecryptMessage)
+	assert.Equal(t, uint32(6), bob.remoteN)
+	p, err := bob.ratchetDecrypt(headers[1], ciphertexts[1], ad, defaultMaxSkip, now, rand.Reader)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintext, p)
+
+	// 期限が切れたものは破棄する
+	e.skippedMessageKeyTTL = time.Minute
+	e.evictSkippedMessageKeys(now.Add(time.Minute))
+	assert.Equal(t, 0, e.totalSkippedMessageKeys())
+}
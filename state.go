@@ -0,0 +1,921 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Export で出力する状態のフォーマットのバージョン
+// 互換性のない変更を行った場合はインクリメントする
+const stateVersion uint8 = 1
+
+const (
+	stateSaltLength   = 32
+	stateNonceLength  = 12
+	stateHeaderLength = 1 + stateSaltLength + stateNonceLength
+)
+
+type x25519KeyPairState struct {
+	PublicKey  []byte `json:"public_key"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+type previousPreKeyPairState struct {
+	ID        uint32             `json:"id"`
+	KeyPair   x25519KeyPairState `json:"key_pair"`
+	ExpiresAt time.Time          `json:"expires_at"`
+	// PQXDH の pqPreKey の seed、公開鍵は seed から生成し直す
+	PQPreKeySeed []byte `json:"pq_pre_key_seed,omitempty"`
+	// MLS の KeyPackage の葉の鍵
+	MLSEncryptionKeyPair *x25519KeyPairState `json:"mls_encryption_key_pair,omitempty"`
+}
+
+type oneTimePreKeyPairState struct {
+	ID        uint32             `json:"id"`
+	KeyPair   x25519KeyPairState `json:"key_pair"`
+	Signature []byte             `json:"signature"`
+}
+
+type oneTimePreKeyState struct {
+	ID        uint32 `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+type preKeyBundleState struct {
+	IdentityKey     []byte `json:"identity_key"`
+	SignedPreKeyID  uint32 `json:"signed_pre_key_id"`
+	SignedPreKey    []byte `json:"signed_pre_key"`
+	PreKeySignature []byte `json:"pre_key_signature"`
+	Capabilities    uint32 `json:"capabilities,omitempty"`
+
+	PQPreKey          []byte `json:"pq_pre_key,omitempty"`
+	PQPreKeySignature []byte `json:"pq_pre_key_signature,omitempty"`
+
+	KeyPackage []byte `json:"key_package,omitempty"`
+}
+
+type membershipChangeState struct {
+	ConnectionID  string              `json:"connection_id"`
+	Stop          bool                `json:"stop,omitempty"`
+	OneTimePreKey *oneTimePreKeyState `json:"one_time_pre_key,omitempty"`
+}
+
+type skippedMessageKeyState struct {
+	DH       []byte    `json:"dh"`
+	N        uint32    `json:"n"`
+	Key      []byte    `json:"key"`
+	Nonce    []byte    `json:"nonce"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+type ratchetStateState struct {
+	SelfDH         x25519KeyPairState       `json:"self_dh"`
+	RemoteDH       []byte                   `json:"remote_dh"`
+	RootKey        []byte                   `json:"root_key"`
+	SelfChainKey   []byte                   `json:"self_chain_key"`
+	RemoteChainKey []byte                   `json:"remote_chain_key"`
+	SelfN          uint32                   `json:"self_n"`
+	RemoteN        uint32                   `json:"remote_n"`
+	PN             uint32                   `json:"pn"`
+	MKSkipped      []skippedMessageKeyState `json:"mk_skipped"`
+
+	// ヘッダーを暗号化する場合のみ
+	SelfHeaderKey       []byte `json:"self_header_key,omitempty"`
+	RemoteHeaderKey     []byte `json:"remote_header_key,omitempty"`
+	SelfNextHeaderKey   []byte `json:"self_next_header_key,omitempty"`
+	RemoteNextHeaderKey []byte `json:"remote_next_header_key,omitempty"`
+}
+
+type sessionState struct {
+	Role                  role                `json:"role"`
+	SelfPreKeyPair        x25519KeyPairState  `json:"self_pre_key_pair"`
+	SelfEphemeralKeyPair  x25519KeyPairState  `json:"self_ephemeral_key_pair"`
+	SelfOneTimePreKeyPair *x25519KeyPairState `json:"self_one_time_pre_key_pair,omitempty"`
+
+	RemoteKeyID                 uint32              `json:"remote_key_id"`
+	RemoteSecretKeyMaterial     []byte              `json:"remote_secret_key_material"`
+	RemoteIdentityKey           []byte              `json:"remote_identity_key"`
+	RemoteSignedPreKeyID        uint32              `json:"remote_signed_pre_key_id"`
+	RemoteSignedPreKey          []byte              `json:"remote_signed_pre_key"`
+	RemoteSignedPreKeySignature []byte              `json:"remote_signed_pre_key_signature"`
+	RemoteEphemeralKey          []byte              `json:"remote_ephemeral_key"`
+	RemoteOneTimePreKey         *oneTimePreKeyState `json:"remote_one_time_pre_key,omitempty"`
+
+	RootKey      []byte             `json:"root_key"`
+	AD           []byte             `json:"ad"`
+	RatchetState *ratchetStateState `json:"ratchet_state"`
+	ResetPending bool               `json:"reset_pending,omitempty"`
+
+	ProtocolVersion       uint8  `json:"protocol_version"`
+	RemoteProtocolVersion uint8  `json:"remote_protocol_version"`
+	RemoteCapabilities    uint32 `json:"remote_capabilities"`
+	Capabilities          uint32 `json:"capabilities,omitempty"`
+}
+
+type groupPrivateKeyState struct {
+	NodeIndex uint32             `json:"node_index"`
+	KeyPair   x25519KeyPairState `json:"key_pair"`
+}
+
+type groupState struct {
+	ID []byte `json:"id"`
+	// Sora 独自の場合は 0 で省略する
+	CipherSuite uint16 `json:"cipher_suite,omitempty"`
+	Epoch       uint32 `json:"epoch"`
+	// ratchetTree.encode の出力
+	Tree          []byte                 `json:"tree"`
+	PrivateKeys   []groupPrivateKeyState `json:"private_keys"`
+	SelfLeafIndex uint32                 `json:"self_leaf_index"`
+	InitSecret    []byte                 `json:"init_secret"`
+	EpochSecret   []byte                 `json:"epoch_secret"`
+	Committer     string                 `json:"committer,omitempty"`
+	Joiners       []string               `json:"joiners,omitempty"`
+	Leavers       []string               `json:"leavers,omitempty"`
+}
+
+type engineState struct {
+	KeyID             uint32 `json:"key_id"`
+	SecretKeyMaterial []byte `json:"secret_key_material"`
+	ConnectionID      string `json:"connection_id"`
+
+	IdentityPublicKey   []byte                    `json:"identity_public_key"`
+	IdentityPrivateKey  []byte                    `json:"identity_private_key"`
+	PreKeyPair          x25519KeyPairState        `json:"pre_key_pair"`
+	SignedPreKeyID      uint32                    `json:"signed_pre_key_id"`
+	PreviousPreKeyPairs []previousPreKeyPairState `json:"previous_pre_key_pairs"`
+	OneTimePreKeyPairs  []oneTimePreKeyPairState  `json:"one_time_pre_key_pairs"`
+	PQPreKeySeed        []byte                    `json:"pq_pre_key_seed,omitempty"`
+	// MLS の KeyPackage の葉の鍵
+	MLSEncryptionKeyPair *x25519KeyPairState `json:"mls_encryption_key_pair,omitempty"`
+	// 最後に採番した oneTimePreKey の ID、ReplenishOneTimePreKeys を追加する前の状態には含まれない
+	OneTimePreKeyID uint32 `json:"one_time_pre_key_id,omitempty"`
+
+	RemotePreKeyBundles map[string]preKeyBundleState `json:"remote_pre_key_bundles"`
+	Sessions            map[string]sessionState      `json:"sessions"`
+	// identityKey は IdentityStore に保存するので、ConnectionID と識別子の組だけを保存する
+	RemoteIdentifiers map[string]string `json:"remote_identifiers,omitempty"`
+	// グループモードの場合のみ
+	Group *groupState `json:"group,omitempty"`
+	// まだコミットしていない入退室、グループモードの場合は Group に含める
+	MembershipChanges        []membershipChangeState `json:"membership_changes,omitempty"`
+	MembershipChangeQueuedAt *time.Time              `json:"membership_change_queued_at,omitempty"`
+}
+
+// Export は Engine の状態を passphraseKey で暗号化して出力する
+// ページの再読み込み後などに Import で復元すれば、再度ハンドシェイクをする必要がない
+//
+// ```erlang
+// <<Version:8, Salt:32/binary, Nonce:12/binary, Ciphertext/binary>>
+// ```
+func (e *Engine) Export(passphraseKey []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.sessions == nil {
+		return nil, ErrUninitialized
+	}
+
+	plaintext, err := json.Marshal(e.state())
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, stateHeaderLength)
+	header[0] = stateVersion
+	if _, err := io.ReadFull(e.random, header[1:]); err != nil {
+		return nil, err
+	}
+	salt := header[1 : 1+stateSaltLength]
+	nonce := header[1+stateSaltLength:]
+
+	key, err := stateKey(passphraseKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	// ヘッダーも改ざんされないように ad に含める
+	ciphertext, err := encrypt(key, nonce, plaintext, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, ciphertext...), nil
+}
+
+// Import は Export で出力した状態を復元する
+// Init を呼ぶ必要はない、失敗した場合は Engine の状態は変更しない
+func (e *Engine) Import(passphraseKey, blob []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(blob) < stateHeaderLength {
+		return ErrInvalidState
+	}
+
+	header := blob[:stateHeaderLength]
+	if header[0] != stateVersion {
+		return ErrUnsupportedStateVersion
+	}
+	salt := header[1 : 1+stateSaltLength]
+	nonce := header[1+stateSaltLength:]
+
+	key, err := stateKey(passphraseKey, salt)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := decrypt(key, nonce, blob[stateHeaderLength:], header)
+	if err != nil {
+		return ErrStateDecrypt
+	}
+
+	var s engineState
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return ErrInvalidState
+	}
+
+	return e.restore(s, e.now())
+}
+
+// stateKey = HKDF-SHA256(passphraseKey, Salt, "SoraState", 32)
+func stateKey(passphraseKey []byte, salt []byte) ([]byte, error) {
+	if len(passphraseKey) == 0 {
+		return nil, ErrEmptyPassphraseKey
+	}
+
+	hkdf := hkdf.New(sha256.New, passphraseKey, salt, []byte("SoraState"))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (e *Engine) state() engineState {
+	s := engineState{
+		KeyID:             e.keyID,
+		SecretKeyMaterial: e.secretKeyMaterial,
+		ConnectionID:      e.connectionID,
+
+		IdentityPublicKey:  e.identityKeyPair.publicKey,
+		IdentityPrivateKey: e.identityKeyPair.privateKey,
+		PreKeyPair:         x25519KeyPairToState(e.preKeyPair),
+		SignedPreKeyID:     e.signedPreKeyID,
+		PQPreKeySeed:       pqPreKeyPairToState(e.pqPreKeyPair),
+		OneTimePreKeyID:    e.oneTimePreKeyID,
+
+		MLSEncryptionKeyPair: mlsEncryptionKeyPairToState(e.mlsEncryptionKeyPair),
+
+		RemotePreKeyBundles: make(map[string]preKeyBundleState),
+		Sessions:            make(map[string]sessionState),
+		RemoteIdentifiers:   e.remoteIdentifiers,
+	}
+
+	for id, previousPreKeyPair := range e.previousPreKeyPairs {
+		s.PreviousPreKeyPairs = append(s.PreviousPreKeyPairs, previousPreKeyPairState{
+			ID:        id,
+			KeyPair:   x25519KeyPairToState(previousPreKeyPair.keyPair),
+			ExpiresAt: previousPreKeyPair.expiresAt,
+
+			PQPreKeySeed:         pqPreKeyPairToState(previousPreKeyPair.pqPreKeyPair),
+			MLSEncryptionKeyPair: mlsEncryptionKeyPairToState(previousPreKeyPair.mlsEncryptionKeyPair),
+		})
+	}
+
+	for _, oneTimePreKeyPair := range e.oneTimePreKeyPairs {
+		s.OneTimePreKeyPairs = append(s.OneTimePreKeyPairs, oneTimePreKeyPairState{
+			ID:        oneTimePreKeyPair.id,
+			KeyPair:   x25519KeyPairToState(oneTimePreKeyPair.keyPair),
+			Signature: oneTimePreKeyPair.signature,
+		})
+	}
+
+	// WithRandom を指定した場合に同じ状態から同じ blob を出力するため、map の順番に依存させない
+	sort.Slice(s.PreviousPreKeyPairs, func(i, j int) bool {
+		return s.PreviousPreKeyPairs[i].ID < s.PreviousPreKeyPairs[j].ID
+	})
+	sort.Slice(s.OneTimePreKeyPairs, func(i, j int) bool {
+		return s.OneTimePreKeyPairs[i].ID < s.OneTimePreKeyPairs[j].ID
+	})
+
+	for connectionID, preKeyBundle := range e.remotePreKeyBundles {
+		// ループ変数の配列をスライスにすると全員が同じ signedPreKey になるのでコピーする
+		signedPreKey := preKeyBundle.signedPreKey
+		s.RemotePreKeyBundles[connectionID] = preKeyBundleState{
+			IdentityKey:     preKeyBundle.identityKey,
+			SignedPreKeyID:  preKeyBundle.signedPreKeyID,
+			SignedPreKey:    signedPreKey[:],
+			PreKeySignature: preKeyBundle.preKeySignature,
+			Capabilities:    preKeyBundle.capabilities,
+
+			PQPreKey:          preKeyBundle.pqPreKey,
+			PQPreKeySignature: preKeyBundle.pqPreKeySignature,
+
+			KeyPackage: preKeyBundle.keyPackage,
+		}
+	}
+
+	for connectionID, session := range e.sessions {
+		s.Sessions[connectionID] = session.state()
+	}
+
+	if e.group != nil {
+		s.Group = e.groupState()
+	}
+
+	for _, c := range e.membershipChanges {
+		s.MembershipChanges = append(s.MembershipChanges, membershipChangeState{
+			ConnectionID:  c.connectionID,
+			Stop:          c.stop,
+			OneTimePreKey: oneTimePreKeyToState(c.oneTimePreKey),
+		})
+	}
+	if !e.membershipChangeQueuedAt.IsZero() {
+		queuedAt := e.membershipChangeQueuedAt
+		s.MembershipChangeQueuedAt = &queuedAt
+	}
+
+	return s
+}
+
+// 直前のエポックは保存しない
+func (e *Engine) groupState() *groupState {
+	g := e.group
+	gs := &groupState{
+		ID:            g.id[:],
+		CipherSuite:   uint16(g.suite),
+		Epoch:         g.epoch,
+		Tree:          g.tree.encode(),
+		SelfLeafIndex: g.selfLeafIndex,
+		InitSecret:    g.initSecret,
+		EpochSecret:   g.epochSecret,
+		Committer:     g.committer,
+	}
+	for x, keyPair := range g.tree.privateKeys {
+		gs.PrivateKeys = append(gs.PrivateKeys, groupPrivateKeyState{
+			NodeIndex: x,
+			KeyPair:   x25519KeyPairToState(keyPair),
+		})
+	}
+	for connectionID := range e.groupJoiners {
+		gs.Joiners = append(gs.Joiners, connectionID)
+	}
+	for connectionID := range e.groupLeavers {
+		gs.Leavers = append(gs.Leavers, connectionID)
+	}
+
+	sort.Slice(gs.PrivateKeys, func(i, j int) bool {
+		return gs.PrivateKeys[i].NodeIndex < gs.PrivateKeys[j].NodeIndex
+	})
+	sort.Strings(gs.Joiners)
+	sort.Strings(gs.Leavers)
+
+	return gs
+}
+
+func (s *session) state() sessionState {
+	ss := sessionState{
+		Role:                 s.role,
+		SelfPreKeyPair:       x25519KeyPairToState(s.selfPreKeyPair),
+		SelfEphemeralKeyPair: x25519KeyPairToState(s.selfEphemeralKeyPair),
+
+		RemoteKeyID:                 s.remoteKeyID,
+		RemoteSecretKeyMaterial:     s.remoteSecretKeyMaterial,
+		RemoteIdentityKey:           s.remoteIdentityKey,
+		RemoteSignedPreKeyID:        s.remoteSignedPreKeyID,
+		RemoteSignedPreKey:          s.remoteSignedPreKey[:],
+		RemoteSignedPreKeySignature: s.remoteSignedPreKeySignature,
+		RemoteEphemeralKey:          s.remoteEphemeralKey[:],
+
+		RootKey:      s.rootKey,
+		AD:           s.ad,
+		ResetPending: s.resetPending,
+
+		ProtocolVersion:       s.protocolVersion,
+		RemoteProtocolVersion: s.remoteProtocolVersion,
+		RemoteCapabilities:    s.remoteCapabilities,
+		Capabilities:          s.capabilities,
+	}
+
+	if s.selfOneTimePreKeyPair != nil {
+		selfOneTimePreKeyPair := x25519KeyPairToState(*s.selfOneTimePreKeyPair)
+		ss.SelfOneTimePreKeyPair = &selfOneTimePreKeyPair
+	}
+
+	ss.RemoteOneTimePreKey = oneTimePreKeyToState(s.remoteOneTimePreKey)
+
+	if s.ratchetState != nil {
+		ss.RatchetState = s.ratchetState.state()
+	}
+
+	return ss
+}
+
+func (rs *ratchetState) state() *ratchetStateState {
+	s := &ratchetStateState{
+		SelfDH: x25519KeyPairToState(x25519KeyPair{
+			publicKey:  rs.selfDH.publicKey,
+			privateKey: rs.selfDH.privateKey,
+		}),
+		RemoteDH:       rs.remoteDH[:],
+		RootKey:        rs.rootKey,
+		SelfChainKey:   rs.selfChainKey,
+		RemoteChainKey: rs.remoteChainKey,
+		SelfN:          rs.selfN,
+		RemoteN:        rs.remoteN,
+		PN:             rs.PN,
+
+		SelfHeaderKey:       rs.selfHeaderKey,
+		RemoteHeaderKey:     rs.remoteHeaderKey,
+		SelfNextHeaderKey:   rs.selfNextHeaderKey,
+		RemoteNextHeaderKey: rs.remoteNextHeaderKey,
+	}
+
+	for k, v := range rs.mkskipped {
+		dh := k.DH
+		s.MKSkipped = append(s.MKSkipped, skippedMessageKeyState{
+			DH:       dh[:],
+			N:        k.N,
+			Key:      v.key,
+			Nonce:    v.nonce,
+			StoredAt: v.storedAt,
+		})
+	}
+
+	sort.Slice(s.MKSkipped, func(i, j int) bool {
+		if c := bytes.Compare(s.MKSkipped[i].DH, s.MKSkipped[j].DH); c != 0 {
+			return c < 0
+		}
+		return s.MKSkipped[i].N < s.MKSkipped[j].N
+	})
+
+	return s
+}
+
+func (e *Engine) restore(s engineState, now time.Time) error {
+	if err := e.checkPQXDH(); err != nil {
+		return err
+	}
+
+	preKeyPair, err := x25519KeyPairFromState(s.PreKeyPair)
+	if err != nil {
+		return err
+	}
+
+	if len(s.IdentityPublicKey) != 32 || len(s.IdentityPrivateKey) != 64 || len(s.SecretKeyMaterial) != 32 {
+		return ErrInvalidState
+	}
+	identityKeyPair := ed25519KeyPair{
+		publicKey:  s.IdentityPublicKey,
+		privateKey: s.IdentityPrivateKey,
+	}
+
+	previousPreKeyPairs := make(map[uint32]previousPreKeyPair)
+	for _, p := range s.PreviousPreKeyPairs {
+		keyPair, err := x25519KeyPairFromState(p.KeyPair)
+		if err != nil {
+			return err
+		}
+		pqPreKeyPair, err := pqPreKeyPairFromState(p.PQPreKeySeed)
+		if err != nil {
+			return err
+		}
+		mlsEncryptionKeyPair, err := mlsEncryptionKeyPairFromState(p.MLSEncryptionKeyPair)
+		if err != nil {
+			return err
+		}
+		previousPreKeyPairs[p.ID] = previousPreKeyPair{
+			keyPair:              *keyPair,
+			pqPreKeyPair:         pqPreKeyPair,
+			mlsEncryptionKeyPair: mlsEncryptionKeyPair,
+			expiresAt:            p.ExpiresAt,
+		}
+	}
+
+	// 含まれない場合は Init で採番した ID までしか利用していない
+	oneTimePreKeyID := s.OneTimePreKeyID
+	if oneTimePreKeyID == 0 {
+		oneTimePreKeyID = oneTimePreKeyCount
+	}
+	oneTimePreKeyPairs := make(map[uint32]oneTimePreKeyPair)
+	for _, p := range s.OneTimePreKeyPairs {
+		keyPair, err := x25519KeyPairFromState(p.KeyPair)
+		if err != nil {
+			return err
+		}
+		if p.ID > oneTimePreKeyID {
+			return ErrInvalidState
+		}
+		oneTimePreKeyPairs[p.ID] = oneTimePreKeyPair{
+			id:        p.ID,
+			keyPair:   *keyPair,
+			signature: p.Signature,
+		}
+	}
+
+	remotePreKeyBundles := make(map[string]preKeyBundle)
+	for connectionID, p := range s.RemotePreKeyBundles {
+		signedPreKey, err := x25519PublicKeyFromState(p.SignedPreKey)
+		if err != nil {
+			return err
+		}
+		remotePreKeyBundles[connectionID] = preKeyBundle{
+			identityKey:     p.IdentityKey,
+			signedPreKeyID:  p.SignedPreKeyID,
+			signedPreKey:    signedPreKey,
+			preKeySignature: p.PreKeySignature,
+			capabilities:    p.Capabilities,
+
+			pqPreKey:          p.PQPreKey,
+			pqPreKeySignature: p.PQPreKeySignature,
+
+			keyPackage: p.KeyPackage,
+		}
+	}
+
+	pqPreKeyPair, err := pqPreKeyPairFromState(s.PQPreKeySeed)
+	if err != nil {
+		return err
+	}
+	// WithPQXDH を指定して PQXDH を行っていなかった状態を復元した場合は、ここで生成する
+	if pqPreKeyPair == nil {
+		pqPreKeyPair, err = e.generatePQPreKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+
+	sessions := make(map[string]*session)
+	for connectionID, ss := range s.Sessions {
+		session, err := restoreSession(ss, now)
+		if err != nil {
+			return err
+		}
+		session.selfConnectionID = s.ConnectionID
+		session.selfIdenityKeyPair = identityKeyPair
+		session.remoteConnectionID = connectionID
+		sessions[connectionID] = session
+	}
+
+	// 失敗した場合に状態を変更しないように、すべて確認してから設定する
+	groupMode, mls := e.groupMode, e.mls
+	var g *group
+	if s.Group != nil {
+		g, err = restoreGroup(*s.Group)
+		if err != nil {
+			return err
+		}
+		// グループモードで保存した状態は WithGroupMode を指定しなくてもグループモードで復元する
+		groupMode = true
+		// MLS も同様に WithMLS を指定しなくても復元するが、Sora 独自のグループは MLS では復元できない
+		if g.suite == groupCipherSuiteMLS {
+			mls = true
+		} else if mls {
+			return ErrInvalidState
+		}
+	} else if groupMode && s.ConnectionID != "" {
+		// 開始済みのグループモードではない状態はグループモードで復元できない
+		return ErrInvalidState
+	}
+
+	var membershipChanges []membershipChange
+	for _, c := range s.MembershipChanges {
+		// 入室は preKeyBundle、退室はセッションが無ければコミットできない
+		_, hasPreKeyBundle := remotePreKeyBundles[c.ConnectionID]
+		_, hasSession := sessions[c.ConnectionID]
+		if (c.Stop && !hasSession) || (!c.Stop && (!hasPreKeyBundle || hasSession)) {
+			return ErrInvalidState
+		}
+		oneTimePreKey, err := oneTimePreKeyFromState(c.OneTimePreKey)
+		if err != nil {
+			return err
+		}
+		membershipChanges = append(membershipChanges, membershipChange{
+			connectionID:  c.ConnectionID,
+			stop:          c.Stop,
+			oneTimePreKey: oneTimePreKey,
+		})
+	}
+
+	mlsEncryptionKeyPair, err := mlsEncryptionKeyPairFromState(s.MLSEncryptionKeyPair)
+	if err != nil {
+		return err
+	}
+	var keyPackage []byte
+	if mls {
+		// MLS を利用していなかった状態を MLS で復元した場合は、ここで生成する
+		if mlsEncryptionKeyPair == nil {
+			mlsEncryptionKeyPair, err = generateX25519KeyPair(e.random)
+			if err != nil {
+				return err
+			}
+		}
+		keyPackage, err = generateMLSKeyPackage(identityKeyPair, *preKeyPair, *mlsEncryptionKeyPair)
+		if err != nil {
+			return err
+		}
+	} else {
+		mlsEncryptionKeyPair = nil
+	}
+
+	e.groupMode = groupMode
+	e.mls = mls
+	e.keyID = s.KeyID
+	e.secretKeyMaterial = s.SecretKeyMaterial
+	e.connectionID = s.ConnectionID
+
+	e.identityKeyPair = identityKeyPair
+	e.preKeyPair = *preKeyPair
+	e.signedPreKeyID = s.SignedPreKeyID
+	e.previousPreKeyPairs = previousPreKeyPairs
+	e.pqPreKeyPair = pqPreKeyPair
+	e.mlsEncryptionKeyPair = mlsEncryptionKeyPair
+	e.selfPreKeyBundle = *generatePreKeyBundle(identityKeyPair, *preKeyPair, s.SignedPreKeyID, e.capabilities(), e.selfPQPreKeyPair())
+	e.selfPreKeyBundle.keyPackage = keyPackage
+	e.oneTimePreKeyPairs = oneTimePreKeyPairs
+	e.oneTimePreKeyID = oneTimePreKeyID
+
+	e.remoteIdentifiers = make(map[string]string)
+	for connectionID, identifier := range s.RemoteIdentifiers {
+		e.remoteIdentifiers[connectionID] = identifier
+	}
+	e.remotePreKeyBundles = remotePreKeyBundles
+	e.sessions = sessions
+	// 保留中のメッセージは保存しない
+	e.pendingMessages = make(map[string][]pendingMessage)
+
+	e.membershipChanges = membershipChanges
+	e.membershipChangeQueuedAt = time.Time{}
+	if s.MembershipChangeQueuedAt != nil {
+		e.membershipChangeQueuedAt = *s.MembershipChangeQueuedAt
+	}
+
+	e.group = g
+	e.groupJoiners = make(map[string]bool)
+	e.groupLeavers = make(map[string]bool)
+	if s.Group != nil {
+		for _, connectionID := range s.Group.Joiners {
+			e.groupJoiners[connectionID] = true
+		}
+		for _, connectionID := range s.Group.Leavers {
+			e.groupLeavers[connectionID] = true
+		}
+	}
+
+	return nil
+}
+
+func restoreGroup(gs groupState) (*group, error) {
+	if len(gs.ID) != groupIDLength || len(gs.InitSecret) != 32 || len(gs.EpochSecret) != 32 {
+		return nil, ErrInvalidState
+	}
+
+	buf := bytes.NewReader(gs.Tree)
+	tree, err := decodeRatchetTree(buf)
+	if err != nil || buf.Len() != 0 {
+		return nil, ErrInvalidState
+	}
+	if tree.leaf(gs.SelfLeafIndex) == nil {
+		return nil, ErrInvalidState
+	}
+	for _, p := range gs.PrivateKeys {
+		keyPair, err := x25519KeyPairFromState(p.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		if p.NodeIndex >= uint32(len(tree.nodes)) {
+			return nil, ErrInvalidState
+		}
+		tree.privateKeys[p.NodeIndex] = *keyPair
+	}
+
+	suite := groupCipherSuite(gs.CipherSuite)
+	if suite != groupCipherSuiteSora && suite != groupCipherSuiteMLS {
+		return nil, ErrInvalidState
+	}
+
+	g := &group{
+		suite:         suite,
+		epoch:         gs.Epoch,
+		tree:          tree,
+		selfLeafIndex: gs.SelfLeafIndex,
+		initSecret:    gs.InitSecret,
+		epochSecret:   gs.EpochSecret,
+		committer:     gs.Committer,
+	}
+	copy(g.id[:], gs.ID)
+	return g, nil
+}
+
+func restoreSession(ss sessionState, now time.Time) (*session, error) {
+	selfPreKeyPair, err := x25519KeyPairFromState(ss.SelfPreKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	selfEphemeralKeyPair, err := x25519KeyPairFromState(ss.SelfEphemeralKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	remoteSignedPreKey, err := x25519PublicKeyFromState(ss.RemoteSignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	remoteEphemeralKey, err := x25519PublicKeyFromState(ss.RemoteEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		role:                 ss.Role,
+		selfPreKeyPair:       *selfPreKeyPair,
+		selfEphemeralKeyPair: *selfEphemeralKeyPair,
+
+		remoteKeyID:                 ss.RemoteKeyID,
+		remoteSecretKeyMaterial:     ss.RemoteSecretKeyMaterial,
+		remoteIdentityKey:           ss.RemoteIdentityKey,
+		remoteSignedPreKeyID:        ss.RemoteSignedPreKeyID,
+		remoteSignedPreKey:          remoteSignedPreKey,
+		remoteSignedPreKeySignature: ss.RemoteSignedPreKeySignature,
+		remoteEphemeralKey:          remoteEphemeralKey,
+
+		rootKey:      ss.RootKey,
+		ad:           ss.AD,
+		resetPending: ss.ResetPending,
+
+		protocolVersion:       ss.ProtocolVersion,
+		remoteProtocolVersion: ss.RemoteProtocolVersion,
+		remoteCapabilities:    ss.RemoteCapabilities,
+		capabilities:          ss.Capabilities,
+	}
+
+	if ss.SelfOneTimePreKeyPair != nil {
+		selfOneTimePreKeyPair, err := x25519KeyPairFromState(*ss.SelfOneTimePreKeyPair)
+		if err != nil {
+			return nil, err
+		}
+		s.selfOneTimePreKeyPair = selfOneTimePreKeyPair
+	}
+
+	s.remoteOneTimePreKey, err = oneTimePreKeyFromState(ss.RemoteOneTimePreKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if ss.RatchetState == nil {
+		return nil, ErrInvalidState
+	}
+	ratchetState, err := restoreRatchetState(*ss.RatchetState, now)
+	if err != nil {
+		return nil, err
+	}
+	// AEAD はセッションの capabilities から決まるので保存しない
+	ratchetState.aead = s.aead()
+	s.ratchetState = ratchetState
+
+	return s, nil
+}
+
+func restoreRatchetState(s ratchetStateState, now time.Time) (*ratchetState, error) {
+	selfDH, err := x25519KeyPairFromState(s.SelfDH)
+	if err != nil {
+		return nil, err
+	}
+	remoteDH, err := x25519PublicKeyFromState(s.RemoteDH)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &ratchetState{
+		selfDH: ratchetKeyPair{
+			privateKey: selfDH.privateKey,
+			publicKey:  selfDH.publicKey,
+		},
+		remoteDH:       remoteDH,
+		rootKey:        s.RootKey,
+		selfChainKey:   s.SelfChainKey,
+		remoteChainKey: s.RemoteChainKey,
+		selfN:          s.SelfN,
+		remoteN:        s.RemoteN,
+		PN:             s.PN,
+		mkskipped:      make(map[mkskippedKey]messageKey),
+
+		selfHeaderKey:       s.SelfHeaderKey,
+		remoteHeaderKey:     s.RemoteHeaderKey,
+		selfNextHeaderKey:   s.SelfNextHeaderKey,
+		remoteNextHeaderKey: s.RemoteNextHeaderKey,
+	}
+
+	for _, skipped := range s.MKSkipped {
+		dh, err := x25519PublicKeyFromState(skipped.DH)
+		if err != nil {
+			return nil, err
+		}
+		// stored_at を持たない状態は Import した時点で保存したとみなす
+		storedAt := skipped.StoredAt
+		if storedAt.IsZero() {
+			storedAt = now
+		}
+		rs.mkskipped[mkskippedKey{DH: dh, N: skipped.N}] = messageKey{
+			key:      skipped.Key,
+			nonce:    skipped.Nonce,
+			storedAt: storedAt,
+		}
+	}
+
+	return rs, nil
+}
+
+func x25519KeyPairToState(keyPair x25519KeyPair) x25519KeyPairState {
+	return x25519KeyPairState{
+		PublicKey:  keyPair.publicKey[:],
+		PrivateKey: keyPair.privateKey[:],
+	}
+}
+
+func x25519KeyPairFromState(s x25519KeyPairState) (*x25519KeyPair, error) {
+	if len(s.PublicKey) != 32 || len(s.PrivateKey) != 32 {
+		return nil, ErrInvalidState
+	}
+
+	keyPair := &x25519KeyPair{}
+	copy(keyPair.publicKey[:], s.PublicKey)
+	copy(keyPair.privateKey[:], s.PrivateKey)
+	return keyPair, nil
+}
+
+func x25519PublicKeyFromState(b []byte) (x25519PublicKey, error) {
+	var publicKey x25519PublicKey
+	if len(b) != 32 {
+		return publicKey, ErrInvalidState
+	}
+	copy(publicKey[:], b)
+	return publicKey, nil
+}
+
+func oneTimePreKeyToState(o *oneTimePreKey) *oneTimePreKeyState {
+	if o == nil {
+		return nil
+	}
+	return &oneTimePreKeyState{
+		ID:        o.id,
+		PublicKey: o.publicKey[:],
+		Signature: o.signature,
+	}
+}
+
+func oneTimePreKeyFromState(s *oneTimePreKeyState) (*oneTimePreKey, error) {
+	if s == nil {
+		return nil, nil
+	}
+	publicKey, err := x25519PublicKeyFromState(s.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &oneTimePreKey{
+		id:        s.ID,
+		publicKey: publicKey,
+		signature: s.Signature,
+	}, nil
+}
+
+func pqPreKeyPairToState(pqPreKeyPair *pqPreKeyPair) []byte {
+	if pqPreKeyPair == nil {
+		return nil
+	}
+	return pqPreKeyPair.seed
+}
+
+func mlsEncryptionKeyPairToState(keyPair *x25519KeyPair) *x25519KeyPairState {
+	if keyPair == nil {
+		return nil
+	}
+	s := x25519KeyPairToState(*keyPair)
+	return &s
+}
+
+func mlsEncryptionKeyPairFromState(s *x25519KeyPairState) (*x25519KeyPair, error) {
+	if s == nil {
+		return nil, nil
+	}
+	return x25519KeyPairFromState(*s)
+}
+
+// PQXDH に対応していない場合は pqPreKey を破棄して、PQXDH を行わない Engine として復元する
+func pqPreKeyPairFromState(seed []byte) (*pqPreKeyPair, error) {
+	if seed == nil || !pqxdhSupported {
+		return nil, nil
+	}
+	if len(seed) != pqSeedLength {
+		return nil, ErrInvalidState
+	}
+	return newPQPreKeyPair(seed)
+}
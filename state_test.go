@@ -0,0 +1,155 @@
+package e2ee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	passphraseKey := []byte("passphrase-key")
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	r2, err := bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+	_, err = alice.ReceiveMessage(r2.Messages[0])
+	assert.Nil(t, err)
+
+	blob, err := alice.Export(passphraseKey)
+	assert.Nil(t, err)
+
+	restoredAlice := NewEngine(version)
+	assert.Nil(t, restoredAlice.Import(passphraseKey, blob))
+	assert.Equal(t, alice.SelfFingerprint(), restoredAlice.SelfFingerprint())
+	assert.Equal(t, alice.RemoteFingerprints(), restoredAlice.RemoteFingerprints())
+	assert.Equal(t, alice.SelfPreKeyBundle(), restoredAlice.SelfPreKeyBundle())
+	assert.Equal(t, alice.OneTimePreKeys(), restoredAlice.OneTimePreKeys())
+	assert.Equal(t, alice.SelfKeyID(), restoredAlice.SelfKeyID())
+
+	// 復元後もハンドシェイクし直さずにメッセージを受け取れる
+	bobMessages, err := bob.messages()
+	assert.Nil(t, err)
+	r3, err := restoredAlice.ReceiveMessage(bobMessages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, bob.secretKeyMaterial, r3.RemoteSecretKeyMaterials[bobConnectionID].SecretKeyMaterial)
+
+	// 復元後にメッセージを送れる
+	aliceMessages, err := restoredAlice.messages()
+	assert.Nil(t, err)
+	r4, err := bob.ReceiveMessage(aliceMessages[0])
+	assert.Nil(t, err)
+	assert.Equal(t, alice.secretKeyMaterial, r4.RemoteSecretKeyMaterials[aliceConnectionID].SecretKeyMaterial)
+
+	// 壊れたデータや鍵が異なる場合は失敗して状態を変更しない
+	other := NewEngine(version)
+	assert.Nil(t, other.Init())
+	otherFingerprint := other.SelfFingerprint()
+
+	assert.ErrorIs(t, other.Import([]byte("wrong-key"), blob), ErrStateDecrypt)
+
+	tampered := append([]byte{}, blob...)
+	tampered[len(tampered)-1] ^= 0x01
+	assert.ErrorIs(t, other.Import(passphraseKey, tampered), ErrStateDecrypt)
+
+	unsupported := append([]byte{}, blob...)
+	unsupported[0] = stateVersion + 1
+	assert.ErrorIs(t, other.Import(passphraseKey, unsupported), ErrUnsupportedStateVersion)
+
+	assert.ErrorIs(t, other.Import(passphraseKey, blob[:10]), ErrInvalidState)
+	assert.Equal(t, otherFingerprint, other.SelfFingerprint())
+
+	// Init していない場合は出力できない
+	_, err = NewEngine(version).Export(passphraseKey)
+	assert.ErrorIs(t, err, ErrUninitialized)
+}
+
+func TestExportImportRemotePreKeyBundles(t *testing.T) {
+	passphraseKey := []byte("passphrase-key")
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start("ALICE---------------------")
+	assert.Nil(t, err)
+
+	// 複数の相手の preKeyBundle がそれぞれ復元される
+	for _, connectionID := range []string{"BOB-----------------------", "CAROL---------------------", "DAVE----------------------"} {
+		remote := NewEngine(version)
+		assert.Nil(t, remote.Init())
+		_, err := alice.AddPreKeyBundle(connectionID, remote.SelfPreKeyBundle())
+		assert.Nil(t, err)
+	}
+
+	blob, err := alice.Export(passphraseKey)
+	assert.Nil(t, err)
+	restored := NewEngine(version)
+	assert.Nil(t, restored.Import(passphraseKey, blob))
+
+	assert.Len(t, restored.remotePreKeyBundles, len(alice.remotePreKeyBundles))
+	for connectionID, preKeyBundle := range alice.remotePreKeyBundles {
+		assert.Equal(t, preKeyBundle.signedPreKey, restored.remotePreKeyBundles[connectionID].signedPreKey, connectionID)
+		assert.Equal(t, preKeyBundle.identityKey, restored.remotePreKeyBundles[connectionID].identityKey, connectionID)
+	}
+}
+
+func TestExportImportSkippedMessageKeys(t *testing.T) {
+	aliceConnectionID := "ALICE---------------------"
+	bobConnectionID := "BOB-----------------------"
+
+	passphraseKey := []byte("passphrase-key")
+
+	alice := NewEngine(version)
+	assert.Nil(t, alice.Init())
+	_, err := alice.Start(aliceConnectionID)
+	assert.Nil(t, err)
+
+	bob := NewEngine(version)
+	assert.Nil(t, bob.Init())
+	_, err = bob.Start(bobConnectionID)
+	assert.Nil(t, err)
+
+	r1, err := alice.StartSession(bobConnectionID, bob.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.AddPreKeyBundle(aliceConnectionID, alice.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[0])
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(r1.Messages[1])
+	assert.Nil(t, err)
+
+	// alice からのメッセージを 1 つ飛ばして受け取る
+	delayed, err := alice.messages()
+	assert.Nil(t, err)
+	latest, err := alice.messages()
+	assert.Nil(t, err)
+	_, err = bob.ReceiveMessage(latest[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(bob.sessions[aliceConnectionID].ratchetState.mkskipped))
+
+	blob, err := bob.Export(passphraseKey)
+	assert.Nil(t, err)
+
+	restoredBob := NewEngine(version)
+	assert.Nil(t, restoredBob.Import(passphraseKey, blob))
+
+	// スキップしたメッセージキーも復元されている
+	_, err = restoredBob.ReceiveMessage(delayed[0])
+	assert.Nil(t, err)
+}
@@ -125,9 +125,9 @@ func TestWasm(t *testing.T) {
 	assert.Equal(1.0, aliceResult2["selfKeyId"])
 	assert.Equal(aliceConnectionID, aliceResult2["selfConnectionId"])
 
-	// null / undefined は許容されないため、err がない場合は文字列を返す
-	r8 := run(ctx, "bob.addPreKeyBundle('%s', alicePreKeyBundle.identityKey, alicePreKeyBundle.signedPreKey, alicePreKeyBundle.preKeySignature) || 'NO-ERROR'", aliceConnectionID)
-	assert.Equal("NO-ERROR", r8.(string))
+	// [result, error]
+	r8 := run(ctx, "bob.addPreKeyBundle('%s', alicePreKeyBundle.identityKey, alicePreKeyBundle.signedPreKey, alicePreKeyBundle.preKeySignature)", aliceConnectionID)
+	assert.Nil(r8.([]interface{})[1])
 
 	// [result, error]
 	r9 := run(ctx, "bob.receiveMessage(aliceResult1.messages[0])")
@@ -172,11 +172,11 @@ func TestWasm(t *testing.T) {
 	assert.Equal(0.0, carolResult1["selfKeyId"].(float64))
 	assert.Equal(32, len(carolResult1["selfSecretKeyMaterial"].(map[string]interface{})))
 
-	r15 := run(ctx, "carol.addPreKeyBundle('%s', alicePreKeyBundle.identityKey, alicePreKeyBundle.signedPreKey, alicePreKeyBundle.preKeySignature) || 'NO-ERROR'", aliceConnectionID)
-	assert.Equal("NO-ERROR", r15.(string))
+	r15 := run(ctx, "carol.addPreKeyBundle('%s', alicePreKeyBundle.identityKey, alicePreKeyBundle.signedPreKey, alicePreKeyBundle.preKeySignature)", aliceConnectionID)
+	assert.Nil(r15.([]interface{})[1])
 
-	r16 := run(ctx, "carol.addPreKeyBundle('%s', bobPreKeyBundle.identityKey, bobPreKeyBundle.signedPreKey, bobPreKeyBundle.preKeySignature) || 'NO-ERROR'", bobConnectionID)
-	assert.Equal("NO-ERROR", r16.(string))
+	r16 := run(ctx, "carol.addPreKeyBundle('%s', bobPreKeyBundle.identityKey, bobPreKeyBundle.signedPreKey, bobPreKeyBundle.preKeySignature)", bobConnectionID)
+	assert.Nil(r16.([]interface{})[1])
 
 	// [result, error]
 	r17 := run(ctx, "[aliceResult2, err] = alice.startSession('%s', carolPreKeyBundle.identityKey, carolPreKeyBundle.signedPreKey, carolPreKeyBundle.preKeySignature)", carolConnectionID)
@@ -0,0 +1,319 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+// グループモードで利用する ratchet tree
+// https://www.rfc-editor.org/rfc/rfc9420.html#name-ratchet-tree-concepts
+//
+// 葉の数を 2 のべき乗に揃えた完全二分木を配列で表現する
+// 偶数番目のノードが葉、奇数番目のノードが中間ノードになり、空のノードは nil になる
+// 葉 i のノードのインデックスは 2i になる
+
+// 不正な木を受け取っても大量に確保しないように葉の数を制限する
+const maxTreeLeafCount = 1 << 16
+
+type treeNode struct {
+	publicKey x25519PublicKey
+
+	// 葉の場合のみ
+	connectionID string
+	identityKey  []byte
+
+	// 中間ノードの場合のみ、このノードの秘密鍵を知らない後から追加された葉のインデックス
+	unmergedLeaves []uint32
+}
+
+type ratchetTree struct {
+	nodes []*treeNode
+	// 自分が知っているノードの秘密鍵、キーはノードのインデックス
+	privateKeys map[uint32]x25519KeyPair
+}
+
+// 自分だけの木を作る
+func newRatchetTree(self treeNode, keyPair x25519KeyPair) *ratchetTree {
+	return &ratchetTree{
+		nodes:       []*treeNode{&self},
+		privateKeys: map[uint32]x25519KeyPair{0: keyPair},
+	}
+}
+
+func treeLevel(x uint32) int {
+	return bits.TrailingZeros32(^x)
+}
+
+func treeLeft(x uint32) uint32 {
+	return x ^ (1 << (treeLevel(x) - 1))
+}
+
+func treeRight(x uint32) uint32 {
+	return x ^ (3 << (treeLevel(x) - 1))
+}
+
+func treeParent(x uint32) uint32 {
+	k := treeLevel(x)
+	b := (x >> (k + 1)) & 1
+	return (x | (1 << k)) ^ (b << (k + 1))
+}
+
+func treeSibling(x uint32) uint32 {
+	p := treeParent(x)
+	if x < p {
+		return treeRight(p)
+	}
+	return treeLeft(p)
+}
+
+// x が a を根とする部分木に含まれるかどうか
+func treeInSubtree(x uint32, a uint32) bool {
+	width := uint32(1)<<treeLevel(a) - 1
+	return a-width <= x && x <= a+width
+}
+
+func (t *ratchetTree) leafCount() uint32 {
+	return uint32(len(t.nodes)+1) / 2
+}
+
+func (t *ratchetTree) root() uint32 {
+	return t.leafCount() - 1
+}
+
+// x の親から根までのノード
+func (t *ratchetTree) directPath(x uint32) []uint32 {
+	var path []uint32
+	root := t.root()
+	for x != root {
+		x = treeParent(x)
+		path = append(path, x)
+	}
+	return path
+}
+
+// directPath の各ノードの、x 側ではない子
+func (t *ratchetTree) copath(x uint32) []uint32 {
+	var copath []uint32
+	root := t.root()
+	for x != root {
+		copath = append(copath, treeSibling(x))
+		x = treeParent(x)
+	}
+	return copath
+}
+
+func (t *ratchetTree) leaf(leafIndex uint32) *treeNode {
+	if 2*leafIndex >= uint32(len(t.nodes)) {
+		return nil
+	}
+	return t.nodes[2*leafIndex]
+}
+
+func (t *ratchetTree) findLeaf(connectionID string) (uint32, bool) {
+	for i := uint32(0); i < t.leafCount(); i++ {
+		if leaf := t.leaf(i); leaf != nil && leaf.connectionID == connectionID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// 空いている一番左の葉に追加する、空いていない場合は木を 2 倍にする
+func (t *ratchetTree) addLeaf(n treeNode) uint32 {
+	leafIndex := t.leafCount()
+	for i := uint32(0); i < t.leafCount(); i++ {
+		if t.leaf(i) == nil {
+			leafIndex = i
+			break
+		}
+	}
+	for leafIndex >= t.leafCount() {
+		t.nodes = append(t.nodes, make([]*treeNode, len(t.nodes)+1)...)
+	}
+
+	x := 2 * leafIndex
+	t.nodes[x] = &n
+	for _, p := range t.directPath(x) {
+		if t.nodes[p] != nil {
+			t.nodes[p].unmergedLeaves = append(t.nodes[p].unmergedLeaves, leafIndex)
+		}
+	}
+	return leafIndex
+}
+
+// 削除した葉が知っている鍵は使えないので、根までのノードも空にする
+// 右半分が空になった場合は木を半分にする
+func (t *ratchetTree) removeLeaf(leafIndex uint32) {
+	x := 2 * leafIndex
+	t.nodes[x] = nil
+	delete(t.privateKeys, x)
+	for _, p := range t.directPath(x) {
+		t.nodes[p] = nil
+		delete(t.privateKeys, p)
+	}
+
+	for t.leafCount() > 1 {
+		half := t.leafCount() - 1
+		for _, n := range t.nodes[half+1:] {
+			if n != nil {
+				return
+			}
+		}
+		for x := range t.privateKeys {
+			if x >= half {
+				delete(t.privateKeys, x)
+			}
+		}
+		t.nodes = t.nodes[:half]
+	}
+}
+
+// x の鍵を知っている参加者全員に届くノードの一覧
+// 空のノードは子のノードで代わりに、unmergedLeaves の葉は個別に暗号化する
+func (t *ratchetTree) resolution(x uint32) []uint32 {
+	if n := t.nodes[x]; n != nil {
+		resolution := []uint32{x}
+		for _, leafIndex := range n.unmergedLeaves {
+			resolution = append(resolution, 2*leafIndex)
+		}
+		return resolution
+	}
+	if treeLevel(x) == 0 {
+		return nil
+	}
+	return append(t.resolution(treeLeft(x)), t.resolution(treeRight(x))...)
+}
+
+func (t *ratchetTree) clone() *ratchetTree {
+	c := &ratchetTree{
+		nodes:       make([]*treeNode, len(t.nodes)),
+		privateKeys: make(map[uint32]x25519KeyPair),
+	}
+	for i, n := range t.nodes {
+		if n == nil {
+			continue
+		}
+		copied := *n
+		copied.unmergedLeaves = append([]uint32(nil), n.unmergedLeaves...)
+		c.nodes[i] = &copied
+	}
+	for x, keyPair := range t.privateKeys {
+		c.privateKeys[x] = keyPair
+	}
+	return c
+}
+
+// 秘密鍵は含めない
+// ```erlang
+// <<LeafCount:32, Node/binary...>>
+// ## 空のノード
+// <<0:8>>
+// ## 葉
+// <<1:8, PublicKey:32/binary, ConnectionID:26/binary, IdentityKey:32/binary>>
+// ## 中間ノード
+// <<1:8, PublicKey:32/binary, UnmergedLeafCount:32, UnmergedLeafIndex:32...>>
+// ```
+func (t *ratchetTree) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, t.leafCount())
+	for x, n := range t.nodes {
+		if n == nil {
+			buf.WriteByte(0)
+			continue
+		}
+		buf.WriteByte(1)
+		buf.Write(n.publicKey[:])
+		if x%2 == 0 {
+			buf.WriteString(n.connectionID)
+			buf.Write(n.identityKey)
+			continue
+		}
+		binary.Write(buf, binary.BigEndian, uint32(len(n.unmergedLeaves)))
+		binary.Write(buf, binary.BigEndian, n.unmergedLeaves)
+	}
+	return buf.Bytes()
+}
+
+// エポックの秘密の導出に含めて、全員が同じ木を持っていることを保証する
+func (t *ratchetTree) hash() [32]byte {
+	return sha256.Sum256(t.encode())
+}
+
+func decodeRatchetTree(buf *bytes.Reader) (*ratchetTree, error) {
+	var leafCount uint32
+	if err := binary.Read(buf, binary.BigEndian, &leafCount); err != nil {
+		return nil, ErrDecodeMessage
+	}
+	if leafCount == 0 || leafCount > maxTreeLeafCount || leafCount&(leafCount-1) != 0 {
+		return nil, ErrDecodeMessage
+	}
+	// 相手が送ってきた数をそのまま信用して確保しない
+	nodeCount := 2*leafCount - 1
+	if uint32(buf.Len()) < nodeCount {
+		return nil, ErrDecodeMessage
+	}
+
+	t := &ratchetTree{
+		nodes:       make([]*treeNode, nodeCount),
+		privateKeys: make(map[uint32]x25519KeyPair),
+	}
+	// 同じ ConnectionID の葉が複数あると findLeaf で片方しか見つからない
+	connectionIDs := make(map[string]bool)
+	for x := uint32(0); x < nodeCount; x++ {
+		present, err := buf.ReadByte()
+		if err != nil {
+			return nil, ErrDecodeMessage
+		}
+		if present == 0 {
+			continue
+		}
+		if present != 1 {
+			return nil, ErrDecodeMessage
+		}
+
+		n := &treeNode{}
+		if err := binary.Read(buf, binary.BigEndian, &n.publicKey); err != nil {
+			return nil, ErrDecodeMessage
+		}
+		if x%2 == 0 {
+			var connectionID [connectionIDLength]byte
+			if err := binary.Read(buf, binary.BigEndian, &connectionID); err != nil {
+				return nil, ErrDecodeMessage
+			}
+			n.connectionID = string(connectionID[:])
+			if connectionIDs[n.connectionID] {
+				return nil, ErrDecodeMessage
+			}
+			connectionIDs[n.connectionID] = true
+			n.identityKey = make([]byte, 32)
+			if err := binary.Read(buf, binary.BigEndian, n.identityKey); err != nil {
+				return nil, ErrDecodeMessage
+			}
+		} else {
+			var unmergedLeafCount uint32
+			if err := binary.Read(buf, binary.BigEndian, &unmergedLeafCount); err != nil {
+				return nil, ErrDecodeMessage
+			}
+			if unmergedLeafCount > leafCount || uint32(buf.Len()) < unmergedLeafCount*4 {
+				return nil, ErrDecodeMessage
+			}
+			n.unmergedLeaves = make([]uint32, unmergedLeafCount)
+			if err := binary.Read(buf, binary.BigEndian, n.unmergedLeaves); err != nil {
+				return nil, ErrDecodeMessage
+			}
+			for _, leafIndex := range n.unmergedLeaves {
+				if leafIndex >= leafCount || !treeInSubtree(2*leafIndex, x) {
+					return nil, ErrDecodeMessage
+				}
+			}
+			if len(n.unmergedLeaves) == 0 {
+				n.unmergedLeaves = nil
+			}
+		}
+		t.nodes[x] = n
+	}
+
+	return t, nil
+}
@@ -0,0 +1,137 @@
+package e2ee
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTreeNode(t *testing.T, connectionID string) (treeNode, x25519KeyPair) {
+	keyPair, err := generateX25519KeyPair(newTestRandom(connectionID))
+	assert.Nil(t, err)
+	return treeNode{
+		publicKey:    keyPair.publicKey,
+		connectionID: connectionID,
+		identityKey:  make([]byte, 32),
+	}, *keyPair
+}
+
+func TestTreeMath(t *testing.T) {
+	// 葉が 4 つの木
+	//       3
+	//   1       5
+	// 0   2   4   6
+	assert.Equal(t, 0, treeLevel(0))
+	assert.Equal(t, 1, treeLevel(5))
+	assert.Equal(t, 2, treeLevel(3))
+	assert.Equal(t, uint32(1), treeLeft(3))
+	assert.Equal(t, uint32(5), treeRight(3))
+	assert.Equal(t, uint32(1), treeParent(2))
+	assert.Equal(t, uint32(3), treeParent(5))
+	assert.Equal(t, uint32(2), treeSibling(0))
+	assert.Equal(t, uint32(1), treeSibling(5))
+	assert.True(t, treeInSubtree(6, 3))
+	assert.True(t, treeInSubtree(4, 5))
+	assert.False(t, treeInSubtree(2, 5))
+
+	tree := &ratchetTree{nodes: make([]*treeNode, 7)}
+	assert.Equal(t, uint32(4), tree.leafCount())
+	assert.Equal(t, uint32(3), tree.root())
+	assert.Equal(t, []uint32{5, 3}, tree.directPath(4))
+	assert.Equal(t, []uint32{6, 1}, tree.copath(4))
+	assert.Nil(t, tree.directPath(3))
+}
+
+func TestRatchetTree(t *testing.T) {
+	self, keyPair := testTreeNode(t, "ALICE---------------------")
+	tree := newRatchetTree(self, keyPair)
+	assert.Equal(t, uint32(1), tree.leafCount())
+
+	bob, _ := testTreeNode(t, "BOB-----------------------")
+	carol, _ := testTreeNode(t, "CAROL---------------------")
+	assert.Equal(t, uint32(1), tree.addLeaf(bob))
+	assert.Equal(t, uint32(2), tree.addLeaf(carol))
+	assert.Equal(t, uint32(4), tree.leafCount())
+
+	// 中間ノードが空なので全員に個別に暗号化する
+	assert.Equal(t, []uint32{2, 4}, tree.resolution(tree.root())[1:])
+	assert.Equal(t, []uint32{4}, tree.resolution(5))
+
+	// 埋まっているノードに追加した葉は unmergedLeaves になる
+	tree.nodes[5] = &treeNode{publicKey: keyPair.publicKey}
+	dave, _ := testTreeNode(t, "DAVE----------------------")
+	assert.Equal(t, uint32(3), tree.addLeaf(dave))
+	assert.Equal(t, []uint32{3}, tree.nodes[5].unmergedLeaves)
+	assert.Equal(t, []uint32{5, 6}, tree.resolution(5))
+
+	leafIndex, ok := tree.findLeaf("CAROL---------------------")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), leafIndex)
+
+	// 削除した葉から根までは空になる
+	tree.removeLeaf(2)
+	assert.Nil(t, tree.nodes[4])
+	assert.Nil(t, tree.nodes[5])
+	assert.Equal(t, uint32(4), tree.leafCount())
+
+	// 右半分が空になったら半分にする
+	tree.removeLeaf(3)
+	assert.Equal(t, uint32(2), tree.leafCount())
+	_, ok = tree.findLeaf("DAVE----------------------")
+	assert.False(t, ok)
+
+	// 空いている葉から埋める
+	tree.addLeaf(carol)
+	tree.addLeaf(dave)
+	leafIndex, _ = tree.findLeaf("DAVE----------------------")
+	assert.Equal(t, uint32(3), leafIndex)
+
+	// 複製は元の木に影響しない
+	c := tree.clone()
+	c.removeLeaf(1)
+	assert.NotNil(t, tree.leaf(1))
+}
+
+func TestRatchetTreeEncode(t *testing.T) {
+	self, keyPair := testTreeNode(t, "ALICE---------------------")
+	tree := newRatchetTree(self, keyPair)
+	for _, connectionID := range []string{"BOB-----------------------", "CAROL---------------------"} {
+		n, _ := testTreeNode(t, connectionID)
+		tree.addLeaf(n)
+	}
+	tree.nodes[3] = &treeNode{publicKey: keyPair.publicKey, unmergedLeaves: []uint32{1, 2}}
+
+	encoded := tree.encode()
+	buf := bytes.NewReader(encoded)
+	decoded, err := decodeRatchetTree(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, tree.nodes, decoded.nodes)
+	assert.Equal(t, tree.hash(), decoded.hash())
+
+	// 同じ ConnectionID の葉
+	carol := tree.nodes[4]
+	bob := *tree.nodes[2]
+	tree.nodes[4] = &bob
+	_, err = decodeRatchetTree(bytes.NewReader(tree.encode()))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+	tree.nodes[4] = carol
+
+	// 部分木に含まれない unmergedLeaves
+	tree.nodes[1] = &treeNode{publicKey: keyPair.publicKey, unmergedLeaves: []uint32{2}}
+	_, err = decodeRatchetTree(bytes.NewReader(tree.encode()))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+
+	// 不正な葉の数
+	_, err = decodeRatchetTree(bytes.NewReader([]byte{0, 0, 0, 3, 0, 0, 0, 0, 0}))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+	_, err = decodeRatchetTree(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.ErrorIs(t, err, ErrDecodeMessage)
+
+	// 途中で切れている
+	for i := 0; i < len(encoded); i++ {
+		_, err = decodeRatchetTree(bytes.NewReader(encoded[:i]))
+		assert.ErrorIs(t, err, ErrDecodeMessage)
+	}
+}
@@ -0,0 +1,149 @@
+//go:build go1.26
+
+package e2ee
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// カプセル化の乱数を指定できる mlkemtest が Go 1.26 以降にしかないため、PQXDH のベクターは別に扱う
+
+// X3DH に ML-KEM-768 のカプセル化を加えた PQXDH の値
+type pqxdhVector struct {
+	// rootKey 以外は X3DH と同じ、rootKey は pqSharedSecret を含めた値
+	X3DH x3dhVector `json:"x3dh"`
+
+	ReceiverSignedPreKeyID uint32 `json:"receiverSignedPreKeyId"`
+	// ML-KEM-768 の decapsulation key の seed (d || z)
+	ReceiverPQPreKeySeed      hexBytes `json:"receiverPqPreKeySeed"`
+	ReceiverPQPreKey          hexBytes `json:"receiverPqPreKey"`
+	ReceiverPQPreKeySignature hexBytes `json:"receiverPqPreKeySignature"`
+	// カプセル化に利用した 32 バイトの乱数 m
+	EncapsulationRandom hexBytes `json:"encapsulationRandom"`
+	PQCiphertext        hexBytes `json:"pqCiphertext"`
+	PQSharedSecret      hexBytes `json:"pqSharedSecret"`
+}
+
+const pqxdhDescription = "PQXDH: X3DH with ML-KEM-768 (FIPS 203). " +
+	"receiverPqPreKey is the encapsulation key of the decapsulation key generated from receiverPqPreKeySeed (d || z). " +
+	"receiverPqPreKeySignature = Ed25519(IK_r, <<receiverSignedPreKeyId:32, receiverPqPreKey>>). " +
+	"(pqSharedSecret, pqCiphertext) = ML-KEM-768.Encaps(receiverPqPreKey, m = encapsulationRandom). " +
+	"rootKey = HKDF-SHA256(ikm = DH1 || DH2 || DH3 [|| DH4] || pqSharedSecret, salt = zeros(32), info = \"SoraText\", 32)."
+
+func generatePQXDHVector(t *testing.T, r *testRandom, withOneTimePreKey bool) pqxdhVector {
+	x3dh := generateX3DHVector(t, r, withOneTimePreKey)
+
+	seed := r.bytes(pqSeedLength)
+	pqPreKeyPair, err := newPQPreKeyPair(seed)
+	assert.Nil(t, err)
+	receiverIdentity := ed25519KeyPair{
+		privateKey: ed25519.NewKeyFromSeed(x3dh.ReceiverIdentitySeed),
+		publicKey:  []byte(x3dh.ReceiverIdentityKey),
+	}
+	signedPreKeyID := uint32(1)
+
+	encapsulationKey, err := mlkem.NewEncapsulationKey768(pqPreKeyPair.publicKey)
+	assert.Nil(t, err)
+	random := r.bytes(32)
+	sharedSecret, ciphertext, err := mlkemtest.Encapsulate768(encapsulationKey, random)
+	assert.Nil(t, err)
+
+	x3dh.RootKey = testPQXDHRootKey(t, x3dh, sharedSecret)
+
+	return pqxdhVector{
+		X3DH:                      x3dh,
+		ReceiverSignedPreKeyID:    signedPreKeyID,
+		ReceiverPQPreKeySeed:      seed,
+		ReceiverPQPreKey:          pqPreKeyPair.publicKey,
+		ReceiverPQPreKeySignature: signPQPreKey(receiverIdentity, signedPreKeyID, pqPreKeyPair.publicKey),
+		EncapsulationRandom:       random,
+		PQCiphertext:              ciphertext,
+		PQSharedSecret:            sharedSecret,
+	}
+}
+
+// sender と receiver の両方で rootKey を求めて一致することを確認する
+func testPQXDHRootKey(t *testing.T, v x3dhVector, pqSharedSecret []byte) []byte {
+	var senderIdentityPrivateKey, senderEphemeralPrivateKey, receiverSignedPrePrivateKey x25519PrivateKey
+	var senderEphemeralKey, receiverSignedPreKey x25519PublicKey
+	copy(senderIdentityPrivateKey[:], v.SenderIdentityX25519Private)
+	copy(senderEphemeralPrivateKey[:], v.SenderEphemeralPrivateKey)
+	copy(senderEphemeralKey[:], v.SenderEphemeralKey)
+	copy(receiverSignedPrePrivateKey[:], v.ReceiverSignedPreKeyPrivate)
+	copy(receiverSignedPreKey[:], v.ReceiverSignedPreKey)
+
+	var receiverOneTimePreKey *x25519PublicKey
+	var receiverOneTimePrePrivateKey *x25519PrivateKey
+	if v.ReceiverOneTimePreKey != nil {
+		receiverOneTimePreKey = &x25519PublicKey{}
+		copy(receiverOneTimePreKey[:], v.ReceiverOneTimePreKey)
+		receiverOneTimePrePrivateKey = &x25519PrivateKey{}
+		copy(receiverOneTimePrePrivateKey[:], v.ReceiverOneTimePreKeyPrivate)
+	}
+
+	receiverIdentity := ed25519KeyPair{privateKey: ed25519.NewKeyFromSeed(v.ReceiverIdentitySeed)}
+	receiverIdentityKey, err := publicEd25519KeyToCurve25519(v.ReceiverIdentityKey)
+	assert.Nil(t, err)
+	senderIdentityKey, err := publicEd25519KeyToCurve25519(v.SenderIdentityKey)
+	assert.Nil(t, err)
+
+	sender, err := senderRootKey(senderIdentityPrivateKey, senderEphemeralPrivateKey,
+		receiverIdentityKey, receiverSignedPreKey, receiverOneTimePreKey, pqSharedSecret)
+	assert.Nil(t, err)
+	receiver, err := receiverRootKey(receiverIdentity.privateEd25519KeyToCurve25519(), receiverSignedPrePrivateKey,
+		senderIdentityKey, senderEphemeralKey, receiverOneTimePrePrivateKey, pqSharedSecret)
+	assert.Nil(t, err)
+	assert.Equal(t, sender, receiver)
+	return sender
+}
+
+func TestPQXDHVectors(t *testing.T) {
+	r := newTestRandom("sora-e2ee pqxdh vectors")
+	vectors := []pqxdhVector{
+		generatePQXDHVector(t, r, false),
+		generatePQXDHVector(t, r, true),
+	}
+	assertVectorFile(t, filepath.Join("testdata", "vectors"), "pqxdh.json", vectorFile{Description: pqxdhDescription, Vectors: vectors})
+}
+
+// ベクターの入力だけから、他の実装と同じ手順で出力を求め直す
+func TestPQXDHVectorsVerify(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "vectors", "pqxdh.json"))
+	assert.Nil(t, err)
+	var file struct {
+		Vectors []pqxdhVector `json:"vectors"`
+	}
+	assert.Nil(t, json.Unmarshal(b, &file))
+	assert.NotEmpty(t, file.Vectors)
+
+	for _, v := range file.Vectors {
+		decapsulationKey, err := mlkem.NewDecapsulationKey768(v.ReceiverPQPreKeySeed)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.ReceiverPQPreKey), decapsulationKey.EncapsulationKey().Bytes())
+
+		signedData := make([]byte, 4)
+		binary.BigEndian.PutUint32(signedData, v.ReceiverSignedPreKeyID)
+		signedData = append(signedData, v.ReceiverPQPreKey...)
+		assert.True(t, ed25519.Verify(ed25519.PublicKey(v.X3DH.ReceiverIdentityKey), signedData, v.ReceiverPQPreKeySignature))
+
+		sharedSecret, ciphertext, err := mlkemtest.Encapsulate768(decapsulationKey.EncapsulationKey(), v.EncapsulationRandom)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.PQCiphertext), ciphertext)
+		assert.Equal(t, []byte(v.PQSharedSecret), sharedSecret)
+
+		sharedSecret, err = decapsulationKey.Decapsulate(v.PQCiphertext)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.PQSharedSecret), sharedSecret)
+
+		assert.Equal(t, []byte(v.X3DH.RootKey), testPQXDHRootKey(t, v.X3DH, v.PQSharedSecret))
+	}
+}
@@ -0,0 +1,793 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -run TestVectors -update-vectors で testdata/vectors 以下を生成し直す
+var updateVectors = flag.Bool("update-vectors", false, "update testdata/vectors")
+
+// 同じ seed からは常に同じ値を返す乱数
+// block(i) = SHA-256(seed || i:64)
+type testRandom struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func newTestRandom(seed string) *testRandom {
+	return &testRandom{seed: []byte(seed)}
+}
+
+func (r *testRandom) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			counter := make([]byte, 8)
+			binary.BigEndian.PutUint64(counter, r.counter)
+			r.counter++
+			block := sha256.Sum256(append(append([]byte{}, r.seed...), counter...))
+			r.buf = block[:]
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (r *testRandom) bytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// JSON では 16 進数の文字列で表現する
+type hexBytes []byte
+
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// 読み込む場合は Vectors にスライスのポインタを指定する
+type vectorFile struct {
+	Description string      `json:"description"`
+	Vectors     interface{} `json:"vectors"`
+}
+
+type x3dhVector struct {
+	// ed25519 の秘密鍵は RFC 8032 の 32 バイトの seed
+	SenderIdentitySeed          hexBytes `json:"senderIdentitySeed"`
+	SenderIdentityKey           hexBytes `json:"senderIdentityKey"`
+	SenderIdentityX25519Private hexBytes `json:"senderIdentityX25519PrivateKey"`
+	SenderEphemeralPrivateKey   hexBytes `json:"senderEphemeralPrivateKey"`
+	SenderEphemeralKey          hexBytes `json:"senderEphemeralKey"`
+
+	ReceiverIdentitySeed           hexBytes `json:"receiverIdentitySeed"`
+	ReceiverIdentityKey            hexBytes `json:"receiverIdentityKey"`
+	ReceiverIdentityX25519Public   hexBytes `json:"receiverIdentityX25519PublicKey"`
+	ReceiverSignedPreKeyPrivate    hexBytes `json:"receiverSignedPreKeyPrivateKey"`
+	ReceiverSignedPreKey           hexBytes `json:"receiverSignedPreKey"`
+	ReceiverPreKeySignature        hexBytes `json:"receiverPreKeySignature"`
+	ReceiverOneTimePreKeyID        uint32   `json:"receiverOneTimePreKeyId,omitempty"`
+	ReceiverOneTimePreKeyPrivate   hexBytes `json:"receiverOneTimePreKeyPrivateKey,omitempty"`
+	ReceiverOneTimePreKey          hexBytes `json:"receiverOneTimePreKey,omitempty"`
+	ReceiverOneTimePreKeySignature hexBytes `json:"receiverOneTimePreKeySignature,omitempty"`
+
+	RootKey hexBytes `json:"rootKey"`
+	// sender の AD、receiver は同じ値を利用する
+	AD hexBytes `json:"ad"`
+}
+
+type kdfRkVector struct {
+	RootKey         hexBytes `json:"rootKey"`
+	SelfPrivateKey  hexBytes `json:"selfPrivateKey"`
+	RemotePublicKey hexBytes `json:"remotePublicKey"`
+	NextRootKey     hexBytes `json:"nextRootKey"`
+	NextChainKey    hexBytes `json:"nextChainKey"`
+}
+
+type messageKeyVector struct {
+	ChainKey     hexBytes `json:"chainKey"`
+	MessageKey   hexBytes `json:"messageKey"`
+	Nonce        hexBytes `json:"nonce"`
+	NextChainKey hexBytes `json:"nextChainKey"`
+}
+
+type secretKeyMaterialVector struct {
+	KeyID             uint32   `json:"keyId"`
+	SecretKeyMaterial hexBytes `json:"secretKeyMaterial"`
+}
+
+type messageVector struct {
+	Name string `json:"name"`
+	// 入力
+	ProtocolVersion    uint8    `json:"protocolVersion"`
+	SelfConnectionID   string   `json:"selfConnectionId"`
+	RemoteConnectionID string   `json:"remoteConnectionId"`
+	IdentityKey        hexBytes `json:"identityKey,omitempty"`
+	EphemeralKey       hexBytes `json:"ephemeralKey,omitempty"`
+	OneTimePreKeyID    uint32   `json:"oneTimePreKeyId"`
+	SignedPreKeyID     uint32   `json:"signedPreKeyId"`
+	RatchetKey         hexBytes `json:"ratchetKey,omitempty"`
+	PN                 uint32   `json:"pn"`
+	N                  uint32   `json:"n"`
+	Ciphertext         hexBytes `json:"ciphertext,omitempty"`
+	// 出力
+	Message hexBytes `json:"message"`
+}
+
+// sender が StartSession で送る 2 つのメッセージを、receiver が復号できるまでの全ての値
+type handshakeVector struct {
+	X3DH x3dhVector `json:"x3dh"`
+
+	SenderConnectionID   string `json:"senderConnectionId"`
+	ReceiverConnectionID string `json:"receiverConnectionId"`
+	// preKeyMessage の末尾の Capabilities、0 の場合は AES-256-GCM で preKeyMessage に含めない
+	Capabilities            uint32   `json:"capabilities,omitempty"`
+	SenderRatchetPrivate    hexBytes `json:"senderRatchetPrivateKey"`
+	SenderRatchetKey        hexBytes `json:"senderRatchetKey"`
+	SenderRootKey           hexBytes `json:"senderRootKey"`
+	SenderChainKey          hexBytes `json:"senderChainKey"`
+	MessageKey              hexBytes `json:"messageKey"`
+	Nonce                   hexBytes `json:"nonce"`
+	SenderKeyID             uint32   `json:"senderKeyId"`
+	SenderSecretKeyMaterial hexBytes `json:"senderSecretKeyMaterial"`
+	// <<KeyId:32, SecretKeyMaterial:32/binary, ProtocolVersion:8, Capabilities:32>>
+	Plaintext     hexBytes `json:"plaintext"`
+	RatchetHeader hexBytes `json:"ratchetHeader"`
+	Ciphertext    hexBytes `json:"ciphertext"`
+
+	PreKeyMessage hexBytes `json:"preKeyMessage"`
+	CipherMessage hexBytes `json:"cipherMessage"`
+}
+
+// ヘッダーを暗号化する場合に StartSession で送る 2 つのメッセージ
+type headerEncryptionVector struct {
+	X3DH x3dhVector `json:"x3dh"`
+
+	SenderConnectionID   string   `json:"senderConnectionId"`
+	ReceiverConnectionID string   `json:"receiverConnectionId"`
+	Capabilities         uint32   `json:"capabilities"`
+	SharedHeaderKey      hexBytes `json:"sharedHeaderKey"`
+	SharedNextHeaderKey  hexBytes `json:"sharedNextHeaderKey"`
+	SenderRatchetPrivate hexBytes `json:"senderRatchetPrivateKey"`
+	SenderRootKey        hexBytes `json:"senderRootKey"`
+	SenderChainKey       hexBytes `json:"senderChainKey"`
+	SenderNextHeaderKey  hexBytes `json:"senderNextHeaderKey"`
+	MessageKey           hexBytes `json:"messageKey"`
+	Nonce                hexBytes `json:"nonce"`
+	Plaintext            hexBytes `json:"plaintext"`
+	RatchetHeader        hexBytes `json:"ratchetHeader"`
+	// <<Nonce:12/binary, EncryptedRatchetHeader:40/binary, Tag:16/binary>>
+	EncryptedHeader hexBytes `json:"encryptedHeader"`
+	Ciphertext      hexBytes `json:"ciphertext"`
+
+	PreKeyMessage hexBytes `json:"preKeyMessage"`
+	CipherMessage hexBytes `json:"cipherMessage"`
+}
+
+const (
+	x3dhDescription = "X3DH: identity keys are Ed25519 and converted to X25519. " +
+		"DH1 = DH(IK_s, SPK_r), DH2 = DH(EK_s, IK_r), DH3 = DH(EK_s, SPK_r), DH4 = DH(EK_s, OPK_r). " +
+		"rootKey = HKDF-SHA256(ikm = DH1 || DH2 || DH3 [|| DH4], salt = zeros(32), info = \"SoraText\", 32). " +
+		"ad = IK_s(Ed25519) || IK_r(Ed25519). " +
+		"preKeySignature = Ed25519(IK_r, SPK_r), oneTimePreKey signature = Ed25519(IK_r, OneTimePreKeyID:32 || OPK_r)."
+	kdfRkDescription = "KDF_RK: dh = X25519(selfPrivateKey, remotePublicKey), " +
+		"HKDF-SHA256(ikm = dh, salt = rootKey, info = \"SoraRatchet\") -> nextRootKey(32) || nextChainKey(32)."
+	messageKeyDescription = "KDF_CK: seed = HMAC-SHA256(chainKey, 0x01), " +
+		"HKDF-SHA256(ikm = seed, salt = zeros(44), info = \"SoraMessageKeys\") -> messageKey(32) || nonce(12). " +
+		"nextChainKey = HMAC-SHA256(chainKey, 0x02)."
+	secretKeyMaterialDescription = "ratchetSecretKeyMaterial: each entry is the previous one ratcheted once and keyId incremented. " +
+		"next = HKDF-SHA256(ikm = zeros(32), salt = secretKeyMaterial, info = \"SFrameRatchetKey\", 32)."
+	messagesDescription = "Message encodings, all integers are big endian. " +
+		"preKeyMessage = <<0:8, ProtocolVersion:8, 0:16, SrcConnectionID:26, DstConnectionID:26, IdentityKey:32, EphemeralKey:32, OneTimePreKeyID:32, SignedPreKeyID:32>>. " +
+		"cipherMessage = <<1:8, ProtocolVersion:8, CiphertextLength:16, SrcConnectionID:26, DstConnectionID:26, RatchetKey:32, PN:32, N:32, Ciphertext>>. " +
+		"resetMessage = <<2:8, ProtocolVersion:8, CiphertextLength:16, preKeyMessage fields, RatchetKey:32, PN:32, N:32, Ciphertext>>."
+	handshakeDescription = "StartSession from sender to receiver. ratchetHeader = <<RatchetKey:32, PN:32, N:32>>. " +
+		"ciphertext = AES-256-GCM(messageKey, nonce, plaintext, aad = ad [|| ProtocolVersion:8 if ProtocolVersion >= 1] || ratchetHeader). " +
+		"If capabilities has 0x04, ChaCha20-Poly1305 (RFC 8439) is used instead of AES-256-GCM with the same messageKey and nonce. " +
+		"senderRootKey and senderChainKey are KDF_RK(x3dh.rootKey, senderRatchetPrivateKey, x3dh.receiverSignedPreKey)."
+	headerEncryptionDescription = "StartSession with header encryption. preKeyMessage has a trailing Capabilities:32 (0x02 = header encryption). " +
+		"sharedHeaderKey || sharedNextHeaderKey = HKDF-SHA256(ikm = x3dh.rootKey, salt = zeros(32), info = \"SoraHeaderKeys\", 64). " +
+		"senderNextHeaderKey is the 3rd 32 bytes of the KDF_RK HKDF output. " +
+		"headerNonce = HMAC-SHA256(headerKey, \"SoraHeaderNonce\" || ratchetHeader)[:12], " +
+		"encryptedHeader = headerNonce || AES-256-GCM(sharedHeaderKey, headerNonce, ratchetHeader, aad = ad [|| ProtocolVersion:8]). " +
+		"ciphertext = AES-256-GCM(messageKey, nonce, plaintext, aad = ad [|| ProtocolVersion:8] || encryptedHeader). " +
+		"cipherMessage = <<3:8, ProtocolVersion:8, CiphertextLength:16, SrcConnectionID:26, DstConnectionID:26, EncryptedHeader:68, Ciphertext>>."
+)
+
+func testVectorIdentity(r *testRandom) *ed25519KeyPair {
+	privateKey := ed25519.NewKeyFromSeed(r.bytes(ed25519.SeedSize))
+	return &ed25519KeyPair{
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+}
+
+func testVectorKeyPair(t *testing.T, r *testRandom) *x25519KeyPair {
+	keyPair, err := generateX25519KeyPair(r)
+	assert.Nil(t, err)
+	return keyPair
+}
+
+func generateX3DHVector(t *testing.T, r *testRandom, withOneTimePreKey bool) x3dhVector {
+	senderIdentity := testVectorIdentity(r)
+	senderEphemeral := testVectorKeyPair(t, r)
+	receiverIdentity := testVectorIdentity(r)
+	receiverPreKeyPair := testVectorKeyPair(t, r)
+	receiverPreKeyBundle := generatePreKeyBundle(*receiverIdentity, *receiverPreKeyPair, 1, selfCapabilities, nil)
+
+	receiverIdentityX25519, err := receiverIdentity.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+	senderIdentityX25519, err := senderIdentity.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+
+	v := x3dhVector{
+		SenderIdentitySeed:           ed25519.PrivateKey(senderIdentity.privateKey).Seed(),
+		SenderIdentityKey:            senderIdentity.publicKey,
+		SenderEphemeralPrivateKey:    senderEphemeral.privateKey[:],
+		SenderEphemeralKey:           senderEphemeral.publicKey[:],
+		ReceiverIdentitySeed:         ed25519.PrivateKey(receiverIdentity.privateKey).Seed(),
+		ReceiverIdentityKey:          receiverIdentity.publicKey,
+		ReceiverIdentityX25519Public: receiverIdentityX25519[:],
+		ReceiverSignedPreKeyPrivate:  receiverPreKeyPair.privateKey[:],
+		ReceiverSignedPreKey:         receiverPreKeyPair.publicKey[:],
+		ReceiverPreKeySignature:      receiverPreKeyBundle.preKeySignature,
+		AD:                           append(append([]byte{}, senderIdentity.publicKey...), receiverIdentity.publicKey...),
+	}
+	senderIdentityX25519Private := senderIdentity.privateEd25519KeyToCurve25519()
+	v.SenderIdentityX25519Private = senderIdentityX25519Private[:]
+
+	var remoteOneTimePreKey *x25519PublicKey
+	var selfOneTimePrePrivateKey *x25519PrivateKey
+	if withOneTimePreKey {
+		oneTimePreKeyPair, err := generateOneTimePreKeyPair(r, *receiverIdentity, 1)
+		assert.Nil(t, err)
+		v.ReceiverOneTimePreKeyID = oneTimePreKeyPair.id
+		v.ReceiverOneTimePreKeyPrivate = oneTimePreKeyPair.keyPair.privateKey[:]
+		v.ReceiverOneTimePreKey = oneTimePreKeyPair.keyPair.publicKey[:]
+		v.ReceiverOneTimePreKeySignature = oneTimePreKeyPair.signature
+		remoteOneTimePreKey = &oneTimePreKeyPair.keyPair.publicKey
+		selfOneTimePrePrivateKey = &oneTimePreKeyPair.keyPair.privateKey
+	}
+
+	sender, err := senderRootKey(senderIdentityX25519Private, senderEphemeral.privateKey,
+		receiverIdentityX25519, receiverPreKeyPair.publicKey, remoteOneTimePreKey, nil)
+	assert.Nil(t, err)
+	receiver, err := receiverRootKey(receiverIdentity.privateEd25519KeyToCurve25519(), receiverPreKeyPair.privateKey,
+		senderIdentityX25519, senderEphemeral.publicKey, selfOneTimePrePrivateKey, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, sender, receiver)
+	v.RootKey = sender
+
+	return v
+}
+
+func generateKdfRkVector(t *testing.T, r *testRandom) kdfRkVector {
+	rootKey := r.bytes(32)
+	self := testVectorKeyPair(t, r)
+	remote := testVectorKeyPair(t, r)
+
+	nextRootKey, nextChainKey, err := kdfRk(rootKey, self.privateKey, remote.publicKey)
+	assert.Nil(t, err)
+
+	// 相手側で同じ値になる
+	otherRootKey, otherChainKey, err := kdfRk(rootKey, remote.privateKey, self.publicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, nextRootKey, otherRootKey)
+	assert.Equal(t, nextChainKey, otherChainKey)
+
+	return kdfRkVector{
+		RootKey:         rootKey,
+		SelfPrivateKey:  self.privateKey[:],
+		RemotePublicKey: remote.publicKey[:],
+		NextRootKey:     nextRootKey,
+		NextChainKey:    nextChainKey,
+	}
+}
+
+func generateMessageKeyVector(t *testing.T, chainKey []byte) messageKeyVector {
+	messageKey, nonce, err := newMessageKey(chainKey, aeadAES256GCM)
+	assert.Nil(t, err)
+	return messageKeyVector{
+		ChainKey:     chainKey,
+		MessageKey:   messageKey,
+		Nonce:        nonce,
+		NextChainKey: newChainKey(chainKey),
+	}
+}
+
+func generateMessageVectors(t *testing.T, r *testRandom) []messageVector {
+	var vectors []messageVector
+
+	for _, tc := range []struct {
+		name              string
+		protocolVersion   uint8
+		withOneTimePreKey bool
+	}{
+		{name: "preKeyMessage", protocolVersion: 0},
+		{name: "preKeyMessage with oneTimePreKey", protocolVersion: 1, withOneTimePreKey: true},
+	} {
+		identity := testVectorIdentity(r)
+		ephemeral := testVectorKeyPair(t, r)
+		s := &session{
+			protocolVersion:      tc.protocolVersion,
+			selfConnectionID:     "ALICE---------------------",
+			remoteConnectionID:   "BOB-----------------------",
+			selfIdenityKeyPair:   *identity,
+			selfEphemeralKeyPair: *ephemeral,
+			remoteSignedPreKeyID: 2,
+		}
+		if tc.withOneTimePreKey {
+			s.remoteOneTimePreKey = &oneTimePreKey{id: 3}
+		}
+		message, err := s.preKeyMessage()
+		assert.Nil(t, err)
+
+		v := messageVector{
+			Name:               tc.name,
+			ProtocolVersion:    tc.protocolVersion,
+			SelfConnectionID:   s.selfConnectionID,
+			RemoteConnectionID: s.remoteConnectionID,
+			IdentityKey:        identity.publicKey,
+			EphemeralKey:       ephemeral.publicKey[:],
+			SignedPreKeyID:     s.remoteSignedPreKeyID,
+			Message:            message,
+		}
+		if s.remoteOneTimePreKey != nil {
+			v.OneTimePreKeyID = s.remoteOneTimePreKey.id
+		}
+		vectors = append(vectors, v)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		protocolVersion uint8
+		reset           bool
+	}{
+		{name: "cipherMessage", protocolVersion: 0},
+		{name: "cipherMessage version 1", protocolVersion: 1},
+		{name: "resetMessage", protocolVersion: 1, reset: true},
+	} {
+		identity := testVectorIdentity(r)
+		ephemeral := testVectorKeyPair(t, r)
+		ratchet := testVectorKeyPair(t, r)
+		s := &session{
+			protocolVersion:      tc.protocolVersion,
+			selfConnectionID:     "BOB-----------------------",
+			remoteConnectionID:   "ALICE---------------------",
+			selfIdenityKeyPair:   *identity,
+			selfEphemeralKeyPair: *ephemeral,
+			remoteSignedPreKeyID: 1,
+		}
+		rs := &ratchetState{
+			selfDH: ratchetKeyPair{publicKey: ratchet.publicKey, privateKey: ratchet.privateKey},
+			PN:     5,
+			selfN:  7,
+		}
+		header, err := rs.header()
+		assert.Nil(t, err)
+		ciphertext := r.bytes(4 + 32 + 1 + 4 + 16)
+
+		v := messageVector{
+			Name:               tc.name,
+			ProtocolVersion:    tc.protocolVersion,
+			SelfConnectionID:   s.selfConnectionID,
+			RemoteConnectionID: s.remoteConnectionID,
+			RatchetKey:         ratchet.publicKey[:],
+			PN:                 rs.PN,
+			N:                  rs.selfN,
+			Ciphertext:         ciphertext,
+		}
+		if tc.reset {
+			v.IdentityKey = identity.publicKey
+			v.EphemeralKey = ephemeral.publicKey[:]
+			v.SignedPreKeyID = s.remoteSignedPreKeyID
+			v.Message, err = s.resetMessage(header, ciphertext)
+		} else {
+			v.Message, err = s.cipherMessage(header, ciphertext)
+		}
+		assert.Nil(t, err)
+		vectors = append(vectors, v)
+	}
+
+	return vectors
+}
+
+func generateHandshakeVector(t *testing.T, withOneTimePreKey bool, options ...Option) handshakeVector {
+	sender := NewEngine(version, append([]Option{WithRandom(newTestRandom("sora-e2ee sender"))}, options...)...)
+	assert.Nil(t, sender.Init())
+	_, err := sender.Start("SENDER--------------------")
+	assert.Nil(t, err)
+
+	receiver := NewEngine(version, append([]Option{WithRandom(newTestRandom("sora-e2ee receiver"))}, options...)...)
+	assert.Nil(t, receiver.Init())
+	_, err = receiver.Start("RECEIVER------------------")
+	assert.Nil(t, err)
+
+	receiverPreKeyBundle := receiver.SelfPreKeyBundle()
+	if withOneTimePreKey {
+		oneTimePreKey := receiver.OneTimePreKeys()[0]
+		receiverPreKeyBundle.OneTimePreKey = &oneTimePreKey
+	}
+
+	// WithRandom を指定しているので、StartSession で生成される鍵とメッセージは毎回同じになる
+	result, err := sender.StartSession(receiver.connectionID, receiverPreKeyBundle)
+	assert.Nil(t, err)
+	session := sender.sessions[receiver.connectionID]
+
+	x3dh := x3dhVector{
+		SenderIdentitySeed:          ed25519.PrivateKey(sender.identityKeyPair.privateKey).Seed(),
+		SenderIdentityKey:           sender.identityKeyPair.publicKey,
+		SenderEphemeralPrivateKey:   session.selfEphemeralKeyPair.privateKey[:],
+		SenderEphemeralKey:          session.selfEphemeralKeyPair.publicKey[:],
+		ReceiverIdentitySeed:        ed25519.PrivateKey(receiver.identityKeyPair.privateKey).Seed(),
+		ReceiverIdentityKey:         receiver.identityKeyPair.publicKey,
+		ReceiverSignedPreKeyPrivate: receiver.preKeyPair.privateKey[:],
+		ReceiverSignedPreKey:        receiver.preKeyPair.publicKey[:],
+		ReceiverPreKeySignature:     receiver.selfPreKeyBundle.preKeySignature,
+		RootKey:                     session.rootKey,
+		AD:                          session.ad,
+	}
+	senderIdentityX25519Private := sender.identityKeyPair.privateEd25519KeyToCurve25519()
+	x3dh.SenderIdentityX25519Private = senderIdentityX25519Private[:]
+	receiverIdentityX25519, err := receiver.identityKeyPair.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+	x3dh.ReceiverIdentityX25519Public = receiverIdentityX25519[:]
+	if withOneTimePreKey {
+		oneTimePreKeyPair := receiver.oneTimePreKeyPairs[receiverPreKeyBundle.OneTimePreKey.ID]
+		x3dh.ReceiverOneTimePreKeyID = oneTimePreKeyPair.id
+		x3dh.ReceiverOneTimePreKeyPrivate = oneTimePreKeyPair.keyPair.privateKey[:]
+		x3dh.ReceiverOneTimePreKey = oneTimePreKeyPair.keyPair.publicKey[:]
+		x3dh.ReceiverOneTimePreKeySignature = oneTimePreKeyPair.signature
+	}
+
+	// 送信前のチェインキーを求め直す
+	nextRootKey, senderChainKey, err := kdfRk(session.rootKey, session.ratchetState.selfDH.privateKey, receiver.preKeyPair.publicKey)
+	assert.Nil(t, err)
+	messageKey, nonce, err := newMessageKey(senderChainKey, session.aead())
+	assert.Nil(t, err)
+
+	cipherMessage := result.Messages[1]
+	header, buf, err := decodeMessageHeader(cipherMessage)
+	assert.Nil(t, err)
+	m, err := decodeCipherMessage(*header, buf)
+	assert.Nil(t, err)
+	ratchetHeader := cipherMessage[4+26+26 : 4+26+26+32+4+4]
+
+	plaintext, err := session.aead().decrypt(messageKey, nonce, m.ciphertext, append(session.messageAD(m.protocolVersion), ratchetHeader...))
+	assert.Nil(t, err)
+
+	// receiver が復号できる
+	_, err = receiver.AddPreKeyBundle(sender.connectionID, sender.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = receiver.ReceiveMessage(result.Messages[0])
+	assert.Nil(t, err)
+	r, err := receiver.ReceiveMessage(result.Messages[1])
+	assert.Nil(t, err)
+	assert.Equal(t, result.SelfSecretKeyMaterial, r.RemoteSecretKeyMaterials[sender.connectionID].SecretKeyMaterial)
+
+	return handshakeVector{
+		X3DH:                    x3dh,
+		SenderConnectionID:      sender.connectionID,
+		ReceiverConnectionID:    receiver.connectionID,
+		Capabilities:            session.capabilities,
+		SenderRatchetPrivate:    session.ratchetState.selfDH.privateKey[:],
+		SenderRatchetKey:        session.ratchetState.selfDH.publicKey[:],
+		SenderRootKey:           nextRootKey,
+		SenderChainKey:          senderChainKey,
+		MessageKey:              messageKey,
+		Nonce:                   nonce,
+		SenderKeyID:             result.SelfKeyID,
+		SenderSecretKeyMaterial: result.SelfSecretKeyMaterial,
+		Plaintext:               plaintext,
+		RatchetHeader:           ratchetHeader,
+		Ciphertext:              m.ciphertext,
+		PreKeyMessage:           result.Messages[0],
+		CipherMessage:           cipherMessage,
+	}
+}
+
+func generateHeaderEncryptionVector(t *testing.T) headerEncryptionVector {
+	sender := NewEngine(version, WithRandom(newTestRandom("sora-e2ee sender")), WithHeaderEncryption())
+	assert.Nil(t, sender.Init())
+	_, err := sender.Start("SENDER--------------------")
+	assert.Nil(t, err)
+
+	receiver := NewEngine(version, WithRandom(newTestRandom("sora-e2ee receiver")), WithHeaderEncryption())
+	assert.Nil(t, receiver.Init())
+	_, err = receiver.Start("RECEIVER------------------")
+	assert.Nil(t, err)
+
+	result, err := sender.StartSession(receiver.connectionID, receiver.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	session := sender.sessions[receiver.connectionID]
+
+	x3dh := x3dhVector{
+		SenderIdentitySeed:          ed25519.PrivateKey(sender.identityKeyPair.privateKey).Seed(),
+		SenderIdentityKey:           sender.identityKeyPair.publicKey,
+		SenderEphemeralPrivateKey:   session.selfEphemeralKeyPair.privateKey[:],
+		SenderEphemeralKey:          session.selfEphemeralKeyPair.publicKey[:],
+		ReceiverIdentitySeed:        ed25519.PrivateKey(receiver.identityKeyPair.privateKey).Seed(),
+		ReceiverIdentityKey:         receiver.identityKeyPair.publicKey,
+		ReceiverSignedPreKeyPrivate: receiver.preKeyPair.privateKey[:],
+		ReceiverSignedPreKey:        receiver.preKeyPair.publicKey[:],
+		ReceiverPreKeySignature:     receiver.selfPreKeyBundle.preKeySignature,
+		RootKey:                     session.rootKey,
+		AD:                          session.ad,
+	}
+	senderIdentityX25519Private := sender.identityKeyPair.privateEd25519KeyToCurve25519()
+	x3dh.SenderIdentityX25519Private = senderIdentityX25519Private[:]
+	receiverIdentityX25519, err := receiver.identityKeyPair.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+	x3dh.ReceiverIdentityX25519Public = receiverIdentityX25519[:]
+
+	sharedHeaderKey, sharedNextHeaderKey, err := sharedHeaderKeys(session.rootKey)
+	assert.Nil(t, err)
+	nextRootKey, senderChainKey, senderNextHeaderKey, err := kdfRkHE(session.rootKey, session.ratchetState.selfDH.privateKey, receiver.preKeyPair.publicKey)
+	assert.Nil(t, err)
+	messageKey, nonce, err := newMessageKey(senderChainKey, session.aead())
+	assert.Nil(t, err)
+
+	cipherMessage := result.Messages[1]
+	header, buf, err := decodeMessageHeader(cipherMessage)
+	assert.Nil(t, err)
+	m, err := decodeCipherMessage(*header, buf)
+	assert.Nil(t, err)
+
+	ad := session.messageAD(m.protocolVersion)
+	ratchetHeader, err := decrypt(sharedHeaderKey, m.encryptedHeader[:headerNonceLength], m.encryptedHeader[headerNonceLength:], ad)
+	assert.Nil(t, err)
+	plaintext, err := decrypt(messageKey, nonce, m.ciphertext, append(append([]byte{}, ad...), m.encryptedHeader...))
+	assert.Nil(t, err)
+
+	// receiver が復号できる
+	_, err = receiver.AddPreKeyBundle(sender.connectionID, sender.SelfPreKeyBundle())
+	assert.Nil(t, err)
+	_, err = receiver.ReceiveMessage(result.Messages[0])
+	assert.Nil(t, err)
+	r, err := receiver.ReceiveMessage(result.Messages[1])
+	assert.Nil(t, err)
+	assert.Equal(t, result.SelfSecretKeyMaterial, r.RemoteSecretKeyMaterials[sender.connectionID].SecretKeyMaterial)
+
+	return headerEncryptionVector{
+		X3DH:                 x3dh,
+		SenderConnectionID:   sender.connectionID,
+		ReceiverConnectionID: receiver.connectionID,
+		Capabilities:         session.capabilities,
+		SharedHeaderKey:      sharedHeaderKey,
+		SharedNextHeaderKey:  sharedNextHeaderKey,
+		SenderRatchetPrivate: session.ratchetState.selfDH.privateKey[:],
+		SenderRootKey:        nextRootKey,
+		SenderChainKey:       senderChainKey,
+		SenderNextHeaderKey:  senderNextHeaderKey,
+		MessageKey:           messageKey,
+		Nonce:                nonce,
+		Plaintext:            plaintext,
+		RatchetHeader:        ratchetHeader,
+		EncryptedHeader:      m.encryptedHeader,
+		Ciphertext:           m.ciphertext,
+		PreKeyMessage:        result.Messages[0],
+		CipherMessage:        cipherMessage,
+	}
+}
+
+func generateVectors(t *testing.T) map[string]vectorFile {
+	r := newTestRandom("sora-e2ee vectors")
+
+	x3dh := []x3dhVector{
+		generateX3DHVector(t, r, false),
+		generateX3DHVector(t, r, true),
+	}
+
+	var kdfRks []kdfRkVector
+	for i := 0; i < 3; i++ {
+		kdfRks = append(kdfRks, generateKdfRkVector(t, r))
+	}
+
+	var messageKeys []messageKeyVector
+	chainKey := r.bytes(32)
+	for i := 0; i < 3; i++ {
+		v := generateMessageKeyVector(t, chainKey)
+		messageKeys = append(messageKeys, v)
+		chainKey = v.NextChainKey
+	}
+
+	secretKeyMaterial := r.bytes(32)
+	secretKeyMaterials := []secretKeyMaterialVector{{KeyID: 0, SecretKeyMaterial: secretKeyMaterial}}
+	for keyID := uint32(1); keyID <= 3; keyID++ {
+		next, err := ratchetSecretKeyMaterial(secretKeyMaterial)
+		assert.Nil(t, err)
+		secretKeyMaterials = append(secretKeyMaterials, secretKeyMaterialVector{KeyID: keyID, SecretKeyMaterial: next})
+		secretKeyMaterial = next
+	}
+
+	handshakes := []handshakeVector{
+		generateHandshakeVector(t, false),
+		generateHandshakeVector(t, true),
+		generateHandshakeVector(t, false, WithChaCha20Poly1305()),
+	}
+
+	return map[string]vectorFile{
+		"x3dh.json":                {Description: x3dhDescription, Vectors: x3dh},
+		"kdf_rk.json":              {Description: kdfRkDescription, Vectors: kdfRks},
+		"message_key.json":         {Description: messageKeyDescription, Vectors: messageKeys},
+		"secret_key_material.json": {Description: secretKeyMaterialDescription, Vectors: secretKeyMaterials},
+		"messages.json":            {Description: messagesDescription, Vectors: generateMessageVectors(t, r)},
+		"handshake.json":           {Description: handshakeDescription, Vectors: handshakes},
+		"header_encryption.json":   {Description: headerEncryptionDescription, Vectors: []headerEncryptionVector{generateHeaderEncryptionVector(t)}},
+	}
+}
+
+// 生成したベクターと testdata/vectors 以下のファイルがバイト単位で一致する
+func TestVectors(t *testing.T) {
+	dir := filepath.Join("testdata", "vectors")
+
+	for name, file := range generateVectors(t) {
+		assertVectorFile(t, dir, name, file)
+	}
+}
+
+// -update-vectors の場合は書き込み、それ以外は既存のファイルと比較する
+func assertVectorFile(t *testing.T, dir string, name string, file vectorFile) {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	assert.Nil(t, encoder.Encode(file))
+	generated := buf.Bytes()
+
+	path := filepath.Join(dir, name)
+	if *updateVectors {
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+		assert.Nil(t, os.WriteFile(path, generated, 0644))
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), string(generated), name)
+}
+
+// ベクターの入力だけから、他の実装と同じ手順で出力を求め直す
+func TestVectorsVerify(t *testing.T) {
+	dir := filepath.Join("testdata", "vectors")
+
+	read := func(name string, v interface{}) {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(b, &vectorFile{Vectors: v}))
+	}
+
+	var x3dhs []x3dhVector
+	read("x3dh.json", &x3dhs)
+	assert.NotEmpty(t, x3dhs)
+	for _, v := range x3dhs {
+		senderIdentity := ed25519KeyPair{privateKey: ed25519.NewKeyFromSeed(v.SenderIdentitySeed)}
+		receiverIdentityKey, err := publicEd25519KeyToCurve25519(ed25519.NewKeyFromSeed(v.ReceiverIdentitySeed).Public().(ed25519.PublicKey))
+		assert.Nil(t, err)
+
+		var senderEphemeralPrivateKey x25519PrivateKey
+		var receiverSignedPreKey x25519PublicKey
+		copy(senderEphemeralPrivateKey[:], v.SenderEphemeralPrivateKey)
+		copy(receiverSignedPreKey[:], v.ReceiverSignedPreKey)
+		var receiverOneTimePreKey *x25519PublicKey
+		if v.ReceiverOneTimePreKey != nil {
+			receiverOneTimePreKey = &x25519PublicKey{}
+			copy(receiverOneTimePreKey[:], v.ReceiverOneTimePreKey)
+		}
+
+		rootKey, err := senderRootKey(senderIdentity.privateEd25519KeyToCurve25519(), senderEphemeralPrivateKey,
+			receiverIdentityKey, receiverSignedPreKey, receiverOneTimePreKey, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.RootKey), rootKey)
+		assert.True(t, ed25519.Verify(ed25519.PublicKey(v.ReceiverIdentityKey), v.ReceiverSignedPreKey, v.ReceiverPreKeySignature))
+	}
+
+	var kdfRks []kdfRkVector
+	read("kdf_rk.json", &kdfRks)
+	assert.NotEmpty(t, kdfRks)
+	for _, v := range kdfRks {
+		var privateKey x25519PrivateKey
+		var publicKey x25519PublicKey
+		copy(privateKey[:], v.SelfPrivateKey)
+		copy(publicKey[:], v.RemotePublicKey)
+		rootKey, chainKey, err := kdfRk(v.RootKey, privateKey, publicKey)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.NextRootKey), rootKey)
+		assert.Equal(t, []byte(v.NextChainKey), chainKey)
+	}
+
+	var messageKeys []messageKeyVector
+	read("message_key.json", &messageKeys)
+	assert.NotEmpty(t, messageKeys)
+	for _, v := range messageKeys {
+		messageKey, nonce, err := newMessageKey(v.ChainKey, aeadAES256GCM)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.MessageKey), messageKey)
+		assert.Equal(t, []byte(v.Nonce), nonce)
+		assert.Equal(t, []byte(v.NextChainKey), newChainKey(v.ChainKey))
+	}
+
+	var secretKeyMaterials []secretKeyMaterialVector
+	read("secret_key_material.json", &secretKeyMaterials)
+	for i := 1; i < len(secretKeyMaterials); i++ {
+		next, err := ratchetSecretKeyMaterial(secretKeyMaterials[i-1].SecretKeyMaterial)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(secretKeyMaterials[i].SecretKeyMaterial), next)
+	}
+
+	var handshakes []handshakeVector
+	read("handshake.json", &handshakes)
+	assert.NotEmpty(t, handshakes)
+	for _, v := range handshakes {
+		aead := aeadAES256GCM
+		if v.Capabilities&capabilityChaCha20Poly1305 != 0 {
+			aead = aeadChaCha20Poly1305
+		}
+		ciphertext, err := aead.encrypt(v.MessageKey, v.Nonce, v.Plaintext, append(append([]byte{}, v.X3DH.AD...), v.RatchetHeader...))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.Ciphertext), ciphertext)
+
+		m, err := decodeSenderKeyMessage(v.Plaintext)
+		assert.Nil(t, err)
+		assert.Equal(t, v.SenderKeyID, m.keyID)
+		assert.Equal(t, []byte(v.SenderSecretKeyMaterial), m.secretKeyMaterial[:])
+	}
+
+	var headerEncryptions []headerEncryptionVector
+	read("header_encryption.json", &headerEncryptions)
+	assert.NotEmpty(t, headerEncryptions)
+	for _, v := range headerEncryptions {
+		sharedHeaderKey, sharedNextHeaderKey, err := sharedHeaderKeys(v.X3DH.RootKey)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.SharedHeaderKey), sharedHeaderKey)
+		assert.Equal(t, []byte(v.SharedNextHeaderKey), sharedNextHeaderKey)
+
+		var privateKey x25519PrivateKey
+		var publicKey x25519PublicKey
+		copy(privateKey[:], v.SenderRatchetPrivate)
+		copy(publicKey[:], v.X3DH.ReceiverSignedPreKey)
+		rootKey, chainKey, nextHeaderKey, err := kdfRkHE(v.X3DH.RootKey, privateKey, publicKey)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.SenderRootKey), rootKey)
+		assert.Equal(t, []byte(v.SenderChainKey), chainKey)
+		assert.Equal(t, []byte(v.SenderNextHeaderKey), nextHeaderKey)
+
+		// ベクターのメッセージはバージョン 0 で送っている
+		encryptedHeader, err := encryptHeader(aeadAES256GCM, v.SharedHeaderKey, v.RatchetHeader, v.X3DH.AD)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.EncryptedHeader), encryptedHeader)
+		ciphertext, err := encrypt(v.MessageKey, v.Nonce, v.Plaintext, append(append([]byte{}, v.X3DH.AD...), v.EncryptedHeader...))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(v.Ciphertext), ciphertext)
+	}
+}
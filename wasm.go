@@ -1,56 +1,44 @@
+//go:build js && wasm
+
 package e2ee
 
 import (
 	"encoding/base64"
 	"syscall/js"
+	"time"
 
 	"errors"
 	"fmt"
 )
 
-type remoteSecretKeyMaterial struct {
-	keyID             uint32
-	secretKeyMaterial []byte
-}
-
-// js にわたすための変換前の処理
-type startSessionResult struct {
-	selfConnectionID         string
-	selfKeyID                uint32
-	selfSecretKeyMaterial    []byte
-	remoteSecretKeyMaterials map[string]remoteSecretKeyMaterial
-	messages                 [][]byte
-}
-
-type stopSessionResult struct {
-	selfConnectionID      string
-	selfKeyID             uint32
-	selfSecretKeyMaterial []byte
-	messages              [][]byte
-}
-
-type receiveMessageResult struct {
-	remoteSecretKeyMaterials map[string]remoteSecretKeyMaterial
-	messages                 [][]byte
-}
-
-const (
-	connectionIDLength = 26
-)
-
 // RegisterCallbacks ...
 func RegisterCallbacks(version string) {
 	js.Global().Set("E2EE", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		e := newE2EE(version)
+		e := NewEngine(version, jsOptions(args)...)
 		this.Set("version", js.FuncOf(e.wasmVersion))
 		this.Set("init", js.FuncOf(e.wasmInitE2EE))
 		this.Set("start", js.FuncOf(e.wasmStartE2EE))
 		this.Set("startSession", js.FuncOf(e.wasmStartSession))
 		this.Set("stopSession", js.FuncOf(e.wasmStopSession))
+		this.Set("queueStartSession", js.FuncOf(e.wasmQueueStartSession))
+		this.Set("queueStopSession", js.FuncOf(e.wasmQueueStopSession))
+		this.Set("commitMembershipChanges", js.FuncOf(e.wasmCommitMembershipChanges))
+		this.Set("resetSession", js.FuncOf(e.wasmResetSession))
 		this.Set("receiveMessage", js.FuncOf(e.wasmReceiveMessage))
 		this.Set("addPreKeyBundle", js.FuncOf(e.wasmAddPreKeyBundle))
+		this.Set("rotateSignedPreKey", js.FuncOf(e.wasmRotateSignedPreKey))
+		this.Set("replenishOneTimePreKeys", js.FuncOf(e.wasmReplenishOneTimePreKeys))
+		this.Set("export", js.FuncOf(e.wasmExport))
+		this.Set("import", js.FuncOf(e.wasmImport))
 		this.Set("selfFingerprint", js.FuncOf(e.wasmSelfFingerprint))
 		this.Set("remoteFingerprints", js.FuncOf(e.wasmRemoteFingerprints))
+		this.Set("sessionPQXDH", js.FuncOf(e.wasmSessionPQXDH))
+		this.Set("safetyNumber", js.FuncOf(e.wasmSafetyNumber))
+		this.Set("verifySafetyNumber", js.FuncOf(e.wasmVerifySafetyNumber))
+		this.Set("setRemoteIdentifier", js.FuncOf(e.wasmSetRemoteIdentifier))
+		this.Set("remoteIdentity", js.FuncOf(e.wasmRemoteIdentity))
+		this.Set("trustIdentity", js.FuncOf(e.wasmTrustIdentity))
+		this.Set("setIdentityVerified", js.FuncOf(e.wasmSetIdentityVerified))
 		return js.Undefined()
 	}))
 
@@ -60,27 +48,174 @@ func RegisterCallbacks(version string) {
 
 }
 
-func (e *e2ee) wasmVersion(this js.Value, args []js.Value) interface{} {
-	return e.getVersion()
+// new E2EE({ headerEncryption: true, chaCha20Poly1305: true, pqxdh: true, requirePQXDH: true, groupMode: true, mls: true }) のように設定を指定できる
+func jsOptions(args []js.Value) []Option {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return nil
+	}
+
+	var options []Option
+	if headerEncryption := args[0].Get("headerEncryption"); headerEncryption.Type() == js.TypeBoolean && headerEncryption.Bool() {
+		options = append(options, WithHeaderEncryption())
+	}
+	if chaCha20Poly1305 := args[0].Get("chaCha20Poly1305"); chaCha20Poly1305.Type() == js.TypeBoolean && chaCha20Poly1305.Bool() {
+		options = append(options, WithChaCha20Poly1305())
+	}
+	if pqxdh := args[0].Get("pqxdh"); pqxdh.Type() == js.TypeBoolean && pqxdh.Bool() {
+		options = append(options, WithPQXDH())
+	}
+	if requirePQXDH := args[0].Get("requirePQXDH"); requirePQXDH.Type() == js.TypeBoolean && requirePQXDH.Bool() {
+		options = append(options, WithRequirePQXDH())
+	}
+	if groupMode := args[0].Get("groupMode"); groupMode.Type() == js.TypeBoolean && groupMode.Bool() {
+		options = append(options, WithGroupMode())
+	}
+	if mls := args[0].Get("mls"); mls.Type() == js.TypeBoolean && mls.Bool() {
+		options = append(options, WithMLS())
+	}
+	if identityStore := args[0].Get("identityStore"); identityStore.Type() == js.TypeObject {
+		options = append(options, WithIdentityStore(jsIdentityStore{identityStore}))
+	}
+	// ミリ秒で指定する
+	if debounce := args[0].Get("membershipChangeDebounce"); debounce.Type() == js.TypeNumber {
+		options = append(options, WithMembershipChangeDebounce(time.Duration(debounce.Float()*float64(time.Millisecond))))
+	}
+	if maxDelay := args[0].Get("maxMembershipChangeDelay"); maxDelay.Type() == js.TypeNumber {
+		options = append(options, WithMaxMembershipChangeDelay(time.Duration(maxDelay.Float()*float64(time.Millisecond))))
+	}
+	return options
+}
+
+// new E2EE({ identityStore: { load, save } }) で指定する IdentityStore
+// load(identifier) は { identityKey, firstSeenAt, verified } か保存していない場合は undefined を返す
+// save(identifier, { identityKey, firstSeenAt, verified }) で保存する
+// identityKey は base64、firstSeenAt は UNIX 時間のミリ秒
+// Engine から同期的に呼び出すため、load と save は Promise を返してはいけない
+// IndexedDB を利用する場合は事前に読み込んだ値を返して、書き込みは save の中で完了を待たずに行うこと
+// 例外を投げた場合や Promise を返した場合は IdentityStoreError になる
+type jsIdentityStore struct {
+	v js.Value
+}
+
+// 例外は js.Error の panic になるので、エラーにして返す
+func (s jsIdentityStore) call(method string, args ...interface{}) (v js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrIdentityStore, method, r)
+		}
+	}()
+
+	v = s.v.Call(method, args...)
+	if v.Type() == js.TypeObject && v.Get("then").Type() == js.TypeFunction {
+		return js.Undefined(), fmt.Errorf("%w: %s returned a Promise", ErrIdentityStore, method)
+	}
+	return v, nil
+}
+
+func (s jsIdentityStore) LoadIdentity(identifier string) (*Identity, error) {
+	v, err := s.call("load", identifier)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsUndefined() || v.IsNull() {
+		return nil, nil
+	}
+
+	identityKey, err := base64.StdEncoding.DecodeString(v.Get("identityKey").String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		IdentityKey: identityKey,
+		FirstSeenAt: time.UnixMilli(int64(v.Get("firstSeenAt").Float())),
+		Verified:    v.Get("verified").Truthy(),
+	}, nil
+}
+
+func (s jsIdentityStore) SaveIdentity(identifier string, identity Identity) error {
+	_, err := s.call("save", identifier, identity.toJsValue())
+	return err
+}
+
+func (i Identity) toJsValue() map[string]interface{} {
+	return map[string]interface{}{
+		"identityKey": base64.StdEncoding.EncodeToString(i.IdentityKey),
+		"firstSeenAt": i.FirstSeenAt.UnixMilli(),
+		"verified":    i.Verified,
+	}
+}
+
+// preKeyBundle の capabilities は省略可能、古いクライアントの preKeyBundle には含まれない
+func jsCapabilities(args []js.Value, index int) uint32 {
+	if len(args) > index && !args[index].IsUndefined() && !args[index].IsNull() {
+		return uint32(args[index].Int())
+	}
+	return 0
+}
+
+// preKeyBundle の pqPreKey と pqPreKeySignature は省略可能、PQXDH に対応していない相手の preKeyBundle には含まれない
+func jsPQPreKey(args []js.Value, index int, p *PreKeyBundle) error {
+	if len(args) <= index+1 || args[index].IsUndefined() || args[index].IsNull() {
+		return nil
+	}
+
+	pqPreKey, err := base64.StdEncoding.DecodeString(args[index].String())
+	if err != nil {
+		return err
+	}
+
+	pqPreKeySignature, err := base64.StdEncoding.DecodeString(args[index+1].String())
+	if err != nil {
+		return err
+	}
+
+	p.PQPreKey = pqPreKey
+	p.PQPreKeySignature = pqPreKeySignature
+	return nil
 }
 
-func (e *e2ee) wasmInitE2EE(this js.Value, args []js.Value) interface{} {
-	if err := e.init(); err != nil {
-		// TODO(v): エラーメッセージを考える
-		return toJsReturnValue(nil, jsError(errors.New("InitError")))
+// preKeyBundle の keyPackage は省略可能、MLS に対応していない相手の preKeyBundle には含まれない
+func jsKeyPackage(args []js.Value, index int, p *PreKeyBundle) error {
+	if len(args) <= index || args[index].IsUndefined() || args[index].IsNull() {
+		return nil
 	}
+
+	keyPackage, err := base64.StdEncoding.DecodeString(args[index].String())
+	if err != nil {
+		return err
+	}
+
+	p.KeyPackage = keyPackage
+	return nil
+}
+
+func (e *Engine) wasmVersion(this js.Value, args []js.Value) interface{} {
+	return e.Version()
+}
+
+func (e *Engine) wasmInitE2EE(this js.Value, args []js.Value) interface{} {
+	if err := e.Init(); err != nil {
+		return toJsReturnValue(nil, jsError(fmt.Errorf("%w: %v", ErrInit, err)))
+	}
+	var oneTimePreKeys []interface{}
+	for _, oneTimePreKey := range e.OneTimePreKeys() {
+		oneTimePreKeys = append(oneTimePreKeys, oneTimePreKey.toJsValue())
+	}
+
 	return map[string]interface{}{
-		"preKeyBundle": e.selfPreKeyBundle.toJsValue(),
+		"preKeyBundle":   e.selfPreKeyBundle.toJsValue(),
+		"oneTimePreKeys": oneTimePreKeys,
 	}
 }
 
-func (e *e2ee) wasmStartE2EE(this js.Value, args []js.Value) interface{} {
+func (e *Engine) wasmStartE2EE(this js.Value, args []js.Value) interface{} {
 	// TODO(v): バリデーション
 	selfConnectionID := args[0].String()
-	if len(selfConnectionID) != connectionIDLength {
-		return toJsReturnValue(nil, jsError(errors.New("UnexpectedSelfConnectionIDError")))
+	secretKeyMaterial, err := e.Start(selfConnectionID)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
 	}
-	secretKeyMaterial := e.start(selfConnectionID)
 
 	result := map[string]interface{}{
 		"selfKeyId":             e.keyID,
@@ -94,40 +229,129 @@ func (p preKeyBundle) toJsValue() map[string]interface{} {
 	base64edSignedPreKey := base64.StdEncoding.EncodeToString(p.signedPreKey[:])
 	base64edPreKeySignature := base64.StdEncoding.EncodeToString(p.preKeySignature)
 
-	return map[string]interface{}{
+	value := map[string]interface{}{
 		"identityKey":     base64edIdentityKey,
+		"signedPreKeyId":  p.signedPreKeyID,
 		"signedPreKey":    base64edSignedPreKey,
 		"preKeySignature": base64edPreKeySignature,
+		"capabilities":    p.capabilities,
+	}
+	if p.pqPreKey != nil {
+		value["pqPreKey"] = base64.StdEncoding.EncodeToString(p.pqPreKey)
+		value["pqPreKeySignature"] = base64.StdEncoding.EncodeToString(p.pqPreKeySignature)
+	}
+	if p.keyPackage != nil {
+		value["keyPackage"] = base64.StdEncoding.EncodeToString(p.keyPackage)
+	}
+
+	return value
+}
+
+func (o OneTimePreKey) toJsValue() map[string]interface{} {
+	return map[string]interface{}{
+		"id":        o.ID,
+		"publicKey": base64.StdEncoding.EncodeToString(o.PublicKey),
+		"signature": base64.StdEncoding.EncodeToString(o.Signature),
+	}
+}
+
+// init で返した oneTimePreKeys の要素を受け取る
+func jsOneTimePreKey(v js.Value) (*OneTimePreKey, error) {
+	publicKey, err := base64.StdEncoding.DecodeString(v.Get("publicKey").String())
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(v.Get("signature").String())
+	if err != nil {
+		return nil, err
 	}
 
+	return &OneTimePreKey{
+		ID:        uint32(v.Get("id").Int()),
+		PublicKey: publicKey,
+		Signature: signature,
+	}, nil
 }
 
-func (e *e2ee) wasmStartSession(this js.Value, args []js.Value) interface{} {
+// startSession と queueStartSession の引数の相手の connectionID と preKeyBundle
+func jsStartSessionArgs(args []js.Value) (string, *PreKeyBundle, error) {
 	// 相手の connectionID を追加
 	remoteConnectionID := args[0].String()
-	if len(remoteConnectionID) != connectionIDLength {
-		return toJsReturnValue(nil, jsError(errors.New("UnexpectedRemoteConnectionIDError")))
-	}
 
 	base64edIdentityKey := args[1].String()
 	identityKey, err := base64.StdEncoding.DecodeString(base64edIdentityKey)
 	if err != nil {
-		return toJsReturnValue(nil, jsError(err))
+		return "", nil, err
 	}
 
 	base64edSignedPreKey := args[2].String()
 	signedPreKey, err := base64.StdEncoding.DecodeString(base64edSignedPreKey)
 	if err != nil {
-		return toJsReturnValue(nil, jsError(err))
+		return "", nil, err
 	}
 
 	base64edPreKeySignature := args[3].String()
 	preKeySignature, err := base64.StdEncoding.DecodeString(base64edPreKeySignature)
+	if err != nil {
+		return "", nil, err
+	}
+
+	remotePreKeyBundle := PreKeyBundle{
+		IdentityKey:     identityKey,
+		SignedPreKey:    signedPreKey,
+		PreKeySignature: preKeySignature,
+	}
+
+	// oneTimePreKey は省略可能
+	if len(args) > 4 && !args[4].IsUndefined() && !args[4].IsNull() {
+		oneTimePreKey, err := jsOneTimePreKey(args[4])
+		if err != nil {
+			return "", nil, err
+		}
+		remotePreKeyBundle.OneTimePreKey = oneTimePreKey
+	}
+
+	// signedPreKeyId は省略可能
+	if len(args) > 5 && !args[5].IsUndefined() && !args[5].IsNull() {
+		remotePreKeyBundle.SignedPreKeyID = uint32(args[5].Int())
+	}
+
+	remotePreKeyBundle.Capabilities = jsCapabilities(args, 6)
+
+	if err := jsPQPreKey(args, 7, &remotePreKeyBundle); err != nil {
+		return "", nil, err
+	}
+
+	if err := jsKeyPackage(args, 9, &remotePreKeyBundle); err != nil {
+		return "", nil, err
+	}
+
+	return remoteConnectionID, &remotePreKeyBundle, nil
+}
+
+func (e *Engine) wasmStartSession(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID, remotePreKeyBundle, err := jsStartSessionArgs(args)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	result, err := e.StartSession(remoteConnectionID, *remotePreKeyBundle)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	return toJsReturnValue(result.toJsValue(), nil)
+}
+
+// 引数は startSession と同じ、戻り値の deadline は commitMembershipChanges を呼ぶ時刻の UNIX 時間のミリ秒
+func (e *Engine) wasmQueueStartSession(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID, remotePreKeyBundle, err := jsStartSessionArgs(args)
 	if err != nil {
 		return toJsReturnValue(nil, jsError(err))
 	}
 
-	result, err := e.startSession(remoteConnectionID, identityKey, signedPreKey, preKeySignature)
+	result, err := e.QueueStartSession(remoteConnectionID, *remotePreKeyBundle)
 	if err != nil {
 		return toJsReturnValue(nil, jsError(err))
 	}
@@ -135,13 +359,20 @@ func (e *e2ee) wasmStartSession(this js.Value, args []js.Value) interface{} {
 	return toJsReturnValue(result.toJsValue(), nil)
 }
 
-func (e *e2ee) wasmStopSession(this js.Value, args []js.Value) interface{} {
+// キューが空になった場合の deadline は 0 になる
+func (e *Engine) wasmQueueStopSession(this js.Value, args []js.Value) interface{} {
 	remoteConnectionID := args[0].String()
-	if len(remoteConnectionID) != connectionIDLength {
-		return toJsReturnValue(nil, jsError(errors.New("UnexpectedRemoteConnectionIDError")))
+
+	result, err := e.QueueStopSession(remoteConnectionID)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
 	}
 
-	result, err := e.stopSession(remoteConnectionID)
+	return toJsReturnValue(result.toJsValue(), nil)
+}
+
+func (e *Engine) wasmCommitMembershipChanges(this js.Value, args []js.Value) interface{} {
+	result, err := e.CommitMembershipChanges()
 	if err != nil {
 		return toJsReturnValue(nil, jsError(err))
 	}
@@ -149,11 +380,10 @@ func (e *e2ee) wasmStopSession(this js.Value, args []js.Value) interface{} {
 	return toJsReturnValue(result.toJsValue(), nil)
 }
 
-func (e *e2ee) wasmReceiveMessage(this js.Value, args []js.Value) interface{} {
-	data := make([]byte, args[0].Get("length").Int())
-	_ = js.CopyBytesToGo(data, args[0])
+func (e *Engine) wasmStopSession(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID := args[0].String()
 
-	result, err := e.receiveMessage(data)
+	result, err := e.StopSession(remoteConnectionID)
 	if err != nil {
 		return toJsReturnValue(nil, jsError(err))
 	}
@@ -161,102 +391,406 @@ func (e *e2ee) wasmReceiveMessage(this js.Value, args []js.Value) interface{} {
 	return toJsReturnValue(result.toJsValue(), nil)
 }
 
-func (e *e2ee) wasmAddPreKeyBundle(this js.Value, args []js.Value) interface{} {
+// 引数に identityKey, signedPreKey, preKeySignature を指定した場合はその preKeyBundle を利用する
+func (e *Engine) wasmResetSession(this js.Value, args []js.Value) interface{} {
 	remoteConnectionID := args[0].String()
-	if len(remoteConnectionID) != connectionIDLength {
-		return jsError(errors.New("UnexpectedRemoteConnectionIDError"))
+
+	var remotePreKeyBundle *PreKeyBundle
+	if len(args) > 3 {
+		identityKey, err := base64.StdEncoding.DecodeString(args[1].String())
+		if err != nil {
+			return toJsReturnValue(nil, jsError(err))
+		}
+
+		signedPreKey, err := base64.StdEncoding.DecodeString(args[2].String())
+		if err != nil {
+			return toJsReturnValue(nil, jsError(err))
+		}
+
+		preKeySignature, err := base64.StdEncoding.DecodeString(args[3].String())
+		if err != nil {
+			return toJsReturnValue(nil, jsError(err))
+		}
+
+		remotePreKeyBundle = &PreKeyBundle{
+			IdentityKey:     identityKey,
+			SignedPreKey:    signedPreKey,
+			PreKeySignature: preKeySignature,
+		}
+
+		// oneTimePreKey は省略可能
+		if len(args) > 4 && !args[4].IsUndefined() && !args[4].IsNull() {
+			oneTimePreKey, err := jsOneTimePreKey(args[4])
+			if err != nil {
+				return toJsReturnValue(nil, jsError(err))
+			}
+			remotePreKeyBundle.OneTimePreKey = oneTimePreKey
+		}
+
+		// signedPreKeyId は省略可能
+		if len(args) > 5 && !args[5].IsUndefined() && !args[5].IsNull() {
+			remotePreKeyBundle.SignedPreKeyID = uint32(args[5].Int())
+		}
+
+		remotePreKeyBundle.Capabilities = jsCapabilities(args, 6)
+
+		if err := jsPQPreKey(args, 7, remotePreKeyBundle); err != nil {
+			return toJsReturnValue(nil, jsError(err))
+		}
+
+		if err := jsKeyPackage(args, 9, remotePreKeyBundle); err != nil {
+			return toJsReturnValue(nil, jsError(err))
+		}
+	}
+
+	result, err := e.ResetSession(remoteConnectionID, remotePreKeyBundle)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
 	}
 
+	return toJsReturnValue(result.toJsValue(), nil)
+}
+
+func (e *Engine) wasmReceiveMessage(this js.Value, args []js.Value) interface{} {
+	data := uint8ArrayToBytes(args[0])
+
+	result, err := e.ReceiveMessage(data)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	return toJsReturnValue(result.toJsValue(), nil)
+}
+
+func (e *Engine) wasmAddPreKeyBundle(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID := args[0].String()
+
 	base64edIdentityKey := args[1].String()
 	identityKey, err := base64.StdEncoding.DecodeString(base64edIdentityKey)
 	if err != nil {
-		return jsError(err)
+		return toJsReturnValue(nil, jsError(err))
 	}
 
 	base64edSignedPreKey := args[2].String()
 	signedPreKey, err := base64.StdEncoding.DecodeString(base64edSignedPreKey)
 	if err != nil {
-		return jsError(err)
+		return toJsReturnValue(nil, jsError(err))
 	}
 
 	base64edPreKeySignature := args[3].String()
 	preKeySignature, err := base64.StdEncoding.DecodeString(base64edPreKeySignature)
 	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	remotePreKeyBundle := PreKeyBundle{
+		IdentityKey:     identityKey,
+		SignedPreKey:    signedPreKey,
+		PreKeySignature: preKeySignature,
+		Capabilities:    jsCapabilities(args, 4),
+	}
+
+	if err := jsPQPreKey(args, 5, &remotePreKeyBundle); err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	if err := jsKeyPackage(args, 7, &remotePreKeyBundle); err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	// 保留していたメッセージを処理した結果を返す
+	result, err := e.AddPreKeyBundle(remoteConnectionID, remotePreKeyBundle)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	return toJsReturnValue(result.toJsValue(), nil)
+}
+
+func (e *Engine) wasmRotateSignedPreKey(this js.Value, args []js.Value) interface{} {
+	if _, err := e.RotateSignedPreKey(); err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	result := map[string]interface{}{
+		"preKeyBundle": e.selfPreKeyBundle.toJsValue(),
+	}
+	return toJsReturnValue(result, nil)
+}
+
+func (e *Engine) wasmReplenishOneTimePreKeys(this js.Value, args []js.Value) interface{} {
+	oneTimePreKeys, err := e.ReplenishOneTimePreKeys()
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	var jsOneTimePreKeys []interface{}
+	for _, oneTimePreKey := range oneTimePreKeys {
+		jsOneTimePreKeys = append(jsOneTimePreKeys, oneTimePreKey.toJsValue())
+	}
+	result := map[string]interface{}{
+		"oneTimePreKeys": jsOneTimePreKeys,
+	}
+	return toJsReturnValue(result, nil)
+}
+
+func (e *Engine) wasmExport(this js.Value, args []js.Value) interface{} {
+	passphraseKey := uint8ArrayToBytes(args[0])
+
+	blob, err := e.Export(passphraseKey)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	return toJsReturnValue(bytesToUint8Array(blob), nil)
+}
+
+func (e *Engine) wasmImport(this js.Value, args []js.Value) interface{} {
+	passphraseKey := uint8ArrayToBytes(args[0])
+	blob := uint8ArrayToBytes(args[1])
+
+	if err := e.Import(passphraseKey, blob); err != nil {
 		return jsError(err)
 	}
 
-	if err := e.addPreKeyBundle(remoteConnectionID, identityKey, signedPreKey, preKeySignature); err != nil {
+	return nil
+}
+
+func (e *Engine) wasmSelfFingerprint(this js.Value, args []js.Value) interface{} {
+	return e.SelfFingerprint()
+}
+
+func (e *Engine) wasmRemoteFingerprints(this js.Value, args []js.Value) interface{} {
+	remoteFingerprints := make(map[string]interface{})
+	for connectionID, fingerprint := range e.RemoteFingerprints() {
+		remoteFingerprints[connectionID] = fingerprint
+	}
+	return remoteFingerprints
+}
+
+// safetyNumber(remoteConnectionId, selfIdentifier, remoteIdentifier)
+func (e *Engine) wasmSafetyNumber(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID := args[0].String()
+	selfIdentifier := args[1].String()
+	remoteIdentifier := args[2].String()
+
+	safetyNumber, err := e.SafetyNumber(remoteConnectionID, selfIdentifier, remoteIdentifier)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	var emoji []interface{}
+	for _, s := range safetyNumber.Emoji {
+		emoji = append(emoji, s)
+	}
+
+	result := map[string]interface{}{
+		"numeric": safetyNumber.Numeric,
+		"emoji":   emoji,
+		"payload": bytesToUint8Array(safetyNumber.Payload),
+	}
+	return toJsReturnValue(result, nil)
+}
+
+// verifySafetyNumber(remoteConnectionId, selfIdentifier, remoteIdentifier, payload)
+func (e *Engine) wasmVerifySafetyNumber(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID := args[0].String()
+	selfIdentifier := args[1].String()
+	remoteIdentifier := args[2].String()
+	payload := uint8ArrayToBytes(args[3])
+
+	ok, err := e.VerifySafetyNumber(remoteConnectionID, selfIdentifier, remoteIdentifier, payload)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	return toJsReturnValue(ok, nil)
+}
+
+// sessionPQXDH(remoteConnectionId)
+func (e *Engine) wasmSessionPQXDH(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID := args[0].String()
+
+	pqxdh, err := e.SessionPQXDH(remoteConnectionID)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+
+	return toJsReturnValue(pqxdh, nil)
+}
+
+// setRemoteIdentifier(remoteConnectionId, identifier)
+func (e *Engine) wasmSetRemoteIdentifier(this js.Value, args []js.Value) interface{} {
+	remoteConnectionID := args[0].String()
+	identifier := args[1].String()
+
+	if err := e.SetRemoteIdentifier(remoteConnectionID, identifier); err != nil {
 		return jsError(err)
 	}
 
 	return nil
 }
 
-func (e *e2ee) wasmSelfFingerprint(this js.Value, args []js.Value) interface{} {
-	return e.selfFingerprint()
+// remoteIdentity(identifier)
+func (e *Engine) wasmRemoteIdentity(this js.Value, args []js.Value) interface{} {
+	identifier := args[0].String()
+
+	identity, err := e.RemoteIdentity(identifier)
+	if err != nil {
+		return toJsReturnValue(nil, jsError(err))
+	}
+	if identity == nil {
+		return toJsReturnValue(nil, nil)
+	}
+
+	return toJsReturnValue(identity.toJsValue(), nil)
 }
 
-func (e *e2ee) wasmRemoteFingerprints(this js.Value, args []js.Value) interface{} {
-	return e.remoteFingerprints()
+// trustIdentity(identifier, identityKey)
+func (e *Engine) wasmTrustIdentity(this js.Value, args []js.Value) interface{} {
+	identifier := args[0].String()
+	identityKey, err := base64.StdEncoding.DecodeString(args[1].String())
+	if err != nil {
+		return jsError(err)
+	}
+
+	if err := e.TrustIdentity(identifier, identityKey); err != nil {
+		return jsError(err)
+	}
+
+	return nil
 }
 
-func (r startSessionResult) toJsValue() map[string]interface{} {
+// setIdentityVerified(identifier, verified)
+func (e *Engine) wasmSetIdentityVerified(this js.Value, args []js.Value) interface{} {
+	identifier := args[0].String()
+	verified := args[1].Bool()
+
+	if err := e.SetIdentityVerified(identifier, verified); err != nil {
+		return jsError(err)
+	}
+
+	return nil
+}
+
+func (r StartSessionResult) toJsValue() map[string]interface{} {
 	secretKeyMaterials := make(map[string]interface{})
-	for connectionID, v := range r.remoteSecretKeyMaterials {
+	for connectionID, v := range r.RemoteSecretKeyMaterials {
 		secretKeyMaterials[connectionID] = map[string]interface{}{
-			"keyId":             v.keyID,
-			"secretKeyMaterial": bytesToUint8Array(v.secretKeyMaterial),
+			"keyId":             v.KeyID,
+			"secretKeyMaterial": bytesToUint8Array(v.SecretKeyMaterial),
 		}
 	}
 
 	var messages []interface{}
-	for _, s := range r.messages {
+	for _, s := range r.Messages {
 		messages = append(messages, bytesToUint8Array(s))
 	}
 
 	return map[string]interface{}{
-		"selfConnectionId":         r.selfConnectionID,
-		"selfKeyId":                r.selfKeyID,
-		"selfSecretKeyMaterial":    bytesToUint8Array(r.selfSecretKeyMaterial),
+		"selfConnectionId":         r.SelfConnectionID,
+		"selfKeyId":                r.SelfKeyID,
+		"selfSecretKeyMaterial":    bytesToUint8Array(r.SelfSecretKeyMaterial),
 		"remoteSecretKeyMaterials": secretKeyMaterials,
 		"messages":                 messages,
 	}
 }
 
-func (r stopSessionResult) toJsValue() map[string]interface{} {
+func (r StopSessionResult) toJsValue() map[string]interface{} {
+	secretKeyMaterials := make(map[string]interface{})
+	for connectionID, v := range r.RemoteSecretKeyMaterials {
+		secretKeyMaterials[connectionID] = map[string]interface{}{
+			"keyId":             v.KeyID,
+			"secretKeyMaterial": bytesToUint8Array(v.SecretKeyMaterial),
+		}
+	}
+
 	var messages []interface{}
-	for _, s := range r.messages {
+	for _, s := range r.Messages {
 		messages = append(messages, bytesToUint8Array(s))
 	}
 
 	return map[string]interface{}{
-		"selfConnectionId":      r.selfConnectionID,
-		"selfKeyId":             r.selfKeyID,
-		"selfSecretKeyMaterial": bytesToUint8Array(r.selfSecretKeyMaterial),
-		"messages":              messages,
+		"selfConnectionId":         r.SelfConnectionID,
+		"selfKeyId":                r.SelfKeyID,
+		"selfSecretKeyMaterial":    bytesToUint8Array(r.SelfSecretKeyMaterial),
+		"remoteSecretKeyMaterials": secretKeyMaterials,
+		"messages":                 messages,
+	}
+}
+
+func (r QueueSessionResult) toJsValue() map[string]interface{} {
+	var deadline int64
+	if !r.Deadline.IsZero() {
+		deadline = r.Deadline.UnixMilli()
+	}
+
+	return map[string]interface{}{
+		"deadline": deadline,
 	}
 }
 
-func (r receiveMessageResult) toJsValue() map[string]interface{} {
+func (r CommitMembershipChangesResult) toJsValue() map[string]interface{} {
 	secretKeyMaterials := make(map[string]interface{})
-	for connectionID, v := range r.remoteSecretKeyMaterials {
+	for connectionID, v := range r.RemoteSecretKeyMaterials {
 		secretKeyMaterials[connectionID] = map[string]interface{}{
-			"keyId":             v.keyID,
-			"secretKeyMaterial": bytesToUint8Array(v.secretKeyMaterial),
+			"keyId":             v.KeyID,
+			"secretKeyMaterial": bytesToUint8Array(v.SecretKeyMaterial),
 		}
 	}
 
 	var messages []interface{}
-	for _, s := range r.messages {
+	for _, s := range r.Messages {
 		messages = append(messages, bytesToUint8Array(s))
 	}
 
 	return map[string]interface{}{
+		"selfConnectionId":         r.SelfConnectionID,
+		"selfKeyId":                r.SelfKeyID,
+		"selfSecretKeyMaterial":    bytesToUint8Array(r.SelfSecretKeyMaterial),
 		"remoteSecretKeyMaterials": secretKeyMaterials,
 		"messages":                 messages,
 	}
 }
 
+func (r ResetSessionResult) toJsValue() map[string]interface{} {
+	var messages []interface{}
+	for _, s := range r.Messages {
+		messages = append(messages, bytesToUint8Array(s))
+	}
+
+	return map[string]interface{}{
+		"selfConnectionId": r.SelfConnectionID,
+		"messages":         messages,
+	}
+}
+
+func (r ReceiveMessageResult) toJsValue() map[string]interface{} {
+	secretKeyMaterials := make(map[string]interface{})
+	for connectionID, v := range r.RemoteSecretKeyMaterials {
+		secretKeyMaterials[connectionID] = map[string]interface{}{
+			"keyId":             v.KeyID,
+			"secretKeyMaterial": bytesToUint8Array(v.SecretKeyMaterial),
+		}
+	}
+
+	var messages []interface{}
+	for _, s := range r.Messages {
+		messages = append(messages, bytesToUint8Array(s))
+	}
+
+	v := map[string]interface{}{
+		"remoteSecretKeyMaterials": secretKeyMaterials,
+		"messages":                 messages,
+	}
+	// グループモードでエポックが進んだ場合だけ自分の SK が変わる
+	if r.SelfSecretKeyMaterial != nil {
+		v["selfKeyId"] = r.SelfKeyID
+		v["selfSecretKeyMaterial"] = bytesToUint8Array(r.SelfSecretKeyMaterial)
+	}
+	return v
+}
+
 func bytesToUint8Array(data []byte) js.Value {
 	d := js.Global().Get("Uint8Array").New(len(data))
 	_ = js.CopyBytesToJS(d, data)
@@ -264,6 +798,13 @@ func bytesToUint8Array(data []byte) js.Value {
 	return d
 }
 
+func uint8ArrayToBytes(v js.Value) []byte {
+	data := make([]byte, v.Get("length").Int())
+	_ = js.CopyBytesToGo(data, v)
+
+	return data
+}
+
 // エラーも js に返すため [jsValue, error] へ
 func toJsReturnValue(jsValue, err interface{}) []interface{} {
 	if jsValue == nil {
@@ -277,8 +818,28 @@ func toJsReturnValue(jsValue, err interface{}) []interface{} {
 }
 
 // error を js の Error オブジェクトへ
+// 呼び出し側でメッセージをパースせずに判定できるように code を設定する
 func jsError(err error) js.Value {
-	return js.Global().Get("Error").New(err.Error())
+	jsErr := js.Global().Get("Error").New(err.Error())
+	jsErr.Set("code", ErrorCode(err))
+
+	var messageError *MessageError
+	if errors.As(err, &messageError) {
+		jsErr.Set("remoteConnectionId", messageError.RemoteConnectionID)
+		jsErr.Set("messageType", uint8(messageError.MessageType))
+		jsErr.Set("pn", messageError.PN)
+		jsErr.Set("n", messageError.N)
+	}
+
+	var identityKeyChangedError *IdentityKeyChangedError
+	if errors.As(err, &identityKeyChangedError) {
+		jsErr.Set("identifier", identityKeyChangedError.Identifier)
+		jsErr.Set("remoteConnectionId", identityKeyChangedError.RemoteConnectionID)
+		jsErr.Set("identityKey", base64.StdEncoding.EncodeToString(identityKeyChangedError.IdentityKey))
+		jsErr.Set("verified", identityKeyChangedError.Previous.Verified)
+	}
+
+	return jsErr
 }
 
 // console にエラーを表示させる
@@ -1,9 +1,12 @@
 package e2ee
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/binary"
 	"io"
+	"time"
 
 	"golang.org/x/crypto/hkdf"
 )
@@ -13,16 +16,167 @@ import (
 // signedPreKey 定期交換
 // oneTimePreKey x N
 
-// TODO(v): oneTimePreKey に対応する
 type preKeyBundle struct {
-	identityKey     []byte
+	identityKey []byte
+	// 0 の場合は ID を指定しない古いクライアント
+	signedPreKeyID  uint32
 	signedPreKey    x25519PublicKey
 	preKeySignature []byte
+	// 省略可能
+	oneTimePreKey *oneTimePreKey
+	// 0 の場合は capabilities を公開しない古いクライアント
+	capabilities uint32
+	// 省略可能、PQXDH に対応していない場合は nil
+	pqPreKey          []byte
+	pqPreKeySignature []byte
+	// 省略可能、MLS を利用しない場合は nil
+	keyPackage []byte
 }
 
-func rootKey(dh1 [32]byte, dh2 [32]byte, dh3 [32]byte) ([]byte, error) {
+// oneTimePreKey は 1 度だけ利用できる署名済みの公開鍵
+// id は 1 から採番し 0 は oneTimePreKey を利用していないことを表す
+type oneTimePreKey struct {
+	id        uint32
+	publicKey x25519PublicKey
+	signature []byte
+}
+
+// RotateSignedPreKey で更新された古い signedPreKey
+// expiresAt を過ぎたら破棄する
+type previousPreKeyPair struct {
+	keyPair              x25519KeyPair
+	pqPreKeyPair         *pqPreKeyPair
+	mlsEncryptionKeyPair *x25519KeyPair
+	expiresAt            time.Time
+}
+
+type oneTimePreKeyPair struct {
+	id        uint32
+	keyPair   x25519KeyPair
+	signature []byte
+}
+
+// PreKeyBundle は相手に配布する公開鍵の組
+type PreKeyBundle struct {
+	IdentityKey []byte
+	// RotateSignedPreKey で更新されるたびに変わる、0 の場合は指定なし
+	SignedPreKeyID  uint32
+	SignedPreKey    []byte
+	PreKeySignature []byte
+	// 相手の OneTimePreKey を 1 つ指定する、nil の場合は DH4 を行わない
+	OneTimePreKey *OneTimePreKey
+	// 相手が対応している機能、0 の場合は古いクライアントとして扱う
+	// 署名の対象ではないため、書き換えられた場合はその機能を利用しないセッションになる
+	Capabilities uint32
+	// PQXDH の ML-KEM-768 の公開鍵、nil の場合は PQXDH を行わない
+	// 署名は identityKey で <<SignedPreKeyID:32, PQPreKey/binary>> に対して行う
+	PQPreKey          []byte
+	PQPreKeySignature []byte
+	// MLS の KeyPackage、nil の場合は MLS を利用しない
+	// init_key は SignedPreKey、LeafNode の signature_key は IdentityKey と一致する必要がある
+	KeyPackage []byte
+}
+
+// OneTimePreKey は Init で生成される署名済みの 1 度限りの公開鍵
+type OneTimePreKey struct {
+	ID        uint32
+	PublicKey []byte
+	Signature []byte
+}
+
+func (p preKeyBundle) export() PreKeyBundle {
+	return PreKeyBundle{
+		IdentityKey:       p.identityKey,
+		SignedPreKeyID:    p.signedPreKeyID,
+		SignedPreKey:      p.signedPreKey[:],
+		PreKeySignature:   p.preKeySignature,
+		Capabilities:      p.capabilities,
+		PQPreKey:          p.pqPreKey,
+		PQPreKeySignature: p.pqPreKeySignature,
+		KeyPackage:        p.keyPackage,
+	}
+}
+
+func (p oneTimePreKeyPair) export() OneTimePreKey {
+	return OneTimePreKey{
+		ID:        p.id,
+		PublicKey: p.keyPair.publicKey[:],
+		Signature: p.signature,
+	}
+}
+
+// 署名の検証を行って preKeyBundle を生成する
+func newPreKeyBundle(p PreKeyBundle) (*preKeyBundle, error) {
+	var copySignedPreKey [32]byte
+	copy(copySignedPreKey[:], p.SignedPreKey)
+
+	ok := ed25519.Verify(p.IdentityKey, p.SignedPreKey, p.PreKeySignature)
+	if !ok {
+		return nil, ErrVerifyFailed
+	}
+
+	preKeyBundle := &preKeyBundle{
+		identityKey:     p.IdentityKey,
+		signedPreKeyID:  p.SignedPreKeyID,
+		signedPreKey:    copySignedPreKey,
+		preKeySignature: p.PreKeySignature,
+		capabilities:    p.Capabilities,
+	}
+
+	if p.PQPreKey != nil {
+		if err := verifyPQPreKey(p.IdentityKey, p.SignedPreKeyID, p.PQPreKey, p.PQPreKeySignature); err != nil {
+			return nil, err
+		}
+		preKeyBundle.pqPreKey = p.PQPreKey
+		preKeyBundle.pqPreKeySignature = p.PQPreKeySignature
+	}
+
+	if p.KeyPackage != nil {
+		keyPackage, err := decodeMLSKeyPackage(p.KeyPackage)
+		if err != nil {
+			return nil, err
+		}
+		if keyPackage.initKey != copySignedPreKey || !bytes.Equal(keyPackage.signatureKey, p.IdentityKey) {
+			return nil, ErrInvalidKeyPackage
+		}
+		preKeyBundle.keyPackage = p.KeyPackage
+	}
+
+	if p.OneTimePreKey != nil {
+		if p.OneTimePreKey.ID == 0 || len(p.OneTimePreKey.PublicKey) != 32 {
+			return nil, ErrInvalidOneTimePreKey
+		}
+
+		var copyOneTimePreKey [32]byte
+		copy(copyOneTimePreKey[:], p.OneTimePreKey.PublicKey)
+
+		ok := ed25519.Verify(p.IdentityKey, oneTimePreKeySignedData(p.OneTimePreKey.ID, copyOneTimePreKey), p.OneTimePreKey.Signature)
+		if !ok {
+			return nil, ErrVerifyFailed
+		}
+
+		preKeyBundle.oneTimePreKey = &oneTimePreKey{
+			id:        p.OneTimePreKey.ID,
+			publicKey: copyOneTimePreKey,
+			signature: p.OneTimePreKey.Signature,
+		}
+	}
+
+	return preKeyBundle, nil
+}
+
+// ID を差し替えられないように ID も署名対象に含める
+// <<OneTimePreKeyID:32, OneTimePreKey:32/binary>>
+func oneTimePreKeySignedData(id uint32, publicKey x25519PublicKey) []byte {
+	data := make([]byte, 4, 4+len(publicKey))
+	binary.BigEndian.PutUint32(data, id)
+	return append(data, publicKey[:]...)
+}
+
+// pqSharedSecret が nil でない場合は PQXDH として DH の後ろに続ける
+func rootKey(pqSharedSecret []byte, dhs ...[32]byte) ([]byte, error) {
 	hash := sha256.New
-	secret := secret(dh1, dh2, dh3)
+	secret := append(secret(dhs...), pqSharedSecret...)
 
 	// 0 でうまったものを生成
 	salt := make([]byte, hash().Size())
@@ -39,31 +193,48 @@ func rootKey(dh1 [32]byte, dh2 [32]byte, dh3 [32]byte) ([]byte, error) {
 }
 
 // remote 関連は remotePreKeyBundle struct で管理したい
+// remoteOneTimePreKey が nil の場合は dh4 を行わない
+// pqSharedSecret が nil の場合は PQXDH を行わない
 func senderRootKey(selfX25519IdentityPrivateKey x25519PrivateKey, selfEphemeralPrivateKey x25519PrivateKey,
-	remoteX25519IdentityKey x25519PublicKey, remoteSignedPreKey x25519PublicKey) ([]byte, error) {
-	// TODO(v): OneTimePreKey dh4 にも対応する
+	remoteX25519IdentityKey x25519PublicKey, remoteSignedPreKey x25519PublicKey, remoteOneTimePreKey *x25519PublicKey,
+	pqSharedSecret []byte) ([]byte, error) {
 	dh1 := dh(selfX25519IdentityPrivateKey, remoteSignedPreKey)
 	dh2 := dh(selfEphemeralPrivateKey, remoteX25519IdentityKey)
 	dh3 := dh(selfEphemeralPrivateKey, remoteSignedPreKey)
 
-	return rootKey(dh1, dh2, dh3)
+	if remoteOneTimePreKey == nil {
+		return rootKey(pqSharedSecret, dh1, dh2, dh3)
+	}
+
+	dh4 := dh(selfEphemeralPrivateKey, *remoteOneTimePreKey)
+
+	return rootKey(pqSharedSecret, dh1, dh2, dh3, dh4)
 }
 
+// selfOneTimePrePrivateKey が nil の場合は dh4 を行わない
+// pqSharedSecret が nil の場合は PQXDH を行わない
 func receiverRootKey(selfIdentityPrivateKey x25519PrivateKey, selfPrePrivateKey x25519PrivateKey,
-	remoteX25519IdentityKey x25519PublicKey, remoteEphemeralKey x25519PublicKey) ([]byte, error) {
-	// TODO(v): OneTimePreKey dh4 にも対応する
+	remoteX25519IdentityKey x25519PublicKey, remoteEphemeralKey x25519PublicKey, selfOneTimePrePrivateKey *x25519PrivateKey,
+	pqSharedSecret []byte) ([]byte, error) {
 	dh1 := dh(selfPrePrivateKey, remoteX25519IdentityKey)
 	dh2 := dh(selfIdentityPrivateKey, remoteEphemeralKey)
 	dh3 := dh(selfPrePrivateKey, remoteEphemeralKey)
 
-	return rootKey(dh1, dh2, dh3)
+	if selfOneTimePrePrivateKey == nil {
+		return rootKey(pqSharedSecret, dh1, dh2, dh3)
+	}
+
+	dh4 := dh(*selfOneTimePrePrivateKey, remoteEphemeralKey)
+
+	return rootKey(pqSharedSecret, dh1, dh2, dh3, dh4)
 }
 
-func secret(dh1 [32]byte, dh2 [32]byte, dh3 [32]byte) []byte {
-	secret := make([]byte, 0, 96)
-	secret = append(secret, dh1[:]...)
-	secret = append(secret, dh2[:]...)
-	secret = append(secret, dh3[:]...)
+// DH1 || DH2 || DH3 || DH4 || SS
+func secret(dhs ...[32]byte) []byte {
+	secret := make([]byte, 0, 32*len(dhs))
+	for _, dh := range dhs {
+		secret = append(secret, dh[:]...)
+	}
 	return secret
 }
 
@@ -72,25 +243,48 @@ type ephemeralKeyPair struct {
 	publicKey  x25519PublicKey
 }
 
-func generateIdentityKeyPair() (*ed25519KeyPair, error) {
-	return generateEd25519KeyPair()
+func generateIdentityKeyPair(random io.Reader) (*ed25519KeyPair, error) {
+	return generateEd25519KeyPair(random)
 }
 
-func generatePreKeyPair() (*x25519KeyPair, error) {
-	return generateX25519KeyPair()
+func generatePreKeyPair(random io.Reader) (*x25519KeyPair, error) {
+	return generateX25519KeyPair(random)
 }
 
 // これは相手に送りつける
 // 毎回変える
-func generateEphemeralKeyPair() (*x25519KeyPair, error) {
-	return generateX25519KeyPair()
+func generateEphemeralKeyPair(random io.Reader) (*x25519KeyPair, error) {
+	return generateX25519KeyPair(random)
 }
 
-func generatePreKeyBundle(identityKeyPair ed25519KeyPair, preKeyPair x25519KeyPair) *preKeyBundle {
+// 相手に配布するため identityKey で署名する
+func generateOneTimePreKeyPair(random io.Reader, identityKeyPair ed25519KeyPair, id uint32) (*oneTimePreKeyPair, error) {
+	keyPair, err := generateX25519KeyPair(random)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := ed25519.Sign(identityKeyPair.privateKey, oneTimePreKeySignedData(id, keyPair.publicKey))
+	return &oneTimePreKeyPair{
+		id:        id,
+		keyPair:   *keyPair,
+		signature: signature,
+	}, nil
+}
+
+// pqPreKeyPair が nil の場合は pqPreKey を含めない
+func generatePreKeyBundle(identityKeyPair ed25519KeyPair, preKeyPair x25519KeyPair, signedPreKeyID uint32, capabilities uint32, pqPreKeyPair *pqPreKeyPair) *preKeyBundle {
 	signature := ed25519.Sign(identityKeyPair.privateKey, preKeyPair.publicKey[:])
-	return &preKeyBundle{
+	preKeyBundle := &preKeyBundle{
 		identityKey:     identityKeyPair.publicKey,
+		signedPreKeyID:  signedPreKeyID,
 		signedPreKey:    preKeyPair.publicKey,
 		preKeySignature: signature,
+		capabilities:    capabilities,
+	}
+	if pqPreKeyPair != nil {
+		preKeyBundle.pqPreKey = pqPreKeyPair.publicKey
+		preKeyBundle.pqPreKeySignature = signPQPreKey(identityKeyPair, signedPreKeyID, pqPreKeyPair.publicKey)
 	}
+	return preKeyBundle
 }
@@ -1,20 +1,21 @@
 package e2ee
 
 import (
+	"crypto/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestX3DH(t *testing.T) {
-	aliceIdentityKeyPair, err := generateEd25519KeyPair()
+	aliceIdentityKeyPair, err := generateEd25519KeyPair(rand.Reader)
 	assert.Nil(t, err)
-	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair()
+	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair(rand.Reader)
 
-	bobIdentityKeyPair, err := generateEd25519KeyPair()
+	bobIdentityKeyPair, err := generateEd25519KeyPair(rand.Reader)
 	assert.Nil(t, err)
 
-	bobPreKeyPair, err := generatePreKeyPair()
+	bobPreKeyPair, err := generatePreKeyPair(rand.Reader)
 	assert.Nil(t, err)
 
 	aliceX25519IdentityPrivateKey := aliceIdentityKeyPair.privateEd25519KeyToCurve25519()
@@ -25,10 +26,66 @@ func TestX3DH(t *testing.T) {
 	assert.Nil(t, err)
 	bobX25519IdentityPrivateKey := bobIdentityKeyPair.privateEd25519KeyToCurve25519()
 
-	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey)
+	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey, nil, nil)
 	assert.Nil(t, err)
-	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey)
+	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey, nil, nil)
 	assert.Nil(t, err)
 
 	assert.Equal(t, aliceRootKey, bobRootKey)
 }
+
+func TestX3DHOneTimePreKey(t *testing.T) {
+	aliceIdentityKeyPair, err := generateEd25519KeyPair(rand.Reader)
+	assert.Nil(t, err)
+	aliceX25519EphemeralKeyPair, err := generateEphemeralKeyPair(rand.Reader)
+	assert.Nil(t, err)
+
+	bobIdentityKeyPair, err := generateEd25519KeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bobPreKeyPair, err := generatePreKeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bobOneTimePreKeyPair, err := generateOneTimePreKeyPair(rand.Reader, *bobIdentityKeyPair, 1)
+	assert.Nil(t, err)
+
+	aliceX25519IdentityPrivateKey := aliceIdentityKeyPair.privateEd25519KeyToCurve25519()
+	aliceX25519IdentityPublicKey, err := aliceIdentityKeyPair.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+
+	bobX25519IdentityPublicKey, err := bobIdentityKeyPair.publicEd25519KeyToCurve25519()
+	assert.Nil(t, err)
+	bobX25519IdentityPrivateKey := bobIdentityKeyPair.privateEd25519KeyToCurve25519()
+
+	aliceRootKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey, &bobOneTimePreKeyPair.keyPair.publicKey, nil)
+	assert.Nil(t, err)
+	bobRootKey, err := receiverRootKey(bobX25519IdentityPrivateKey, bobPreKeyPair.privateKey, aliceX25519IdentityPublicKey, aliceX25519EphemeralKeyPair.publicKey, &bobOneTimePreKeyPair.keyPair.privateKey, nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, aliceRootKey, bobRootKey)
+
+	// dh4 を行わない場合とは異なる
+	aliceRootKeyWithoutOneTimePreKey, err := senderRootKey(aliceX25519IdentityPrivateKey, aliceX25519EphemeralKeyPair.privateKey, bobX25519IdentityPublicKey, bobPreKeyPair.publicKey, nil, nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, aliceRootKey, aliceRootKeyWithoutOneTimePreKey)
+}
+
+func TestPreKeyBundleOneTimePreKeySignature(t *testing.T) {
+	bobIdentityKeyPair, err := generateEd25519KeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bobPreKeyPair, err := generatePreKeyPair(rand.Reader)
+	assert.Nil(t, err)
+	bobOneTimePreKeyPair, err := generateOneTimePreKeyPair(rand.Reader, *bobIdentityKeyPair, 1)
+	assert.Nil(t, err)
+
+	p := generatePreKeyBundle(*bobIdentityKeyPair, *bobPreKeyPair, 1, selfCapabilities, nil).export()
+	oneTimePreKey := bobOneTimePreKeyPair.export()
+	p.OneTimePreKey = &oneTimePreKey
+
+	b, err := newPreKeyBundle(p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), b.oneTimePreKey.id)
+
+	// ID を差し替えると署名検証に失敗する
+	oneTimePreKey.ID = 2
+	_, err = newPreKeyBundle(p)
+	assert.NotNil(t, err)
+}